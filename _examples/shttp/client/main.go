@@ -25,11 +25,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
 	"github.com/netsec-ethz/scion-apps/pkg/shttp"
 )
 
 func main() {
 	serverAddrStr := flag.String("s", "", "Server address (<ISD-AS,[IP]> or <hostname>, optionally with appended <:port>)")
+	pinFile := flag.String("pins", "", "File with pinned server certificates (default ~/.config/scion-apps/shttp-client/known_hosts)")
 	flag.Parse()
 
 	if len(*serverAddrStr) == 0 {
@@ -37,9 +39,23 @@ func main() {
 		os.Exit(2)
 	}
 
+	// The self-signed certificate of the server is pinned on first use
+	if *pinFile == "" {
+		var err error
+		*pinFile, err = appquic.DefaultPinStorePath("shttp-client")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	pins, err := appquic.LoadPinStore(*pinFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	appquic.SetPinStore(pins)
+
 	// Create a standard server with our custom RoundTripper
 	c := &http.Client{
-		Transport: shttp.NewRoundTripper(&tls.Config{InsecureSkipVerify: true}, nil),
+		Transport: shttp.NewRoundTripper(&tls.Config{}, nil),
 	}
 	// (just for demonstration on how to use Close. Clients are safe for concurrent use and should be re-used)
 	defer c.Transport.(shttp.RoundTripper).Close()
@@ -17,33 +17,62 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
 	"github.com/netsec-ethz/scion-apps/pkg/shttp"
 )
 
 func main() {
 	port := flag.Uint("p", 443, "port the server listens on")
+	metrics := flag.String("metrics", "", "serve Prometheus metrics on this TCP address, e.g. localhost:9090")
+	identity := flag.String("identity", "", "directory with a persistent TLS certificate and key, generated if missing (default ~/.config/scion-apps/shttp-fileserver)")
 	flag.Parse()
 
+	if *metrics != "" {
+		if err := appnet.ServeMetrics(*metrics); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The certificate is kept across restarts, so that clients can pin it
+	if *identity == "" {
+		var err error
+		*identity, err = appquic.DefaultKeyPairDir("shttp-fileserver")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	keyPair, err := appquic.LoadKeyPairDir(*identity, appquic.KeyTypeECDSA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig := &tls.Config{GetCertificate: keyPair.GetCertificate}
+
 	handler := http.FileServer(http.Dir(""))
-	log.Fatal(shttp.ListenAndServe(fmt.Sprintf(":%d", *port), withLogger(handler), nil))
+	log.Fatal(shttp.ListenAndServe(fmt.Sprintf(":%d", *port), withLogger(handler), tlsConfig))
 }
 
 // withLogger returns a handler that logs requests (after completion) in a simple format:
-//	  <time> <remote address> "<request>" <status code> <size of reply>
+//	  <time> <remote address> "<request>" <status code> <size of reply> <ISDs on path>
 func withLogger(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		wrec := &recordingResponseWriter{ResponseWriter: w}
 		h.ServeHTTP(wrec, r)
 
-		log.Printf("%s \"%s %s %s/SCION\" %d %d\n",
+		isds := "-"
+		if path := shttp.RemotePath(r); path != nil {
+			isds = fmt.Sprint(path.ISDs())
+		}
+		log.Printf("%s \"%s %s %s/SCION\" %d %d %s\n",
 			r.RemoteAddr,
 			r.Method, r.URL, r.Proto,
-			wrec.status, wrec.bytes)
+			wrec.status, wrec.bytes, isds)
 	})
 }
 
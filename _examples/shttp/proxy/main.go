@@ -9,6 +9,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
 	"github.com/netsec-ethz/scion-apps/pkg/shttp"
 	"github.com/scionproto/scion/go/lib/snet"
 )
@@ -17,6 +18,7 @@ func main() {
 
 	local := flag.String("local", "", "The local HTTP or SCION address on which the server will be listening")
 	remote := flag.String("remote", "", "The SCION or HTTP address on which the server will be requested")
+	pinFile := flag.String("pins", "", "File with pinned server certificates (default ~/.config/scion-apps/shttp-proxy/known_hosts)")
 
 	flag.Parse()
 
@@ -25,7 +27,19 @@ func main() {
 	// parseUDPAddr validates if the address is a SCION address
 	// which we can use to proxy to SCION
 	if _, err := snet.ParseUDPAddr(*remote); err == nil {
-		proxyHandler, err := shttp.NewSingleSCIONHostReverseProxy(*remote, &tls.Config{InsecureSkipVerify: true})
+		// The self-signed certificate of the remote is pinned on first use
+		if *pinFile == "" {
+			*pinFile, err = appquic.DefaultPinStorePath("shttp-proxy")
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		pins, err := appquic.LoadPinStore(*pinFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		appquic.SetPinStore(pins)
+		proxyHandler, err := shttp.NewSingleSCIONHostReverseProxy(*remote, &tls.Config{})
 		if err != nil {
 			log.Fatalf("Failed to create SCION reverse proxy %s", err)
 		}
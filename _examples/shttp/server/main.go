@@ -15,6 +15,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -22,14 +23,24 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
 	"github.com/netsec-ethz/scion-apps/pkg/shttp"
 )
 
 func main() {
 
 	port := flag.Uint("p", 443, "port the server listens on")
+	metrics := flag.String("metrics", "", "serve Prometheus metrics on this TCP address, e.g. localhost:9090")
+	identity := flag.String("identity", "", "directory with a persistent TLS certificate and key, generated if missing (default ~/.config/scion-apps/shttp-server)")
 	flag.Parse()
 
+	if *metrics != "" {
+		if err := appnet.ServeMetrics(*metrics); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	m := http.NewServeMux()
 
 	// handler that responds with a friendly greeting
@@ -84,5 +95,19 @@ func main() {
 		}
 	})
 
-	log.Fatal(shttp.ListenAndServe(fmt.Sprintf(":%d", *port), m, nil))
+	// The certificate is kept across restarts, so that clients can pin it
+	if *identity == "" {
+		var err error
+		*identity, err = appquic.DefaultKeyPairDir("shttp-server")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	keyPair, err := appquic.LoadKeyPairDir(*identity, appquic.KeyTypeECDSA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig := &tls.Config{GetCertificate: keyPair.GetCertificate}
+
+	log.Fatal(shttp.ListenAndServe(fmt.Sprintf(":%d", *port), m, tlsConfig))
 }
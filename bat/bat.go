@@ -36,6 +36,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
 	"github.com/netsec-ethz/scion-apps/pkg/shttp"
 )
 
@@ -54,8 +56,11 @@ var (
 	pretty           bool
 	download         bool
 	insecureSSL      bool
+	pinFile          string
 	auth             string
 	proxy            string
+	policy           string
+	pathSpec         string
 	printV           string
 	printOption      uint8
 	body             string
@@ -82,9 +87,12 @@ func init() {
 	flag.BoolVar(&download, "d", false, "Download the url content as file")
 	flag.BoolVar(&insecureSSL, "insecure", false, "Allow connections to SSL sites without certs")
 	flag.BoolVar(&insecureSSL, "i", false, "Allow connections to SSL sites without certs")
+	flag.StringVar(&pinFile, "pins", "", "File with pinned server certificates")
 	flag.StringVar(&auth, "auth", "", "HTTP authentication username:password, USER[:PASS]")
 	flag.StringVar(&auth, "a", "", "HTTP authentication username:password, USER[:PASS]")
 	flag.StringVar(&proxy, "proxy", "", "Proxy host and port, PROXY_URL")
+	flag.StringVar(&policy, "policy", "", "Path policy, as JSON or name of a JSON file")
+	flag.StringVar(&pathSpec, "path", "", "Path to use, as fingerprint or hop sequence")
 	flag.BoolVar(&bench, "bench", false, "Sends bench requests to URL")
 	flag.BoolVar(&bench, "b", false, "Sends bench requests to URL")
 	flag.IntVar(&benchN, "b.N", 1000, "Number of requests to run")
@@ -96,8 +104,6 @@ func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
 	flag.Usage = usage
 	flag.Parse()
-
-	defaultSetting.Transport = shttp.NewRoundTripper(&tls.Config{InsecureSkipVerify: true}, nil)
 }
 
 func parsePrintOption(s string) {
@@ -152,6 +158,39 @@ func main() {
 		usage()
 	}
 
+	if !insecureSSL {
+		// self-signed certificates are pinned on first use
+		if pinFile == "" {
+			var err error
+			pinFile, err = appquic.DefaultPinStorePath("bat")
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		pins, err := appquic.LoadPinStore(pinFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		appquic.SetPinStore(pins)
+	}
+	defaultSetting.Transport = shttp.NewRoundTripper(&tls.Config{InsecureSkipVerify: insecureSSL}, nil)
+
+	if policy != "" {
+		pathPolicy, err := appnet.PolicyFromString(policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		appnet.SetPathPolicy(pathPolicy)
+	}
+	var spec *appnet.PathSpec
+	if pathSpec != "" {
+		var err error
+		spec, err = appnet.ParsePathSpec(pathSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if strings.HasPrefix(*URL, ":") {
 		urlb := []byte(*URL)
 		if *URL == ":" {
@@ -170,6 +209,17 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if spec != nil {
+		host := u.Host
+		if u.Port() == "" {
+			host += ":443"
+		}
+		raddr, err := appnet.ResolveUDPAddr(appnet.UnmangleSCIONAddr(host))
+		if err != nil {
+			log.Fatal(err)
+		}
+		appnet.SetPathSpec(raddr.IA, spec)
+	}
 	if auth != "" {
 		userpass := strings.Split(auth, ":")
 		if len(userpass) == 2 {
@@ -184,10 +234,6 @@ func main() {
 		password, _ := u.User.Password()
 		httpreq.GetRequest().SetBasicAuth(u.User.Username(), password)
 	}
-	// Insecure SSL Support
-	if insecureSSL {
-		httpreq.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
-	}
 	// Proxy Support
 	if proxy != "" {
 		purl, err := url.Parse(proxy)
@@ -370,7 +416,10 @@ flags:
   -j, -json=true              Send the data in a JSON object
   -p, -pretty=true            Print Json Pretty Format
   -i, -insecure=false         Allow connections to SSL sites without certs
+  -pins=FILE                  File with pinned server certificates, default ~/.config/scion-apps/bat/known_hosts
   -proxy=PROXY_URL            Proxy with host and port
+  -policy=POLICY              Path policy, as JSON or name of a JSON file
+  -path=PATH                  Path to use, as fingerprint or hop sequence
   -print="A"                  String specifying what the output should contain, default will print all information
          "H" request headers
          "B" request body
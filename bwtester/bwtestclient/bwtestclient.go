@@ -34,7 +34,6 @@ import (
 
 	. "github.com/netsec-ethz/scion-apps/bwtester/bwtestlib"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
-	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
@@ -255,7 +254,7 @@ func main() {
 		// Control channel connection
 		CCConn *snet.Conn
 		// Data channel connection
-		DCConn *snet.Conn
+		DCConn *appnet.BatchConn
 
 		clientBwpStr string
 		clientBwp    BwtestParameters
@@ -263,6 +262,8 @@ func main() {
 		serverBwp    BwtestParameters
 		interactive  bool
 		pathAlgo     string
+		policy       string
+		pathSpec     string
 
 		err   error
 		tzero time.Time // initialized to "zero" time
@@ -275,7 +276,9 @@ func main() {
 	flag.StringVar(&serverBwpStr, "sc", DefaultBwtestParameters, "Server->Client test parameter")
 	flag.StringVar(&clientBwpStr, "cs", DefaultBwtestParameters, "Client->Server test parameter")
 	flag.BoolVar(&interactive, "i", false, "Interactive path selection, prompt to choose path")
-	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path selection algorithm / metric (\"shortest\", \"mtu\")")
+	flag.StringVar(&policy, "policy", "", "Path policy, as JSON or name of a JSON file")
+	flag.StringVar(&pathSpec, "path", "", "Path to use, as fingerprint or hop sequence")
+	flag.StringVar(&pathAlgo, "pathAlgo", "", "Path selection algorithm / metric (\"shortest\", \"mtu\", \"latency\", \"loss\")")
 
 	flag.Parse()
 	flagset := make(map[string]bool)
@@ -288,6 +291,12 @@ func main() {
 		os.Exit(0)
 	}
 
+	if policy != "" {
+		pathPolicy, err := appnet.PolicyFromString(policy)
+		Check(err)
+		appnet.SetPathPolicy(pathPolicy)
+	}
+
 	if len(serverCCAddrStr) > 0 {
 		serverCCAddr, err = appnet.ResolveUDPAddr(serverCCAddrStr)
 		Check(err)
@@ -295,19 +304,32 @@ func main() {
 		printUsage()
 		Check(fmt.Errorf("Error, server address needs to be specified with -s"))
 	}
+	if pathSpec != "" {
+		spec, err := appnet.ParsePathSpec(pathSpec)
+		Check(err)
+		appnet.SetPathSpec(serverCCAddr.IA, spec)
+	}
 
 	var path snet.Path
 	if interactive {
-		path, err = appnet.ChoosePathInteractive(serverCCAddr.IA)
+		var paths []snet.Path
+		paths, err = appnet.ChoosePathsInteractive(serverCCAddr.IA, appnet.PathChooserConfig{Probe: serverCCAddr})
 		Check(err)
+		if len(paths) > 0 {
+			path = paths[0]
+		}
 	} else {
 		var metric int
 		if pathAlgo == "mtu" {
 			metric = appnet.MTU
 		} else if pathAlgo == "shortest" {
 			metric = appnet.Shortest
+		} else if pathAlgo == "latency" {
+			metric = appnet.Latency
+		} else if pathAlgo == "loss" {
+			metric = appnet.Loss
 		}
-		path, err = appnet.ChoosePathByMetric(metric, serverCCAddr.IA)
+		path, err = appnet.ChoosePathByMetricAddr(metric, serverCCAddr)
 		Check(err)
 	}
 	if path != nil {
@@ -326,15 +348,18 @@ func main() {
 	serverDCAddr.Host.Port = serverCCAddr.Host.Port + 1
 
 	// Data channel connection
-	DCConn, err = appnet.DefNetwork().Dial(
-		context.TODO(), "udp", clientDCAddr, serverDCAddr, addr.SvcNone)
+	DCConn, err = appnet.DialBatch(clientDCAddr, serverDCAddr)
 	Check(err)
 
-	// update default packet size to max MTU on the selected path
-	if path != nil {
-		InferedPktSize = int64(path.Metadata().MTU)
+	// update default packet size to the max payload on the selected path, as discovered by
+	// probing the path MTU
+	ctx, cancel := context.WithTimeout(context.Background(), MaxDuration)
+	maxPayload, err := appnet.ProbeMaxPayload(ctx, serverDCAddr)
+	cancel()
+	if err == nil {
+		InferedPktSize = int64(maxPayload)
 	} else {
-		// use default packet size when within same AS and pathEntry is not set
+		// use default packet size if the path MTU could not be discovered
 		InferedPktSize = DefaultPktSize
 	}
 	if !flagset["cs"] && flagset["sc"] { // Only one direction set, used same for reverse
@@ -351,8 +376,15 @@ func main() {
 	serverBwp.Port = uint16(serverDCAddr.Host.Port)
 	fmt.Println("\nTest parameters:")
 	fmt.Println("clientDCAddr -> serverDCAddr", clientDCAddr, "->", serverDCAddr)
+	if path != nil {
+		fmt.Println("Path:", appnet.NewPathInfo(path))
+	}
 	fmt.Printf("client->server: %d seconds, %d bytes, %d packets\n",
 		int(clientBwp.BwtestDuration/time.Second), clientBwp.PacketSize, clientBwp.NumPackets)
+	if maxPayload > 0 && clientBwp.PacketSize > int64(maxPayload) {
+		fmt.Printf("Warning: packet size exceeds the maximum payload of %d bytes on the path, "+
+			"client->server packets will be dropped\n", maxPayload)
+	}
 	fmt.Printf("server->client: %d seconds, %d bytes, %d packets\n",
 		int(serverBwp.BwtestDuration/time.Second), serverBwp.PacketSize, serverBwp.NumPackets)
 
@@ -522,8 +554,24 @@ func main() {
 			variance/1e6, average/1e6)
 		fmt.Printf("Interarrival time min: %dms, interarrival time max: %dms\n",
 			sres.IPAmin/1e6, sres.IPAmax/1e6)
+		// The SCMP errors are received by the sender, the server reports those for S->C
+		printPathFailures(&res)
+		if sres.PathFailures > 0 {
+			fmt.Println("\nS->C path failures")
+			printPathFailures(sres)
+		}
 		return
 	}
 
 	fmt.Println("Error, could not fetch server results, MaxTries attempted without success.")
 }
+
+// printPathFailures prints the number of SCMP errors received by the sender of a bwtest
+// direction. These indicate that (some of) the lost packets were dropped due to a path
+// failure, e.g. a revoked interface.
+func printPathFailures(res *BwtestResult) {
+	if res.PathFailures > 0 {
+		fmt.Printf("Path failure: %d SCMP messages received by the sender, last: %s\n",
+			res.PathFailures, res.LastPathFailure)
+	}
+}
@@ -16,9 +16,11 @@ package bwtestlib
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"os"
 	"sort"
 	"sync"
@@ -26,7 +28,7 @@ import (
 
 	log "github.com/inconshreveable/log15"
 
-	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
 )
 
 const (
@@ -43,6 +45,10 @@ const (
 	MaxPacketSize int64 = 66000
 	// Make sure the port number is a port the server application can connect to
 	MinPort uint16 = 1024
+	// Maximum number of packets sent or received with a single call on the data connection
+	BatchSize int64 = 64
+	// Maximum duration of the packets sent at once, to catch up with the schedule after a delay
+	MaxBurstDuration time.Duration = time.Millisecond * 5
 
 	MaxTries int64         = 5 // Number of times to try to reach server
 	Timeout  time.Duration = time.Millisecond * 500
@@ -68,6 +74,12 @@ type BwtestResult struct {
 	// Only requests that contain the correct key can obtain the result
 	PrgKey             []byte
 	ExpectedFinishTime time.Time
+	// Number of SCMP errors received in response to the packets sent in the opposite
+	// direction, e.g. for a revoked interface on the path, to tell path failures apart
+	// from packet loss
+	PathFailures int64
+	// Description of the last SCMP error
+	LastPathFailure string
 }
 
 func Check(e error) {
@@ -159,52 +171,85 @@ func DecodeBwtestParameters(buf []byte) (*BwtestParameters, int, error) {
 	return &v, is - bb.Len(), err
 }
 
-func HandleDCConnSend(bwp *BwtestParameters, udpConnection *snet.Conn) {
-	sb := make([]byte, bwp.PacketSize)
-	var i int64 = 0
-	t0 := time.Now()
-	finish := t0.Add(bwp.BwtestDuration + GracePeriodSend)
-	var interPktInterval time.Duration
-	if bwp.NumPackets > 1 {
-		interPktInterval = bwp.BwtestDuration / time.Duration(bwp.NumPackets-1)
-	} else {
-		interPktInterval = bwp.BwtestDuration
+// HandleDCConnSend sends the packets of the bandwidth test, paced to the
+// bandwidth given by the parameters. The packets that are due at the same
+// time, i.e. all packets that are late, are sent together with a single write
+// of up to BatchSize packets.
+func HandleDCConnSend(bwp *BwtestParameters, udpConnection *appnet.BatchConn) {
+	msgs := make([]appnet.Message, BatchSize)
+	for j := range msgs {
+		msgs[j].Buffer = make([]byte, bwp.PacketSize)
+	}
+	// The first packet is sent right away and the last one after BwtestDuration
+	var bitrate int64
+	if bwp.NumPackets > 1 && bwp.BwtestDuration > 0 {
+		bitrate = int64(float64(bwp.PacketSize*8*(bwp.NumPackets-1)) / bwp.BwtestDuration.Seconds())
+	}
+	burst := int64(float64(bitrate/8)*MaxBurstDuration.Seconds()) / bwp.PacketSize
+	if burst < 1 {
+		burst = 1
+	}
+	if burst > BatchSize {
+		burst = BatchSize
 	}
+	pacer := appnet.NewPacer(bitrate, int(burst*bwp.PacketSize))
+
+	var i int64 = 0
+	finish := time.Now().Add(bwp.BwtestDuration + GracePeriodSend)
+	ctx, cancel := context.WithDeadline(context.Background(), finish)
+	defer cancel()
 	for i < bwp.NumPackets {
-		// Compute how long to wait
-		t1 := time.Now()
-		if t1.After(finish) {
+		if time.Now().After(finish) {
 			// We've been sending for too long, sending bandwidth must be insufficient. Abort sending.
 			return
 		}
-		t2 := t0.Add(interPktInterval * time.Duration(i))
-		if t1.Before(t2) {
-			time.Sleep(t2.Sub(t1))
+		max := bwp.NumPackets - i
+		if max > BatchSize {
+			max = BatchSize
 		}
-		// Send packet now
-		PrgFill(bwp.PrgKey, int(i*bwp.PacketSize), sb)
-		// Place packet number at the beginning of the packet, overwriting some PRG data
-		binary.LittleEndian.PutUint32(sb, uint32(i*bwp.PacketSize))
-		_, err := udpConnection.Write(sb)
+		n, err := pacer.WaitBatch(ctx, int(bwp.PacketSize), int(max))
+		if err != nil {
+			// The next packet is due after the finish time
+			return
+		}
+		// Send packets now
+		for j, m := range msgs[:n] {
+			iv := (i + int64(j)) * bwp.PacketSize
+			PrgFill(bwp.PrgKey, int(iv), m.Buffer)
+			// Place packet number at the beginning of the packet, overwriting some PRG data
+			binary.LittleEndian.PutUint32(m.Buffer, uint32(iv))
+		}
+		_, err = udpConnection.WriteBatch(msgs[:n])
 		Check(err)
-		i++
+		i += int64(n)
 	}
 }
 
-func HandleDCConnReceive(bwp *BwtestParameters, udpConnection *snet.Conn, res *BwtestResult, resLock *sync.Mutex, done *sync.Mutex) {
+func HandleDCConnReceive(bwp *BwtestParameters, udpConnection *appnet.BatchConn, res *BwtestResult, resLock *sync.Mutex, done *sync.Mutex) {
 	resLock.Lock()
 	finish := res.ExpectedFinishTime
 	resLock.Unlock()
-	var numPacketsReceived, correctlyReceived int64 = 0, 0
+	var numPacketsReceived, correctlyReceived, pathFailures int64 = 0, 0, 0
+	var lastPathFailure string
 	InterPacketArrivalTime := make(map[int]int64)
 	_ = udpConnection.SetReadDeadline(finish)
-	// Make the receive buffer a bit larger to enable detection of packets that are too large
-	recBuf := make([]byte, bwp.PacketSize+1000)
+	// Make the receive buffers a bit larger to enable detection of packets that are too large
+	msgs := make([]appnet.Message, BatchSize)
+	for i := range msgs {
+		msgs[i].Buffer = make([]byte, bwp.PacketSize+1000)
+	}
 	cmpBuf := make([]byte, bwp.PacketSize)
 	for time.Now().Before(finish) && correctlyReceived < bwp.NumPackets {
-		n, err := udpConnection.Read(recBuf)
+		numMsgs, err := udpConnection.ReadBatch(msgs)
 		// Ignore errors, todo: detect type of error and quit if it was because of a SetReadDeadline
 		if err != nil {
+			// SCMP errors are returned for the packets sent on this connection, i.e. in the
+			// opposite direction
+			var scmpErr *appnet.SCMPError
+			if errors.As(err, &scmpErr) {
+				pathFailures++
+				lastPathFailure = scmpErr.Error()
+			}
 			// If the ReadDeadline expired, then we should extend the finish time, which is
 			// extended on the client side if no response is received from the server. On the server
 			// side, however, a short BwtestDuration with several consecutive packet losses would
@@ -214,51 +259,55 @@ func HandleDCConnReceive(bwp *BwtestParameters, udpConnection *snet.Conn, res *B
 			resLock.Unlock()
 			continue
 		}
-		numPacketsReceived++
-		if int64(n) != bwp.PacketSize {
-			// The packet has incorrect size, do not count as a correct packet
-			// fmt.Println("Incorrect size.", n, "bytes instead of", bwp.PacketSize)
-			continue
-		}
-		// Could consider pre-computing all the packets in a separate goroutine
-		// but since computation is usually much higher than bandwidth, this is
-		// not necessary
-		// Todo: create separate verif function which only compares the packet
-		// so that a discrepancy is noticed immediately without generating the
-		// entire packet
-		iv := int64(binary.LittleEndian.Uint32(recBuf))
-		seqNo := int(iv / bwp.PacketSize)
-		InterPacketArrivalTime[seqNo] = time.Now().UnixNano()
-		PrgFill(bwp.PrgKey, int(iv), cmpBuf)
-		binary.LittleEndian.PutUint32(cmpBuf, uint32(iv))
-		if bytes.Equal(recBuf[:bwp.PacketSize], cmpBuf) {
-			if correctlyReceived == 0 {
-				// Adjust finish time after first correctly received packet
-				// Note that we should check that we're not too far away from the beginning of the
-				// bwtest, otherwise we're extending the time for too long. If the server's 'N' response
-				// packet was not dropped, then sending should start within MaxRTT at most.
-				newFinish := time.Now().Add(bwp.BwtestDuration + StragglerWaitPeriod)
-				if newFinish.After(finish) {
-					finish = newFinish
-					_ = udpConnection.SetReadDeadline(finish)
-					resLock.Lock()
-					if res.ExpectedFinishTime.Before(finish) {
-						// Most likely what happened is that the server's 'N' response packet got dropped (in case this
-						// is the receive function on the server side) or the client's request packet got dropped (in
-						// case this is the receive function on the client side). In both cases the ExpectedFinishTime
-						// needs to be updated
-						res.ExpectedFinishTime = finish
+		for _, m := range msgs[:numMsgs] {
+			numPacketsReceived++
+			if int64(m.N) != bwp.PacketSize {
+				// The packet has incorrect size, do not count as a correct packet
+				// fmt.Println("Incorrect size.", m.N, "bytes instead of", bwp.PacketSize)
+				continue
+			}
+			// Could consider pre-computing all the packets in a separate goroutine
+			// but since computation is usually much higher than bandwidth, this is
+			// not necessary
+			// Todo: create separate verif function which only compares the packet
+			// so that a discrepancy is noticed immediately without generating the
+			// entire packet
+			iv := int64(binary.LittleEndian.Uint32(m.Buffer))
+			seqNo := int(iv / bwp.PacketSize)
+			InterPacketArrivalTime[seqNo] = time.Now().UnixNano()
+			PrgFill(bwp.PrgKey, int(iv), cmpBuf)
+			binary.LittleEndian.PutUint32(cmpBuf, uint32(iv))
+			if bytes.Equal(m.Buffer[:bwp.PacketSize], cmpBuf) {
+				if correctlyReceived == 0 {
+					// Adjust finish time after first correctly received packet
+					// Note that we should check that we're not too far away from the beginning of the
+					// bwtest, otherwise we're extending the time for too long. If the server's 'N' response
+					// packet was not dropped, then sending should start within MaxRTT at most.
+					newFinish := time.Now().Add(bwp.BwtestDuration + StragglerWaitPeriod)
+					if newFinish.After(finish) {
+						finish = newFinish
+						_ = udpConnection.SetReadDeadline(finish)
+						resLock.Lock()
+						if res.ExpectedFinishTime.Before(finish) {
+							// Most likely what happened is that the server's 'N' response packet got dropped (in case this
+							// is the receive function on the server side) or the client's request packet got dropped (in
+							// case this is the receive function on the client side). In both cases the ExpectedFinishTime
+							// needs to be updated
+							res.ExpectedFinishTime = finish
+						}
+						resLock.Unlock()
 					}
-					resLock.Unlock()
 				}
+				correctlyReceived++
 			}
-			correctlyReceived++
 		}
 	}
 
 	resLock.Lock()
 	res.NumPacketsReceived = numPacketsReceived
 	res.CorrectlyReceived = correctlyReceived
+	res.PathFailures = pathFailures
+	res.LastPathFailure = lastPathFailure
 	res.IPAvar, res.IPAmin, res.IPAavg, res.IPAmax = aggrInterArrivalTime(InterPacketArrivalTime)
 
 	// We're done here, let's see if we need to wait for the send function to complete so we can close the connection
@@ -20,7 +20,6 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"flag"
 	"fmt"
 	"net"
@@ -33,7 +32,6 @@ import (
 
 	. "github.com/netsec-ethz/scion-apps/bwtester/bwtestlib"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
-	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
@@ -92,7 +90,7 @@ func main() {
 
 func runServer(port uint16) error {
 
-	conn, err := appnet.ListenPort(port)
+	conn, err := appnet.ListenAll(port)
 	if err != nil {
 		return err
 	}
@@ -103,7 +101,7 @@ func runServer(port uint16) error {
 	return nil
 }
 
-func handleClients(CCConn *snet.Conn, receivePacketBuffer []byte, sendPacketBuffer []byte) {
+func handleClients(CCConn *appnet.WildcardConn, receivePacketBuffer []byte, sendPacketBuffer []byte) {
 
 	for {
 		// Handle client requests
@@ -134,7 +132,7 @@ func handleClients(CCConn *snet.Conn, receivePacketBuffer []byte, sendPacketBuff
 			}
 		}
 		clientCCAddrStr := clientCCAddr.String()
-		fmt.Println("Received request:", clientCCAddrStr)
+		fmt.Println("Received request:", appnet.NamedAddr(clientCCAddr))
 
 		if receivePacketBuffer[0] == 'N' {
 			// New bwtest request
@@ -195,13 +193,13 @@ func handleClients(CCConn *snet.Conn, receivePacketBuffer []byte, sendPacketBuff
 			clientDCAddr := clientCCAddr.Copy()
 			clientDCAddr.Host.Port = int(clientBwp.Port)
 
-			// Address of server Data Connection (DC)
-			serverCCAddr := CCConn.LocalAddr().(*net.UDPAddr)
+			// Address of server Data Connection (DC), on the local address that
+			// received the request
+			serverCCAddr := CCConn.LocalAddrFor(clientCCAddr)
 			serverDCAddr := &net.UDPAddr{IP: serverCCAddr.IP, Port: int(serverBwp.Port)}
 
 			// Open Data Connection
-			DCConn, err := appnet.DefNetwork().Dial(
-				context.TODO(), "udp", serverDCAddr, clientDCAddr, addr.SvcNone)
+			DCConn, err := appnet.DialBatch(serverDCAddr, clientDCAddr)
 			if err != nil {
 				// An error happened, ask the client to try again in 1 second
 				sendPacketBuffer[0] = 'N'
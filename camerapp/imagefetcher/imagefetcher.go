@@ -19,6 +19,7 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"flag"
 	"fmt"
@@ -36,11 +37,20 @@ const (
 
 	// Number of blocks that are simultaneously requested
 	maxNumBlocksRequested               = 5
-	blockSize             uint32        = 1000
 	rttTimeoutMult        time.Duration = 3
 	consecReqWaitTime     time.Duration = 500 * time.Microsecond
+
+	// Block size used if the path MTU can not be discovered
+	defaultBlockSize uint32 = 1000
+	// Length of the header of the block responses: 'G', start byte, end byte
+	blockHeaderLen = 9
+	// Maximum block size supported by the packet buffers of the fetcher and the server
+	maxBlockSize uint32 = 2500 - blockHeaderLen
 )
 
+// Size of the requested blocks, such that the responses fit into the path MTU
+var blockSize = defaultBlockSize
+
 func check(e error) {
 	if e != nil {
 		log.Fatal(e)
@@ -103,12 +113,31 @@ func fetchFileInfo(udpConnection *snet.Conn) (string, uint32, time.Duration, err
 	return "", 0, 0, fmt.Errorf("could not obtain file information")
 }
 
+// inferBlockSize returns the largest block size for which the block responses fit into the
+// path MTU, as discovered by probing the path. The responses are sent over the reversed path.
+func inferBlockSize(udpConnection *snet.Conn) uint32 {
+	ctx, cancel := context.WithTimeout(context.Background(), maxWaitDelay)
+	defer cancel()
+	maxPayload, err := appnet.ProbeMaxPayload(ctx, udpConnection.RemoteAddr().(*snet.UDPAddr))
+	if err != nil || maxPayload <= blockHeaderLen {
+		return defaultBlockSize
+	}
+	size := uint32(maxPayload - blockHeaderLen)
+	if size > maxBlockSize {
+		size = maxBlockSize
+	}
+	return size
+}
+
 func blockFetcher(fetchBlockChan chan uint32, udpConnection *snet.Conn, fileName string, fileSize uint32) {
 	packetBuffer := make([]byte, 512)
 	packetBuffer[0] = 'G'
 	packetBuffer[1] = byte(len(fileName))
 	copy(packetBuffer[2:], []byte(fileName))
 	sendLen := 2 + len(fileName) + 8
+	// Space the requests by consecReqWaitTime
+	bitrate := int64(sendLen*8) * int64(time.Second/consecReqWaitTime)
+	writer := appnet.NewPacedWriter(udpConnection, appnet.NewPacer(bitrate, sendLen))
 	for i := range fetchBlockChan {
 		binary.LittleEndian.PutUint32(packetBuffer[sendLen-8:], i)
 		readLength := blockSize
@@ -117,7 +146,7 @@ func blockFetcher(fetchBlockChan chan uint32, udpConnection *snet.Conn, fileName
 			readLength = fileSize - i
 		}
 		binary.LittleEndian.PutUint32(packetBuffer[sendLen-4:], i+readLength)
-		_, err := udpConnection.Write(packetBuffer[:sendLen])
+		_, err := writer.Write(packetBuffer[:sendLen])
 		check(err)
 	}
 }
@@ -167,10 +196,27 @@ func main() {
 
 	serverAddrStr := flag.String("s", "", "Server address (<ISD-AS,[IP]:port> or <hostname:port>)")
 	outputFilePath := flag.String("output", "", "Path to the output file")
+	policy := flag.String("policy", "", "Path policy, as JSON or name of a JSON file")
+	pathSpec := flag.String("path", "", "Path to use, as fingerprint or hop sequence")
 	flag.Parse()
 
-	udpConnection, err := appnet.Dial(*serverAddrStr)
+	if *policy != "" {
+		pathPolicy, err := appnet.PolicyFromString(*policy)
+		check(err)
+		appnet.SetPathPolicy(pathPolicy)
+	}
+
+	serverAddr, err := appnet.ResolveUDPAddr(*serverAddrStr)
+	check(err)
+	if *pathSpec != "" {
+		spec, err := appnet.ParsePathSpec(*pathSpec)
+		check(err)
+		appnet.SetPathSpec(serverAddr.IA, spec)
+	}
+
+	udpConnection, err := appnet.DialAddr(serverAddr)
 	check(err)
+	blockSize = inferBlockSize(udpConnection)
 
 	fileName, fileSize, rttApprox, err := fetchFileInfo(udpConnection)
 	check(err)
@@ -205,9 +251,9 @@ func main() {
 			fmt.Print("r")
 			i = i + blockSize
 			if len(requestedBlockMap) < maxNumBlocksRequested {
-				// If we can fetch yet one more additional block,
-				// wait for a short amount of time before requesting the next block
-				waitDuration = consecReqWaitTime
+				// If we can fetch yet one more additional block, request it right away,
+				// the requests are paced by the blockFetcher
+				waitDuration = 0
 			}
 		}
 		// If a missing block has reached a timeout, then request it again.
@@ -230,8 +276,8 @@ func main() {
 				done = true
 			}
 		case <-time.After(waitDuration):
-			if waitDuration == consecReqWaitTime {
-				// Do not include numTimeouts if it was a short waiting period between consecutive requests
+			if waitDuration == 0 {
+				// Do not include numTimeouts if we did not wait for more blocks
 				continue
 			}
 			numTimeouts++
@@ -25,6 +25,8 @@ import (
 	"sync"
 
 	"github.com/netsec-ethz/scion-apps/netcat/modes"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
 	scionlog "github.com/scionproto/scion/go/lib/log"
 
 	log "github.com/inconshreveable/log15"
@@ -43,6 +45,17 @@ var (
 
 	verboseMode     bool
 	veryVerboseMode bool
+
+	policy   string
+	pathSpec string
+	pinFile  string
+	insecure bool
+
+	identityDir string
+	keyType     string
+	trcDir      string
+	asCertFile  string
+	asKeyFile   string
 )
 
 func printUsage() {
@@ -61,6 +74,14 @@ func printUsage() {
 	fmt.Println("  -c: Instead of piping the connection to stdin/stdout, run the given command using /bin/sh")
 	fmt.Println("  -u: UDP mode")
 	fmt.Println("  -b: Send or expect an extra (throw-away) byte before the actual data")
+	fmt.Println("  -policy: Path policy, as JSON or name of a JSON file")
+	fmt.Println("  -path: Path to use, as fingerprint or hop sequence")
+	fmt.Println("  -pins: Pin self-signed server certificates in the given file on first use (default ~/.config/scion-apps/netcat/known_hosts)")
+	fmt.Println("  -insecure: Do not verify the server certificate")
+	fmt.Println("  -identity: In listen mode, use the persistent certificate and key in the given directory, generated if missing")
+	fmt.Println("  -keytype: Type of the key generated for -identity: rsa, ecdsa (default) or ed25519")
+	fmt.Println("  -trcs: Verify servers presenting their AS certificate against the TRCs in the given directory")
+	fmt.Println("  -ascert, -askey: In listen mode, present the given AS certificate chain, with the AS key")
 	fmt.Println("  -v: Enable verbose mode")
 	fmt.Println("  -vv: Enable very verbose mode")
 }
@@ -76,6 +97,15 @@ func main() {
 	flag.StringVar(&commandString, "c", "", "Command")
 	flag.BoolVar(&verboseMode, "v", false, "Verbose mode")
 	flag.BoolVar(&veryVerboseMode, "vv", false, "Very verbose mode")
+	flag.StringVar(&policy, "policy", "", "Path policy")
+	flag.StringVar(&pathSpec, "path", "", "Path to use")
+	flag.StringVar(&pinFile, "pins", "", "File with pinned server certificates")
+	flag.BoolVar(&insecure, "insecure", false, "Do not verify the server certificate")
+	flag.StringVar(&identityDir, "identity", "", "Directory with persistent server certificate and key")
+	flag.StringVar(&keyType, "keytype", string(appquic.KeyTypeECDSA), "Type of generated server key")
+	flag.StringVar(&trcDir, "trcs", "", "Directory with TRCs")
+	flag.StringVar(&asCertFile, "ascert", "", "AS certificate chain file")
+	flag.StringVar(&asKeyFile, "askey", "", "AS key file")
 	flag.Parse()
 
 	if veryVerboseMode {
@@ -111,6 +141,44 @@ func main() {
 		golog.Panicf("-K flag requires -c flag!")
 	}
 
+	if policy != "" {
+		pathPolicy, err := appnet.PolicyFromString(policy)
+		if err != nil {
+			golog.Panicf("Invalid path policy: %v", err)
+		}
+		appnet.SetPathPolicy(pathPolicy)
+	}
+	var spec *appnet.PathSpec
+	if pathSpec != "" {
+		var err error
+		spec, err = appnet.ParsePathSpec(pathSpec)
+		if err != nil {
+			golog.Panicf("Invalid path: %v", err)
+		}
+	}
+	if !insecure && !listen && !udpMode {
+		// self-signed certificates are pinned on first use
+		if pinFile == "" {
+			var err error
+			pinFile, err = appquic.DefaultPinStorePath("netcat")
+			if err != nil {
+				golog.Panicf("Can't determine the pinned certificates file: %v", err)
+			}
+		}
+		pins, err := appquic.LoadPinStore(pinFile)
+		if err != nil {
+			golog.Panicf("Can't load pinned certificates: %v", err)
+		}
+		appquic.SetPinStore(pins)
+	}
+	if trcDir != "" {
+		trcs, err := appquic.LoadTRCStore(trcDir)
+		if err != nil {
+			golog.Panicf("Can't load TRCs: %v", err)
+		}
+		appquic.SetTRCStore(trcs)
+	}
+
 	log.Info("Launching netcat")
 
 	var conns chan io.ReadWriteCloser
@@ -124,6 +192,13 @@ func main() {
 		conns = doListen(uint16(port))
 	} else {
 		remoteAddr := tail[0]
+		if spec != nil {
+			raddr, err := appnet.ResolveUDPAddr(remoteAddr)
+			if err != nil {
+				golog.Panicf("Can't resolve %s: %v", remoteAddr, err)
+			}
+			appnet.SetPathSpec(raddr.IA, spec)
+		}
 		conns = make(chan io.ReadWriteCloser, 1)
 		conns <- doDial(remoteAddr)
 	}
@@ -239,7 +314,7 @@ func doDial(remoteAddr string) io.ReadWriteCloser {
 	if udpMode {
 		conn = modes.DoDialUDP(remoteAddr)
 	} else {
-		conn = modes.DoDialQUIC(remoteAddr)
+		conn = modes.DoDialQUIC(remoteAddr, !insecure)
 	}
 
 	if extraByte {
@@ -259,7 +334,24 @@ func doListen(port uint16) chan io.ReadWriteCloser {
 	if udpMode {
 		conns = modes.DoListenUDP(port)
 	} else {
-		conns = modes.DoListenQUIC(port)
+		var keyPair *appquic.KeyPair
+		if asCertFile != "" || asKeyFile != "" {
+			var err error
+			keyPair, err = appquic.LoadASKeyPair(asCertFile, asKeyFile)
+			if err != nil {
+				golog.Panicf("Can't load AS certificate: %v", err)
+			}
+		} else if identityDir != "" {
+			kt, err := appquic.ParseKeyType(keyType)
+			if err != nil {
+				golog.Panicf("Invalid key type: %v", err)
+			}
+			keyPair, err = appquic.LoadKeyPairDir(identityDir, kt)
+			if err != nil {
+				golog.Panicf("Can't load server certificate: %v", err)
+			}
+		}
+		conns = modes.DoListenQUIC(port, keyPair)
 	}
 
 	var nconns chan io.ReadWriteCloser
@@ -21,6 +21,7 @@ import (
 	golog "log"
 
 	"github.com/lucas-clemente/quic-go"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
 
 	log "github.com/inconshreveable/log15"
@@ -55,13 +56,18 @@ func (conn *sessConn) Close() error {
 	return nil
 }
 
-// DoListenQUIC listens on a QUIC socket
-func DoListenQUIC(port uint16) chan io.ReadWriteCloser {
+// DoListenQUIC listens on a QUIC socket. If keyPair is nil, a dummy
+// certificate is used.
+func DoListenQUIC(port uint16, keyPair *appquic.KeyPair) chan io.ReadWriteCloser {
+	tlsConf := &tls.Config{NextProtos: []string{nextProto}}
+	if keyPair != nil {
+		tlsConf.GetCertificate = keyPair.GetCertificate
+	} else {
+		tlsConf.Certificates = appquic.GetDummyTLSCerts()
+	}
 	listener, err := appquic.ListenPort(
 		port,
-		&tls.Config{
-			Certificates: appquic.GetDummyTLSCerts(),
-			NextProtos:   []string{nextProto}},
+		tlsConf,
 		&quic.Config{KeepAlive: true},
 	)
 	if err != nil {
@@ -83,7 +89,7 @@ func DoListenQUIC(port uint16) chan io.ReadWriteCloser {
 				continue
 			}
 
-			log.Info("New QUIC connection")
+			log.Info("New QUIC connection", "addr", appnet.NamedAddr(sess.RemoteAddr()))
 
 			conns <- &sessConn{
 				sess:   sess,
@@ -95,12 +101,13 @@ func DoListenQUIC(port uint16) chan io.ReadWriteCloser {
 	return conns
 }
 
-// DoDialQUIC dials with a QUIC socket
-func DoDialQUIC(remoteAddr string) io.ReadWriteCloser {
+// DoDialQUIC dials with a QUIC socket. If verify is set, the server
+// certificate is verified, see appquic.DialAddr.
+func DoDialQUIC(remoteAddr string, verify bool) io.ReadWriteCloser {
 	sess, err := appquic.Dial(
 		remoteAddr,
 		&tls.Config{
-			InsecureSkipVerify: true,
+			InsecureSkipVerify: !verify,
 			NextProtos:         []string{nextProto},
 		},
 		&quic.Config{KeepAlive: true},
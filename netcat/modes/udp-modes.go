@@ -46,8 +46,9 @@ func (conn *udpListenConn) Close() error {
 }
 
 // DoDialUDP dials with a UDP socket
+// The path is automatically replaced when it expires or is revoked.
 func DoDialUDP(remoteAddr string) io.ReadWriteCloser {
-	conn, err := appnet.Dial(remoteAddr)
+	conn, err := appnet.DialManaged(remoteAddr)
 	if err != nil {
 		golog.Panicf("Can't dial remote address %v: %v", remoteAddr, err)
 	}
@@ -82,7 +83,7 @@ func DoListenUDP(port uint16) chan io.ReadWriteCloser {
 			nrespChan := readResponses[addrStr]
 			if !contained {
 				// create new UDP connection
-				log.Info("New UDP connection", "addr", addrStr)
+				log.Info("New UDP connection", "addr", appnet.NamedAddr(addr))
 				nbufChan = make(chan []byte)
 				nrespChan = make(chan int, 1)
 
@@ -42,17 +42,18 @@ func TestIntegrationScionNetcat(t *testing.T) {
 	// Start a scion-netcat server socket and query it with a scion-netcat client
 	// Common arguments
 	cmnArgs := []string{"-vv"}
-	// Server
-	serverPort := "1234"
-	serverArgs := []string{"-l", serverPort}
-	serverArgs = append(cmnArgs, serverArgs...)
-
 	testMessage := "Hello World!"
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(tmpDir)
+
+	// Server, with a persistent certificate that the client pins on first use
+	serverPort := "1234"
+	serverArgs := []string{"-l", "-identity", path.Join(tmpDir, "identity"), serverPort}
+	serverArgs = append(cmnArgs, serverArgs...)
+	clientArgs := append(cmnArgs, "-pins", path.Join(tmpDir, "known_hosts"))
 	clientBinWrapperCmd, err := wrapperCommand(tmpDir, fmt.Sprintf("echo -e '%s'", testMessage),
 		integration.AppBinPath(clientBin))
 	if err != nil {
@@ -80,7 +81,7 @@ func TestIntegrationScionNetcat(t *testing.T) {
 		},
 		{
 			"client_hello",
-			append(cmnArgs, integration.DstAddrPattern+":"+serverPort),
+			append(clientArgs, integration.DstAddrPattern+":"+serverPort),
 			integration.RegExp(fmt.Sprintf("^%s$", testMessage)),
 			nil,
 			nil,
@@ -32,20 +32,47 @@ single SCION AS. When running multiple local ASes, e.g. during development, the
 address of the sciond corresponding to the desired AS needs to be specified in
 the SCION_DAEMON_ADDRESS environment variable.
 
+Applications that need to talk to several local ASes from one process, or that
+cannot tolerate the process exiting when the hidden initialisation fails, can
+instead construct their own Network explicitly with NewNetwork. The
+package-level functions Dial, Listen, QueryPaths etc. are all available as
+methods on such a Network.
+
 
 Wildcard IP Addresses
 
 snet does not currently support binding to wildcard addresses. This will hopefully be
 added soon-ish, but in the meantime, this package emulates this functionality.
-There is one restriction, that applies to hosts with multiple IP addresses in the AS:
-the behaviour will be that of binding to one specific local IP address, which means that
-the application will not be reachable using any of the other IP addresses.
-Traffic sent will always appear to originate from this specific IP address,
+There is one restriction for Listen and ListenPort, that applies to hosts with multiple
+IP addresses in the AS: the behaviour will be that of binding to one specific local IP
+address, which means that the application will not be reachable using any of the other
+IP addresses. Traffic sent will always appear to originate from this specific IP address,
 even if that's not the correct route to a destination in the local AS.
 
-This restriction will very likely not cause any issues, as a fairly contrived
-network setup would be required. Also, sciond has a similar restriction (binds
-to one specific IP address).
+Servers on hosts with multiple IP addresses in the AS can use ListenAll instead,
+which binds a socket on each of the local IP addresses and replies from the address
+on which a request arrived.
+
+
+SCMP Errors and Path MTU
+
+SCMP error messages received in response to the packets sent on a conn, e.g. for
+a revoked interface or for a packet that is too big, are returned from the next
+Read as *SCMPError, and are also available through NotifySCMP.
+
+MaxPayload returns the maximum size of the payload of the UDP packets on a path.
+As the MTU announced in the path metadata may be too optimistic and SCMP packet
+too big messages are not delivered by all dispatcher versions, ProbeMaxPayload
+discovers the actual path MTU with SCMP echo requests.
+
+
+Batched I/O and Pacing
+
+Applications sending or receiving at high packet rates can use DialBatch to
+obtain a BatchConn, which sends and receives multiple datagrams per call and
+reuses the serialized SCION headers for all packets to the remote.
+A Pacer limits the sending rate to a target bitrate, e.g. to send the batches
+of a BatchConn or, with a PacedWriter, the packets written to a conn.
 */
 package appnet
 
@@ -58,6 +85,7 @@ import (
 	"time"
 
 	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/pathpol"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/snet/addrutil"
@@ -67,38 +95,232 @@ import (
 // Network extends the snet.Network interface by making the local IA and common
 // sciond connections public.
 // The default singleton instance of this type is obtained by the DefNetwork
-// function.
+// function. Additional instances can be created with NewNetwork.
+//
+// The methods corresponding to the package level functions Dial and Listen are
+// DialHost and ListenUDP, as Dial and Listen are the methods of the embedded
+// snet.Network.
 type Network struct {
 	snet.Network
-	IA            addr.IA
-	PathQuerier   snet.PathQuerier
-	hostInLocalAS net.IP
+	IA             addr.IA
+	PathQuerier    snet.PathQuerier
+	hostInLocalAS  net.IP
+	resolver       Resolver
+	queryTimeout   time.Duration
+	sciondConn     sciond.Connector
+	dispatcher     reliable.Dispatcher
+	connDispatcher reliable.Dispatcher
+	paths          *pathCache
+	scmp           *scmpNotifier
+	pmtu           *pmtuCache
+
+	policyMutex sync.RWMutex
+	policy      *pathpol.Policy
+	pathSpecs   map[addr.IA]*PathSpec
+}
+
+// Config holds the parameters for NewNetwork.
+// Zero values are replaced by the defaults from DefaultConfig.
+type Config struct {
+	// SciondAddress is the address of the SCION daemon API.
+	SciondAddress string
+	// DispatcherSocket is the path of the dispatcher's UNIX socket.
+	DispatcherSocket string
+	// InitTimeout limits the time for connecting to sciond and for the
+	// initial queries. This is in addition to the deadline of the context
+	// passed to NewNetwork.
+	InitTimeout time.Duration
+	// QueryTimeout limits the time for each path query to sciond.
+	QueryTimeout time.Duration
+	// Resolver is used to resolve host names in Network.DialHost and
+	// Network.ResolveUDPAddr.
+	Resolver Resolver
+	// PathPolicy is used to filter the paths, see Network.SetPathPolicy.
+	// Optional.
+	PathPolicy *pathpol.Policy
 }
 
 const (
-	initTimeout = 1 * time.Second
+	initTimeout  = 1 * time.Second
+	queryTimeout = 5 * time.Second
 )
 
-var defNetwork Network
+var defNetwork *Network
 var initOnce sync.Once
 
+// DefaultConfig returns the configuration used for the default Network.
+// The locations of the sciond and dispatcher sockets can be overridden using
+// the SCION_DAEMON_ADDRESS and SCION_DISPATCHER_SOCKET environment variables,
+// respectively.
+func DefaultConfig() Config {
+	return Config{
+		SciondAddress:    defaultSciondAddress(),
+		DispatcherSocket: defaultDispatcherSocket(),
+		InitTimeout:      initTimeout,
+		QueryTimeout:     queryTimeout,
+		Resolver:         DefaultResolver(),
+	}
+}
+
+func defaultSciondAddress() string {
+	if address, ok := os.LookupEnv("SCION_DAEMON_ADDRESS"); ok {
+		return address
+	}
+	return sciond.DefaultAPIAddress
+}
+
+func defaultDispatcherSocket() string {
+	if socket, ok := os.LookupEnv("SCION_DISPATCHER_SOCKET"); ok {
+		return socket
+	}
+	return reliable.DefaultDispPath
+}
+
 // DefNetwork initialises and returns the singleton default Network.
 // Typically, this will not be needed for applications directly, as they can
 // use the simplified Dial/Listen functions provided here.
+//
+// If the initialisation fails, the process exits. Use NewNetwork to handle
+// such errors gracefully.
 func DefNetwork() *Network {
 	initOnce.Do(mustInitDefNetwork)
-	return &defNetwork
+	return defNetwork
+}
+
+// NewNetwork creates a new Network, connecting to the sciond and the
+// dispatcher specified in cfg.
+// Unlike DefNetwork, this returns an error if the connection to sciond can not
+// be established or if the dispatcher socket is not found.
+func NewNetwork(ctx context.Context, cfg Config) (*Network, error) {
+	cfg = withConfigDefaults(cfg)
+	if cfg.InitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.InitTimeout)
+		defer cancel()
+	}
+	dispatcher, err := findDispatcher(cfg.DispatcherSocket)
+	if err != nil {
+		return nil, err
+	}
+	sciondConn, err := findSciond(ctx, cfg.SciondAddress)
+	if err != nil {
+		return nil, err
+	}
+	localIA, err := sciondConn.LocalIA(ctx)
+	if err != nil {
+		sciondConn.Close(ctx)
+		return nil, err
+	}
+	hostInLocalAS, err := findAnyHostInLocalAS(ctx, sciondConn)
+	if err != nil {
+		sciondConn.Close(ctx)
+		return nil, err
+	}
+	pathQuerier := sciond.Querier{Connector: sciondConn, IA: localIA}
+	n := newNetwork(localIA, dispatcher, sciond.RevHandler{Connector: sciondConn},
+		pathQuerier, hostInLocalAS, cfg)
+	n.sciondConn = sciondConn
+	return n, nil
+}
+
+// NewCustomNetwork creates a Network for the local IA from custom components,
+// instead of connecting to sciond and to the dispatcher socket.
+// The PathQuerier is used to look up paths and hostInLocalAS is used to
+// determine the local IP address, see note on wildcard addresses in the
+// package documentation.
+// The SciondAddress and DispatcherSocket in cfg are ignored.
+//
+// This is mostly useful for testing, see package appnettest for an in-memory
+// implementation of the components.
+func NewCustomNetwork(ia addr.IA, dispatcher reliable.Dispatcher, pathQuerier snet.PathQuerier,
+	hostInLocalAS net.IP, cfg Config) *Network {
+
+	return newNetwork(ia, dispatcher, nil, pathQuerier, hostInLocalAS, withConfigDefaults(cfg))
+}
+
+func newNetwork(ia addr.IA, dispatcher reliable.Dispatcher, revHandler snet.RevocationHandler,
+	pathQuerier snet.PathQuerier, hostInLocalAS net.IP, cfg Config) *Network {
+
+	pmtu := newPMTUCache()
+	paths := newPathCache(pathQuerier, cfg.QueryTimeout)
+	scmp := newSCMPNotifier(revHandler, paths, pmtu)
+	connDispatcher := &scmpDispatcher{Dispatcher: &metricsDispatcher{dispatcher}, notifier: scmp}
+	return &Network{
+		Network:        snet.NewNetwork(ia, connDispatcher, revHandler),
+		IA:             ia,
+		PathQuerier:    pathQuerier,
+		hostInLocalAS:  hostInLocalAS,
+		resolver:       cfg.Resolver,
+		queryTimeout:   cfg.QueryTimeout,
+		dispatcher:     dispatcher,
+		connDispatcher: connDispatcher,
+		paths:          paths,
+		scmp:           scmp,
+		pmtu:           pmtu,
+		policy:         cfg.PathPolicy,
+	}
+}
+
+// SetDefNetwork replaces the default Network used by the package-level
+// functions, e.g. by a Network created with NewCustomNetwork in tests.
+// The initialisation of the default Network is skipped if it has not happened
+// yet.
+func SetDefNetwork(n *Network) {
+	initOnce.Do(func() {})
+	defNetwork = n
+}
+
+// withConfigDefaults returns a copy of cfg, with the zero values replaced by
+// the corresponding values from DefaultConfig. Only the defaults for the zero
+// values are determined, e.g. the DefaultResolver is not loaded if cfg
+// specifies a Resolver.
+func withConfigDefaults(cfg Config) Config {
+	if cfg.SciondAddress == "" {
+		cfg.SciondAddress = defaultSciondAddress()
+	}
+	if cfg.DispatcherSocket == "" {
+		cfg.DispatcherSocket = defaultDispatcherSocket()
+	}
+	if cfg.InitTimeout == 0 {
+		cfg.InitTimeout = initTimeout
+	}
+	if cfg.QueryTimeout == 0 {
+		cfg.QueryTimeout = queryTimeout
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = DefaultResolver()
+	}
+	return cfg
+}
+
+// Close closes the connection to sciond and stops the background refresh of
+// the cached paths.
+// Conns created from this Network are not affected.
+func (n *Network) Close() error {
+	if n.paths != nil {
+		n.paths.Close()
+	}
+	if n.sciondConn == nil {
+		return nil
+	}
+	return n.sciondConn.Close(context.Background())
 }
 
 // Dial connects to the address (on the SCION/UDP network).
 // The address can be of the form of a SCION address (i.e. of the form "ISD-AS,[IP]:port")
 // or in the form of hostname:port.
 func Dial(address string) (*snet.Conn, error) {
-	raddr, err := ResolveUDPAddr(address)
+	return DefNetwork().DialHost(address)
+}
+
+// DialHost connects to the address (on the SCION/UDP network).
+// See Dial.
+func (n *Network) DialHost(address string) (*snet.Conn, error) {
+	raddr, err := n.ResolveUDPAddr(address)
 	if err != nil {
 		return nil, err
 	}
-	return DialAddr(raddr)
+	return n.DialAddr(raddr)
 }
 
 // DialAddr connects to the address (on the SCION/UDP network).
@@ -106,52 +328,70 @@ func Dial(address string) (*snet.Conn, error) {
 // If no path is specified in raddr, DialAddr will choose the first available path.
 // This path is never updated during the lifetime of the conn. This does not
 // support long lived connections well, as the path *will* expire.
-// This is all that snet currently provides, we'll need to add a layer on top
-// that updates the paths in case they expire or are revoked.
+// Use DialAddrManaged for a connection that updates the path in case it
+// expires or is revoked.
 func DialAddr(raddr *snet.UDPAddr) (*snet.Conn, error) {
+	return DefNetwork().DialAddr(raddr)
+}
+
+// DialAddr connects to the address (on the SCION/UDP network).
+// See DialAddr.
+func (n *Network) DialAddr(raddr *snet.UDPAddr) (*snet.Conn, error) {
 	if raddr.Path.IsEmpty() {
-		err := SetDefaultPath(raddr)
+		err := n.SetDefaultPath(raddr)
 		if err != nil {
 			return nil, err
 		}
 	}
-	localIP, err := resolveLocal(raddr)
+	localIP, err := n.resolveLocal(raddr)
 	if err != nil {
 		return nil, err
 	}
 	laddr := &net.UDPAddr{IP: localIP}
-	return DefNetwork().Dial(context.Background(), "udp", laddr, raddr, addr.SvcNone)
+	return n.Dial(context.Background(), "udp", laddr, raddr, addr.SvcNone)
 }
 
 // Listen acts like net.ListenUDP in a SCION network.
 // The listen address or parts of it may be nil or unspecified, signifying to
 // listen on a wildcard address.
 //
-// See note on wildcard addresses in the package documentation.
+// See note on wildcard addresses in the package documentation. Use ListenAll
+// to listen on all local IP addresses.
 func Listen(listen *net.UDPAddr) (*snet.Conn, error) {
+	return DefNetwork().ListenUDP(listen)
+}
+
+// ListenUDP acts like net.ListenUDP in a SCION network.
+// See Listen.
+func (n *Network) ListenUDP(listen *net.UDPAddr) (*snet.Conn, error) {
 	if listen == nil {
 		listen = &net.UDPAddr{}
 	}
 	if listen.IP == nil || listen.IP.IsUnspecified() {
-		localIP, err := defaultLocalIP()
+		localIP, err := n.defaultLocalIP()
 		if err != nil {
 			return nil, err
 		}
 		listen = &net.UDPAddr{IP: localIP, Port: listen.Port, Zone: listen.Zone}
 	}
-	defNetwork := DefNetwork()
 	integrationEnv, _ := os.LookupEnv("SCION_GO_INTEGRATION")
 	if integrationEnv == "1" || integrationEnv == "true" || integrationEnv == "TRUE" {
-		fmt.Printf("Listening ia=:%v\n", defNetwork.IA)
+		fmt.Printf("Listening ia=:%v\n", n.IA)
 	}
-	return defNetwork.Listen(context.Background(), "udp", listen, addr.SvcNone)
+	return n.Listen(context.Background(), "udp", listen, addr.SvcNone)
 }
 
 // ListenPort is a shortcut to Listen on a specific port with a wildcard IP address.
 //
 // See note on wildcard addresses in the package documentation.
 func ListenPort(port uint16) (*snet.Conn, error) {
-	return Listen(&net.UDPAddr{Port: int(port)})
+	return DefNetwork().ListenPort(port)
+}
+
+// ListenPort is a shortcut to Listen on a specific port with a wildcard IP address.
+// See ListenPort.
+func (n *Network) ListenPort(port uint16) (*snet.Conn, error) {
+	return n.ListenUDP(&net.UDPAddr{Port: int(port)})
 }
 
 // resolveLocal returns the source IP address for traffic to raddr. If
@@ -161,12 +401,12 @@ func ListenPort(port uint16) (*snet.Conn, error) {
 // The purpose of this function is to workaround not being able to bind to
 // wildcard addresses in snet.
 // See note on wildcard addresses in the package documentation.
-func resolveLocal(raddr *snet.UDPAddr) (net.IP, error) {
+func (n *Network) resolveLocal(raddr *snet.UDPAddr) (net.IP, error) {
 	if raddr.NextHop != nil {
 		nextHop := raddr.NextHop.IP
 		return addrutil.ResolveLocal(nextHop)
 	}
-	return defaultLocalIP()
+	return n.defaultLocalIP()
 }
 
 // defaultLocalIP returns _a_ IP of this host in the local AS.
@@ -174,52 +414,20 @@ func resolveLocal(raddr *snet.UDPAddr) (net.IP, error) {
 // The purpose of this function is to workaround not being able to bind to
 // wildcard addresses in snet.
 // See note on wildcard addresses in the package documentation.
-func defaultLocalIP() (net.IP, error) {
-	return addrutil.ResolveLocal(DefNetwork().hostInLocalAS)
+func (n *Network) defaultLocalIP() (net.IP, error) {
+	return addrutil.ResolveLocal(n.hostInLocalAS)
 }
 
 func mustInitDefNetwork() {
-	err := initDefNetwork()
+	n, err := NewNetwork(context.Background(), DefaultConfig())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing SCION network: %v\n", err)
 		os.Exit(1)
 	}
+	defNetwork = n
 }
 
-func initDefNetwork() error {
-	ctx, cancel := context.WithTimeout(context.Background(), initTimeout)
-	defer cancel()
-	dispatcher, err := findDispatcher()
-	if err != nil {
-		return err
-	}
-	sciondConn, err := findSciond(ctx)
-	if err != nil {
-		return err
-	}
-	localIA, err := sciondConn.LocalIA(ctx)
-	if err != nil {
-		return err
-	}
-	hostInLocalAS, err := findAnyHostInLocalAS(ctx, sciondConn)
-	if err != nil {
-		return err
-	}
-	pathQuerier := sciond.Querier{Connector: sciondConn, IA: localIA}
-	n := snet.NewNetwork(
-		localIA,
-		dispatcher,
-		sciond.RevHandler{Connector: sciondConn},
-	)
-	defNetwork = Network{Network: n, IA: localIA, PathQuerier: pathQuerier, hostInLocalAS: hostInLocalAS}
-	return nil
-}
-
-func findSciond(ctx context.Context) (sciond.Connector, error) {
-	address, ok := os.LookupEnv("SCION_DAEMON_ADDRESS")
-	if !ok {
-		address = sciond.DefaultAPIAddress
-	}
+func findSciond(ctx context.Context, address string) (sciond.Connector, error) {
 	sciondConn, err := sciond.NewService(address).Connect(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect to SCIOND at %s (override with SCION_DAEMON_ADDRESS): %w", address, err)
@@ -227,27 +435,15 @@ func findSciond(ctx context.Context) (sciond.Connector, error) {
 	return sciondConn, nil
 }
 
-func findDispatcher() (reliable.Dispatcher, error) {
-	path, err := findDispatcherSocket()
+func findDispatcher(path string) (reliable.Dispatcher, error) {
+	err := statSocket(path)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error looking for SCION dispatcher socket at %s (override with SCION_DISPATCHER_SOCKET): %w", path, err)
 	}
 	dispatcher := reliable.NewDispatcher(path)
 	return dispatcher, nil
 }
 
-func findDispatcherSocket() (string, error) {
-	path, ok := os.LookupEnv("SCION_DISPATCHER_SOCKET")
-	if !ok {
-		path = reliable.DefaultDispPath
-	}
-	err := statSocket(path)
-	if err != nil {
-		return "", fmt.Errorf("error looking for SCION dispatcher socket at %s (override with SCION_DISPATCHER_SOCKET): %w", path, err)
-	}
-	return path, nil
-}
-
 func statSocket(path string) error {
 	fileinfo, err := os.Stat(path)
 	if err != nil {
@@ -0,0 +1,56 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWithConfigDefaults(t *testing.T) {
+	def := DefaultConfig()
+
+	cfg := withConfigDefaults(Config{})
+	if cfg.SciondAddress != def.SciondAddress || cfg.DispatcherSocket != def.DispatcherSocket ||
+		cfg.InitTimeout != def.InitTimeout || cfg.QueryTimeout != def.QueryTimeout ||
+		cfg.Resolver == nil {
+		t.Errorf("zero Config not replaced by defaults, got %+v", cfg)
+	}
+
+	explicit := Config{
+		SciondAddress:    "127.0.0.19:30255",
+		DispatcherSocket: "/run/shm/dispatcher/other.sock",
+		InitTimeout:      3 * time.Second,
+		QueryTimeout:     7 * time.Second,
+		Resolver:         ResolverList{},
+	}
+	cfg = withConfigDefaults(explicit)
+	if cfg.SciondAddress != explicit.SciondAddress || cfg.DispatcherSocket != explicit.DispatcherSocket ||
+		cfg.InitTimeout != explicit.InitTimeout || cfg.QueryTimeout != explicit.QueryTimeout {
+		t.Errorf("explicit Config values overridden, expected %+v, got %+v", explicit, cfg)
+	}
+	if resolvers, ok := cfg.Resolver.(ResolverList); !ok || len(resolvers) != 0 {
+		t.Errorf("explicit Resolver overridden, got %v", cfg.Resolver)
+	}
+}
+
+func TestNewNetworkNoDispatcher(t *testing.T) {
+	cfg := Config{DispatcherSocket: "non_existing_dispatcher_socket"}
+	n, err := NewNetwork(context.Background(), cfg)
+	if err == nil {
+		t.Fatalf("expected error for non-existing dispatcher socket, got %v", n)
+	}
+}
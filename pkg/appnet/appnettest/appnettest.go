@@ -0,0 +1,244 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package appnettest provides an in-memory SCION network for testing
+applications built on appnet, without a running SCION topology, dispatcher or
+sciond.
+
+A Net consists of paths between IAs, configured with AddPath. NewNetwork
+returns an appnet.Network for one IA of the Net, on which the usual Dial,
+Listen, QueryPaths, ProbePaths etc. work as on a real SCION network. SetDefault
+replaces the default appnet Network, so that the package-level functions of
+appnet use the Net.
+
+	mn := appnettest.NewNet()
+	mn.AddPath(iaA, iaB, appnettest.PathConfig{Latency: 10 * time.Millisecond})
+	mn.AddPath(iaA, iaB, appnettest.PathConfig{Loss: 0.5})
+	mn.AddHost("server", iaB, net.IPv4(127, 0, 0, 1))
+	mn.SetDefault(iaA)
+	conn, err := appnet.Dial("server:1234")
+
+Packets are serialized and decoded as on a real network, using a special path
+type that identifies the path in the Net. Latency, loss and the MTU of a path
+are applied to the packets sent over it. Packets that are dropped because they
+exceed the MTU, traverse a revoked interface or are sent to a port without
+socket are answered with the corresponding SCMP error message (packet too big,
+external interface down and destination unreachable, respectively). SCMP echo
+requests are answered, regardless of the destination host.
+
+All hosts bind to the loopback address by default. Actual network
+communication does not take place.
+*/
+package appnettest
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// PathConfig describes a path between two IAs of a Net.
+type PathConfig struct {
+	// Interfaces is the sequence of interfaces traversed by the path, in the
+	// direction from source to destination. Defaults to a direct link between
+	// source and destination, with interface IDs unique in the Net.
+	Interfaces []snet.PathInterface
+	// MTU is the maximum size of packets on the path. Larger packets are
+	// dropped and answered with an SCMP packet too big message. Defaults to
+	// 1472.
+	MTU uint16
+	// Expiry is the expiration time of the path. Defaults to 6 hours after
+	// the path was added.
+	Expiry time.Time
+	// Latency is the one-way delay of packets on the path.
+	Latency time.Duration
+	// Loss is the probability that a packet on the path is dropped, in [0,1].
+	Loss float64
+}
+
+const (
+	defaultMTU    = 1472
+	defaultExpiry = 6 * time.Hour
+)
+
+// Net is an in-memory SCION network.
+// The zero value is not usable, use NewNet.
+type Net struct {
+	mutex      sync.Mutex
+	paths      map[uint32]*pathEntry
+	nextPathID uint32
+	revoked    map[snet.PathInterface]struct{}
+	hosts      map[string]*snet.SCIONAddress
+	sockets    map[socketKey]*conn
+	rand       *rand.Rand
+}
+
+type pathEntry struct {
+	src, dst addr.IA
+	cfg      PathConfig
+}
+
+// NewNet creates an empty Net.
+func NewNet() *Net {
+	return &Net{
+		paths:   make(map[uint32]*pathEntry),
+		revoked: make(map[snet.PathInterface]struct{}),
+		hosts:   make(map[string]*snet.SCIONAddress),
+		sockets: make(map[socketKey]*conn),
+		rand:    rand.New(rand.NewSource(1)),
+	}
+}
+
+// NewNetwork returns an appnet.Network for a host in ia.
+// Each Network has its own path cache; sockets opened on Networks for the
+// same IA share the same address space.
+func (m *Net) NewNetwork(ia addr.IA) *appnet.Network {
+	return appnet.NewCustomNetwork(
+		ia,
+		&dispatcher{net: m},
+		&querier{net: m, local: ia},
+		net.IPv4(127, 0, 0, 1),
+		appnet.Config{Resolver: m},
+	)
+}
+
+// SetDefault replaces the default appnet Network by a Network for a host in
+// ia. See appnet.SetDefNetwork.
+func (m *Net) SetDefault(ia addr.IA) *appnet.Network {
+	n := m.NewNetwork(ia)
+	appnet.SetDefNetwork(n)
+	return n
+}
+
+// AddPath adds a path from src to dst. The path can also be used in the
+// reverse direction.
+func (m *Net) AddPath(src, dst addr.IA, cfg PathConfig) *Path {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id := m.nextPathID
+	m.nextPathID++
+	if len(cfg.Interfaces) == 0 {
+		cfg.Interfaces = []snet.PathInterface{
+			{IA: src, ID: ifID(id)},
+			{IA: dst, ID: ifID(id)},
+		}
+	}
+	if cfg.MTU == 0 {
+		cfg.MTU = defaultMTU
+	}
+	if cfg.Expiry.IsZero() {
+		cfg.Expiry = time.Now().Add(defaultExpiry)
+	}
+	m.paths[id] = &pathEntry{src: src, dst: dst, cfg: cfg}
+	return &Path{net: m, id: id}
+}
+
+// Revoke marks the interface as down. Paths traversing the interface are no
+// longer returned by path queries, and packets sent over such paths are
+// answered with an SCMP interface down message.
+func (m *Net) Revoke(iface snet.PathInterface) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.revoked[iface] = struct{}{}
+}
+
+// Unrevoke marks the interface as up again.
+func (m *Net) Unrevoke(iface snet.PathInterface) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.revoked, iface)
+}
+
+// AddHost adds a host name that is resolved to the address ia,ip.
+func (m *Net) AddHost(name string, ia addr.IA, ip net.IP) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hosts[name] = &snet.SCIONAddress{IA: ia, Host: addr.HostFromIP(ip)}
+}
+
+// Resolve implements appnet.Resolver for the host names added with AddHost.
+func (m *Net) Resolve(name string) (*snet.SCIONAddress, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if a, ok := m.hosts[name]; ok {
+		return &snet.SCIONAddress{IA: a.IA, Host: a.Host.Copy()}, nil
+	}
+	return nil, &appnet.HostNotFoundError{Host: name}
+}
+
+// ReverseResolve implements appnet.ReverseResolver for the host names added
+// with AddHost. The names are returned in lexicographic order.
+func (m *Net) ReverseResolve(address *snet.SCIONAddress) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	for name, a := range m.hosts {
+		if a.IA == address.IA && a.Host.Equal(address.Host) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, &appnet.HostNotFoundError{Host: address.String()}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Path is a handle to a path added to a Net, to modify its properties.
+type Path struct {
+	net *Net
+	id  uint32
+}
+
+// Update modifies the configuration of the path, e.g. to change its latency
+// or loss.
+func (p *Path) Update(f func(cfg *PathConfig)) {
+	p.net.mutex.Lock()
+	defer p.net.mutex.Unlock()
+	if e, ok := p.net.paths[p.id]; ok {
+		f(&e.cfg)
+	}
+}
+
+// Interfaces returns the interfaces of the path, in the direction from source
+// to destination.
+func (p *Path) Interfaces() []snet.PathInterface {
+	p.net.mutex.Lock()
+	defer p.net.mutex.Unlock()
+	if e, ok := p.net.paths[p.id]; ok {
+		return append([]snet.PathInterface(nil), e.cfg.Interfaces...)
+	}
+	return nil
+}
+
+// Remove removes the path from the Net.
+// Packets sent over the path are dropped.
+func (p *Path) Remove() {
+	p.net.mutex.Lock()
+	defer p.net.mutex.Unlock()
+	delete(p.net.paths, p.id)
+}
+
+func (p *Path) String() string {
+	return fmt.Sprintf("mock path %d", p.id)
+}
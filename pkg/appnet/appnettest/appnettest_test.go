@@ -0,0 +1,634 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnettest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+var (
+	iaA = addr.IA{I: 1, A: 0xff0000000110}
+	iaB = addr.IA{I: 1, A: 0xff0000000111}
+)
+
+func TestDialListen(t *testing.T) {
+	mn := NewNet()
+	mn.AddPath(iaA, iaB, PathConfig{})
+	mn.AddHost("server", iaB, net.IPv4(127, 0, 0, 1))
+
+	server := mn.NewNetwork(iaB)
+	client := mn.NewNetwork(iaA)
+
+	sconn, err := server.ListenPort(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	cconn, err := client.DialHost("server:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+
+	if _, err := cconn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	_ = sconn.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := sconn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("unexpected payload %q", buf[:n])
+	}
+	// reply on the reversed path
+	if _, err := sconn.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	_ = cconn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = cconn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Errorf("unexpected payload %q", buf[:n])
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	mn := NewNet()
+	conn, err := mn.NewNetwork(iaA).ListenPort(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = conn.ReadFrom(make([]byte, 16))
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+}
+
+func TestQueryPaths(t *testing.T) {
+	mn := NewNet()
+	p0 := mn.AddPath(iaA, iaB, PathConfig{MTU: 1000})
+	mn.AddPath(iaA, iaB, PathConfig{})
+
+	paths, err := mn.NewNetwork(iaB).QueryPaths(iaA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("expected 2 paths, got %d", len(paths))
+	}
+	md := paths[0].Metadata()
+	if md.MTU != 1000 {
+		t.Errorf("expected MTU 1000, got %d", md.MTU)
+	}
+	// reversed
+	ifaces := p0.Interfaces()
+	if md.Interfaces[0] != ifaces[1] || md.Interfaces[1] != ifaces[0] {
+		t.Errorf("expected reversed interfaces %v, got %v", ifaces, md.Interfaces)
+	}
+
+	mn.Revoke(ifaces[0])
+	paths = mn.queryPaths(iaB, iaA, time.Now())
+	if len(paths) != 1 {
+		t.Errorf("expected 1 path after revocation, got %d", len(paths))
+	}
+}
+
+func TestQueryPathsSpec(t *testing.T) {
+	mn := NewNet()
+	mn.AddPath(iaA, iaB, PathConfig{})
+	p1 := mn.AddPath(iaA, iaB, PathConfig{})
+
+	n := mn.NewNetwork(iaA)
+	paths, err := n.QueryPaths(iaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := appnet.ParsePathSpec(appnet.NewPathInfo(paths[1]).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetPathSpec(iaB, spec)
+	paths, err = n.QueryPaths(iaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0].Metadata().Interfaces[0] != p1.Interfaces()[0] {
+		t.Errorf("expected only path %s, got %v", p1, paths)
+	}
+
+	// The spec does not apply to other destinations
+	iaC := addr.IA{I: 1, A: 0xff0000000112}
+	mn.AddPath(iaA, iaC, PathConfig{})
+	if paths, err := n.QueryPaths(iaC); err != nil || len(paths) != 1 {
+		t.Errorf("expected path to other destination, got %v, %v", paths, err)
+	}
+
+	n.SetPathSpec(iaB, nil)
+	if paths, err := n.QueryPaths(iaB); err != nil || len(paths) != 2 {
+		t.Errorf("expected all paths after removing spec, got %v, %v", paths, err)
+	}
+}
+
+func TestProbePaths(t *testing.T) {
+	mn := NewNet()
+	mn.AddPath(iaA, iaB, PathConfig{Latency: 20 * time.Millisecond})
+	mn.AddPath(iaA, iaB, PathConfig{Loss: 1})
+
+	n := mn.NewNetwork(iaA)
+	paths, err := n.QueryPaths(iaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := &snet.UDPAddr{IA: iaB, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	probes := n.ProbePaths(context.Background(), dst, paths, appnet.ProbeConfig{
+		Attempts: 2,
+		Interval: 10 * time.Millisecond,
+		Timeout:  200 * time.Millisecond,
+	})
+	if probes[0].Err != nil || probes[0].Loss != 0 {
+		t.Errorf("unexpected probe result %+v", probes[0])
+	}
+	if probes[0].RTT < 40*time.Millisecond {
+		t.Errorf("expected RTT of at least 40ms, got %s", probes[0].RTT)
+	}
+	if probes[1].Loss != 1 {
+		t.Errorf("expected loss 1 on lossy path, got %f", probes[1].Loss)
+	}
+}
+
+func TestChoosePathByMetric(t *testing.T) {
+	mn := NewNet()
+	mn.AddPath(iaA, iaB, PathConfig{Loss: 1})
+	fast := mn.AddPath(iaA, iaB, PathConfig{})
+
+	n := mn.NewNetwork(iaA)
+	if _, err := n.ChoosePathByMetric(appnet.Latency, iaB); err == nil {
+		t.Errorf("expected error for latency metric without host")
+	}
+	if path, err := n.ChoosePathByMetric(appnet.Shortest, iaB); err != nil || path == nil {
+		t.Errorf("expected path, got %v, %v", path, err)
+	}
+	dst := &snet.UDPAddr{IA: iaB, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	path, err := n.ChoosePathByMetricAddr(appnet.Loss, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Metadata().Interfaces[0] != fast.Interfaces()[0] {
+		t.Errorf("expected path %s, got %s", fast, path)
+	}
+}
+
+// blockingSelector is a RoundRobinSelector whose Reset blocks until release
+// is closed, like a selector probing the paths.
+type blockingSelector struct {
+	appnet.RoundRobinSelector
+	release chan struct{}
+}
+
+func (s *blockingSelector) Reset(dst *snet.UDPAddr, paths []snet.Path) error {
+	<-s.release
+	return s.RoundRobinSelector.Reset(dst, paths)
+}
+
+func TestMultipathConnConstructSelector(t *testing.T) {
+	iaC := addr.IA{I: 1, A: 0xff0000000112}
+	mn := NewNet()
+	mn.AddPath(iaA, iaB, PathConfig{})
+	mn.AddPath(iaA, iaC, PathConfig{})
+	client := mn.NewNetwork(iaA)
+	conn, err := client.ListenPort(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	var constructed int32
+	mconn := client.NewMultipathConn(conn, appnet.MultipathConfig{
+		NewSelector: func() appnet.PathSelector {
+			if atomic.AddInt32(&constructed, 1) == 1 {
+				return &blockingSelector{release: release}
+			}
+			closed := make(chan struct{})
+			close(closed)
+			return &blockingSelector{release: closed}
+		},
+	})
+	defer mconn.Close()
+
+	dstB := &snet.UDPAddr{IA: iaB, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+	dstC := &snet.UDPAddr{IA: iaC, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := mconn.WriteTo([]byte("hello"), dstB); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&constructed) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Writes to other destinations are not blocked by the construction
+	done := make(chan error, 1)
+	go func() {
+		_, err := mconn.WriteTo([]byte("hello"), dstC)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write blocked by construction of selector for other destination")
+	}
+	close(release)
+	wg.Wait()
+	// One selector for each destination
+	if n := atomic.LoadInt32(&constructed); n != 2 {
+		t.Errorf("expected 2 selectors, got %d", n)
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	mn := NewNet()
+	p0 := mn.AddPath(iaA, iaB, PathConfig{})
+	mn.AddPath(iaA, iaB, PathConfig{})
+
+	server := mn.NewNetwork(iaB)
+	sconn, err := server.ListenPort(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+
+	client := mn.NewNetwork(iaA)
+	raddr := &snet.UDPAddr{IA: iaB, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+	conn, err := client.DialAddrManaged(raddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	initial := conn.Path()
+	if initial.Metadata().Interfaces[0] != p0.Interfaces()[0] {
+		t.Fatalf("expected initial path %s, got %s", p0, initial)
+	}
+	mn.Revoke(p0.Interfaces()[1])
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// the interface down message is handled during Read
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _ = conn.Read(make([]byte, 16))
+	if snet.Fingerprint(conn.Path()) == snet.Fingerprint(initial) {
+		t.Errorf("path not switched after revocation")
+	}
+}
+
+func TestSCMPErrors(t *testing.T) {
+	mn := NewNet()
+	p0 := mn.AddPath(iaA, iaB, PathConfig{MTU: 600})
+	server := mn.NewNetwork(iaB)
+	sconn, err := server.ListenPort(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+
+	client := mn.NewNetwork(iaA)
+	notifications := make(chan *appnet.SCMPError, 8)
+	stop := client.NotifySCMP(notifications)
+	defer stop()
+	paths, err := client.QueryPaths(iaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		port     int
+		size     int
+		revoke   bool
+		expected error
+		check    func(t *testing.T, e *appnet.SCMPError)
+	}{
+		{"port unreachable", 4321, 100, false, appnet.ErrDestinationUnreachable,
+			func(t *testing.T, e *appnet.SCMPError) {
+				if e.Destination == nil || e.Destination.Host.Port != 4321 {
+					t.Errorf("expected destination port 4321, got %v", e.Destination)
+				}
+			},
+		},
+		{"packet too big", 1234, 1000, false, appnet.ErrPacketTooBig,
+			func(t *testing.T, e *appnet.SCMPError) {
+				if e.MTU != 600 {
+					t.Errorf("expected MTU 600, got %d", e.MTU)
+				}
+			},
+		},
+		{"interface down", 1234, 100, true, appnet.ErrPathDown,
+			func(t *testing.T, e *appnet.SCMPError) {
+				if e.Interface == nil || *e.Interface != p0.Interfaces()[1] {
+					t.Errorf("expected interface %v, got %v", p0.Interfaces()[1], e.Interface)
+				}
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raddr := &snet.UDPAddr{IA: iaB, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.port}}
+			conn, err := client.DialAddr(raddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if c.revoke {
+				mn.Revoke(p0.Interfaces()[1])
+			}
+			if _, err := conn.Write(make([]byte, c.size)); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 16))
+			var scmpErr *appnet.SCMPError
+			if !errors.As(err, &scmpErr) || !errors.Is(err, c.expected) {
+				t.Fatalf("expected %v, got %v", c.expected, err)
+			}
+			if scmpErr.Path == nil || snet.Fingerprint(scmpErr.Path) != snet.Fingerprint(paths[0]) {
+				t.Errorf("expected path %s, got %v", paths[0], scmpErr.Path)
+			}
+			c.check(t, scmpErr)
+			select {
+			case n := <-notifications:
+				if n != scmpErr {
+					t.Errorf("expected notification %v, got %v", scmpErr, n)
+				}
+			default:
+				t.Errorf("no notification for %v", scmpErr)
+			}
+		})
+	}
+}
+
+func TestMaxPayload(t *testing.T) {
+	mn := NewNet()
+	p0 := mn.AddPath(iaA, iaB, PathConfig{MTU: 1000})
+	server := mn.NewNetwork(iaB)
+	sconn, err := server.ListenPort(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+
+	client := mn.NewNetwork(iaA)
+	paths, err := client.QueryPaths(iaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr := &snet.UDPAddr{IA: iaB, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+	appnet.SetPath(raddr, paths[0])
+	conn, err := client.DialAddr(raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// checkMaxPayload checks that a packet of size max is delivered and that
+	// a larger packet is answered with packet too big
+	checkMaxPayload := func(max int) {
+		t.Helper()
+		buf := make([]byte, 2000)
+		if _, err := conn.Write(buf[:max]); err != nil {
+			t.Fatal(err)
+		}
+		_ = sconn.SetReadDeadline(time.Now().Add(time.Second))
+		if n, _, err := sconn.ReadFrom(buf); err != nil || n != max {
+			t.Errorf("expected packet of %d bytes, got %d, %v", max, n, err)
+		}
+		if _, err := conn.Write(buf[:max+1]); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(buf); !errors.Is(err, appnet.ErrPacketTooBig) {
+			t.Errorf("expected packet too big for %d bytes, got %v", max+1, err)
+		}
+	}
+
+	announced := client.MaxPayload(raddr)
+	checkMaxPayload(announced)
+
+	// The actual MTU is lower than announced in the metadata
+	p0.Update(func(cfg *PathConfig) { cfg.MTU = 800 })
+	probed, err := client.ProbeMaxPayload(context.Background(), raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probed != announced-200 {
+		t.Errorf("expected max payload %d, got %d", announced-200, probed)
+	}
+	if cached := client.MaxPayload(raddr); cached != probed {
+		t.Errorf("expected cached max payload %d, got %d", probed, cached)
+	}
+	checkMaxPayload(probed)
+}
+
+func TestBatchConn(t *testing.T) {
+	mn := NewNet()
+	mn.AddPath(iaA, iaB, PathConfig{})
+	server := mn.NewNetwork(iaB)
+	client := mn.NewNetwork(iaA)
+
+	raddr := &snet.UDPAddr{IA: iaB, Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+	conn, err := client.DialBatch(nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	caddr := &snet.UDPAddr{IA: iaA, Host: laddr}
+	paths, err := server.QueryPaths(iaA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appnet.SetPath(caddr, paths[0])
+	sconn, err := server.DialBatch(&net.UDPAddr{Port: 1234}, caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+
+	const numMsgs = 100
+	msgs := make([]appnet.Message, numMsgs)
+	for i := range msgs {
+		msgs[i].Buffer = []byte{byte(i), byte(i), byte(i)}[:1+i%3]
+	}
+	for _, c := range []struct {
+		name     string
+		from, to *appnet.BatchConn
+	}{
+		{"client->server", conn, sconn},
+		{"server->client", sconn, conn},
+	} {
+		if n, err := c.from.WriteBatch(msgs); err != nil || n != numMsgs {
+			t.Fatalf("%s: expected %d messages sent, got %d, %v", c.name, numMsgs, n, err)
+		}
+		recv := make([]appnet.Message, 16)
+		for i := range recv {
+			recv[i].Buffer = make([]byte, 10)
+		}
+		_ = c.to.SetReadDeadline(time.Now().Add(time.Second))
+		for received := 0; received < numMsgs; {
+			n, err := c.to.ReadBatch(recv)
+			if err != nil {
+				t.Fatalf("%s: %v after %d messages", c.name, err, received)
+			}
+			for _, m := range recv[:n] {
+				if !bytes.Equal(m.Buffer[:m.N], msgs[received].Buffer) {
+					t.Fatalf("%s: message %d: expected %v, got %v",
+						c.name, received, msgs[received].Buffer, m.Buffer[:m.N])
+				}
+				received++
+			}
+		}
+	}
+}
+
+// gatherMetrics returns the values of the counters and the sample counts of
+// the histograms gathered from reg, by metric name and labels, e.g.
+// `appnet_packets_total{direction="in",ia="1-ff00:0:110",path="local"}`.
+func gatherMetrics(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			labelStr := "{" + strings.Join(labels, ",") + "}"
+			if h := m.GetHistogram(); h != nil {
+				values[f.GetName()+"_count"+labelStr] = float64(h.GetSampleCount())
+			} else {
+				values[f.GetName()+labelStr] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+	// separate IAs; the metrics are shared by all tests and runs, so only
+	// their increase is checked
+	iaC := addr.IA{I: 2, A: 0xff0000000210}
+	iaD := addr.IA{I: 2, A: 0xff0000000211}
+	appnet.EnableMetrics()
+	reg := prometheus.NewRegistry()
+	if err := appnet.RegisterMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+	before := gatherMetrics(t, reg)
+
+	mn := NewNet()
+	mn.AddPath(iaC, iaD, PathConfig{})
+	mn.AddHost("server", iaD, net.IPv4(127, 0, 0, 1))
+	server := mn.NewNetwork(iaD)
+	client := mn.NewNetwork(iaC)
+
+	sconn, err := server.ListenPort(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	cconn, err := client.DialHost("server:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+	paths, err := client.QueryPaths(iaD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := snet.Fingerprint(paths[0]).String()
+
+	buf := make([]byte, 16)
+	for i := 0; i < 3; i++ {
+		if _, err := cconn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		_ = sconn.SetReadDeadline(time.Now().Add(time.Second))
+		_, from, err := sconn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sconn.WriteTo([]byte("pong"), from); err != nil {
+			t.Fatal(err)
+		}
+		_ = cconn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := cconn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after := gatherMetrics(t, reg)
+	for metric, expected := range map[string]float64{
+		fmt.Sprintf(`appnet_packets_total{direction="out",ia="%s",path="%s"}`, iaD, fingerprint): 3,
+		fmt.Sprintf(`appnet_packets_total{direction="in",ia="%s",path="%s"}`, iaD, fingerprint):  3,
+		// the server did not look up the path of the replies
+		fmt.Sprintf(`appnet_packets_total{direction="in",ia="%s",path="unknown"}`, iaC):   3,
+		fmt.Sprintf(`appnet_packets_total{direction="out",ia="%s",path="unknown"}`, iaC):  3,
+		fmt.Sprintf(`appnet_path_query_duration_seconds_count{ia="%s",result="ok"}`, iaD): 1,
+		`appnet_resolve_duration_seconds_count{result="ok"}`:                              1,
+	} {
+		if v := after[metric] - before[metric]; v != expected {
+			t.Errorf("expected %s to increase by %v, got %v", metric, expected, v)
+		}
+	}
+
+	// the metrics are exported by the MetricsHandler
+	rec := httptest.NewRecorder()
+	appnet.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "appnet_packets_total{") {
+		t.Errorf("expected metrics to contain appnet_packets_total, got\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnettest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/internal/deadline"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/slayers"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+	"github.com/scionproto/scion/go/lib/topology/underlay"
+)
+
+const (
+	// firstEphemeralPort is the first port assigned to sockets registered
+	// with port 0.
+	firstEphemeralPort = 32768
+	// queueSize is the number of packets buffered per socket. Further
+	// packets are dropped.
+	queueSize = 1024
+	// maxQuoteLen is the maximum length of the packet quoted in SCMP error
+	// messages.
+	maxQuoteLen = 1024
+)
+
+// ephemeralPorts counts the ports assigned to sockets registered with port 0.
+// It is shared by all Nets, so that the sockets of a process have distinct
+// local addresses, as expected e.g. by quic-go which multiplexes the conns by
+// their local address. Accessed atomically.
+var ephemeralPorts uint32
+
+// ephemeralPort returns the next port to assign to a socket registered with
+// port 0, cycling through the ports from firstEphemeralPort.
+func ephemeralPort() uint16 {
+	n := atomic.AddUint32(&ephemeralPorts, 1) - 1
+	return uint16(firstEphemeralPort + n%(0x10000-firstEphemeralPort))
+}
+
+type socketKey struct {
+	ia   addr.IA
+	ip   string
+	port uint16
+}
+
+// dispatcher implements reliable.Dispatcher for a Net.
+type dispatcher struct {
+	net *Net
+}
+
+func (d *dispatcher) Register(ctx context.Context, ia addr.IA, address *net.UDPAddr,
+	svc addr.HostSVC) (net.PacketConn, uint16, error) {
+
+	if svc != addr.SvcNone {
+		return nil, 0, errors.New("appnettest: SVC addresses are not supported")
+	}
+	return d.net.register(ia, address)
+}
+
+func (m *Net) register(ia addr.IA, address *net.UDPAddr) (*conn, uint16, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := socketKey{ia: ia, ip: address.IP.String(), port: uint16(address.Port)}
+	if key.port == 0 {
+		for i := firstEphemeralPort; i <= 0xffff; i++ {
+			key.port = ephemeralPort()
+			if _, used := m.sockets[key]; !used {
+				break
+			}
+		}
+	}
+	if _, used := m.sockets[key]; used {
+		return nil, 0, fmt.Errorf("appnettest: address %s,%s:%d already in use", ia, key.ip, key.port)
+	}
+	c := &conn{
+		net:    m,
+		key:    key,
+		local:  &net.UDPAddr{IP: address.IP, Port: int(key.port)},
+		queue:  make(chan packet, queueSize),
+		closed: make(chan struct{}),
+	}
+	m.sockets[key] = c
+	return c, key.port, nil
+}
+
+func (m *Net) unregister(c *conn) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.sockets[c.key] == c {
+		delete(m.sockets, c.key)
+	}
+}
+
+type packet struct {
+	raw     []byte
+	lastHop *net.UDPAddr
+}
+
+// conn is a socket registered with the dispatcher of a Net. It implements
+// net.PacketConn on serialized SCION packets, like the connections to the
+// actual dispatcher.
+type conn struct {
+	net   *Net
+	key   socketKey
+	local *net.UDPAddr
+
+	queue     chan packet
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	readDeadline deadline.Deadline
+}
+
+func (c *conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, errClosed
+	default:
+	}
+	select {
+	case p := <-c.queue:
+		if len(p.raw) > len(b) {
+			return 0, nil, errors.New("appnettest: buffer too small")
+		}
+		return copy(b, p.raw), p.lastHop, nil
+	case <-c.closed:
+		return 0, nil, errClosed
+	case <-c.readDeadline.Wait():
+		return 0, nil, deadline.TimeoutError{}
+	}
+}
+
+// WriteTo sends the serialized SCION packet. The underlay address is ignored,
+// the packet is routed based on the path and destination in the SCION header.
+func (c *conn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+	pkt := &snet.Packet{Bytes: append([]byte(nil), b...)}
+	if err := pkt.Decode(); err != nil {
+		return 0, err
+	}
+	c.net.route(c, pkt)
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.net.unregister(c)
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block.
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *conn) enqueue(p packet) {
+	select {
+	case c.queue <- p:
+	case <-c.closed:
+	default:
+		log.Debug("appnettest: queue full, dropping packet", "socket", c.local)
+	}
+}
+
+// route forwards the packet sent from the socket from, applying the
+// properties of the path.
+func (m *Net) route(from *conn, pkt *snet.Packet) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lastHop := &net.UDPAddr{IP: pkt.Source.Host.IP(), Port: underlay.EndhostPort}
+	var latency time.Duration
+	if !pkt.Path.IsEmpty() || pkt.Source.IA != pkt.Destination.IA {
+		e, err := m.pathForPacket(pkt)
+		if err != nil {
+			log.Debug("appnettest: dropping packet", "err", err)
+			return
+		}
+		if iface := m.revokedInterface(e); iface != nil {
+			m.sendInterfaceDown(from, pkt, *iface)
+			return
+		}
+		if len(pkt.Bytes) > int(e.cfg.MTU) {
+			log.Debug("appnettest: dropping packet exceeding MTU", "len", len(pkt.Bytes))
+			m.sendPacketTooBig(from, pkt, e.cfg.MTU)
+			return
+		}
+		if e.cfg.Loss > 0 && m.rand.Float64() < e.cfg.Loss {
+			return
+		}
+		lastHop = routerAddr
+		latency = e.cfg.Latency
+	}
+
+	switch pld := pkt.Payload.(type) {
+	case snet.UDPPayload:
+		key := socketKey{
+			ia:   pkt.Destination.IA,
+			ip:   pkt.Destination.Host.IP().String(),
+			port: pld.DstPort,
+		}
+		to, ok := m.sockets[key]
+		if !ok {
+			log.Debug("appnettest: dropping packet to unknown socket", "dst", key)
+			m.sendPortUnreachable(from, pkt, 2*latency)
+			return
+		}
+		deliver(to, packet{raw: pkt.Bytes, lastHop: lastHop}, latency)
+	case snet.SCMPEchoRequest:
+		reply, err := replyPacket(pkt, pkt.Destination, snet.SCMPEchoReply{
+			Identifier: pld.Identifier,
+			SeqNumber:  pld.SeqNumber,
+			Payload:    pld.Payload,
+		})
+		if err != nil {
+			log.Debug("appnettest: unable to create echo reply", "err", err)
+			return
+		}
+		deliver(from, packet{raw: reply, lastHop: lastHop}, 2*latency)
+	default:
+		log.Debug("appnettest: dropping unsupported packet", "payload", pkt.Payload)
+	}
+}
+
+// pathForPacket returns the path of the Net on which the packet is sent.
+// Must be called with m.mutex held.
+func (m *Net) pathForPacket(pkt *snet.Packet) (*pathEntry, error) {
+	if pkt.Path.Type != PathType {
+		return nil, fmt.Errorf("unsupported path type %s", pkt.Path.Type)
+	}
+	var p rawPath
+	if err := p.DecodeFromBytes(pkt.Path.Raw); err != nil {
+		return nil, err
+	}
+	if p.src != pkt.Source.IA || p.dst != pkt.Destination.IA {
+		return nil, fmt.Errorf("path from %s to %s used for packet from %s to %s",
+			p.src, p.dst, pkt.Source.IA, pkt.Destination.IA)
+	}
+	e, ok := m.paths[p.id]
+	if !ok {
+		return nil, fmt.Errorf("unknown path %d", p.id)
+	}
+	if !(e.src == p.src && e.dst == p.dst) && !(e.src == p.dst && e.dst == p.src) {
+		return nil, fmt.Errorf("path %d does not connect %s and %s", p.id, p.src, p.dst)
+	}
+	if !e.cfg.Expiry.After(time.Now()) {
+		return nil, fmt.Errorf("path %d expired", p.id)
+	}
+	return e, nil
+}
+
+// sendInterfaceDown answers the packet with an SCMP external interface down
+// message from the AS of the revoked interface.
+// Must be called with m.mutex held.
+func (m *Net) sendInterfaceDown(from *conn, pkt *snet.Packet, iface snet.PathInterface) {
+	src := snet.SCIONAddress{IA: iface.IA, Host: addr.HostFromIP(routerAddr.IP)}
+	msg, err := replyPacket(pkt, src, snet.SCMPExternalInterfaceDown{
+		IA:        iface.IA,
+		Interface: uint64(iface.ID),
+		Payload:   quote(pkt),
+	})
+	if err != nil {
+		log.Debug("appnettest: unable to create interface down message", "err", err)
+		return
+	}
+	deliver(from, packet{raw: msg, lastHop: routerAddr}, 0)
+}
+
+// sendPacketTooBig answers the packet with an SCMP packet too big message
+// from the first router on the path.
+// Must be called with m.mutex held.
+func (m *Net) sendPacketTooBig(from *conn, pkt *snet.Packet, mtu uint16) {
+	src := snet.SCIONAddress{IA: pkt.Source.IA, Host: addr.HostFromIP(routerAddr.IP)}
+	var info [4]byte
+	binary.BigEndian.PutUint16(info[2:4], mtu)
+	typeCode := slayers.CreateSCMPTypeCode(slayers.SCMPTypePacketTooBig, 0)
+	msg, err := scmpErrorPacket(pkt, src, typeCode, info)
+	if err != nil {
+		log.Debug("appnettest: unable to create packet too big message", "err", err)
+		return
+	}
+	deliver(from, packet{raw: msg, lastHop: routerAddr}, 0)
+}
+
+// sendPortUnreachable answers the packet with an SCMP destination unreachable
+// message from the destination host.
+// Must be called with m.mutex held.
+func (m *Net) sendPortUnreachable(from *conn, pkt *snet.Packet, latency time.Duration) {
+	typeCode := slayers.CreateSCMPTypeCode(slayers.SCMPTypeDestinationUnreachable,
+		slayers.SCMPCodePortUnreachable)
+	msg, err := scmpErrorPacket(pkt, pkt.Destination, typeCode, [4]byte{})
+	if err != nil {
+		log.Debug("appnettest: unable to create destination unreachable message", "err", err)
+		return
+	}
+	lastHop := &net.UDPAddr{IP: pkt.Destination.Host.IP(), Port: underlay.EndhostPort}
+	if !pkt.Path.IsEmpty() {
+		lastHop = routerAddr
+	}
+	deliver(from, packet{raw: msg, lastHop: lastHop}, latency)
+}
+
+// scmpErrorPacket creates the serialized SCMP error message from src to the
+// source of pkt, consisting of 4 bytes of type specific information and the
+// quoted packet.
+// snet only supports serializing some of the SCMP error messages, so the
+// message is created as a destination unreachable message, which has the
+// same layout, and the SCMP header is then replaced.
+func scmpErrorPacket(pkt *snet.Packet, src snet.SCIONAddress, typeCode slayers.SCMPTypeCode,
+	info [4]byte) ([]byte, error) {
+
+	q := quote(pkt)
+	raw, err := replyPacket(pkt, src, snet.SCMPDestinationUnreachable{Payload: q})
+	if err != nil {
+		return nil, err
+	}
+	var scn slayers.SCION
+	if err := scn.DecodeFromBytes(raw, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	scmp := &slayers.SCMP{TypeCode: typeCode}
+	if err := scmp.SetNetworkLayerForChecksum(&scn); err != nil {
+		return nil, err
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true}
+	payload := gopacket.Payload(append(info[:], q...))
+	if err := gopacket.SerializeLayers(buf, opts, scmp, payload); err != nil {
+		return nil, err
+	}
+	hdr := raw[:len(raw)-len(scn.Payload)]
+	return append(hdr, buf.Bytes()...), nil
+}
+
+// quote returns the (truncated) packet to be quoted in SCMP error messages.
+func quote(pkt *snet.Packet) []byte {
+	if len(pkt.Bytes) > maxQuoteLen {
+		return pkt.Bytes[:maxQuoteLen]
+	}
+	return pkt.Bytes
+}
+
+// replyPacket creates the serialized packet from src to the source of pkt,
+// on the reversed path.
+func replyPacket(pkt *snet.Packet, src snet.SCIONAddress, payload snet.Payload) ([]byte, error) {
+	path := pkt.Path.Copy()
+	if err := path.Reverse(); err != nil {
+		return nil, err
+	}
+	reply := &snet.Packet{
+		PacketInfo: snet.PacketInfo{
+			Source:      src,
+			Destination: pkt.Source,
+			Path:        path,
+			Payload:     payload,
+		},
+	}
+	if path.IsEmpty() {
+		reply.Path = spath.Path{}
+	}
+	if err := reply.Serialize(); err != nil {
+		return nil, err
+	}
+	return reply.Bytes, nil
+}
+
+func deliver(to *conn, p packet, latency time.Duration) {
+	if latency <= 0 {
+		to.enqueue(p)
+		return
+	}
+	time.AfterFunc(latency, func() { to.enqueue(p) })
+}
+
+var errClosed = errors.New("appnettest: use of closed connection")
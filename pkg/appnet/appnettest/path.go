@@ -0,0 +1,161 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnettest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/slayers/path"
+	"github.com/scionproto/scion/go/lib/snet"
+	snetpath "github.com/scionproto/scion/go/lib/snet/path"
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+// PathType is the dataplane path type used in the packets of a Net.
+// The path identifies the direction and the path in the Net.
+const PathType path.Type = 253
+
+const rawPathLen = 20
+
+func init() {
+	path.RegisterPath(path.Metadata{
+		Type: PathType,
+		Desc: "appnettest",
+		New: func() path.Path {
+			return &rawPath{}
+		},
+	})
+}
+
+// rawPath is the dataplane path of the packets in a Net.
+// It implements path.Path.
+type rawPath struct {
+	src, dst addr.IA
+	id       uint32
+}
+
+func (p *rawPath) SerializeTo(b []byte) error {
+	if len(b) < rawPathLen {
+		return errors.New("buffer too short for appnettest path")
+	}
+	binary.BigEndian.PutUint64(b[0:8], uint64(p.src.IAInt()))
+	binary.BigEndian.PutUint64(b[8:16], uint64(p.dst.IAInt()))
+	binary.BigEndian.PutUint32(b[16:20], p.id)
+	return nil
+}
+
+func (p *rawPath) DecodeFromBytes(b []byte) error {
+	if len(b) < rawPathLen {
+		return errors.New("invalid appnettest path")
+	}
+	p.src = addr.IAInt(binary.BigEndian.Uint64(b[0:8])).IA()
+	p.dst = addr.IAInt(binary.BigEndian.Uint64(b[8:16])).IA()
+	p.id = binary.BigEndian.Uint32(b[16:20])
+	return nil
+}
+
+func (p *rawPath) Reverse() (path.Path, error) {
+	return &rawPath{src: p.dst, dst: p.src, id: p.id}, nil
+}
+
+func (p *rawPath) Len() int {
+	return rawPathLen
+}
+
+func (p *rawPath) Type() path.Type {
+	return PathType
+}
+
+func (p *rawPath) spath() spath.Path {
+	raw := make([]byte, rawPathLen)
+	_ = p.SerializeTo(raw)
+	return spath.Path{Raw: raw, Type: PathType}
+}
+
+// routerAddr is the underlay address of the border routers in a Net.
+var routerAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 30041}
+
+func ifID(pathID uint32) common.IFIDType {
+	return common.IFIDType(pathID + 1)
+}
+
+// querier implements snet.PathQuerier for a Net.
+type querier struct {
+	net   *Net
+	local addr.IA
+}
+
+func (q *querier) Query(ctx context.Context, dst addr.IA) ([]snet.Path, error) {
+	return q.net.queryPaths(q.local, dst, time.Now()), nil
+}
+
+// queryPaths returns all usable paths from src to dst, in the order in which
+// they were added.
+func (m *Net) queryPaths(src, dst addr.IA, now time.Time) []snet.Path {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var paths []snet.Path
+	for id := uint32(0); id < m.nextPathID; id++ {
+		e, ok := m.paths[id]
+		if !ok || !e.cfg.Expiry.After(now) || m.revokedInterface(e) != nil {
+			continue
+		}
+		raw := &rawPath{src: e.src, dst: e.dst, id: id}
+		interfaces := append([]snet.PathInterface(nil), e.cfg.Interfaces...)
+		if e.src == dst && e.dst == src {
+			raw = &rawPath{src: e.dst, dst: e.src, id: id}
+			interfaces = reverseInterfaces(interfaces)
+		} else if e.src != src || e.dst != dst {
+			continue
+		}
+		paths = append(paths, snetpath.Path{
+			Dst:     dst,
+			SPath:   raw.spath(),
+			NextHop: routerAddr,
+			Meta: snet.PathMetadata{
+				Interfaces: interfaces,
+				MTU:        e.cfg.MTU,
+				Expiry:     e.cfg.Expiry,
+			},
+		})
+	}
+	return paths
+}
+
+// revokedInterface returns the first revoked interface on the path, or nil.
+// Must be called with m.mutex held.
+func (m *Net) revokedInterface(e *pathEntry) *snet.PathInterface {
+	for _, iface := range e.cfg.Interfaces {
+		if _, ok := m.revoked[iface]; ok {
+			return &iface
+		}
+	}
+	return nil
+}
+
+func reverseInterfaces(ifaces []snet.PathInterface) []snet.PathInterface {
+	r := make([]snet.PathInterface, len(ifaces))
+	for i := range ifaces {
+		r[len(ifaces)-1-i] = ifaces[i]
+	}
+	return r
+}
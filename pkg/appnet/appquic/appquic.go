@@ -18,8 +18,10 @@
 package appquic
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"sync"
 
 	"github.com/lucas-clemente/quic-go"
@@ -75,6 +77,25 @@ func Dial(remote string, tlsConf *tls.Config, quicConf *quic.Config) (quic.Sessi
 // analogous to appnet.DialAddr.
 // The host parameter is used for SNI.
 // The tls.Config must define an application protocol (using NextProtos).
+//
+// Unless InsecureSkipVerify is set in the tls.Config, the certificate of the
+// server is verified against the identity of the server: if host is a
+// hostname, the certificate must be valid for this hostname. Otherwise, the
+// server is identified by its SCION address and the certificate must contain
+// the URI returned by SCIONAddressURI. The certificate must be signed by one
+// of the RootCAs of the tls.Config, or by a system root if RootCAs is nil.
+// Certificates that are not signed by a trusted CA, e.g. self-signed
+// certificates, are checked against the PinStore set with SetPinStore, if any.
+// If a TRCStore is set with SetTRCStore, servers dialled by their SCION
+// address (i.e. host is not a hostname) may instead present the certificate
+// chain of their AS (see LoadASKeyPair); the chain must then be valid under
+// the TRC of the ISD of raddr and the AS certificate must be for the AS of
+// raddr, which authenticates the server as a host in this AS. As this does not
+// authenticate a hostname, servers dialled by hostname must present a
+// certificate for the hostname, or a pinned certificate.
+//
+// The session keeps using the path of raddr, even if the path fails; use
+// DialAddrMigrating for a session that switches to another path.
 func DialAddr(raddr *snet.UDPAddr, host string, tlsConf *tls.Config, quicConf *quic.Config) (quic.Session, error) {
 	err := ensurePathDefined(raddr)
 	if err != nil {
@@ -84,6 +105,7 @@ func DialAddr(raddr *snet.UDPAddr, host string, tlsConf *tls.Config, quicConf *q
 	if err != nil {
 		return nil, err
 	}
+	tlsConf = verifyingTLSConfig(tlsConf, host, raddr)
 	host = appnet.MangleSCIONAddr(host)
 	session, err := quic.Dial(sconn, raddr, host, tlsConf, quicConf)
 	if err != nil {
@@ -92,6 +114,48 @@ func DialAddr(raddr *snet.UDPAddr, host string, tlsConf *tls.Config, quicConf *q
 	return &closerSession{session, sconn}, nil
 }
 
+// DialMigrating establishes a new QUIC connection to a server at the remote
+// address, analogous to Dial, and returns a MigratingSession.
+func DialMigrating(remote string, tlsConf *tls.Config, quicConf *quic.Config,
+	migrationConf *MigrationConfig) (*MigratingSession, error) {
+
+	raddr, err := appnet.ResolveUDPAddr(remote)
+	if err != nil {
+		return nil, err
+	}
+	return DialAddrMigrating(raddr, remote, tlsConf, quicConf, migrationConf)
+}
+
+// DialAddrMigrating establishes a new QUIC connection to a server at the
+// remote address, analogous to DialAddr, and returns a MigratingSession.
+// If migrationConf is nil, the session only switches away from a failed path.
+// The server must follow the session to the new paths, see MigratingSession.
+func DialAddrMigrating(raddr *snet.UDPAddr, host string, tlsConf *tls.Config, quicConf *quic.Config,
+	migrationConf *MigrationConfig) (*MigratingSession, error) {
+
+	if migrationConf == nil {
+		migrationConf = &MigrationConfig{}
+	}
+	conn, err := dialMigratingConn(raddr, *migrationConf)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf = verifyingTLSConfig(tlsConf, host, raddr)
+	host = appnet.MangleSCIONAddr(host)
+	session, err := quic.Dial(conn, raddr, host, tlsConf, quicConf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Stop probing the paths when the session is closed by the peer or times
+	// out.
+	go func() {
+		<-session.Context().Done()
+		conn.Close()
+	}()
+	return &MigratingSession{Session: session, conn: conn}, nil
+}
+
 // DialEarly establishes a new 0-RTT QUIC connection to a server. Analogous to Dial.
 func DialEarly(remote string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlySession, error) {
 	raddr, err := appnet.ResolveUDPAddr(remote)
@@ -101,7 +165,8 @@ func DialEarly(remote string, tlsConf *tls.Config, quicConf *quic.Config) (quic.
 	return DialAddrEarly(raddr, remote, tlsConf, quicConf)
 }
 
-// DialAddrEarly establishes a new 0-RTT QUIC connection to a server. Analogous to DialAddr.
+// DialAddrEarly establishes a new 0-RTT QUIC connection to a server. Analogous to DialAddr,
+// including the verification of the server certificate.
 func DialAddrEarly(raddr *snet.UDPAddr, host string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlySession, error) {
 	err := ensurePathDefined(raddr)
 	if err != nil {
@@ -111,6 +176,7 @@ func DialAddrEarly(raddr *snet.UDPAddr, host string, tlsConf *tls.Config, quicCo
 	if err != nil {
 		return nil, err
 	}
+	tlsConf = verifyingTLSConfig(tlsConf, host, raddr)
 	host = appnet.MangleSCIONAddr(host)
 	session, err := quic.DialEarly(sconn, raddr, host, tlsConf, quicConf)
 	if err != nil {
@@ -120,6 +186,17 @@ func DialAddrEarly(raddr *snet.UDPAddr, host string, tlsConf *tls.Config, quicCo
 	return &closerEarlySession{session.(quic.EarlySession), sconn}, nil
 }
 
+// DialConn establishes a new QUIC connection to a server at the remote
+// address over an existing conn, e.g. a conn applying a path policy.
+// The certificate of the server is verified as described for DialAddr; the
+// host parameter is used for SNI and to identify the server.
+func DialConn(conn net.PacketConn, raddr *snet.UDPAddr, host string, tlsConf *tls.Config,
+	quicConf *quic.Config) (quic.Session, error) {
+
+	tlsConf = verifyingTLSConfig(tlsConf, host, raddr)
+	return quic.Dial(conn, raddr, appnet.MangleSCIONAddr(host), tlsConf, quicConf)
+}
+
 func ensurePathDefined(raddr *snet.UDPAddr) error {
 	if raddr.Path.IsEmpty() {
 		return appnet.SetDefaultPath(raddr)
@@ -128,14 +205,141 @@ func ensurePathDefined(raddr *snet.UDPAddr) error {
 }
 
 // ListenPort listens for QUIC connections on a SCION/UDP port.
+// The accepted sessions are *Session, see Listener.
 //
 // See note on wildcard addresses in the appnet package documentation.
-func ListenPort(port uint16, tlsConf *tls.Config, quicConfig *quic.Config) (quic.Listener, error) {
+func ListenPort(port uint16, tlsConf *tls.Config, quicConfig *quic.Config) (*Listener, error) {
 	sconn, err := appnet.ListenPort(port)
 	if err != nil {
 		return nil, err
 	}
-	return quic.Listen(sconn, tlsConf, quicConfig)
+	conn := NewPathConn(sconn)
+	listener, err := quic.Listen(conn, tlsConf, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{Listener: listener, conn: conn}, nil
+}
+
+// Listener is a quic.Listener returning sessions that give access to the
+// SCION address of the remote and the path used to communicate with it.
+type Listener struct {
+	quic.Listener
+	conn *PathConn
+}
+
+// Accept returns a new session, of type *Session. See AcceptSession.
+func (l *Listener) Accept(ctx context.Context) (quic.Session, error) {
+	return l.AcceptSession(ctx)
+}
+
+// AcceptSession returns a new session.
+func (l *Listener) AcceptSession(ctx context.Context) (*Session, error) {
+	sess, err := l.Listener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Session: sess, conn: l.conn}, nil
+}
+
+// SetFollowPaths sets whether the replies to the remotes follow the remotes
+// when they switch paths, e.g. to accept a MigratingSession. The paths of the
+// received packets are not authenticated; see PathConn.SetFollowPaths.
+func (l *Listener) SetFollowPaths(follow bool) {
+	l.conn.SetFollowPaths(follow)
+}
+
+// Session is a QUIC session accepted by a Listener.
+//
+// The replies to the remote are sent on the reverse of the path of the first
+// packet received from the remote, unless a path is set with SetPath, or on
+// the reverse of the path of the last packet if the Listener follows paths,
+// see Listener.SetFollowPaths.
+type Session struct {
+	quic.Session
+	conn *PathConn
+}
+
+// RemoteSCIONAddr returns the SCION address of the remote, including the
+// path on which replies are sent.
+func (s *Session) RemoteSCIONAddr() *snet.UDPAddr {
+	if reply := s.conn.ReplyAddr(s.RemoteAddr()); reply != nil {
+		return reply
+	}
+	raddr, _ := s.RemoteAddr().(*snet.UDPAddr)
+	return raddr.Copy()
+}
+
+// Path returns the description of the path on which replies are sent to the
+// remote, see appnet.ReplyPathInfo. Returns nil if the remote is in the local
+// AS.
+func (s *Session) Path() *appnet.PathInfo {
+	return appnet.ReplyPathInfo(s.RemoteSCIONAddr())
+}
+
+// SetPath sets the path on which replies are sent to the remote. If path is
+// nil, the replies are sent on the path of the remote again.
+func (s *Session) SetPath(path snet.Path) {
+	s.conn.SetPath(s.RemoteAddr().(*snet.UDPAddr), path)
+}
+
+// NotifyPathChange registers ch to receive the new address of the remote,
+// including the reversed path, whenever the remote sends from a different
+// path. Sending to ch does not block; notifications are dropped if ch is not
+// ready.
+// The returned function cancels the registration; it should be called when
+// the session is closed.
+func (s *Session) NotifyPathChange(ch chan<- *snet.UDPAddr) (stop func()) {
+	return s.conn.NotifyPathChange(s.RemoteAddr(), ch)
+}
+
+// MigratingSession is a QUIC session that can switch to another path to the
+// server without interrupting the session.
+//
+// The session switches paths when the current path fails, i.e. when an SCMP
+// interface down message is received for the path or when the path expires,
+// when another path has a lower RTT if probing is enabled in the
+// MigrationConfig, and when a path is set with SetPath.
+// The server must follow the client to the new path, as sessions accepted by
+// a Listener do if it follows paths (see Listener.SetFollowPaths).
+type MigratingSession struct {
+	quic.Session
+	conn *migratingConn
+}
+
+// CloseWithError closes the session and the underlying conn.
+func (s *MigratingSession) CloseWithError(code quic.ErrorCode, desc string) error {
+	s.conn.Close()
+	return s.Session.CloseWithError(code, desc)
+}
+
+// RemoteSCIONAddr returns the SCION address of the server, including the
+// current path.
+func (s *MigratingSession) RemoteSCIONAddr() *snet.UDPAddr {
+	return s.conn.remoteAddr()
+}
+
+// Path returns the current path to the server.
+// Returns nil if the server is in the local AS, or if the path with which
+// the session was dialled is not known from a path query.
+func (s *MigratingSession) Path() snet.Path {
+	return s.conn.currentPath()
+}
+
+// SetPath switches to the path and keeps using it, i.e. the session no
+// longer switches to paths with a lower RTT. The session still switches
+// away from the path if it fails. If path is nil, the path is selected
+// automatically again.
+func (s *MigratingSession) SetPath(path snet.Path) error {
+	return s.conn.setFixedPath(path)
+}
+
+// NotifyPathChange registers ch to receive the new path whenever the session
+// switches paths. Sending to ch does not block; notifications are dropped if
+// ch is not ready.
+// The returned function cancels the registration.
+func (s *MigratingSession) NotifyPathChange(ch chan<- snet.Path) (stop func()) {
+	return s.conn.notifyPathChange(ch)
 }
 
 // GetDummyTLSCert returns the singleton TLS certificate with a fresh
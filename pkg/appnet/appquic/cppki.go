@@ -0,0 +1,201 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/scrypto/cppki"
+)
+
+var (
+	trcStoreMutex sync.RWMutex
+	trcStore      *TRCStore
+)
+
+// SetTRCStore sets the TRCs used to verify the certificates of servers that
+// present a certificate chain of the SCION control-plane PKI, i.e. their AS
+// certificate (see LoadASKeyPair), when dialled by SCION address.
+// If no TRCStore is set, such certificates are treated like any other
+// certificate not signed by a trusted CA.
+// See note on certificate verification in DialAddr.
+func SetTRCStore(trcs *TRCStore) {
+	trcStoreMutex.Lock()
+	defer trcStoreMutex.Unlock()
+	trcStore = trcs
+}
+
+func getTRCStore() *TRCStore {
+	trcStoreMutex.RLock()
+	defer trcStoreMutex.RUnlock()
+	return trcStore
+}
+
+// TRCStore is a set of trusted TRCs, the trust anchors of the SCION
+// control-plane PKI. The TRCs are not verified against each other; like the
+// TRCs configured for the control service of an AS, they must be obtained from
+// a trusted source.
+type TRCStore struct {
+	// trcs are the TRCs for each ISD, in ascending order
+	trcs map[addr.ISD][]cppki.TRC
+}
+
+// LoadTRCStore loads the TRCs from the *.trc files in the directory dir,
+// e.g. the certs directory of the SCION configuration of the host.
+// The files can be DER or PEM encoded signed TRCs.
+func LoadTRCStore(dir string) (*TRCStore, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.trc"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no TRC files in %s", dir)
+	}
+	s := &TRCStore{trcs: make(map[addr.ISD][]cppki.TRC)}
+	for _, file := range files {
+		trc, err := loadTRC(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		s.add(trc)
+	}
+	return s, nil
+}
+
+func loadTRC(file string) (cppki.TRC, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return cppki.TRC{}, err
+	}
+	if block, _ := pem.Decode(raw); block != nil {
+		raw = block.Bytes
+	}
+	signed, err := cppki.DecodeSignedTRC(raw)
+	if err != nil {
+		return cppki.TRC{}, err
+	}
+	return signed.TRC, nil
+}
+
+func (s *TRCStore) add(trc cppki.TRC) {
+	trcs := append(s.trcs[trc.ID.ISD], trc)
+	sort.Slice(trcs, func(i, j int) bool {
+		if trcs[i].ID.Base != trcs[j].ID.Base {
+			return trcs[i].ID.Base < trcs[j].ID.Base
+		}
+		return trcs[i].ID.Serial < trcs[j].ID.Serial
+	})
+	s.trcs[trc.ID.ISD] = trcs
+}
+
+// activeTRCs returns the TRCs of the ISD that can be used for verification at
+// time now: the latest TRC and, during its grace period, its predecessor.
+func (s *TRCStore) activeTRCs(isd addr.ISD, now time.Time) []*cppki.TRC {
+	trcs := s.trcs[isd]
+	if len(trcs) == 0 {
+		return nil
+	}
+	latest := &trcs[len(trcs)-1]
+	if !latest.Validity.Contains(now) {
+		return nil
+	}
+	active := []*cppki.TRC{latest}
+	if len(trcs) > 1 && latest.InGracePeriod(now) {
+		pred := &trcs[len(trcs)-2]
+		if pred.ID.Base == latest.ID.Base && pred.ID.Serial == latest.ID.Serial-1 {
+			active = append(active, pred)
+		}
+	}
+	return active
+}
+
+// verifyASChain verifies that the chain, consisting of an AS certificate and
+// the certificate of the issuing CA, is valid under the active TRCs of the ISD
+// of ia at time now, and that the AS certificate is for ia.
+func (s *TRCStore) verifyASChain(chain []*x509.Certificate, ia addr.IA, now time.Time) error {
+	certIA, err := cppki.ExtractIA(chain[0].Subject)
+	if err != nil {
+		return err
+	}
+	if certIA == nil || !certIA.Equal(ia) {
+		return fmt.Errorf("AS certificate is not valid for %s", ia)
+	}
+	trcs := s.activeTRCs(ia.I, now)
+	if len(trcs) == 0 {
+		return fmt.Errorf("no valid TRC for ISD %d", ia.I)
+	}
+	for _, trc := range trcs {
+		err = cppki.VerifyChain(chain, cppki.VerifyOptions{TRC: trc, CurrentTime: now})
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("AS certificate chain verification failed: %w", err)
+}
+
+// asChain returns the parsed certificates if rawCerts is a SCION AS
+// certificate chain, i.e. an AS certificate and the certificate of the
+// issuing CA.
+func asChain(rawCerts [][]byte) ([]*x509.Certificate, bool) {
+	if len(rawCerts) != 2 {
+		return nil, false
+	}
+	chain := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, false
+		}
+		chain[i] = cert
+	}
+	if certType, err := cppki.ValidateCert(chain[0]); err != nil || certType != cppki.AS {
+		return nil, false
+	}
+	return chain, true
+}
+
+// LoadASKeyPair loads the AS certificate chain and the private key of the AS
+// from the given PEM files, e.g. the files in the crypto/as directory of the
+// SCION configuration of the AS, as a KeyPair.
+// A server presenting its AS certificate is authenticated as a host in its AS
+// by clients that have the TRC of the ISD (see SetTRCStore).
+//
+// As AS certificates are short-lived, the files are reloaded when they
+// change; the files are not generated if they do not exist.
+func LoadASKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	kp := &KeyPair{certFile: certFile, keyFile: keyFile, validate: validateASKeyPair}
+	if err := kp.load(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+func validateASKeyPair(cert *tls.Certificate) error {
+	chain, ok := asChain(cert.Certificate)
+	if !ok {
+		return errors.New("not a SCION AS certificate chain")
+	}
+	return cppki.ValidateChain(chain)
+}
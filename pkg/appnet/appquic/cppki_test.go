@@ -0,0 +1,114 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/scrypto/cppki"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// The files in testdata are the chains and TRCs from the testdata of the
+// scion cppki package.
+
+func loadTestChain(t *testing.T, file string) []*x509.Certificate {
+	t.Helper()
+	chain, err := cppki.ReadPEMCerts(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+func TestVerifyASChain(t *testing.T) {
+	trcs, err := LoadTRCStore("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain110 := loadTestChain(t, "testdata/ISD1-ASff00_0_110.pem")
+	chain210 := loadTestChain(t, "testdata/ISD2-ASff00_0_210.pem")
+	ia110 := addr.IA{I: 1, A: 0xff0000000110}
+	ia111 := addr.IA{I: 1, A: 0xff0000000111}
+	ia210 := addr.IA{I: 2, A: 0xff0000000210}
+	now := chain110[0].NotBefore.Add(time.Hour)
+
+	cases := []struct {
+		name  string
+		chain []*x509.Certificate
+		ia    addr.IA
+		now   time.Time
+		valid bool
+	}{
+		{"ISD 1", chain110, ia110, now, true},
+		{"ISD 2", chain210, ia210, chain210[0].NotBefore.Add(time.Hour), true},
+		{"other AS", chain110, ia111, now, false},
+		{"other ISD", chain110, addr.IA{I: 2, A: ia110.A}, now, false},
+		{"CA of other ISD", []*x509.Certificate{chain110[0], chain210[1]}, ia110, now, false},
+		{"expired", chain110, ia110, chain110[0].NotAfter.Add(time.Hour), false},
+	}
+	for _, c := range cases {
+		err := trcs.verifyASChain(c.chain, c.ia, c.now)
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+}
+
+func TestASChain(t *testing.T) {
+	chain := loadTestChain(t, "testdata/ISD1-ASff00_0_110.pem")
+	if _, ok := asChain([][]byte{chain[0].Raw, chain[1].Raw}); !ok {
+		t.Error("expected AS certificate chain to be detected")
+	}
+	if _, ok := asChain([][]byte{chain[1].Raw, chain[0].Raw}); ok {
+		t.Error("unexpected AS certificate chain starting with CA certificate")
+	}
+	leaf, _ := testCert(t, nil, nil, false, []string{"example.org"}, nil)
+	if _, ok := asChain([][]byte{leaf.Raw, chain[1].Raw}); ok {
+		t.Error("unexpected AS certificate chain for web PKI certificate")
+	}
+}
+
+func TestVerifyServerASChain(t *testing.T) {
+	trcs, err := LoadTRCStore("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := loadTestChain(t, "testdata/ISD1-ASff00_0_110.pem")
+	rawCerts := [][]byte{chain[0].Raw, chain[1].Raw}
+	ia := addr.IA{I: 1, A: 0xff0000000110}
+	now := chain[0].NotBefore.Add(time.Hour)
+	raddr := &snet.UDPAddr{IA: ia, Host: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}}
+
+	// Dialled by SCION address, the AS certificate authenticates the server
+	identity, hostname := serverIdentity(raddr.String(), raddr)
+	if _, err := verifyServer(rawCerts, nil, identity, hostname, ia, nil, trcs, now); err != nil {
+		t.Errorf("unexpected error for SCION address: %v", err)
+	}
+
+	// Dialled by hostname, the AS certificate does not authenticate the
+	// hostname and is treated like any other certificate not signed by a
+	// trusted CA
+	identity, hostname = serverIdentity("example.org:443", raddr)
+	if _, err := verifyServer(rawCerts, nil, identity, hostname, ia, nil, trcs, now); err == nil {
+		t.Error("expected error for AS certificate of server dialled by hostname")
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+)
+
+const (
+	// keyPairCertFile and keyPairKeyFile are the names of the files of a
+	// KeyPair in a directory, see LoadKeyPairDir.
+	keyPairCertFile = "cert.pem"
+	keyPairKeyFile  = "key.pem"
+	// keyPairReloadInterval is the minimum interval between two checks for
+	// changes of the files of a KeyPair.
+	keyPairReloadInterval = time.Second
+)
+
+// KeyType is the type of the private key of a generated KeyPair.
+type KeyType string
+
+const (
+	KeyTypeRSA     KeyType = "rsa"
+	KeyTypeECDSA   KeyType = "ecdsa"
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
+// ParseKeyType parses the name of a KeyType, e.g. from a command line flag.
+func ParseKeyType(s string) (KeyType, error) {
+	switch t := KeyType(s); t {
+	case KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported key type %q, expected %s, %s or %s",
+			s, KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519)
+	}
+}
+
+// KeyPair is a persistent TLS certificate and private key of a server,
+// stored in PEM files.
+// In contrast to GetDummyTLSCerts, the server keeps its certificate across
+// restarts, so that clients can pin it (see PinStore).
+//
+// The files are reloaded when they change, so that the certificate can be
+// replaced without restarting the server. Use GetCertificate in the
+// tls.Config of the server:
+//
+//	keyPair, err := appquic.LoadKeyPairDir(dir, appquic.KeyTypeECDSA)
+//	...
+//	tlsConf := &tls.Config{GetCertificate: keyPair.GetCertificate, ...}
+type KeyPair struct {
+	certFile, keyFile string
+	// validate, if set, is called to check a certificate before it is used.
+	validate func(*tls.Certificate) error
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	certStat  os.FileInfo
+	keyStat   os.FileInfo
+	lastCheck time.Time
+}
+
+// LoadKeyPair loads the PEM encoded certificate and private key from the
+// given files. If neither of the files exists, a private key of the given
+// type and a self-signed certificate are generated and written to the files.
+func LoadKeyPair(certFile, keyFile string, keyType KeyType) (*KeyPair, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		if err := generateKeyPairFiles(certFile, keyFile, keyType); err != nil {
+			return nil, err
+		}
+		log.Info("appquic: Generated TLS certificate", "cert", certFile, "key", keyFile)
+	}
+	kp := &KeyPair{certFile: certFile, keyFile: keyFile}
+	if err := kp.load(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// LoadKeyPairDir loads the KeyPair from the files cert.pem and key.pem in
+// the directory dir, analogous to LoadKeyPair. The directory is created if
+// it does not exist.
+func LoadKeyPairDir(dir string, keyType KeyType) (*KeyPair, error) {
+	return LoadKeyPair(filepath.Join(dir, keyPairCertFile), filepath.Join(dir, keyPairKeyFile), keyType)
+}
+
+// DefaultKeyPairDir returns the default directory for the KeyPair of the
+// application app, in the user's configuration directory, e.g.
+// ~/.config/scion-apps/<app>.
+func DefaultKeyPairDir(app string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "scion-apps", app), nil
+}
+
+// DefaultPinStorePath returns the default path of the PinStore of the
+// application app, in the user's configuration directory, e.g.
+// ~/.config/scion-apps/<app>/known_hosts.
+func DefaultPinStorePath(app string) (string, error) {
+	dir, err := DefaultKeyPairDir(app)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "known_hosts"), nil
+}
+
+// Certificate returns the current certificate. The files are reloaded first,
+// if they have changed.
+func (kp *KeyPair) Certificate() *tls.Certificate {
+	kp.mutex.Lock()
+	defer kp.mutex.Unlock()
+	if time.Since(kp.lastCheck) >= keyPairReloadInterval {
+		kp.lastCheck = time.Now()
+		if kp.changed() {
+			if err := kp.loadLocked(); err != nil {
+				// The files may be in the middle of being replaced; keep the old
+				// certificate and retry on the next check.
+				log.Warn("appquic: Failed to reload TLS certificate", "cert", kp.certFile, "err", err)
+			} else {
+				log.Info("appquic: Reloaded TLS certificate", "cert", kp.certFile)
+			}
+		}
+	}
+	return kp.cert
+}
+
+// GetCertificate returns the current certificate, for use as
+// tls.Config.GetCertificate.
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.Certificate(), nil
+}
+
+func (kp *KeyPair) load() error {
+	kp.mutex.Lock()
+	defer kp.mutex.Unlock()
+	kp.lastCheck = time.Now()
+	return kp.loadLocked()
+}
+
+func (kp *KeyPair) loadLocked() error {
+	certStat, err := os.Stat(kp.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(kp.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return err
+	}
+	if kp.validate != nil {
+		if err := kp.validate(&cert); err != nil {
+			return err
+		}
+	}
+	kp.cert = &cert
+	kp.certStat = certStat
+	kp.keyStat = keyStat
+	return nil
+}
+
+// changed checks whether the files have been modified since they were loaded.
+func (kp *KeyPair) changed() bool {
+	return fileChanged(kp.certFile, kp.certStat) || fileChanged(kp.keyFile, kp.keyStat)
+}
+
+func fileChanged(path string, loaded os.FileInfo) bool {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return !os.SameFile(stat, loaded) ||
+		!stat.ModTime().Equal(loaded.ModTime()) ||
+		stat.Size() != loaded.Size()
+}
+
+// generateKeyPairFiles generates a private key of the given type and a
+// self-signed certificate and writes them to the files.
+func generateKeyPairFiles(certFile, keyFile string, keyType KeyType) error {
+	priv, err := generateKey(keyType)
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := createCertificate(priv)
+	if err != nil {
+		return err
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, certPEM, 0644)
+}
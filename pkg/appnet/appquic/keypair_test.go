@@ -0,0 +1,149 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadKeyPair(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		t.Run(string(keyType), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "appquic")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			kpDir := filepath.Join(dir, "server")
+
+			kp, err := LoadKeyPairDir(kpDir, keyType)
+			if err != nil {
+				t.Fatalf("unexpected error generating key pair: %v", err)
+			}
+			cert := kp.Certificate()
+			switch key := cert.PrivateKey.(type) {
+			case *rsa.PrivateKey:
+				if keyType != KeyTypeRSA {
+					t.Errorf("expected %s key, got RSA", keyType)
+				}
+			case *ecdsa.PrivateKey:
+				if keyType != KeyTypeECDSA {
+					t.Errorf("expected %s key, got ECDSA", keyType)
+				}
+			case ed25519.PrivateKey:
+				if keyType != KeyTypeEd25519 {
+					t.Errorf("expected %s key, got Ed25519", keyType)
+				}
+			default:
+				t.Errorf("unexpected key type %T", key)
+			}
+			if stat, err := os.Stat(filepath.Join(kpDir, keyPairKeyFile)); err != nil {
+				t.Fatal(err)
+			} else if stat.Mode().Perm() != 0600 {
+				t.Errorf("expected key file mode 0600, got %v", stat.Mode().Perm())
+			}
+
+			// Loading again must return the same certificate
+			kp2, err := LoadKeyPairDir(kpDir, keyType)
+			if err != nil {
+				t.Fatalf("unexpected error loading key pair: %v", err)
+			}
+			if !bytes.Equal(kp2.Certificate().Certificate[0], cert.Certificate[0]) {
+				t.Error("expected same certificate after loading again")
+			}
+		})
+	}
+}
+
+func TestLoadKeyPairMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appquic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := LoadKeyPairDir(dir, KeyTypeECDSA); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, keyPairKeyFile)); err != nil {
+		t.Fatal(err)
+	}
+	// Do not overwrite the certificate if only the key is missing
+	if _, err := LoadKeyPairDir(dir, KeyTypeECDSA); err == nil {
+		t.Error("expected error loading key pair with missing key file")
+	}
+}
+
+func TestKeyPairReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appquic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "a", keyPairCertFile)
+	keyFile := filepath.Join(dir, "a", keyPairKeyFile)
+
+	kp, err := LoadKeyPair(certFile, keyFile, KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := kp.Certificate()
+
+	// Replace the files with a new key pair, as an administrator would
+	newCertFile := filepath.Join(dir, "b", keyPairCertFile)
+	newKeyFile := filepath.Join(dir, "b", keyPairKeyFile)
+	if err := generateKeyPairFiles(newCertFile, newKeyFile, KeyTypeECDSA); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newKeyFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if kp.Certificate() != old {
+		t.Error("expected no reload before the reload interval")
+	}
+	kp.lastCheck = time.Now().Add(-keyPairReloadInterval)
+	if kp.Certificate() != old {
+		t.Error("expected old certificate to be kept while the new certificate is missing")
+	}
+
+	if err := os.Rename(newCertFile, certFile); err != nil {
+		t.Fatal(err)
+	}
+	kp.lastCheck = time.Now().Add(-keyPairReloadInterval)
+	cert, err := kp.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("expected reloaded ECDSA key, got %T", cert.PrivateKey)
+	}
+}
+
+func TestParseKeyType(t *testing.T) {
+	if keyType, err := ParseKeyType("ed25519"); err != nil || keyType != KeyTypeEd25519 {
+		t.Errorf("expected ed25519, got %q, %v", keyType, err)
+	}
+	if _, err := ParseKeyType("dsa"); err == nil {
+		t.Error("expected error for unsupported key type")
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/pathpol"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+const (
+	// migrationExpiryMargin is the minimum remaining lifetime of the path of
+	// a session. Paths expiring sooner are replaced before sending.
+	migrationExpiryMargin = 10 * time.Second
+	// migrationRevocationTTL is the time for which an interface reported down
+	// in an SCMP message is avoided.
+	migrationRevocationTTL = 10 * time.Second
+	// defaultMinRTTImprovement is the default for
+	// MigrationConfig.MinRTTImprovement.
+	defaultMinRTTImprovement = 0.1
+)
+
+// MigrationConfig configures when a MigratingSession switches to another
+// path. The zero value only enables switching away from a failed path.
+type MigrationConfig struct {
+	// ProbeInterval is the interval at which the paths to the server are
+	// probed with SCMP echo requests (see appnet.ProbePaths). The session
+	// switches to a path with a lower RTT, and away from the current path if
+	// none of the echo requests sent on it are answered.
+	// Zero disables probing.
+	ProbeInterval time.Duration
+	// MinRTTImprovement is the minimum relative reduction of the RTT, in
+	// (0,1], for switching to a path with a lower RTT. This avoids
+	// oscillating between paths with similar RTTs. Defaults to 0.1.
+	MinRTTImprovement float64
+	// Probe configures the echo requests sent on each path.
+	Probe appnet.ProbeConfig
+	// PathPolicy is applied in addition to the path policy of the Network,
+	// both to the path with which the session is dialled and to the paths
+	// it switches to. Optional.
+	PathPolicy *pathpol.Policy
+	// NewSelector creates the PathSelector choosing the path to the server
+	// among the usable paths, when dialling without a path and when switching
+	// away from a failed path. Only the first path returned by Next is used.
+	// Paths found by probing are instead chosen by their RTT.
+	// Defaults to the first usable path.
+	NewSelector func() appnet.PathSelector
+}
+
+// migratingConn is the conn of a dialled session. It sends all packets on
+// its current path to the server, so that the path can be switched
+// transparently to the QUIC session.
+type migratingConn struct {
+	*snet.Conn
+	config MigrationConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex  sync.Mutex
+	remote *snet.UDPAddr
+	// path is the current path, if known, i.e. if it was obtained from a
+	// path query. Nil for a remote in the local AS.
+	path snet.Path
+	// fixed is true if the path was set explicitly with setFixedPath.
+	fixed       bool
+	selector    appnet.PathSelector
+	revoked     map[snet.PathInterface]time.Time
+	subscribers map[chan<- snet.Path]struct{}
+}
+
+// dialMigratingConn opens a conn to raddr. If no path is set in raddr, the
+// path is chosen among the paths allowed by the config, see MigrationConfig.
+func dialMigratingConn(raddr *snet.UDPAddr, config MigrationConfig) (*migratingConn, error) {
+	if config.MinRTTImprovement == 0 {
+		config.MinRTTImprovement = defaultMinRTTImprovement
+	}
+	c := &migratingConn{
+		config:      config,
+		remote:      raddr.Copy(),
+		revoked:     make(map[snet.PathInterface]time.Time),
+		subscribers: make(map[chan<- snet.Path]struct{}),
+	}
+	if config.NewSelector != nil {
+		c.selector = config.NewSelector()
+	}
+	if !c.isLocal() {
+		if err := c.initPath(); err != nil {
+			return nil, err
+		}
+	}
+	sconn, err := appnet.Listen(nil)
+	if err != nil {
+		return nil, err
+	}
+	c.Conn = sconn
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if !c.isLocal() && config.ProbeInterval > 0 {
+		go c.probeLoop()
+	}
+	return c, nil
+}
+
+// initPath sets the initial path: the path of the remote address, if set,
+// or else the path chosen by the selector among the allowed paths.
+func (c *migratingConn) initPath() error {
+	if !c.remote.Path.IsEmpty() {
+		c.path = findPath(c.remote)
+		return nil
+	}
+	paths, err := c.queryPaths(c.remote.IA)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no path to %s", c.remote.IA)
+	}
+	c.path = c.selectPath(paths)
+	appnet.SetPath(c.remote, c.path)
+	return nil
+}
+
+// findPath returns the path to raddr with the dataplane path of raddr, from
+// the paths returned by QueryPaths, or nil if there is no such path.
+func findPath(raddr *snet.UDPAddr) snet.Path {
+	paths, err := appnet.QueryPaths(raddr.IA)
+	if err != nil {
+		return nil
+	}
+	for _, p := range paths {
+		if bytes.Equal(p.Path().Raw, raddr.Path.Raw) {
+			return p
+		}
+	}
+	return nil
+}
+
+// queryPaths returns the paths to ia returned by QueryPaths that are allowed by
+// the PathPolicy of the config.
+func (c *migratingConn) queryPaths(ia addr.IA) ([]snet.Path, error) {
+	paths, err := appnet.QueryPaths(ia)
+	if err != nil || len(paths) == 0 || c.config.PathPolicy == nil {
+		return paths, err
+	}
+	paths = c.config.PathPolicy.Filter(paths)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no path to %s allowed by path policy", ia)
+	}
+	return paths, nil
+}
+
+// selectPath returns the path chosen by the selector among the paths, which
+// must not be empty, or the first path if there is no selector.
+// Must be called with c.mutex held, unless the conn is not yet shared.
+func (c *migratingConn) selectPath(paths []snet.Path) snet.Path {
+	if c.selector == nil || c.selector.Reset(c.remote, paths) != nil {
+		return paths[0]
+	}
+	if next := c.selector.Next(); len(next) > 0 {
+		return next[0]
+	}
+	return paths[0]
+}
+
+// WriteTo writes a packet to the server on the current path. The address
+// raddr is ignored, the conn is only used for the session to the server.
+// If the current path has expired, it is first replaced by another path.
+func (c *migratingConn) WriteTo(b []byte, raddr net.Addr) (int, error) {
+	return c.Conn.WriteTo(b, c.writeAddr())
+}
+
+// ReadFrom reads a packet from the conn.
+// SCMP errors are handled internally and are not returned, as the QUIC
+// session would fail on any error returned by the conn; path down errors
+// trigger a switch to another path.
+func (c *migratingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.Conn.ReadFrom(b)
+		var scmpErr *appnet.SCMPError
+		if errors.As(err, &scmpErr) {
+			c.handleSCMP(scmpErr)
+			continue
+		}
+		return n, from, err
+	}
+}
+
+func (c *migratingConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *migratingConn) isLocal() bool {
+	return c.remote.IA == appnet.DefNetwork().IA
+}
+
+func (c *migratingConn) remoteAddr() *snet.UDPAddr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.remote.Copy()
+}
+
+func (c *migratingConn) currentPath() snet.Path {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.path
+}
+
+// writeAddr returns the address to use for the next packet, replacing the
+// current path if it has expired.
+func (c *migratingConn) writeAddr() *snet.UDPAddr {
+	c.mutex.Lock()
+	remote := c.remote
+	expired := c.path != nil && !c.isUsable(c.path, time.Now())
+	c.mutex.Unlock()
+	if !expired {
+		return remote
+	}
+	if err := c.switchPath(remote, "path expired"); err != nil {
+		// Keep using the path; the session times out if no other path
+		// becomes available.
+		log.Debug("appquic: Unable to switch path", "err", err)
+	}
+	return c.remoteAddr()
+}
+
+func (c *migratingConn) handleSCMP(scmpErr *appnet.SCMPError) {
+	if !errors.Is(scmpErr, appnet.ErrPathDown) {
+		log.Debug("appquic: Ignoring SCMP error", "err", scmpErr)
+		return
+	}
+	c.mutex.Lock()
+	now := time.Now()
+	if scmpErr.Interface != nil {
+		c.revoked[*scmpErr.Interface] = now.Add(migrationRevocationTTL)
+	}
+	remote := c.remote
+	// Without metadata, it is not known whether the path traverses the
+	// interface; assume that it does.
+	usable := c.isLocal() || (c.path != nil && c.path.Metadata() != nil && c.isUsable(c.path, now))
+	c.mutex.Unlock()
+	if usable {
+		return
+	}
+	if err := c.switchPath(remote, "path down"); err != nil {
+		log.Debug("appquic: Unable to switch path", "err", err)
+	}
+}
+
+// setFixedPath switches to the path and disables switching to paths with a
+// lower RTT, see MigratingSession.SetPath.
+func (c *migratingConn) setFixedPath(path snet.Path) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if path == nil {
+		c.fixed = false
+		return nil
+	}
+	if c.isLocal() {
+		return errors.New("remote is in the local AS")
+	}
+	if path.Destination() != c.remote.IA {
+		return fmt.Errorf("path destination %s does not match remote %s", path.Destination(), c.remote.IA)
+	}
+	c.setPath(path, "requested")
+	c.fixed = true
+	return nil
+}
+
+func (c *migratingConn) notifyPathChange(ch chan<- snet.Path) (stop func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.subscribers[ch] = struct{}{}
+	return func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.subscribers, ch)
+	}
+}
+
+// switchPath switches from the path of remote to the usable path chosen by
+// the selector among the allowed paths, other than the current path. Nothing
+// is done if the path was switched in the meantime, e.g. by a concurrent call.
+// Must be called without c.mutex held, as the path query may block.
+func (c *migratingConn) switchPath(remote *snet.UDPAddr, reason string) error {
+	paths, err := c.queryPaths(remote.IA)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !bytes.Equal(c.remote.Path.Raw, remote.Path.Raw) {
+		return nil
+	}
+	now := time.Now()
+	var candidates []snet.Path
+	for _, p := range paths {
+		if !c.isCurrent(p) && c.isUsable(p, now) {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no usable path to %s", c.remote.IA)
+	}
+	c.setPath(c.selectPath(candidates), reason)
+	return nil
+}
+
+// setPath sets the current path and notifies the subscribers. The path is no
+// longer fixed, unless the caller sets c.fixed again.
+// Must be called with c.mutex held.
+func (c *migratingConn) setPath(path snet.Path, reason string) {
+	log.Debug("appquic: Switching path", "remote", c.remote, "reason", reason,
+		"old", c.path, "new", path)
+	remote := c.remote.Copy()
+	appnet.SetPath(remote, path)
+	c.remote = remote
+	c.path = path
+	c.fixed = false
+	for ch := range c.subscribers {
+		select {
+		case ch <- path:
+		default:
+		}
+	}
+}
+
+// isCurrent returns true if path is the current path.
+// Must be called with c.mutex held.
+func (c *migratingConn) isCurrent(path snet.Path) bool {
+	return bytes.Equal(path.Path().Raw, c.remote.Path.Raw)
+}
+
+// isUsable returns true if the path does not expire soon and does not
+// traverse any interface reported down, analogous to appnet.ManagedConn.
+// Must be called with c.mutex held.
+func (c *migratingConn) isUsable(path snet.Path, now time.Time) bool {
+	md := path.Metadata()
+	if md == nil {
+		return true
+	}
+	if !md.Expiry.IsZero() && md.Expiry.Before(now.Add(migrationExpiryMargin)) {
+		return false
+	}
+	for _, iface := range md.Interfaces {
+		if expiry, ok := c.revoked[iface]; ok {
+			if expiry.After(now) {
+				return false
+			}
+			delete(c.revoked, iface)
+		}
+	}
+	return true
+}
+
+func (c *migratingConn) probeLoop() {
+	ticker := time.NewTicker(c.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.probe()
+		}
+	}
+}
+
+// probe probes the paths to the server and switches to the best path, if the
+// current path is unresponsive or if the RTT of the best path is lower by at
+// least MinRTTImprovement.
+func (c *migratingConn) probe() {
+	remote := c.remoteAddr()
+	paths, err := c.queryPaths(remote.IA)
+	if err != nil {
+		log.Debug("appquic: Unable to query paths for probing", "err", err)
+		return
+	}
+	probes := appnet.ProbePaths(c.ctx, remote, paths, c.config.Probe)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ctx.Err() != nil || !bytes.Equal(c.remote.Path.Raw, remote.Path.Raw) {
+		// closed, or switched paths while probing; the results are outdated
+		return
+	}
+	now := time.Now()
+	var current, best *appnet.PathProbe
+	for i := range probes {
+		p := &probes[i]
+		if c.isCurrent(p.Path) {
+			current = p
+			continue
+		}
+		if p.Err != nil || p.Loss >= 1 || !c.isUsable(p.Path, now) {
+			continue
+		}
+		if best == nil || p.Loss < best.Loss || (p.Loss == best.Loss && p.RTT < best.RTT) {
+			best = p
+		}
+	}
+	if best == nil {
+		return
+	}
+	switch {
+	case current == nil:
+		c.setPath(best.Path, "path no longer available")
+	case current.Err != nil || current.Loss >= 1:
+		c.setPath(best.Path, "path unresponsive")
+	case !c.fixed && best.Loss <= current.Loss &&
+		float64(best.RTT) < float64(current.RTT)*(1-c.config.MinRTTImprovement):
+		c.setPath(best.Path, "lower RTT")
+	}
+}
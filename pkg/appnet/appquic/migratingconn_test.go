@@ -0,0 +1,307 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appnettest"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+func TestMigratingConn(t *testing.T) {
+	iaA := addr.IA{I: 1, A: 0xff0000000110}
+	iaB := addr.IA{I: 1, A: 0xff0000000111}
+	mn := appnettest.NewNet()
+	p0 := mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+	p1 := mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+	mn.SetDefault(iaA)
+	server := mn.NewNetwork(iaB)
+
+	sconn, err := server.ListenPort(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	raddr := &snet.UDPAddr{IA: iaB, Host: sconn.LocalAddr().(*net.UDPAddr)}
+	c, err := dialMigratingConn(raddr, MigrationConfig{
+		Probe: appnet.ProbeConfig{Attempts: 1, Timeout: 200 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ch := make(chan snet.Path, 4)
+	stop := c.notifyPathChange(ch)
+	defer stop()
+
+	uses := func(path snet.Path, p *appnettest.Path) bool {
+		return path != nil && path.Metadata().Interfaces[0] == p.Interfaces()[0]
+	}
+	buf := make([]byte, 16)
+	// send to the server, which must receive the packet on the current path
+	send := func() {
+		t.Helper()
+		if _, err := c.WriteTo([]byte("ping"), raddr); err != nil {
+			t.Fatal(err)
+		}
+		_ = sconn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := sconn.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectSwitch := func(p *appnettest.Path) {
+		t.Helper()
+		if !uses(c.currentPath(), p) {
+			t.Fatalf("expected path %s, got %s", p, c.currentPath())
+		}
+		select {
+		case path := <-ch:
+			if !uses(path, p) {
+				t.Errorf("expected notification for path %s, got %s", p, path)
+			}
+		default:
+			t.Error("expected path change notification")
+		}
+	}
+
+	if !uses(c.currentPath(), p0) {
+		t.Fatalf("expected initial path %s, got %s", p0, c.currentPath())
+	}
+	send()
+
+	// Better RTT
+	p0.Update(func(cfg *appnettest.PathConfig) { cfg.Latency = 50 * time.Millisecond })
+	c.probe()
+	expectSwitch(p1)
+	send()
+
+	// Explicitly chosen path is kept, despite the higher RTT
+	paths, err := appnet.QueryPaths(iaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if uses(path, p0) {
+			if err := c.setFixedPath(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expectSwitch(p0)
+	c.probe()
+	if !uses(c.currentPath(), p0) {
+		t.Errorf("expected chosen path %s to be kept, got %s", p0, c.currentPath())
+	}
+	send()
+
+	// Automatic selection again
+	if err := c.setFixedPath(nil); err != nil {
+		t.Fatal(err)
+	}
+	c.probe()
+	expectSwitch(p1)
+	send()
+
+	// Failure: the interface down message is handled during ReadFrom and is
+	// not returned. This is tested last, as the revoked interface is avoided
+	// until the revocation expires.
+	mn.Revoke(p1.Interfaces()[1])
+	if _, err := c.WriteTo([]byte("ping"), raddr); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var scmpErr *appnet.SCMPError
+	if _, _, err := c.ReadFrom(buf); err == nil || errors.As(err, &scmpErr) {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	expectSwitch(p0)
+	send()
+}
+
+// lastSelector selects the last of the paths.
+type lastSelector struct {
+	paths []snet.Path
+}
+
+func (s *lastSelector) Reset(dst *snet.UDPAddr, paths []snet.Path) error {
+	s.paths = paths
+	return nil
+}
+
+func (s *lastSelector) Next() []snet.Path {
+	return s.paths[len(s.paths)-1:]
+}
+
+func TestMigratingConnPolicy(t *testing.T) {
+	iaA := addr.IA{I: 1, A: 0xff0000000110}
+	iaB := addr.IA{I: 1, A: 0xff0000000111}
+	mn := appnettest.NewNet()
+	p0 := mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+	p1 := mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+	// the path with the lowest RTT, last for the selector, but not allowed
+	pd := mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+	mn.SetDefault(iaA)
+	server := mn.NewNetwork(iaB)
+
+	sconn, err := server.ListenPort(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	denied := pd.Interfaces()[0]
+	policy, err := appnet.PolicyFromString(fmt.Sprintf(`{"acl": ["- %s#%d", "+"]}`, denied.IA, denied.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr := &snet.UDPAddr{IA: iaB, Host: sconn.LocalAddr().(*net.UDPAddr)}
+	c, err := dialMigratingConn(raddr, MigrationConfig{
+		Probe:       appnet.ProbeConfig{Attempts: 1, Timeout: 200 * time.Millisecond},
+		PathPolicy:  policy,
+		NewSelector: func() appnet.PathSelector { return &lastSelector{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	uses := func(p *appnettest.Path) bool {
+		path := c.currentPath()
+		return path != nil && path.Metadata().Interfaces[0] == p.Interfaces()[0]
+	}
+	if !uses(p1) {
+		t.Fatalf("expected initial path %s chosen by the selector, got %s", p1, c.currentPath())
+	}
+
+	p0.Update(func(cfg *appnettest.PathConfig) { cfg.Latency = 20 * time.Millisecond })
+	p1.Update(func(cfg *appnettest.PathConfig) { cfg.Latency = 50 * time.Millisecond })
+	c.probe()
+	if !uses(p0) {
+		t.Fatalf("expected allowed path %s with lower RTT, got %s", p0, c.currentPath())
+	}
+
+	if err := c.switchPath(c.remoteAddr(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if !uses(p1) {
+		t.Errorf("expected allowed path %s chosen by the selector, got %s", p1, c.currentPath())
+	}
+}
+
+func TestMigratingSession(t *testing.T) {
+	iaA := addr.IA{I: 1, A: 0xff0000000110}
+	iaB := addr.IA{I: 1, A: 0xff0000000111}
+	mn := appnettest.NewNet()
+	p0 := mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+	p1 := mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+	mn.SetDefault(iaA)
+	server := mn.NewNetwork(iaB)
+
+	sconn, err := server.ListenPort(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := NewPathConn(sconn)
+	defer pc.Close()
+	pc.SetFollowPaths(true)
+	listener, err := quic.Listen(pc, &tls.Config{
+		Certificates: GetDummyTLSCerts(),
+		NextProtos:   []string{"test"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// echo on the first stream of each session
+	go func() {
+		for {
+			sess, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := sess.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	raddr := &snet.UDPAddr{IA: iaB, Host: pc.LocalAddr().(*net.UDPAddr)}
+	sess, err := DialAddrMigrating(raddr, raddr.String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"test"},
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.CloseWithError(0, "")
+	stream, err := sess.OpenStreamSync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uses := func(path snet.Path, p *appnettest.Path) bool {
+		return path != nil && path.Metadata().Interfaces[0] == p.Interfaces()[0]
+	}
+	buf := make([]byte, 4)
+	echo := func() {
+		t.Helper()
+		_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := stream.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "ping" {
+			t.Fatalf("expected echo, got %q", buf)
+		}
+	}
+
+	serverPaths, err := server.QueryPaths(iaA)
+	if err != nil || len(serverPaths) != 2 {
+		t.Fatalf("expected 2 paths, got %v, %v", serverPaths, err)
+	}
+	echo()
+	if !uses(sess.Path(), p0) {
+		t.Fatalf("expected initial path %s, got %s", p0, sess.Path())
+	}
+	// The session switches to the other path when the path fails, and the
+	// server follows
+	mn.Revoke(p0.Interfaces()[1])
+	echo()
+	if !uses(sess.Path(), p1) {
+		t.Errorf("expected path %s after failure, got %s", p1, sess.Path())
+	}
+	caddr := &snet.UDPAddr{IA: iaA, Host: sess.LocalAddr().(*net.UDPAddr)}
+	info := pc.ReplyPathInfo(caddr)
+	if info == nil || info.Fingerprint != snet.Fingerprint(serverPaths[1]).String() {
+		t.Errorf("expected the server to reply on path %v, got %+v", serverPaths[1], info)
+	}
+	echo()
+}
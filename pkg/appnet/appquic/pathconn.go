@@ -0,0 +1,247 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+const (
+	// pathConnPeerTimeout is the time after which the path of a remote is
+	// forgotten, if no further packets were received.
+	pathConnPeerTimeout = 5 * time.Minute
+	// pathConnMaxPeers is the number of remotes above which the forgotten
+	// remotes are purged.
+	pathConnMaxPeers = 4096
+)
+
+// PathConn wraps a listening conn, e.g. a *snet.Conn or an
+// *appnet.WildcardConn, to keep track of the paths on which each remote sends
+// its packets.
+//
+// By default, replies are sent on the reverse of the path of the first packet
+// received from the remote. Use SetPath to choose the path for the replies to
+// a remote instead, or SetFollowPaths to send the replies on the path of the
+// last packet received from the remote, so that they follow the remote when
+// it migrates to another path.
+type PathConn struct {
+	net.PacketConn
+
+	mutex       sync.Mutex
+	follow      bool
+	peers       map[string]*pathPeer
+	subscribers map[string]map[chan<- *snet.UDPAddr]struct{}
+}
+
+type pathPeer struct {
+	// first is the address of the first packet received from the remote, with
+	// the reversed path.
+	first *snet.UDPAddr
+	// addr is the address of the last packet received from the remote, with
+	// the reversed path.
+	addr *snet.UDPAddr
+	// reply is the address with the path set with SetPath, or nil.
+	reply *snet.UDPAddr
+	seen  time.Time
+}
+
+// NewPathConn returns a PathConn wrapping conn.
+func NewPathConn(conn net.PacketConn) *PathConn {
+	return &PathConn{
+		PacketConn:  conn,
+		peers:       make(map[string]*pathPeer),
+		subscribers: make(map[string]map[chan<- *snet.UDPAddr]struct{}),
+	}
+}
+
+// SetFollowPaths sets whether the replies to a remote, for which no path was
+// set with SetPath, are sent on the reverse of the path of the last packet
+// received from the remote instead of the first one.
+//
+// Note that the paths of the received packets are not authenticated; when
+// following, anyone who can spoof the address of a remote can redirect the
+// replies to the remote onto a path of their choice.
+func (c *PathConn) SetFollowPaths(follow bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.follow = follow
+}
+
+// ReadFrom reads a packet and records the path on which it was received.
+// SCMP errors are not returned, as a QUIC listener would fail on any error
+// returned by the conn; they are e.g. received for the replies still sent on
+// the previous path of a remote that switched paths. Use appnet.NotifySCMP to
+// observe them.
+func (c *PathConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(b)
+		var scmpErr *appnet.SCMPError
+		if errors.As(err, &scmpErr) {
+			continue
+		}
+		if raddr, ok := from.(*snet.UDPAddr); ok && err == nil {
+			c.record(raddr)
+		}
+		return n, from, err
+	}
+}
+
+// WriteTo writes a packet to raddr, on the path returned by ReplyAddr.
+func (c *PathConn) WriteTo(b []byte, raddr net.Addr) (int, error) {
+	if reply := c.ReplyAddr(raddr); reply != nil {
+		raddr = reply
+	}
+	return c.PacketConn.WriteTo(b, raddr)
+}
+
+// RemoteAddr returns the address of the last packet received from raddr,
+// including the reversed path, or nil if no packet was received from raddr.
+func (c *PathConn) RemoteAddr(raddr net.Addr) *snet.UDPAddr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if p, ok := c.peers[raddr.String()]; ok && p.addr != nil {
+		return p.addr.Copy()
+	}
+	return nil
+}
+
+// ReplyAddr returns the address, including the path, to which the replies to
+// raddr are sent, or nil if neither a packet was received from raddr nor a
+// path was set. This is the path set with SetPath, or else the reverse of the
+// path of the first packet received from raddr, or of the last one if
+// following paths, see SetFollowPaths.
+func (c *PathConn) ReplyAddr(raddr net.Addr) *snet.UDPAddr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p, ok := c.peers[raddr.String()]
+	if !ok {
+		return nil
+	} else if p.reply != nil {
+		return p.reply.Copy()
+	} else if c.follow && p.addr != nil {
+		return p.addr.Copy()
+	} else if p.first != nil {
+		return p.first.Copy()
+	}
+	return nil
+}
+
+// ReplyPathInfo returns the description of the path on which the replies to
+// raddr are sent, see appnet.ReplyPathInfo.
+// Returns nil if the path is unknown or empty.
+func (c *PathConn) ReplyPathInfo(raddr net.Addr) *appnet.PathInfo {
+	reply := c.ReplyAddr(raddr)
+	if reply == nil {
+		return nil
+	}
+	return appnet.ReplyPathInfo(reply)
+}
+
+// SetPath sets the path on which the replies to raddr are sent. If path is
+// nil, the replies are sent on the path of the remote again, see ReplyAddr.
+func (c *PathConn) SetPath(raddr *snet.UDPAddr, path snet.Path) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := raddr.String()
+	p, ok := c.peers[key]
+	if path == nil {
+		if ok {
+			p.reply = nil
+		}
+		return
+	}
+	if !ok {
+		p = &pathPeer{seen: time.Now()}
+		c.peers[key] = p
+	}
+	p.reply = raddr.Copy()
+	appnet.SetPath(p.reply, path)
+}
+
+// NotifyPathChange registers ch to receive the new address of raddr,
+// including the reversed path, whenever raddr sends from a different path.
+// The notifications are sent whether or not the replies follow the paths of
+// the remote, see SetFollowPaths.
+// Sending to ch does not block; notifications are dropped if ch is not
+// ready.
+// The returned function cancels the registration.
+func (c *PathConn) NotifyPathChange(raddr net.Addr, ch chan<- *snet.UDPAddr) (stop func()) {
+	key := raddr.String()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.subscribers[key] == nil {
+		c.subscribers[key] = make(map[chan<- *snet.UDPAddr]struct{})
+	}
+	c.subscribers[key][ch] = struct{}{}
+	return func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.subscribers[key], ch)
+		if len(c.subscribers[key]) == 0 {
+			delete(c.subscribers, key)
+		}
+	}
+}
+
+func (c *PathConn) record(raddr *snet.UDPAddr) {
+	key := raddr.String()
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p, ok := c.peers[key]
+	if !ok {
+		if len(c.peers) >= pathConnMaxPeers {
+			c.purge(now)
+		}
+		c.peers[key] = &pathPeer{first: raddr, addr: raddr, seen: now}
+		return
+	}
+	p.seen = now
+	if p.first == nil {
+		p.first = raddr
+	}
+	if p.addr != nil && bytes.Equal(p.addr.Path.Raw, raddr.Path.Raw) {
+		return
+	}
+	changed := p.addr != nil
+	p.addr = raddr
+	if !changed {
+		return
+	}
+	for ch := range c.subscribers[key] {
+		select {
+		case ch <- raddr.Copy():
+		default:
+		}
+	}
+}
+
+// purge removes the remotes from which no packet was received for
+// pathConnPeerTimeout and for which no path was set.
+// Must be called with c.mutex held.
+func (c *PathConn) purge(now time.Time) {
+	for k, p := range c.peers {
+		if p.reply == nil && now.Sub(p.seen) > pathConnPeerTimeout {
+			delete(c.peers, k)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appnettest"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+func TestPathConn(t *testing.T) {
+	iaA := addr.IA{I: 1, A: 0xff0000000110}
+	iaB := addr.IA{I: 1, A: 0xff0000000111}
+	mn := appnettest.NewNet()
+	mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+	mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+	server := mn.SetDefault(iaB)
+	client := mn.NewNetwork(iaA)
+
+	sconn, err := server.ListenPort(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := NewPathConn(sconn)
+	defer pc.Close()
+	cconn, err := client.ListenPort(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+
+	clientPaths, err := client.QueryPaths(iaB)
+	if err != nil || len(clientPaths) != 2 {
+		t.Fatalf("expected 2 paths, got %v, %v", clientPaths, err)
+	}
+	serverPaths, err := server.QueryPaths(iaA)
+	if err != nil || len(serverPaths) != 2 {
+		t.Fatalf("expected 2 paths, got %v, %v", serverPaths, err)
+	}
+	saddr := &snet.UDPAddr{IA: iaB, Host: pc.LocalAddr().(*net.UDPAddr)}
+	buf := make([]byte, 16)
+
+	// send from the client on the path, return the address at the server
+	send := func(path snet.Path) *snet.UDPAddr {
+		t.Helper()
+		raddr := saddr.Copy()
+		appnet.SetPath(raddr, path)
+		if _, err := cconn.WriteTo([]byte("ping"), raddr); err != nil {
+			t.Fatal(err)
+		}
+		_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+		_, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return from.(*snet.UDPAddr)
+	}
+	// reply from the server to raddr, return the path at the client
+	reply := func(raddr *snet.UDPAddr) spath.Path {
+		t.Helper()
+		if _, err := pc.WriteTo([]byte("pong"), raddr); err != nil {
+			t.Fatal(err)
+		}
+		_ = cconn.SetReadDeadline(time.Now().Add(time.Second))
+		_, from, err := cconn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return from.(*snet.UDPAddr).Path
+	}
+	samePath := func(a, b spath.Path) bool {
+		return bytes.Equal(a.Raw, b.Raw)
+	}
+
+	first := send(clientPaths[0])
+	if remote := pc.RemoteAddr(first); remote == nil || !samePath(remote.Path, first.Path) {
+		t.Errorf("expected remote address %v, got %v", first, remote)
+	}
+	info := pc.ReplyPathInfo(first)
+	if info == nil || info.Fingerprint != snet.Fingerprint(serverPaths[0]).String() {
+		t.Errorf("expected info for path %v, got %+v", serverPaths[0], info)
+	}
+	ch := make(chan *snet.UDPAddr, 1)
+	stop := pc.NotifyPathChange(first, ch)
+	defer stop()
+
+	// Same path, no notification
+	send(clientPaths[0])
+	select {
+	case raddr := <-ch:
+		t.Errorf("unexpected path change notification %v", raddr)
+	default:
+	}
+
+	// The client migrates to the other path
+	second := send(clientPaths[1])
+	select {
+	case raddr := <-ch:
+		if !samePath(raddr.Path, second.Path) {
+			t.Errorf("expected notification with path %v, got %v", second.Path, raddr.Path)
+		}
+	default:
+		t.Error("expected path change notification")
+	}
+	if remote := pc.RemoteAddr(first); remote == nil || !samePath(remote.Path, second.Path) {
+		t.Errorf("expected remote address %v, got %v", second, remote)
+	}
+	// By default, the replies stay on the path of the first packet
+	if path := reply(first); !samePath(path, clientPaths[0].Path()) {
+		t.Errorf("expected reply on the first path, got %v", path)
+	}
+	// The replies to the original address follow the client
+	pc.SetFollowPaths(true)
+	if path := reply(first); !samePath(path, clientPaths[1].Path()) {
+		t.Errorf("expected reply on the new path, got %v", path)
+	}
+
+	// Explicitly chosen path
+	pc.SetPath(first, serverPaths[0])
+	if path := reply(first); !samePath(path, clientPaths[0].Path()) {
+		t.Errorf("expected reply on the chosen path, got %v", path)
+	}
+	pc.SetPath(first, nil)
+	if path := reply(first); !samePath(path, clientPaths[1].Path()) {
+		t.Errorf("expected reply on the path of the client after reset, got %v", path)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrPinMismatch is returned when a server presents a certificate with a
+// different public key than the one pinned for it.
+var ErrPinMismatch = errors.New("certificate does not match the pinned public key")
+
+// PinStore is a trust-on-first-use store of the public keys of servers, like
+// the known_hosts file of ssh.
+// The public key of the certificate presented by a server is pinned the first
+// time the server is contacted; later connections to the server are only
+// accepted if it presents a certificate with the same public key.
+//
+// The pins are stored in a file, with one line per server, containing the
+// identity of the server (the hostname or the SCION address without port)
+// and the base64 encoded SHA-256 hash of the SubjectPublicKeyInfo of the
+// certificate:
+//
+//	1-ff00:0:110,10.0.0.1 5q3x+Tj/lj0wcq1qIb2pqWrhtwS6K8fTf+6Q6sv9oy8=
+//	example.org Tj3ZBjyDmWmW7SzYxA7P2xuo9Jt1H6MxAgQ4DaWk4YM=
+//
+// Lines starting with # are ignored.
+type PinStore struct {
+	path  string
+	mutex sync.Mutex
+	pins  map[string]string
+}
+
+// LoadPinStore loads the pins from the file at path. The file is created
+// when the first pin is added, if it does not exist.
+func LoadPinStore(path string) (*PinStore, error) {
+	s := &PinStore{path: path, pins: make(map[string]string)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected identity and public key hash", path, lineNo)
+		}
+		if _, err := base64.StdEncoding.DecodeString(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid public key hash: %w", path, lineNo, err)
+		}
+		s.pins[fields[0]] = fields[1]
+	}
+	return s, scanner.Err()
+}
+
+// Check checks the certificate presented by the server with the given
+// identity against the pin for this identity. If there is no pin, the public
+// key of the certificate is pinned and stored in the file.
+func (s *PinStore) Check(identity string, cert *x509.Certificate) error {
+	pin := publicKeyPin(cert)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if pinned, ok := s.pins[identity]; ok {
+		if pinned != pin {
+			return fmt.Errorf("%w for %s", ErrPinMismatch, identity)
+		}
+		return nil
+	}
+	if err := s.append(identity, pin); err != nil {
+		return err
+	}
+	s.pins[identity] = pin
+	return nil
+}
+
+// Remove removes the pin for the identity, e.g. after the server has changed
+// its key.
+func (s *PinStore) Remove(identity string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.pins[identity]; !ok {
+		return nil
+	}
+	delete(s.pins, identity)
+	var buf bytes.Buffer
+	for id, pin := range s.pins {
+		fmt.Fprintf(&buf, "%s %s\n", id, pin)
+	}
+	return ioutil.WriteFile(s.path, buf.Bytes(), 0600)
+}
+
+func (s *PinStore) append(identity, pin string) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", identity, pin); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// publicKeyPin returns the base64 encoded SHA-256 hash of the
+// SubjectPublicKeyInfo of the certificate.
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -16,6 +16,10 @@ package appquic
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -30,29 +34,50 @@ import (
 // generateKeyAndCert generates a private key and a self-signed dummy
 // certificate usable for quic TLS with "InsecureSkipVerify==true"
 func generateKeyAndCert() (*tls.Certificate, error) {
-	priv, err := rsaGenerateKey()
+	priv, err := generateKey(KeyTypeRSA)
 	if err != nil {
-		return nil, nil
+		return nil, err
+	}
+	certPEM, keyPEM, err := createCertificate(priv)
+	if err != nil {
+		return nil, err
 	}
-	return createCertificate(priv)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	return &cert, err
 }
 
-func rsaGenerateKey() (*rsa.PrivateKey, error) {
-	return rsa.GenerateKey(rand.Reader, 2048)
+// generateKey generates a private key of the given type.
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
 }
 
 // createCertificate creates a self-signed dummy certificate for the given key
+// and returns the PEM encoded certificate and private key.
 // Inspired/copy pasted from crypto/tls/generate_cert.go
-func createCertificate(priv *rsa.PrivateKey) (*tls.Certificate, error) {
+func createCertificate(priv crypto.Signer) (certPEM, keyPEM []byte, err error) {
 	notBefore := time.Now()
 	notAfter := notBefore.Add(365 * 24 * time.Hour)
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate serial number: %s", err)
+		return nil, nil, fmt.Errorf("failed to generate serial number: %s", err)
 	}
 
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, isRSA := priv.(*rsa.PrivateKey); isRSA {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
@@ -60,32 +85,31 @@ func createCertificate(priv *rsa.PrivateKey) (*tls.Certificate, error) {
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              keyUsage,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		DNSNames:              []string{"dummy"},
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	certPEMBuf := &bytes.Buffer{}
 	if err := pem.Encode(certPEMBuf, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
 	if err != nil {
-		return nil, fmt.Errorf("unable to marshal private key: %v", err)
+		return nil, nil, fmt.Errorf("unable to marshal private key: %v", err)
 	}
 
 	keyPEMBuf := &bytes.Buffer{}
 	if err := pem.Encode(keyPEMBuf, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	cert, err := tls.X509KeyPair(certPEMBuf.Bytes(), keyPEMBuf.Bytes())
-	return &cert, err
+	return certPEMBuf.Bytes(), keyPEMBuf.Bytes(), nil
 }
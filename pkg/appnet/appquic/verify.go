@@ -0,0 +1,193 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// scionURIScheme is the scheme of the URIs identifying SCION hosts in the
+// subject alternative names of certificates.
+const scionURIScheme = "scion"
+
+var (
+	pinStoreMutex sync.RWMutex
+	pinStore      *PinStore
+)
+
+// SetPinStore sets the PinStore used to verify the certificates of servers
+// that are not signed by a trusted CA, e.g. self-signed certificates.
+// If no PinStore is set, such certificates are rejected.
+// See note on certificate verification in DialAddr.
+func SetPinStore(pins *PinStore) {
+	pinStoreMutex.Lock()
+	defer pinStoreMutex.Unlock()
+	pinStore = pins
+}
+
+func getPinStore() *PinStore {
+	pinStoreMutex.RLock()
+	defer pinStoreMutex.RUnlock()
+	return pinStore
+}
+
+// SCIONAddressURI returns the URI identifying the SCION host with the given
+// ISD-AS and IP address in certificates, e.g. "scion:1-ff00:0:110,10.0.0.1".
+// A certificate is valid for a SCION address if this URI is contained in its
+// subject alternative names.
+func SCIONAddressURI(ia addr.IA, ip net.IP) *url.URL {
+	return &url.URL{Scheme: scionURIScheme, Opaque: scionIdentity(ia, ip)}
+}
+
+// serverIdentity returns the identity of the server dialled as host, at
+// raddr. This is the hostname if host is a hostname, or the SCION address
+// without port, as in SCIONAddressURI, otherwise.
+// The returned hostname is empty if the server is identified by its SCION
+// address.
+func serverIdentity(host string, raddr *snet.UDPAddr) (identity string, hostname string) {
+	if host != "" {
+		if _, err := snet.ParseUDPAddr(host); err != nil {
+			hostname = host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				hostname = h
+			}
+			hostname = strings.ToLower(hostname)
+			return hostname, hostname
+		}
+	}
+	return scionIdentity(raddr.IA, raddr.Host.IP), ""
+}
+
+func scionIdentity(ia addr.IA, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s,%s", ia, ip4)
+	}
+	return fmt.Sprintf("%s,[%s]", ia, ip)
+}
+
+// verifyingTLSConfig returns a copy of tlsConf that verifies the certificate
+// of the server dialled as host, at raddr.
+// The standard verification of crypto/tls is replaced, as it verifies the
+// certificate against the server name, which is not meaningful for SCION
+// addresses.
+// Servers dialled by SCION address that present a SCION AS certificate chain
+// are verified against the TRCs, if a TRCStore is set.
+// If tlsConf has InsecureSkipVerify set, it is returned unchanged.
+func verifyingTLSConfig(tlsConf *tls.Config, host string, raddr *snet.UDPAddr) *tls.Config {
+	if tlsConf == nil || tlsConf.InsecureSkipVerify {
+		return tlsConf
+	}
+	identity, hostname := serverIdentity(host, raddr)
+	pins := getPinStore()
+	trcs := getTRCStore()
+	roots := tlsConf.RootCAs
+	next := tlsConf.VerifyPeerCertificate
+
+	conf := tlsConf.Clone()
+	conf.InsecureSkipVerify = true
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		chains, err := verifyServer(rawCerts, roots, identity, hostname, raddr.IA, pins, trcs, time.Now())
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			return next(rawCerts, chains)
+		}
+		return nil
+	}
+	return conf
+}
+
+// verifyServer verifies the certificate chain presented by the server dialled
+// as hostname (empty if dialled by SCION address), in the AS ia.
+// An AS certificate chain only authenticates the server as a host in the AS,
+// not as the host with a given name, so it is only verified against the TRCs
+// if the server is dialled by its SCION address. Otherwise, and for other
+// certificates, see verifyServerCert.
+func verifyServer(rawCerts [][]byte, roots *x509.CertPool, identity, hostname string, ia addr.IA,
+	pins *PinStore, trcs *TRCStore, now time.Time) ([][]*x509.Certificate, error) {
+
+	if chain, ok := asChain(rawCerts); ok && trcs != nil && hostname == "" {
+		if err := trcs.verifyASChain(chain, ia, now); err != nil {
+			return nil, err
+		}
+		return [][]*x509.Certificate{chain}, nil
+	}
+	return verifyServerCert(rawCerts, roots, identity, hostname, pins)
+}
+
+// verifyServerCert verifies the certificate chain presented by the server.
+// A chain signed by one of the roots (or the system roots, if roots is nil)
+// must be valid for the identity of the server, i.e. for the hostname or for
+// the SCION address. Otherwise, the certificate is checked against the pins,
+// if any.
+// The verified chains are returned, if the certificate was signed by a root.
+func verifyServerCert(rawCerts [][]byte, roots *x509.CertPool, identity, hostname string,
+	pins *PinStore) ([][]*x509.Certificate, error) {
+
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no server certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+	leaf := certs[0]
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := leaf.Verify(opts)
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthority) && pins != nil {
+		return nil, pins.Check(identity, leaf)
+	} else if err != nil {
+		return nil, err
+	}
+	if hostname != "" {
+		return chains, leaf.VerifyHostname(hostname)
+	}
+	if !hasURI(leaf, scionURIScheme, identity) {
+		return nil, fmt.Errorf("certificate is not valid for %s", identity)
+	}
+	return chains, nil
+}
+
+func hasURI(cert *x509.Certificate, scheme, opaque string) bool {
+	for _, u := range cert.URIs {
+		if u.Scheme == scheme && u.Opaque == opaque {
+			return true
+		}
+	}
+	return false
+}
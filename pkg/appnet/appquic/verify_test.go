@@ -0,0 +1,165 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appquic
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+var testIA = addr.IA{I: 1, A: 0xff0000000110}
+
+// testCert creates a certificate for the hostnames and URIs, signed by parent
+// or self-signed if parent is nil.
+func testCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+	isCA bool, dnsNames []string, uris []*url.URL) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              dnsNames,
+		URIs:                  uris,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestServerIdentity(t *testing.T) {
+	raddr4 := &snet.UDPAddr{IA: testIA, Host: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}}
+	raddr6 := &snet.UDPAddr{IA: testIA, Host: &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 443}}
+	cases := []struct {
+		host     string
+		raddr    *snet.UDPAddr
+		identity string
+		hostname string
+	}{
+		{"Example.org:443", raddr4, "example.org", "example.org"},
+		{"example.org", raddr4, "example.org", "example.org"},
+		{"1-ff00:0:110,[10.0.0.1]:443", raddr4, "1-ff00:0:110,10.0.0.1", ""},
+		{"", raddr4, "1-ff00:0:110,10.0.0.1", ""},
+		{"1-ff00:0:110,[fd00::1]:443", raddr6, "1-ff00:0:110,[fd00::1]", ""},
+	}
+	for _, c := range cases {
+		identity, hostname := serverIdentity(c.host, c.raddr)
+		if identity != c.identity || hostname != c.hostname {
+			t.Errorf("serverIdentity(%q): expected %q, %q, got %q, %q",
+				c.host, c.identity, c.hostname, identity, hostname)
+		}
+	}
+}
+
+func TestVerifyServerCert(t *testing.T) {
+	ca, caKey := testCert(t, nil, nil, true, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	uri4 := SCIONAddressURI(testIA, net.IPv4(10, 0, 0, 1))
+	uri6 := SCIONAddressURI(testIA, net.ParseIP("fd00::1"))
+	leaf, _ := testCert(t, ca, caKey, false, []string{"example.org"}, []*url.URL{uri4, uri6})
+	selfSigned, _ := testCert(t, nil, nil, false, []string{"example.org"}, []*url.URL{uri4})
+	other, _ := testCert(t, nil, nil, false, []string{"example.org"}, []*url.URL{uri4})
+
+	dir, err := ioutil.TempDir("", "appquic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pinFile := filepath.Join(dir, "pins", "known_hosts")
+	pins, err := LoadPinStore(pinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		cert     *x509.Certificate
+		identity string
+		hostname string
+		pins     *PinStore
+		valid    bool
+	}{
+		{"hostname", leaf, "example.org", "example.org", nil, true},
+		{"wrong hostname", leaf, "example.com", "example.com", nil, false},
+		{"SCION address", leaf, "1-ff00:0:110,10.0.0.1", "", nil, true},
+		{"SCION IPv6 address", leaf, "1-ff00:0:110,[fd00::1]", "", nil, true},
+		{"wrong SCION address", leaf, "1-ff00:0:110,10.0.0.2", "", nil, false},
+		{"self-signed without pins", selfSigned, "example.org", "example.org", nil, false},
+		{"self-signed, first use", selfSigned, "example.org", "example.org", pins, true},
+		{"self-signed, pinned", selfSigned, "example.org", "example.org", pins, true},
+		{"other key", other, "example.org", "example.org", pins, false},
+		{"other key, other host", other, "1-ff00:0:110,10.0.0.1", "", pins, true},
+	}
+	for _, c := range cases {
+		_, err := verifyServerCert([][]byte{c.cert.Raw}, roots, c.identity, c.hostname, c.pins)
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+
+	// The pins are persisted
+	reloaded, err := LoadPinStore(pinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Check("example.org", other); !errors.Is(err, ErrPinMismatch) {
+		t.Errorf("expected pin mismatch after reload, got %v", err)
+	}
+	if err := reloaded.Remove("example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Check("example.org", other); err != nil {
+		t.Errorf("expected new pin after removing the old one, got %v", err)
+	}
+	if err := reloaded.Check("1-ff00:0:110,10.0.0.1", other); err != nil {
+		t.Errorf("expected pin to be kept when removing another one, got %v", err)
+	}
+}
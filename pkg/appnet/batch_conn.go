@@ -0,0 +1,469 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/internal/deadline"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/slayers"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/sock/reliable"
+	"github.com/scionproto/scion/go/lib/topology/underlay"
+)
+
+const (
+	// batchQueueLen is the number of received packets buffered by a
+	// BatchConn, i.e. the maximum number of packets returned by one ReadBatch.
+	batchQueueLen = 64
+	// batchFrameBufSize is the initial size of the buffers used to send
+	// multiple packets to the dispatcher with a single write.
+	batchFrameBufSize = 1 << 16
+)
+
+var errBatchConnClosed = errors.New("use of closed connection")
+
+// Message is a datagram sent by WriteBatch or received by ReadBatch.
+type Message struct {
+	// Buffer contains the payload of the datagram. For ReadBatch, it must be
+	// large enough to hold the payload of the received datagram.
+	Buffer []byte
+	// N is the size of the payload received by ReadBatch. It is ignored by
+	// WriteBatch, which always sends the entire Buffer.
+	N int
+}
+
+// BatchConn is a connected SCION/UDP socket for high packet rates, that sends
+// and receives multiple datagrams per call.
+//
+// The SCION and UDP headers for the remote are serialized once, when the
+// connection is created, and only the lengths and the checksum are updated for
+// each packet. The packets passed to WriteBatch are sent to the dispatcher
+// with a single write. Received packets are buffered by a background reader,
+// and ReadBatch returns all that are available without blocking again.
+//
+// The path of the remote address is never updated, like for DialAddr.
+// SCMP errors received for the packets sent are returned by ReadBatch as
+// SCMPError.
+type BatchConn struct {
+	conn    net.PacketConn
+	local   *snet.UDPAddr
+	remote  *snet.UDPAddr
+	nextHop *net.UDPAddr
+
+	writeMutex sync.Mutex
+	header     []byte   // serialized headers of a packet without payload
+	csumBase   uint32   // checksum of the header fields that do not change
+	pkts       [][]byte // serialized packets of the last WriteBatch, reused
+
+	packets chan batchPacket
+	free    chan []byte
+
+	readMutex sync.Mutex
+	pending   *batchPacket // error to return on the next ReadBatch
+
+	closeOnce    sync.Once
+	closed       chan struct{}
+	readDeadline deadline.Deadline
+}
+
+// batchPacket is a packet received by BatchConn, with the payload inside buf.
+type batchPacket struct {
+	buf     []byte
+	payload []byte
+	err     error
+}
+
+// DialBatch connects to raddr from laddr, like DialAddr, and returns a
+// BatchConn.
+// The local address or parts of it may be nil or unspecified, in which case the
+// local IP is determined like for DialAddr and the port is chosen by the
+// dispatcher.
+func DialBatch(laddr *net.UDPAddr, raddr *snet.UDPAddr) (*BatchConn, error) {
+	return DefNetwork().DialBatch(laddr, raddr)
+}
+
+// DialBatch connects to raddr from laddr and returns a BatchConn.
+// See DialBatch.
+func (n *Network) DialBatch(laddr *net.UDPAddr, raddr *snet.UDPAddr) (*BatchConn, error) {
+	raddr = raddr.Copy()
+	if raddr.Path.IsEmpty() {
+		err := n.SetDefaultPath(raddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if laddr == nil {
+		laddr = &net.UDPAddr{}
+	}
+	if laddr.IP == nil || laddr.IP.IsUnspecified() {
+		localIP, err := n.resolveLocal(raddr)
+		if err != nil {
+			return nil, err
+		}
+		laddr = &net.UDPAddr{IP: localIP, Port: laddr.Port, Zone: laddr.Zone}
+	}
+	conn, port, err := n.connDispatcher.Register(context.Background(), n.IA, laddr, addr.SvcNone)
+	if err != nil {
+		return nil, err
+	}
+	local := &snet.UDPAddr{IA: n.IA, Host: &net.UDPAddr{IP: laddr.IP, Port: int(port)}}
+	nextHop := raddr.NextHop
+	if nextHop == nil && raddr.IA == n.IA {
+		nextHop = &net.UDPAddr{IP: raddr.Host.IP, Port: underlay.EndhostPort, Zone: raddr.Host.Zone}
+	}
+	header, err := udpHeader(local, raddr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &BatchConn{
+		conn:     conn,
+		local:    local,
+		remote:   raddr,
+		nextHop:  nextHop,
+		header:   header,
+		csumBase: udpChecksumBase(header),
+		packets:  make(chan batchPacket, batchQueueLen),
+		free:     make(chan []byte, batchQueueLen),
+		closed:   make(chan struct{}),
+	}
+	for i := 0; i < batchQueueLen; i++ {
+		c.free <- make([]byte, snet.BufSize)
+	}
+	go c.receive()
+	return c, nil
+}
+
+// WriteBatch sends the datagrams in msgs to the remote address. It returns
+// the number of datagrams sent, which is len(msgs) unless an error occurred.
+func (c *BatchConn) WriteBatch(msgs []Message) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	for len(c.pkts) < len(msgs) {
+		c.pkts = append(c.pkts, nil)
+	}
+	pkts := c.pkts[:len(msgs)]
+	for i, m := range msgs {
+		pkt, err := c.serialize(pkts[i][:0], m.Buffer)
+		if err != nil {
+			return 0, err
+		}
+		pkts[i] = pkt
+	}
+	if err := writePackets(c.conn, pkts, c.nextHop); err != nil {
+		return 0, err
+	}
+	return len(msgs), nil
+}
+
+// Write sends a single datagram to the remote address.
+func (c *BatchConn) Write(b []byte) (int, error) {
+	if _, err := c.WriteBatch([]Message{{Buffer: b}}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// serialize appends the SCION packet with the payload b to buf.
+func (c *BatchConn) serialize(buf, b []byte) ([]byte, error) {
+	l4Len := 8 + len(b)
+	if len(c.header)+len(b) > common.MaxMTU {
+		return nil, fmt.Errorf("payload of %d bytes too large", len(b))
+	}
+	buf = append(buf, c.header...)
+	buf = append(buf, b...)
+	udp := buf[len(c.header)-8:]
+	binary.BigEndian.PutUint16(buf[6:8], uint16(l4Len))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(l4Len))
+	// The length is part of both the pseudo header and the UDP header
+	csum := c.csumBase + 2*uint32(l4Len) + checksumSum(b)
+	binary.BigEndian.PutUint16(udp[6:8], foldChecksum(csum))
+	return buf, nil
+}
+
+// ReadBatch reads datagrams from the remote address into msgs and returns the
+// number of datagrams read. It blocks until at least one datagram is
+// available and returns all datagrams that are available at this time, up to
+// len(msgs).
+//
+// If an error is received after some datagrams, these are returned first and
+// the error is returned by the next call.
+func (c *BatchConn) ReadBatch(msgs []Message) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	if c.pending != nil {
+		p := c.pending
+		c.pending = nil
+		return 0, p.err
+	}
+	var p batchPacket
+	select {
+	case p = <-c.packets:
+	case <-c.closed:
+		return 0, errBatchConnClosed
+	case <-c.readDeadline.Wait():
+		return 0, deadline.TimeoutError{}
+	}
+	n := 0
+	for {
+		if p.err != nil {
+			c.free <- p.buf
+			if n == 0 {
+				return 0, p.err
+			}
+			c.pending = &batchPacket{err: p.err}
+			return n, nil
+		}
+		if len(p.payload) > len(msgs[n].Buffer) {
+			c.free <- p.buf
+			return n, fmt.Errorf("buffer too small: %d bytes received, %d available",
+				len(p.payload), len(msgs[n].Buffer))
+		}
+		msgs[n].N = copy(msgs[n].Buffer, p.payload)
+		c.free <- p.buf
+		n++
+		if n == len(msgs) {
+			return n, nil
+		}
+		select {
+		case p = <-c.packets:
+		default:
+			return n, nil
+		}
+	}
+}
+
+// Read reads a single datagram from the remote address.
+func (c *BatchConn) Read(b []byte) (int, error) {
+	msgs := []Message{{Buffer: b}}
+	if _, err := c.ReadBatch(msgs); err != nil {
+		return 0, err
+	}
+	return msgs[0].N, nil
+}
+
+// receive reads the packets from the dispatcher and passes them to ReadBatch.
+func (c *BatchConn) receive() {
+	for {
+		var buf []byte
+		select {
+		case buf = <-c.free:
+		case <-c.closed:
+			return
+		}
+		n, _, err := c.conn.ReadFrom(buf)
+		p := batchPacket{buf: buf, err: err}
+		if err == nil {
+			p.payload, err = udpPayload(buf[:n])
+			if err != nil {
+				log.Debug("BatchConn: dropping packet", "err", err)
+				c.free <- buf
+				continue
+			}
+		}
+		select {
+		case c.packets <- p:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *BatchConn) LocalAddr() net.Addr {
+	return c.local.Host
+}
+
+// RemoteAddr returns the remote address, including the path.
+func (c *BatchConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *BatchConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *BatchConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *BatchConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *BatchConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// udpHeader returns the serialized SCION and UDP headers of a packet from
+// local to remote without payload.
+func udpHeader(local, remote *snet.UDPAddr) ([]byte, error) {
+	pkt := &snet.Packet{
+		PacketInfo: snet.PacketInfo{
+			Source:      snet.SCIONAddress{IA: local.IA, Host: addr.HostFromIP(local.Host.IP)},
+			Destination: snet.SCIONAddress{IA: remote.IA, Host: addr.HostFromIP(remote.Host.IP)},
+			Path:        remote.Path,
+			Payload: snet.UDPPayload{
+				SrcPort: uint16(local.Host.Port),
+				DstPort: uint16(remote.Host.Port),
+				Payload: []byte{},
+			},
+		},
+	}
+	if err := pkt.Serialize(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), pkt.Bytes...), nil
+}
+
+// udpChecksumBase returns the sum of the fields of the SCION pseudo header
+// and the UDP header in header, except for the lengths and the checksum.
+func udpChecksumBase(header []byte) uint32 {
+	var scn slayers.SCION
+	if err := scn.DecodeFromBytes(header, gopacket.NilDecodeFeedback); err != nil {
+		// not reached for headers serialized by udpHeader
+		panic(err)
+	}
+	udp := header[len(header)-8:]
+	// The address header contains the IAs and the host addresses
+	csum := checksumSum(header[slayers.CmnHdrLen : slayers.CmnHdrLen+scn.AddrHdrLen()])
+	csum += uint32(common.L4UDP)
+	csum += checksumSum(udp[0:4])
+	return csum
+}
+
+// checksumSum returns the 16-bit sum of b, as used in the internet checksum.
+func checksumSum(b []byte) uint32 {
+	var csum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		csum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		csum += uint32(b[len(b)-1]) << 8
+	}
+	return csum
+}
+
+func foldChecksum(csum uint32) uint16 {
+	for csum > 0xffff {
+		csum = (csum >> 16) + (csum & 0xffff)
+	}
+	return ^uint16(csum)
+}
+
+// udpPayload returns the UDP payload of a serialized SCION packet.
+func udpPayload(raw []byte) ([]byte, error) {
+	var scn slayers.SCION
+	if err := scn.DecodeFromBytes(raw, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	if scn.NextHdr != common.L4UDP {
+		return nil, fmt.Errorf("unexpected L4 protocol %v", scn.NextHdr)
+	}
+	var udp slayers.UDP
+	if err := udp.DecodeFromBytes(scn.Payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return udp.Payload, nil
+}
+
+// packetBatchWriter is implemented by the wrappers of the connections
+// registered with the dispatcher, to pass batches of packets through to
+// writePackets.
+type packetBatchWriter interface {
+	writePackets(pkts [][]byte, nextHop *net.UDPAddr) error
+}
+
+var frameBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, batchFrameBufSize)
+		return &b
+	},
+}
+
+// writePackets sends the serialized SCION packets to nextHop. On a connection
+// to the dispatcher, all packets are framed into one buffer and sent with a
+// single write. Other connections send one packet after the other.
+func writePackets(conn net.PacketConn, pkts [][]byte, nextHop *net.UDPAddr) error {
+	switch c := conn.(type) {
+	case packetBatchWriter:
+		return c.writePackets(pkts, nextHop)
+	case *reliable.Conn:
+		return writeFrames(c, pkts, nextHop)
+	}
+	for _, pkt := range pkts {
+		if _, err := conn.WriteTo(pkt, nextHop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFrames sends the packets to the dispatcher with a single write, using
+// the framing of the reliable socket protocol.
+// The write mutex of conn is bypassed; the conn must not be written to
+// concurrently.
+func writeFrames(conn *reliable.Conn, pkts [][]byte, nextHop *net.UDPAddr) error {
+	bufp := frameBufPool.Get().(*[]byte)
+	defer frameBufPool.Put(bufp)
+
+	// frame header: cookie, address type, length, IP address and port
+	const maxFrameHeaderLen = 8 + 1 + 4 + net.IPv6len + 2
+	size := 0
+	for _, pkt := range pkts {
+		size += maxFrameHeaderLen + len(pkt)
+	}
+	if len(*bufp) < size {
+		*bufp = make([]byte, size)
+	}
+	buf := *bufp
+	n := 0
+	for _, pkt := range pkts {
+		p := &reliable.UnderlayPacket{Address: nextHop, Payload: pkt}
+		m, err := p.SerializeTo(buf[n:])
+		if err != nil {
+			return err
+		}
+		n += m
+	}
+	_, err := conn.UnixConn.Write(buf[:n])
+	return err
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/sock/reliable"
+)
+
+func TestBatchConnSerialize(t *testing.T) {
+	local := &snet.UDPAddr{
+		IA:   addr.IA{I: 1, A: 0xff0000000110},
+		Host: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40001},
+	}
+	remote := &snet.UDPAddr{
+		IA:   addr.IA{I: 1, A: 0xff0000000110},
+		Host: &net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 30041},
+	}
+	header, err := udpHeader(local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &BatchConn{header: header, csumBase: udpChecksumBase(header)}
+	for _, size := range []int{0, 1, 2, 1000, 1337} {
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i * 7)
+		}
+		pkt := &snet.Packet{
+			PacketInfo: snet.PacketInfo{
+				Source:      snet.SCIONAddress{IA: local.IA, Host: addr.HostFromIP(local.Host.IP)},
+				Destination: snet.SCIONAddress{IA: remote.IA, Host: addr.HostFromIP(remote.Host.IP)},
+				Payload: snet.UDPPayload{
+					SrcPort: uint16(local.Host.Port),
+					DstPort: uint16(remote.Host.Port),
+					Payload: payload,
+				},
+			},
+		}
+		if err := pkt.Serialize(); err != nil {
+			t.Fatal(err)
+		}
+		serialized, err := c.serialize(nil, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(serialized, pkt.Bytes) {
+			t.Errorf("payload of %d bytes: expected\n%x\ngot\n%x", size, []byte(pkt.Bytes), serialized)
+		}
+		if decoded, err := udpPayload(serialized); err != nil || !bytes.Equal(decoded, payload) {
+			t.Errorf("payload of %d bytes: decoding failed: %v", size, err)
+		}
+	}
+}
+
+func TestWriteFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "dispatcher.sock")
+	listener, err := reliable.Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := reliable.Dial(context.Background(), socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// more than batchFrameBufSize in total, to grow the buffer
+	var pkts [][]byte
+	for i := 0; i < 20; i++ {
+		pkts = append(pkts, bytes.Repeat([]byte{byte(i)}, 5000+i))
+	}
+	nextHop := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 30041}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- writePackets(conn, pkts, nextHop)
+	}()
+	buf := make([]byte, snet.BufSize)
+	for i, pkt := range pkts {
+		n, from, err := peer.(*reliable.Conn).ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], pkt) || from.String() != nextHop.String() {
+			t.Errorf("packet %d: expected %d bytes from %s, got %d bytes from %s",
+				i, len(pkt), nextHop, n, from)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+const (
+	// dnsTXTPrefix is the prefix of the TXT records containing a SCION address.
+	dnsTXTPrefix = "scion="
+	// defaultDNSTimeout is the default timeout for a DNS lookup.
+	defaultDNSTimeout = 5 * time.Second
+)
+
+// DNSResolver is a Resolver looking up SCION addresses in DNS TXT records.
+// The records are of the form
+//
+//	scion=<ISD-AS>,<IP>
+//
+// e.g. "scion=1-ff00:0:110,10.0.0.1". The IP may also be enclosed in
+// brackets, as in the hosts file. If there are multiple such records for a
+// name, the first valid one is used.
+type DNSResolver struct {
+	// Resolver is the DNS resolver used for the lookups. Defaults to
+	// net.DefaultResolver.
+	Resolver *net.Resolver
+	// Timeout is the timeout for a lookup. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// NewDNSResolver creates a DNSResolver querying the DNS server at the given
+// host:port address. If server is empty, the system's DNS configuration is
+// used.
+func NewDNSResolver(server string) *DNSResolver {
+	if server == "" {
+		return &DNSResolver{}
+	}
+	return &DNSResolver{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		},
+	}
+}
+
+// Resolve implements Resolver. A HostNotFoundError is returned if the name
+// does not exist or if it has no TXT record with a SCION address.
+func (r *DNSResolver) Resolve(name string) (*snet.SCIONAddress, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	records, err := resolver.LookupTXT(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, &HostNotFoundError{name}
+	} else if err != nil {
+		return nil, fmt.Errorf("DNS lookup for %q failed: %w", name, err)
+	}
+	for _, record := range records {
+		if !strings.HasPrefix(record, dnsTXTPrefix) {
+			continue
+		}
+		addr, err := addrFromTXT(strings.TrimPrefix(record, dnsTXTPrefix))
+		if err != nil {
+			continue
+		}
+		return &addr, nil
+	}
+	return nil, &HostNotFoundError{name}
+}
+
+// addrFromTXT parses the SCION address in a TXT record, with or without
+// brackets around the IP.
+func addrFromTXT(s string) (snet.SCIONAddress, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexRune(s, ','); i >= 0 && !strings.HasPrefix(s[i+1:], "[") {
+		s = s[:i+1] + "[" + s[i+1:] + "]"
+	}
+	return addrFromString(s)
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+func TestDNSResolver(t *testing.T) {
+	server := startDNSStub(t, map[string][]string{
+		"host1.example.": {"scion=17-ffaa:0:1,192.168.1.1"},
+		"host2.example.": {"v=spf1 -all", "scion=18-ffaa:1:2,[10.0.8.10]"},
+		"host3.example.": {"scion=20-ffaa:c0ff:ee12,::ff1:ce00:dead:10cc:baad:f00d"},
+		"host4.example.": {"scion=invalid", "scion=17-ffaa:0:1,192.168.1.4"},
+		"nosc.example.":  {"v=spf1 -all"},
+		"bad.example.":   {"scion=17-ffaa:0:1"},
+	})
+	defer server.Close()
+	resolver := NewDNSResolver(server.LocalAddr().String())
+
+	cases := []testCase{
+		{"host1.example.", mustParse("17-ffaa:0:1,[192.168.1.1]")},
+		{"host2.example.", mustParse("18-ffaa:1:2,[10.0.8.10]")},
+		{"host3.example.", mustParse("20-ffaa:c0ff:ee12,[::ff1:ce00:dead:10cc:baad:f00d]")},
+		{"host4.example.", mustParse("17-ffaa:0:1,[192.168.1.4]")},
+		{"nosc.example.", nil},
+		{"bad.example.", nil},
+		{"unknown.example.", nil},
+	}
+	testResolver(t, resolver, cases)
+
+	// Not found in DNS falls through to next resolver in list
+	list := ResolverList{
+		resolver,
+		dummyResolver{map[string]*snet.SCIONAddress{
+			"unknown.example.": mustParse("1-ff00:0:1,[192.0.2.1]"),
+		}},
+	}
+	testResolver(t, list, []testCase{
+		{"host1.example.", mustParse("17-ffaa:0:1,[192.168.1.1]")},
+		{"unknown.example.", mustParse("1-ff00:0:1,[192.0.2.1]")},
+	})
+}
+
+// startDNSStub starts a DNS server on localhost answering TXT queries with
+// the given records. Names not in records are answered with NXDOMAIN, other
+// query types with an empty answer.
+func startDNSStub(t *testing.T, records map[string][]string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply, err := dnsStubReply(buf[:n], records)
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(reply, from)
+		}
+	}()
+	return conn
+}
+
+func dnsStubReply(query []byte, records map[string][]string) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	txts, found := records[strings.ToLower(q.Name.String())]
+	rcode := dnsmessage.RCodeSuccess
+	if !found {
+		rcode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:            header.ID,
+		Response:      true,
+		Authoritative: true,
+		RCode:         rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if q.Type == dnsmessage.TypeTXT {
+		for _, txt := range txts {
+			err := b.TXTResource(dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Class: dnsmessage.ClassINET,
+				TTL:   60,
+			}, dnsmessage.TXTResource{TXT: []string{txt}})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Finish()
+}
@@ -19,15 +19,21 @@ import (
 	"net"
 	"regexp"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
 var (
-	resolveEtcHosts      Resolver = &hostsfileResolver{"/etc/hosts"}
-	resolveEtcScionHosts Resolver = &hostsfileResolver{"/etc/scion/hosts"}
+	resolveEtcHosts      Resolver = &hostsfileResolver{path: "/etc/hosts"}
+	resolveEtcScionHosts Resolver = &hostsfileResolver{path: "/etc/scion/hosts"}
 	resolveRains         Resolver = nil
+	// newRainsResolver creates a Resolver querying the given RAINS server, or
+	// the server configured in /etc/scion/rains.cfg if server is nil.
+	// nil if built with norains.
+	newRainsResolver func(server *snet.UDPAddr, timeout time.Duration) Resolver
 )
 
 var (
@@ -64,6 +70,17 @@ func ResolveUDPAddr(address string) (*snet.UDPAddr, error) {
 	return ResolveUDPAddrAt(address, DefaultResolver())
 }
 
+// ResolveUDPAddr parses the address and resolves the hostname using the
+// Resolver configured for this Network.
+// See ResolveUDPAddr.
+func (n *Network) ResolveUDPAddr(address string) (*snet.UDPAddr, error) {
+	resolver := n.resolver
+	if resolver == nil {
+		resolver = DefaultResolver()
+	}
+	return ResolveUDPAddrAt(address, resolver)
+}
+
 // ResolveUDPAddrAt parses the address and resolves the hostname.
 // The address can be of the form of a SCION address (i.e. of the form "ISD-AS,[IP]:port")
 // or in the form of "hostname:port".
@@ -82,7 +99,9 @@ func ResolveUDPAddrAt(address string, resolver Resolver) (*snet.UDPAddr, error)
 	if err != nil {
 		return nil, err
 	}
+	start := time.Now()
 	host, err := resolver.Resolve(hostStr)
+	observeResolve(start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -90,15 +109,99 @@ func ResolveUDPAddrAt(address string, resolver Resolver) (*snet.UDPAddr, error)
 	return &snet.UDPAddr{IA: ia, Host: &net.UDPAddr{IP: host.Host.IP(), Port: port}}, nil
 }
 
+// ReverseResolve looks up the host names for the address, using the
+// DefaultResolver. Reverse lookups are supported by the hosts files and RAINS.
+// Returns a HostNotFoundError if no name was found.
+func ReverseResolve(address *snet.SCIONAddress) ([]string, error) {
+	return ReverseResolveAt(address, DefaultResolver())
+}
+
+// ReverseResolve looks up the host names for the address, using the Resolver
+// configured for this Network.
+// See ReverseResolve.
+func (n *Network) ReverseResolve(address *snet.SCIONAddress) ([]string, error) {
+	resolver := n.resolver
+	if resolver == nil {
+		resolver = DefaultResolver()
+	}
+	return ReverseResolveAt(address, resolver)
+}
+
+// ReverseResolveAt looks up the host names for the address, using resolver.
+// Returns a HostNotFoundError if the resolver does not implement
+// ReverseResolver or if no name was found.
+func ReverseResolveAt(address *snet.SCIONAddress, resolver Resolver) ([]string, error) {
+	r, ok := resolver.(ReverseResolver)
+	if !ok {
+		return nil, &HostNotFoundError{address.String()}
+	}
+	return r.ReverseResolve(address)
+}
+
+// NamedAddr formats a SCION address for display, prefixed with its host name
+// if the DefaultResolver finds one, e.g. "server1 (17-ffaa:1:10,10.0.8.100:80)".
+// If no name is found, or if address is not a *snet.UDPAddr, this returns
+// address.String().
+func NamedAddr(address net.Addr) string {
+	return namedAddr(address, DefaultResolver())
+}
+
+// NamedAddr formats a SCION address for display, prefixed with its host name,
+// using the Resolver configured for this Network.
+// See NamedAddr.
+func (n *Network) NamedAddr(address net.Addr) string {
+	resolver := n.resolver
+	if resolver == nil {
+		resolver = DefaultResolver()
+	}
+	return namedAddr(address, resolver)
+}
+
+func namedAddr(address net.Addr, resolver Resolver) string {
+	a, ok := address.(*snet.UDPAddr)
+	if !ok || a == nil || a.Host == nil {
+		return fmt.Sprint(address)
+	}
+	names, err := ReverseResolveAt(&snet.SCIONAddress{IA: a.IA, Host: addr.HostFromIP(a.Host.IP)}, resolver)
+	if err != nil || len(names) == 0 {
+		return a.String()
+	}
+	return fmt.Sprintf("%s (%s)", names[0], a)
+}
+
 // DefaultResolver returns the default name resolver, used in ResolveUDPAddr.
-// It will use the following sources, in the given order of precedence, to
-// resolve a name:
+//
+// If a resolver configuration file exists at the path given by the
+// SCION_RESOLVER_CONFIG environment variable, or by default at
+// /etc/scion/resolver.toml, the resolvers are set up as configured in this
+// file, see LoadResolverConfig.
+// Otherwise, it will use the following sources, in the given order of
+// precedence, to resolve a name:
 //
 //  - /etc/hosts
 //  - /etc/scion/hosts
 //  - RAINS, if a server is configured in /etc/scion/rains.cfg.
 //    Disabled if built with !norains.
+//
+// The hosts files are only parsed again after they have been modified, and
+// the RAINS results are cached according to the validity of the answer, see
+// CachingResolver.
+//
+// The configuration file is loaded on the first call. If it can not be
+// loaded, the returned Resolver fails with the corresponding error.
 func DefaultResolver() Resolver {
+	defaultResolverOnce.Do(func() {
+		defaultResolver = loadDefaultResolver()
+	})
+	return defaultResolver
+}
+
+var (
+	defaultResolver     Resolver
+	defaultResolverOnce sync.Once
+)
+
+func builtinResolver() Resolver {
 	return ResolverList{
 		resolveEtcHosts,
 		resolveEtcScionHosts,
@@ -19,26 +19,37 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
 type hostsTable map[string]snet.SCIONAddress
 
+// hostsReverseTable maps addresses, formatted with reverseKey, to the host
+// names in the order in which they appear in the file.
+type hostsReverseTable map[string][]string
+
 // hostsfileResolver is an implementation of the resolver interface, backed
 // by an /etc/hosts-like file.
+// The parsed file is kept in memory and only reloaded when the modification
+// time or the size of the file changes.
 type hostsfileResolver struct {
 	path string
+
+	mutex   sync.Mutex
+	table   hostsTable
+	reverse hostsReverseTable
+	modTime time.Time
+	size    int64
 }
 
 // Resolve implements
 func (r *hostsfileResolver) Resolve(name string) (*snet.SCIONAddress, error) {
 
-	// Note: obviously not perfectly elegant to parse the entire file for
-	// every query. However, properly caching this and still always provide
-	// fresh results after changes to the hosts file seems like a bigger task and
-	// for now that would be overkill.
-	table, err := loadHostsFile(r.path)
+	table, _, err := r.hosts()
 	if err != nil {
 		return nil, fmt.Errorf("error loading %s: %s", r.path, err)
 	}
@@ -49,21 +60,59 @@ func (r *hostsfileResolver) Resolve(name string) (*snet.SCIONAddress, error) {
 	return &addr, nil
 }
 
-func loadHostsFile(path string) (hostsTable, error) {
+// ReverseResolve implements ReverseResolver.
+func (r *hostsfileResolver) ReverseResolve(address *snet.SCIONAddress) ([]string, error) {
+	_, reverse, err := r.hosts()
+	if err != nil {
+		return nil, fmt.Errorf("error loading %s: %s", r.path, err)
+	}
+	names, ok := reverse[reverseKey(address)]
+	if !ok {
+		return nil, &HostNotFoundError{address.String()}
+	}
+	return append([]string(nil), names...), nil
+}
+
+// hosts returns the tables of the hosts file, reloading the file if it has
+// been modified since it was last loaded.
+func (r *hostsfileResolver) hosts() (hostsTable, hostsReverseTable, error) {
+	info, err := os.Stat(r.path)
+	if os.IsNotExist(err) {
+		// not existing file treated like an empty file
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.table != nil && info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return r.table, r.reverse, nil
+	}
+	table, reverse, err := loadHostsFile(r.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.table, r.reverse, r.modTime, r.size = table, reverse, info.ModTime(), info.Size()
+	return table, reverse, nil
+}
+
+func loadHostsFile(path string) (hostsTable, hostsReverseTable, error) {
 	file, err := os.Open(path)
 	if os.IsNotExist(err) {
 		// not existing file treated like an empty file,
 		// just return an empty table
-		return nil, nil
+		return nil, nil, nil
 	} else if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer file.Close()
 	return parseHostsFile(file)
 }
 
-func parseHostsFile(file *os.File) (hostsTable, error) {
+func parseHostsFile(file *os.File) (hostsTable, hostsReverseTable, error) {
 	hosts := make(hostsTable)
+	reverse := make(hostsReverseTable)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -85,11 +134,35 @@ func parseHostsFile(file *os.File) (hostsTable, error) {
 				continue
 			}
 
-			// map hostnames to scionAddress
+			// map hostnames to scionAddress, and back
+			key := reverseKey(&addr)
 			for _, name := range fields[1:] {
 				hosts[name] = addr
+				if !containsString(reverse[key], name) {
+					reverse[key] = append(reverse[key], name)
+				}
 			}
 		}
 	}
-	return hosts, scanner.Err()
+	return hosts, reverse, scanner.Err()
+}
+
+// reverseKey returns the key for the address in a hostsReverseTable.
+// The host address is normalized, e.g. IPv4-mapped IPv6 addresses are
+// represented as IPv4 addresses.
+func reverseKey(address *snet.SCIONAddress) string {
+	host := address.Host
+	if ip := host.IP(); ip != nil {
+		host = addr.HostFromIP(ip)
+	}
+	return fmt.Sprintf("%s,%s", address.IA, host)
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
 }
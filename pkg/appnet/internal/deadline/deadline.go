@@ -0,0 +1,87 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package deadline implements read deadlines for the conns of appnet and
+// appnettest that receive their packets from a channel.
+package deadline
+
+import (
+	"sync"
+	"time"
+)
+
+// TimeoutError is returned when a read deadline expires.
+type TimeoutError struct{}
+
+func (TimeoutError) Error() string   { return "i/o timeout" }
+func (TimeoutError) Timeout() bool   { return true }
+func (TimeoutError) Temporary() bool { return true }
+
+// Deadline is a read deadline that can be changed while a read is blocked.
+// The zero value is a Deadline that is not set.
+type Deadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline expires
+}
+
+// Set sets the deadline; the zero time clears it.
+func (d *Deadline) Set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	select {
+	case <-d.cancel:
+		d.cancel = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return
+	}
+	cancel := d.cancel
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(cancel)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(dur, func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.timer == timer {
+			close(cancel)
+			d.timer = nil
+		}
+	})
+	d.timer = timer
+}
+
+// Wait returns a channel that is closed when the deadline expires.
+// The channel changes when the deadline is set, so it must be obtained anew
+// for each read.
+func (d *Deadline) Wait() <-chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	return d.cancel
+}
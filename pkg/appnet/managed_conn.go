@@ -0,0 +1,262 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+const (
+	// pathExpiryMargin is the minimum remaining lifetime of a path used by a
+	// ManagedConn. Paths expiring sooner are replaced before sending.
+	pathExpiryMargin = 10 * time.Second
+)
+
+// ManagedConn is a connected SCION/UDP socket that automatically switches to
+// a different path when the current path expires or when one of its
+// interfaces is revoked.
+//
+// Revocations are received as SCMP messages on the connection; they are
+// handled during Read/ReadFrom and are not returned to the application.
+// The path is only checked and replaced when writing, so a ManagedConn that
+// is only used for reading will not switch paths.
+type ManagedConn struct {
+	*snet.Conn
+	network *Network
+
+	// ia is the IA of the remote
+	ia addr.IA
+
+	mutex   sync.Mutex
+	raddr   *snet.UDPAddr
+	path    snet.Path
+	revoked map[snet.PathInterface]time.Time
+}
+
+// DialManaged connects to the address (on the SCION/UDP network) and returns a
+// ManagedConn that keeps the path up to date.
+// The address can be of the form of a SCION address (i.e. of the form "ISD-AS,[IP]:port")
+// or in the form of hostname:port.
+func DialManaged(address string) (*ManagedConn, error) {
+	return DefNetwork().DialManaged(address)
+}
+
+// DialManaged connects to the address using a ManagedConn.
+// See DialManaged.
+func (n *Network) DialManaged(address string) (*ManagedConn, error) {
+	raddr, err := n.ResolveUDPAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	return n.DialAddrManaged(raddr, nil)
+}
+
+// DialAddrManaged connects to the address (on the SCION/UDP network) and returns a
+// ManagedConn that keeps the path up to date.
+//
+// The path is used initially; if path is nil, the first usable path returned by
+// QueryPaths is chosen. Any path set in raddr is ignored.
+func DialAddrManaged(raddr *snet.UDPAddr, path snet.Path) (*ManagedConn, error) {
+	return DefNetwork().DialAddrManaged(raddr, path)
+}
+
+// DialAddrManaged connects to the address using a ManagedConn.
+// See DialAddrManaged.
+func (n *Network) DialAddrManaged(raddr *snet.UDPAddr, path snet.Path) (*ManagedConn, error) {
+	c := &ManagedConn{
+		network: n,
+		ia:      raddr.IA,
+		raddr:   raddr.Copy(),
+		revoked: make(map[snet.PathInterface]time.Time),
+	}
+	if raddr.IA != n.IA {
+		if path == nil {
+			if err := c.switchPath(); err != nil {
+				return nil, err
+			}
+		} else {
+			c.setPath(path)
+		}
+	}
+	conn, err := n.DialAddr(c.raddr)
+	if err != nil {
+		return nil, err
+	}
+	c.Conn = conn
+	return c, nil
+}
+
+// Path returns the path currently used by the connection.
+// Returns nil if the remote is in the local IA.
+func (c *ManagedConn) Path() snet.Path {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.path
+}
+
+// RemoteAddr returns the remote address, including the current path.
+func (c *ManagedConn) RemoteAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.raddr.Copy()
+}
+
+// MaxPayload returns the maximum size of the payload of the packets written on
+// the current path, see Network.MaxPayload.
+func (c *ManagedConn) MaxPayload() int {
+	return c.network.MaxPayload(c.RemoteAddr().(*snet.UDPAddr))
+}
+
+// ProbeMaxPayload discovers the path MTU of the current path and returns the
+// maximum size of the payload of the packets written on it, see
+// Network.ProbeMaxPayload.
+func (c *ManagedConn) ProbeMaxPayload(ctx context.Context) (int, error) {
+	return c.network.ProbeMaxPayload(ctx, c.RemoteAddr().(*snet.UDPAddr))
+}
+
+// Write writes to the remote, on the current path.
+// If the current path has expired or was revoked, it is first replaced by
+// another path.
+func (c *ManagedConn) Write(b []byte) (int, error) {
+	raddr, err := c.remote()
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.WriteTo(b, raddr)
+}
+
+// Read reads from the connection.
+// Path down errors (see SCMPError) are handled internally and are not
+// returned; other SCMP errors are returned.
+func (c *ManagedConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// ReadFrom reads from the connection.
+// Path down errors (see SCMPError) are handled internally and are not
+// returned; other SCMP errors are returned.
+func (c *ManagedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.Conn.ReadFrom(b)
+		var scmpErr *SCMPError
+		if errors.As(err, &scmpErr) && scmpErr.Interface != nil {
+			c.handleRevocation(*scmpErr.Interface)
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+// remote returns the remote address to use for the next packet, replacing the
+// current path if necessary.
+func (c *ManagedConn) remote() (*snet.UDPAddr, error) {
+	c.mutex.Lock()
+	usable := c.path == nil || c.isUsable(c.path, time.Now())
+	raddr := c.raddr
+	c.mutex.Unlock()
+	if usable {
+		return raddr, nil
+	}
+	if err := c.switchPath(); err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.raddr, nil
+}
+
+// handleRevocation records the revoked interface and switches away from the
+// current path if it is affected.
+func (c *ManagedConn) handleRevocation(iface snet.PathInterface) {
+	c.mutex.Lock()
+	c.revoked[iface] = time.Now().Add(scmpRevocationTTL)
+	log.Debug("ManagedConn: received revocation", "interface", iface)
+	affected := c.path != nil && !c.isUsable(c.path, time.Now())
+	c.mutex.Unlock()
+	if affected {
+		if err := c.switchPath(); err != nil {
+			log.Debug("ManagedConn: unable to switch path after revocation", "err", err)
+		}
+	}
+}
+
+// switchPath replaces the current path by the first usable path returned by
+// QueryPaths, unless the current path is usable, e.g. because it was already
+// replaced concurrently.
+// The paths are queried without holding c.mutex, so that the query does not
+// block the conn.
+func (c *ManagedConn) switchPath() error {
+	paths, err := c.network.QueryPaths(c.ia)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if c.path != nil && c.isUsable(c.path, now) {
+		return nil
+	}
+	for _, p := range paths {
+		if c.isUsable(p, now) {
+			log.Debug("ManagedConn: switching path", "old", c.path, "new", p)
+			c.setPath(p)
+			observePathSwitch(c.ia)
+			return nil
+		}
+	}
+	return fmt.Errorf("no usable path to %s", c.ia)
+}
+
+// setPath sets the current path.
+// Must be called with c.mutex held.
+func (c *ManagedConn) setPath(path snet.Path) {
+	raddr := c.raddr.Copy()
+	SetPath(raddr, path)
+	c.raddr = raddr
+	c.path = path
+}
+
+// isUsable returns true if the path does not expire soon and does not
+// traverse any revoked interface.
+// Must be called with c.mutex held.
+func (c *ManagedConn) isUsable(path snet.Path, now time.Time) bool {
+	md := path.Metadata()
+	if md == nil {
+		return true
+	}
+	if !md.Expiry.IsZero() && md.Expiry.Before(now.Add(pathExpiryMargin)) {
+		return false
+	}
+	for _, iface := range md.Interfaces {
+		if expiry, ok := c.revoked[iface]; ok {
+			if expiry.After(now) {
+				return false
+			}
+			delete(c.revoked, iface)
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+func TestManagedConnIsUsable(t *testing.T) {
+	now := time.Now()
+	ia := addr.IA{I: 1, A: 0xff0000000110}
+	ifA := snet.PathInterface{IA: ia, ID: common.IFIDType(1)}
+	ifB := snet.PathInterface{IA: ia, ID: common.IFIDType(2)}
+
+	c := &ManagedConn{revoked: make(map[snet.PathInterface]time.Time)}
+
+	valid := &mockPath{metadata: &snet.PathMetadata{
+		Interfaces: []snet.PathInterface{ifA},
+		Expiry:     now.Add(time.Hour),
+	}}
+	expiring := &mockPath{metadata: &snet.PathMetadata{
+		Interfaces: []snet.PathInterface{ifB},
+		Expiry:     now.Add(pathExpiryMargin / 2),
+	}}
+	if !c.isUsable(valid, now) {
+		t.Errorf("valid path not usable")
+	}
+	if c.isUsable(expiring, now) {
+		t.Errorf("expiring path usable")
+	}
+
+	c.revoked[ifA] = now.Add(time.Minute)
+	if c.isUsable(valid, now) {
+		t.Errorf("path with revoked interface usable")
+	}
+	if !c.isUsable(valid, now.Add(2*time.Minute)) {
+		t.Errorf("path with expired revocation not usable")
+	}
+	if _, ok := c.revoked[ifA]; ok {
+		t.Errorf("expired revocation not removed")
+	}
+}
+
+// mockPath satisfies the snet.Path interface, with configurable metadata.
+type mockPath struct {
+	metadata *snet.PathMetadata
+}
+
+func (p *mockPath) UnderlayNextHop() *net.UDPAddr { return nil }
+func (p *mockPath) Path() spath.Path              { return spath.Path{} }
+func (p *mockPath) Destination() addr.IA          { return addr.IA{} }
+func (p *mockPath) Metadata() *snet.PathMetadata  { return p.metadata }
+func (p *mockPath) Copy() snet.Path               { return p }
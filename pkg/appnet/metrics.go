@@ -0,0 +1,348 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/slayers"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/sock/reliable"
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+// Values of the path label for traffic that is not sent over a known path.
+const (
+	// metricsPathLocal is the path label for traffic within the local AS.
+	metricsPathLocal = "local"
+	// metricsPathUnknown is the path label for traffic over a path that was
+	// not obtained from a path query of this process, e.g. replies of a
+	// server.
+	metricsPathUnknown = "unknown"
+)
+
+var (
+	metricPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "appnet",
+		Name:      "packets_total",
+		Help:      "Number of SCION packets sent and received, by remote IA and path fingerprint.",
+	}, []string{"direction", "ia", "path"})
+	metricBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "appnet",
+		Name:      "bytes_total",
+		Help:      "Size of the SCION packets sent and received, including headers, by remote IA and path fingerprint.",
+	}, []string{"direction", "ia", "path"})
+	metricPathSwitches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "appnet",
+		Name:      "path_switches_total",
+		Help:      "Number of times a connection changed its path(s) to a remote IA, e.g. after a revocation.",
+	}, []string{"ia"})
+	metricResolveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "appnet",
+		Name:      "resolve_duration_seconds",
+		Help:      "Duration of host name lookups.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"result"})
+	metricPathQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "appnet",
+		Name:      "path_query_duration_seconds",
+		Help:      "Duration of path queries to sciond, by destination IA.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"ia", "result"})
+)
+
+// metricsEnabled is set (to 1) by EnableMetrics.
+var metricsEnabled int32
+
+// EnableMetrics enables the collection of metrics on the traffic and the path
+// and name lookups of all Networks. Only the traffic of conns created after
+// EnableMetrics is counted.
+//
+// The metrics are:
+//
+//	appnet_packets_total{direction,ia,path}
+//	appnet_bytes_total{direction,ia,path}
+//	appnet_path_switches_total{ia}
+//	appnet_resolve_duration_seconds{result}
+//	appnet_path_query_duration_seconds{ia,result}
+//
+// where direction is "in" or "out", ia is the remote IA and path is the
+// fingerprint of the path (see PathInfo), "local" for traffic in the local AS
+// or "unknown" for traffic over paths not looked up by this process, e.g. the
+// replies sent by a server.
+//
+// Use MetricsHandler or ServeMetrics to export the metrics.
+func EnableMetrics() {
+	atomic.StoreInt32(&metricsEnabled, 1)
+}
+
+func metricsOn() bool {
+	return atomic.LoadInt32(&metricsEnabled) != 0
+}
+
+// RegisterMetrics registers the appnet metrics with r, e.g. with the
+// prometheus.DefaultRegisterer for applications that export their own
+// metrics.
+func RegisterMetrics(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		metricPackets,
+		metricBytes,
+		metricPathSwitches,
+		metricResolveDuration,
+		metricPathQueryDuration,
+	} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetricsHandler enables the collection of metrics and returns an HTTP
+// handler exporting the appnet metrics, together with the Go runtime and
+// process metrics, in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	EnableMetrics()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	if err := RegisterMetrics(registry); err != nil {
+		panic(err) // only fails for duplicate registrations on a fresh registry
+	}
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// ServeMetrics enables the collection of metrics and serves them on the
+// (TCP/IP) address at the path /metrics, in the background, see
+// MetricsHandler.
+// An error is returned if the address can not be bound.
+func ServeMetrics(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Error("Serving metrics failed", "address", address, "err", err)
+		}
+	}()
+	return nil
+}
+
+// observeResolve records the duration of a host name lookup started at start.
+func observeResolve(start time.Time, err error) {
+	if !metricsOn() {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		var notFound *HostNotFoundError
+		if errors.As(err, &notFound) {
+			result = "not_found"
+		} else {
+			result = "error"
+		}
+	}
+	metricResolveDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// observePathQuery records the duration of a path query started at start.
+func observePathQuery(ia addr.IA, start time.Time, err error) {
+	if !metricsOn() {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricPathQueryDuration.WithLabelValues(ia.String(), result).Observe(time.Since(start).Seconds())
+}
+
+// observePathSwitch records that a connection changed its path(s) to ia.
+func observePathSwitch(ia addr.IA) {
+	if !metricsOn() {
+		return
+	}
+	metricPathSwitches.WithLabelValues(ia.String()).Inc()
+}
+
+// metricsPathLabel returns the path label for traffic over the path.
+// For received packets, the path is reversed first.
+func metricsPathLabel(p spath.Path, received bool) string {
+	if p.IsEmpty() {
+		return metricsPathLocal
+	}
+	if received {
+		p = p.Copy()
+		if err := p.Reverse(); err != nil {
+			return metricsPathUnknown
+		}
+	}
+	if known := lookupPath(p); known != nil {
+		return known.fingerprint
+	}
+	return metricsPathUnknown
+}
+
+// metricsDispatcher wraps the connections registered with the dispatcher, to
+// count the packets sent and received if metrics are enabled.
+type metricsDispatcher struct {
+	reliable.Dispatcher
+}
+
+func (d *metricsDispatcher) Register(ctx context.Context, ia addr.IA, address *net.UDPAddr,
+	svc addr.HostSVC) (net.PacketConn, uint16, error) {
+
+	conn, port, err := d.Dispatcher.Register(ctx, ia, address, svc)
+	if err != nil || !metricsOn() {
+		return conn, port, err
+	}
+	return &metricsConn{PacketConn: conn}, port, nil
+}
+
+// maxMetricsConnCounters is the number of distinct remote IAs and paths per
+// metricsConn above which the cached counters are dropped.
+const maxMetricsConnCounters = 1024
+
+// metricsConn counts the SCION packets read from and written to the
+// underlying connection to the dispatcher.
+// The counters are cached per remote IA and raw dataplane path, so that the
+// packets only need to be decoded and matched against the known paths (see
+// metricsPathLabel) for the first packet over a path. The cache is dropped
+// when the known paths change.
+type metricsConn struct {
+	net.PacketConn
+
+	mutex      sync.Mutex
+	generation uint64
+	counters   map[string]packetCounters
+	key        []byte
+}
+
+type packetCounters struct {
+	packets prometheus.Counter
+	bytes   prometheus.Counter
+}
+
+func (c *metricsConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.countPacket(b[:n], true)
+	}
+	return n, from, err
+}
+
+func (c *metricsConn) WriteTo(b []byte, to net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, to)
+	if err == nil {
+		c.countPacket(b, false)
+	}
+	return n, err
+}
+
+func (c *metricsConn) writePackets(pkts [][]byte, nextHop *net.UDPAddr) error {
+	if err := writePackets(c.PacketConn, pkts, nextHop); err != nil {
+		return err
+	}
+	for _, pkt := range pkts {
+		c.countPacket(pkt, false)
+	}
+	return nil
+}
+
+func (c *metricsConn) countPacket(raw []byte, received bool) {
+	c.mutex.Lock()
+	var ok bool
+	c.key, ok = appendPacketKey(c.key[:0], raw, received)
+	if !ok {
+		c.mutex.Unlock()
+		return
+	}
+	generation := atomic.LoadUint64(&knownPathsGeneration)
+	if c.counters == nil || c.generation != generation || len(c.counters) >= maxMetricsConnCounters {
+		c.counters = make(map[string]packetCounters)
+		c.generation = generation
+	}
+	counters, ok := c.counters[string(c.key)]
+	if !ok {
+		counters, ok = newPacketCounters(raw, received)
+		if !ok {
+			c.mutex.Unlock()
+			return
+		}
+		c.counters[string(c.key)] = counters
+	}
+	c.mutex.Unlock()
+	counters.packets.Inc()
+	counters.bytes.Add(float64(len(raw)))
+}
+
+// appendPacketKey appends the key identifying the remote IA and the raw path
+// of the packet to key, without decoding the packet. Returns false if the
+// packet is too short.
+func appendPacketKey(key []byte, raw []byte, received bool) ([]byte, bool) {
+	const iaOffset = slayers.CmnHdrLen
+	if len(raw) < slayers.CmnHdrLen+2*addr.IABytes {
+		return key, false
+	}
+	hdrLen := int(raw[5]) * slayers.LineLen
+	dstAddrLen := int(raw[9]>>4&0x3+1) * slayers.LineLen
+	srcAddrLen := int(raw[9]&0x3+1) * slayers.LineLen
+	pathOffset := slayers.CmnHdrLen + 2*addr.IABytes + dstAddrLen + srcAddrLen
+	if pathOffset > hdrLen || hdrLen > len(raw) {
+		return key, false
+	}
+	remoteIA := raw[iaOffset : iaOffset+addr.IABytes]
+	direction := byte(0)
+	if received {
+		remoteIA = raw[iaOffset+addr.IABytes : iaOffset+2*addr.IABytes]
+		direction = 1
+	}
+	key = append(key, direction, raw[8])
+	key = append(key, remoteIA...)
+	key = append(key, raw[pathOffset:hdrLen]...)
+	return key, true
+}
+
+// newPacketCounters decodes the packet and returns the counters for its
+// direction, remote IA and path.
+func newPacketCounters(raw []byte, received bool) (packetCounters, bool) {
+	pkt := &snet.Packet{Bytes: raw}
+	if err := pkt.Decode(); err != nil {
+		return packetCounters{}, false
+	}
+	direction, remote := "out", pkt.Destination.IA
+	if received {
+		direction, remote = "in", pkt.Source.IA
+	}
+	path := metricsPathLabel(pkt.Path, received)
+	return packetCounters{
+		packets: metricPackets.WithLabelValues(direction, remote.String(), path),
+		bytes:   metricBytes.WithLabelValues(direction, remote.String(), path),
+	}, true
+}
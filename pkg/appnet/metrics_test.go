@@ -0,0 +1,154 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/slayers/path"
+	"github.com/scionproto/scion/go/lib/slayers/path/scion"
+	"github.com/scionproto/scion/go/lib/snet"
+	snetpath "github.com/scionproto/scion/go/lib/snet/path"
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+func serializeSCIONPath(t *testing.T, d *scion.Decoded) spath.Path {
+	raw := make([]byte, d.Len())
+	if err := d.SerializeTo(raw); err != nil {
+		t.Fatal(err)
+	}
+	return spath.Path{Raw: raw, Type: scion.PathType}
+}
+
+func newTestDecodedPath() *scion.Decoded {
+	return &scion.Decoded{
+		Base: scion.Base{
+			PathMeta: scion.MetaHdr{SegLen: [3]uint8{2, 2, 0}},
+			NumINF:   2,
+			NumHops:  4,
+		},
+		InfoFields: []*path.InfoField{
+			{SegID: 0x111, Timestamp: 1},
+			{SegID: 0x222, Timestamp: 2, ConsDir: true},
+		},
+		HopFields: []*path.HopField{
+			{ConsIngress: 0, ConsEgress: 1, Mac: []byte{1, 1, 1, 1, 1, 1}},
+			{ConsIngress: 2, ConsEgress: 0, Mac: []byte{2, 2, 2, 2, 2, 2}},
+			{ConsIngress: 0, ConsEgress: 3, Mac: []byte{3, 3, 3, 3, 3, 3}},
+			{ConsIngress: 4, ConsEgress: 0, Mac: []byte{4, 4, 4, 4, 4, 4}},
+		},
+	}
+}
+
+func TestMetricsPathLabel(t *testing.T) {
+	newDecoded := newTestDecodedPath
+	forward := serializeSCIONPath(t, newDecoded())
+	p := snetpath.Path{
+		Dst:   addr.IA{I: 1, A: 0xff0000000112},
+		SPath: forward,
+		Meta: snet.PathMetadata{Interfaces: []snet.PathInterface{
+			{IA: addr.IA{I: 1, A: 0xff0000000110}, ID: 1},
+			{IA: addr.IA{I: 1, A: 0xff0000000112}, ID: 2},
+		}},
+	}
+	recordPaths([]snet.Path{p})
+	fingerprint := snet.Fingerprint(p).String()
+
+	if label := metricsPathLabel(forward, false); label != fingerprint {
+		t.Errorf("expected fingerprint %s for sent packet, got %s", fingerprint, label)
+	}
+
+	// The reply is sent on the reversed path, with the segment IDs and
+	// pointers updated by the routers on the way.
+	reply := newDecoded()
+	if _, err := reply.Reverse(); err != nil {
+		t.Fatal(err)
+	}
+	reply.InfoFields[0].SegID = 0x333
+	reply.InfoFields[1].SegID = 0x444
+	reply.PathMeta.CurrINF = 1
+	reply.PathMeta.CurrHF = 3
+	if label := metricsPathLabel(serializeSCIONPath(t, reply), true); label != fingerprint {
+		t.Errorf("expected fingerprint %s for received packet, got %s", fingerprint, label)
+	}
+
+	other := newDecoded()
+	other.HopFields[1].Mac = []byte{5, 5, 5, 5, 5, 5}
+	if label := metricsPathLabel(serializeSCIONPath(t, other), false); label != metricsPathUnknown {
+		t.Errorf("expected %s for unknown path, got %s", metricsPathUnknown, label)
+	}
+	if label := metricsPathLabel(spath.Path{}, true); label != metricsPathLocal {
+		t.Errorf("expected %s for empty path, got %s", metricsPathLocal, label)
+	}
+}
+
+func TestMetricsConnCounters(t *testing.T) {
+	src := addr.IA{I: 1, A: 0xff0000000120}
+	dst := addr.IA{I: 1, A: 0xff0000000122}
+	d := newTestDecodedPath()
+	// distinct from other tests and from previous runs, as the known paths and
+	// the metrics are global
+	d.HopFields[0].Mac = make([]byte, 6)
+	rand.Read(d.HopFields[0].Mac)
+	forward := serializeSCIONPath(t, d)
+	pkt := &snet.Packet{PacketInfo: snet.PacketInfo{
+		Source:      snet.SCIONAddress{IA: src, Host: addr.HostFromIP(net.IPv4(127, 0, 0, 1))},
+		Destination: snet.SCIONAddress{IA: dst, Host: addr.HostFromIP(net.IPv4(127, 0, 0, 2))},
+		Path:        forward,
+		Payload:     snet.UDPPayload{SrcPort: 1, DstPort: 2, Payload: []byte("hello")},
+	}}
+	if err := pkt.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	p := snetpath.Path{
+		Dst:   dst,
+		SPath: forward,
+		Meta: snet.PathMetadata{Interfaces: []snet.PathInterface{
+			{IA: src, ID: 1},
+			{IA: dst, ID: 2},
+		}},
+	}
+	unknown := metricPackets.WithLabelValues("out", dst.String(), metricsPathUnknown)
+	known := metricPackets.WithLabelValues("out", dst.String(), snet.Fingerprint(p).String())
+	unknownBefore, knownBefore := testutil.ToFloat64(unknown), testutil.ToFloat64(known)
+
+	c := &metricsConn{}
+	c.countPacket(pkt.Bytes, false)
+	c.countPacket(pkt.Bytes, false)
+	if v := testutil.ToFloat64(unknown) - unknownBefore; v != 2 {
+		t.Errorf("expected 2 packets over unknown path, got %v", v)
+	}
+	if len(c.counters) != 1 {
+		t.Errorf("expected 1 cached counter, got %d", len(c.counters))
+	}
+
+	// once the path is known, the cached counter is replaced
+	recordPaths([]snet.Path{p})
+	c.countPacket(pkt.Bytes, false)
+	if v := testutil.ToFloat64(known) - knownBefore; v != 1 {
+		t.Errorf("expected 1 packet over known path, got %v", v)
+	}
+	if v := testutil.ToFloat64(unknown) - unknownBefore; v != 2 {
+		t.Errorf("expected unchanged count for unknown path, got %v", v)
+	}
+
+	// truncated packets are ignored
+	c.countPacket(pkt.Bytes[:10], false)
+}
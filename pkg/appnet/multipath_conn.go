@@ -0,0 +1,334 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/pathpol"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// MultipathConfig contains the parameters for NewMultipathConn.
+type MultipathConfig struct {
+	// NewSelector creates the PathSelector for each destination IA.
+	// Defaults to round-robin path selection.
+	NewSelector func() PathSelector
+	// PathPolicy is applied in addition to the path policy of the Network.
+	// Optional.
+	PathPolicy *pathpol.Policy
+}
+
+// MultipathConn is a wrapper around snet.Conn that overrides its WriteTo
+// function, so that it chooses the path(s) on which the packet is written.
+// The paths are chosen by a PathSelector for each destination IA.
+//
+// When one of the interfaces of a path is revoked, the affected selectors are
+// reset with the remaining paths. If no path remains, the paths are queried
+// again on the next write.
+// The selectors are also reset whenever the paths are refreshed in the path
+// cache of the Network, so that expired paths are replaced.
+type MultipathConn struct {
+	net.PacketConn
+	network   *Network
+	conf      MultipathConfig
+	mutex     sync.Mutex
+	selectors map[addr.IA]*selectorEntry
+	// pending is closed when the selector under construction for the IA is
+	// installed.
+	pending map[addr.IA]chan struct{}
+	closed  bool
+}
+
+type selectorEntry struct {
+	selector    PathSelector
+	dst         *snet.UDPAddr
+	paths       []snet.Path
+	unsubscribe func()
+	// updates counts the path updates from the path cache, to discard the
+	// selectors constructed for outdated paths.
+	updates int
+}
+
+// NewMultipathConn constructs a MultipathConn, on a conn from the default Network.
+func NewMultipathConn(c *snet.Conn, conf MultipathConfig) *MultipathConn {
+	return DefNetwork().NewMultipathConn(c, conf)
+}
+
+// NewMultipathConn constructs a MultipathConn, on a conn from this Network.
+// See NewMultipathConn.
+func (n *Network) NewMultipathConn(c *snet.Conn, conf MultipathConfig) *MultipathConn {
+	if conf.NewSelector == nil {
+		conf.NewSelector = func() PathSelector { return &RoundRobinSelector{} }
+	}
+	return &MultipathConn{
+		PacketConn: c,
+		network:    n,
+		conf:       conf,
+		selectors:  make(map[addr.IA]*selectorEntry),
+		pending:    make(map[addr.IA]chan struct{}),
+	}
+}
+
+// WriteTo wraps snet.Conn.WriteTo, sending the packet on the path(s) chosen
+// by the selector for the destination.
+// The path in raddr is ignored.
+func (c *MultipathConn) WriteTo(b []byte, raddr net.Addr) (int, error) {
+	address, ok := raddr.(*snet.UDPAddr)
+	if !ok {
+		return 0, errors.New("unable to write to non-SCION address")
+	}
+
+	paths, err := c.nextPaths(address)
+	if err != nil {
+		return 0, err
+	}
+	if len(paths) == 0 { // local IA
+		dst := address.Copy()
+		SetPath(dst, nil)
+		return c.PacketConn.WriteTo(b, dst)
+	}
+	// For multiple paths, the write succeeds if the packet was sent on any path
+	var firstErr error
+	sent := false
+	for _, path := range paths {
+		dst := address.Copy()
+		SetPath(dst, path)
+		if _, err := c.PacketConn.WriteTo(b, dst); err != nil {
+			log.Debug("MultipathConn: write failed", "path", path, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent = true
+	}
+	if !sent {
+		return 0, firstErr
+	}
+	return len(b), nil
+}
+
+// Close closes the underlying conn and cancels the path subscriptions.
+func (c *MultipathConn) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	for ia := range c.selectors {
+		c.removeSelector(ia)
+	}
+	c.mutex.Unlock()
+	return c.PacketConn.Close()
+}
+
+// ReadFrom wraps snet.Conn.ReadFrom.
+// Path down errors (see SCMPError) are handled internally and are not
+// returned; other SCMP errors are returned.
+func (c *MultipathConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		var scmpErr *SCMPError
+		if errors.As(err, &scmpErr) && scmpErr.Interface != nil {
+			c.handleRevocation(*scmpErr.Interface)
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+// nextPaths returns the paths for the next packet to address, from the
+// selector for the destination IA. The selector is constructed on the first
+// packet to the IA; as this may involve querying and probing the paths, it is
+// done without holding c.mutex, and concurrent writes to the same IA wait for
+// it.
+func (c *MultipathConn) nextPaths(address *snet.UDPAddr) ([]snet.Path, error) {
+	ia := address.IA
+	if ia == c.network.IA {
+		return nil, nil
+	}
+	for {
+		c.mutex.Lock()
+		if entry, ok := c.selectors[ia]; ok {
+			paths := entry.selector.Next()
+			c.mutex.Unlock()
+			return paths, nil
+		}
+		if pending, ok := c.pending[ia]; ok {
+			c.mutex.Unlock()
+			<-pending
+			continue
+		}
+		pending := make(chan struct{})
+		c.pending[ia] = pending
+		c.mutex.Unlock()
+
+		entry, err := c.constructSelector(address)
+
+		c.mutex.Lock()
+		delete(c.pending, ia)
+		close(pending)
+		if err != nil {
+			c.mutex.Unlock()
+			return nil, err
+		}
+		if c.closed {
+			c.mutex.Unlock()
+			return nil, errors.New("use of closed MultipathConn")
+		}
+		c.installSelector(ia, entry)
+		paths := entry.selector.Next()
+		c.mutex.Unlock()
+		return paths, nil
+	}
+}
+
+// installSelector installs the selector entry for ia and subscribes to the
+// updates of the paths.
+// Must be called with c.mutex held.
+func (c *MultipathConn) installSelector(ia addr.IA, entry *selectorEntry) {
+	c.selectors[ia] = entry
+	entry.unsubscribe = c.network.SubscribePaths(ia, func(paths []snet.Path) {
+		c.updatePaths(ia, entry, paths)
+	})
+}
+
+// removeSelector removes the selector for ia.
+// Must be called with c.mutex held.
+func (c *MultipathConn) removeSelector(ia addr.IA) {
+	if entry, ok := c.selectors[ia]; ok {
+		if entry.unsubscribe != nil {
+			entry.unsubscribe()
+		}
+		delete(c.selectors, ia)
+	}
+}
+
+// updatePaths replaces the selector of the entry by a new selector for the
+// refreshed paths from the path cache.
+// As constructing the selector may involve probing the paths, it is done in
+// the background, without holding c.mutex; updatePaths is called from the
+// refresh of the path cache and must return quickly.
+func (c *MultipathConn) updatePaths(ia addr.IA, entry *selectorEntry, paths []snet.Path) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.selectors[ia] != entry {
+		return
+	}
+	entry.updates++
+	update := entry.updates
+	paths = c.conf.PathPolicy.Filter(paths)
+	if len(paths) == 0 {
+		// Query again on next write
+		c.removeSelector(ia)
+		return
+	}
+	log.Debug("MultipathConn: updating paths", "ia", ia, "paths", len(paths))
+	dst := entry.dst
+	go func() {
+		selector := c.conf.NewSelector()
+		err := selector.Reset(dst, paths)
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.selectors[ia] != entry || entry.updates != update {
+			return
+		}
+		if err != nil {
+			c.removeSelector(ia)
+			return
+		}
+		entry.selector = selector
+		entry.paths = paths
+	}()
+}
+
+func (c *MultipathConn) constructSelector(address *snet.UDPAddr) (*selectorEntry, error) {
+
+	paths, err := c.queryPaths(address.IA)
+	if err != nil {
+		return nil, err
+	}
+	entry := &selectorEntry{
+		selector: c.conf.NewSelector(),
+		dst:      address.Copy(),
+		paths:    paths,
+	}
+	if err := entry.selector.Reset(entry.dst, paths); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (c *MultipathConn) queryPaths(ia addr.IA) ([]snet.Path, error) {
+	paths, err := c.network.QueryPaths(ia)
+	if err != nil {
+		return nil, err
+	}
+	paths = c.conf.PathPolicy.Filter(paths)
+	if len(paths) == 0 {
+		return nil, errNoPaths
+	}
+	return paths, nil
+}
+
+// handleRevocation removes the paths traversing the revoked interface from
+// all affected selectors.
+func (c *MultipathConn) handleRevocation(iface snet.PathInterface) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for ia, entry := range c.selectors {
+		remaining := make([]snet.Path, 0, len(entry.paths))
+		for _, p := range entry.paths {
+			if !pathContainsInterface(p, iface) {
+				remaining = append(remaining, p)
+			}
+		}
+		if len(remaining) == len(entry.paths) {
+			continue
+		}
+		log.Debug("MultipathConn: removing revoked paths", "ia", ia, "interface", iface,
+			"remaining", len(remaining))
+		observePathSwitch(ia)
+		if len(remaining) == 0 {
+			// Nothing left, query again on next write
+			c.removeSelector(ia)
+			continue
+		}
+		if err := entry.selector.Reset(entry.dst, remaining); err != nil {
+			c.removeSelector(ia)
+			continue
+		}
+		entry.paths = remaining
+	}
+}
+
+func pathContainsInterface(path snet.Path, iface snet.PathInterface) bool {
+	md := path.Metadata()
+	if md == nil {
+		return false
+	}
+	for _, pi := range md.Interfaces {
+		if pi == iface {
+			return true
+		}
+	}
+	return false
+}
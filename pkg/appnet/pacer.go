@@ -0,0 +1,191 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// pacerSpinDuration is the time before the end of a wait during which the
+// Pacer yields in a loop instead of sleeping, as timers may fire late by tens
+// of microseconds.
+const pacerSpinDuration = 50 * time.Microsecond
+
+// Pacer is a token bucket limiting the rate at which packets are sent to a
+// target bitrate, allowing bursts of up to burst bytes.
+//
+// The schedule of the packets is kept independently of the time at which the
+// waiting goroutine is actually woken up, so that delays do not accumulate:
+// a sender that falls behind, e.g. because of a late timer or a slow write,
+// may send up to burst bytes at once to catch up.
+//
+// A Pacer is safe for concurrent use by multiple goroutines.
+type Pacer struct {
+	mutex   sync.Mutex
+	clock   pacerClock
+	perByte float64       // time per byte, in nanoseconds
+	burst   time.Duration // time to send burst bytes at the target rate
+	tat     time.Time     // time at which the bucket is full again
+}
+
+// pacerClock is the source of time of a Pacer, replaced in tests.
+type pacerClock interface {
+	Now() time.Time
+	// SleepUntil blocks until t or until ctx is done.
+	SleepUntil(ctx context.Context, t time.Time) error
+}
+
+// NewPacer returns a Pacer for the bitrate, in bits per second, and the burst
+// size, in bytes. A bitrate of 0 or less disables pacing.
+// The bucket is initially full, i.e. a burst can be sent right away.
+func NewPacer(bitrate int64, burst int) *Pacer {
+	p := &Pacer{clock: systemClock{}}
+	p.SetRate(bitrate, burst)
+	return p
+}
+
+// SetRate changes the bitrate, in bits per second, and the burst size, in
+// bytes. The packets sent before are accounted at the new rate.
+func (p *Pacer) SetRate(bitrate int64, burst int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if bitrate <= 0 {
+		p.perByte = 0
+		p.burst = 0
+		return
+	}
+	p.perByte = 8 * float64(time.Second) / float64(bitrate)
+	p.burst = p.cost(burst)
+}
+
+// Wait blocks until a packet of size bytes may be sent, and accounts for it.
+// If ctx is done before, the packet is not accounted for and the error of
+// ctx is returned.
+func (p *Pacer) Wait(ctx context.Context, size int) error {
+	_, err := p.WaitBatch(ctx, size, 1)
+	return err
+}
+
+// WaitBatch blocks until a packet of size bytes may be sent, and returns the
+// number of packets of this size, up to max, that may be sent at this time.
+// All of these packets are accounted for.
+// If ctx is done before, no packet is accounted for and the error of ctx is
+// returned.
+func (p *Pacer) WaitBatch(ctx context.Context, size int, max int) (int, error) {
+	p.mutex.Lock()
+	if p.perByte == 0 {
+		p.mutex.Unlock()
+		return max, nil
+	}
+	cost := p.cost(size)
+	now := p.clock.Now()
+	start := p.tat
+	if start.Before(now) {
+		start = now
+	}
+	next := start.Add(cost)
+	at := next.Add(-p.tolerance(cost))
+	p.tat = next
+	p.mutex.Unlock()
+
+	if err := p.clock.SleepUntil(ctx, at); err != nil {
+		p.mutex.Lock()
+		p.tat = p.tat.Add(-cost)
+		p.mutex.Unlock()
+		return 0, err
+	}
+
+	// Take the further packets that conform at the time of the wake up
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now = p.clock.Now()
+	n := 1
+	for n < max {
+		next := p.tat.Add(cost)
+		if next.Sub(now) > p.tolerance(cost) {
+			break
+		}
+		p.tat = next
+		n++
+	}
+	return n, nil
+}
+
+// cost returns the time to send size bytes at the target rate.
+func (p *Pacer) cost(size int) time.Duration {
+	return time.Duration(float64(size) * p.perByte)
+}
+
+// tolerance returns how far the schedule may be ahead of the current time
+// after sending a packet with the given cost. Packets larger than the burst
+// size are sent when the bucket is full.
+func (p *Pacer) tolerance(cost time.Duration) time.Duration {
+	if cost > p.burst {
+		return cost
+	}
+	return p.burst
+}
+
+// systemClock is the pacerClock using the system time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SleepUntil blocks until t or until ctx is done. The last
+// pacerSpinDuration are spent yielding in a loop, for precise wake up times.
+func (systemClock) SleepUntil(ctx context.Context, t time.Time) error {
+	if d := time.Until(t) - pacerSpinDuration; d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	for time.Now().Before(t) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		runtime.Gosched()
+	}
+	return nil
+}
+
+// PacedWriter paces the writes to an underlying writer, e.g. a *snet.Conn,
+// where each Write sends one packet.
+type PacedWriter struct {
+	w     io.Writer
+	pacer *Pacer
+}
+
+// NewPacedWriter returns a PacedWriter writing to w, paced by pacer.
+func NewPacedWriter(w io.Writer, pacer *Pacer) *PacedWriter {
+	return &PacedWriter{w: w, pacer: pacer}
+}
+
+// Write blocks until the pacer allows sending b, and writes it.
+func (w *PacedWriter) Write(b []byte) (int, error) {
+	if err := w.pacer.Wait(context.Background(), len(b)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(b)
+}
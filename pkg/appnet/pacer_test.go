@@ -0,0 +1,123 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock is a pacerClock for tests. Sleeping advances the time
+// immediately, plus late to simulate timers firing late.
+type fakeClock struct {
+	now  time.Time
+	late time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) SleepUntil(ctx context.Context, t time.Time) error {
+	if !t.After(c.now) {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.now = t.Add(c.late)
+	return nil
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestPacer(bitrate int64, burst int, clock *fakeClock) *Pacer {
+	p := NewPacer(bitrate, burst)
+	p.clock = clock
+	return p
+}
+
+func TestPacerBurst(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	p := newTestPacer(8e5, 10000, clock)
+	if n, err := p.WaitBatch(context.Background(), 1000, 100); err != nil || n != 10 {
+		t.Errorf("expected burst of 10 packets, got %d, %v", n, err)
+	}
+	if d := clock.now.Sub(time.Unix(1600000000, 0)); d != 0 {
+		t.Errorf("expected no wait for burst, got %v", d)
+	}
+	// The bucket is empty, the next packet is due after 10ms
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Wait(ctx, 1000); err != context.Canceled {
+		t.Errorf("expected canceled, got %v", err)
+	}
+	t0 := clock.now
+	if err := p.Wait(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if d := clock.now.Sub(t0); d != 10*time.Millisecond {
+		t.Errorf("expected wait of 10ms, got %v", d)
+	}
+
+	unlimited := NewPacer(0, 0)
+	if n, err := unlimited.WaitBatch(context.Background(), 1000, 100); err != nil || n != 100 {
+		t.Errorf("expected 100 packets without pacing, got %d, %v", n, err)
+	}
+}
+
+func TestPacerRate(t *testing.T) {
+	const (
+		size     = 1000
+		rate     = 80e6 // 10 packets per millisecond
+		duration = 200 * time.Millisecond
+	)
+	const burst = 20 // 2ms, to catch up after timers firing late
+	cases := []struct {
+		name string
+		late time.Duration
+	}{
+		{"exact timers", 0},
+		{"late timers", 300 * time.Microsecond},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1600000000, 0), late: c.late}
+			p := newTestPacer(rate, burst*size, clock)
+			t0 := clock.now
+			sent := 0
+			for clock.now.Sub(t0) < duration {
+				n, err := p.WaitBatch(context.Background(), size, 16)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sent += n
+				// simulate a slow sender, falling behind occasionally
+				if sent%100 < n {
+					clock.Sleep(200 * time.Microsecond)
+				}
+			}
+			elapsed := clock.now.Sub(t0)
+			expected := int(elapsed.Seconds() * rate / 8 / size)
+			// delays do not accumulate, the sender catches up within the burst
+			if sent < expected || sent > expected+burst+16 {
+				t.Errorf("expected about %d packets in %v, got %d", expected, elapsed, sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/slayers/path/scion"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+const (
+	// maxKnownPaths is the number of paths above which the registry of the
+	// paths obtained from path queries is reset.
+	maxKnownPaths = 4096
+	// pathRefreshMargin is the time before the expiry of the first path to a
+	// destination at which the paths are refreshed.
+	pathRefreshMargin = 1 * time.Minute
+	// minPathRefreshInterval limits the rate of refreshes for paths that
+	// expire very soon, and is the retry interval for failed refreshes.
+	minPathRefreshInterval = 10 * time.Second
+	// maxPathRefreshInterval is the maximum time between two refreshes, so
+	// that new paths are eventually picked up.
+	maxPathRefreshInterval = 5 * time.Minute
+	// pathCacheIdleTimeout is the time after which destinations that are no
+	// longer queried and have no subscribers are evicted from the cache.
+	pathCacheIdleTimeout = 5 * time.Minute
+)
+
+// pathCache caches the paths to each destination IA, to avoid querying
+// sciond for every dial.
+// The paths in the cache are refreshed in the background, before they expire.
+// Paths traversing an interface reported down by an SCMP message are removed
+// (see Revoke). Subscribers are notified whenever the paths to a destination
+// change.
+type pathCache struct {
+	querier      snet.PathQuerier
+	queryTimeout time.Duration
+
+	mutex   sync.Mutex
+	entries map[addr.IA]*pathCacheEntry
+	revoked map[snet.PathInterface]time.Time
+	closed  bool
+}
+
+type pathCacheEntry struct {
+	paths []snet.Path
+	// fetched is closed once the initial query has completed; err is the
+	// error of the initial query.
+	fetched     chan struct{}
+	err         error
+	lastUsed    time.Time
+	timer       *time.Timer
+	subscribers map[*pathSubscription]struct{}
+	// refreshing is the refresh in progress, if any.
+	refreshing *pathRefresh
+}
+
+// pathRefresh is a refresh of the paths of an entry, shared by all concurrent
+// requests for the entry.
+type pathRefresh struct {
+	done  chan struct{}
+	paths []snet.Path
+	err   error
+}
+
+type pathSubscription struct {
+	notify func(paths []snet.Path)
+}
+
+func newPathCache(querier snet.PathQuerier, queryTimeout time.Duration) *pathCache {
+	return &pathCache{
+		querier:      querier,
+		queryTimeout: queryTimeout,
+		entries:      make(map[addr.IA]*pathCacheEntry),
+		revoked:      make(map[snet.PathInterface]time.Time),
+	}
+}
+
+// Get returns the (deduplicated) paths to ia that have not expired.
+// If the paths are not in the cache or if all cached paths have expired,
+// sciond is queried. Concurrent requests for the same destination share a
+// single query.
+// The returned slice is a copy and may be modified by the caller.
+func (c *pathCache) Get(ia addr.IA) ([]snet.Path, error) {
+	paths, err := c.get(ia)
+	return copyPaths(paths), err
+}
+
+func (c *pathCache) get(ia addr.IA) ([]snet.Path, error) {
+	c.mutex.Lock()
+	e, ok := c.entries[ia]
+	if !ok {
+		e = &pathCacheEntry{
+			fetched:     make(chan struct{}),
+			subscribers: make(map[*pathSubscription]struct{}),
+		}
+		c.entries[ia] = e
+		c.mutex.Unlock()
+		return c.fetch(ia, e)
+	}
+	c.mutex.Unlock()
+
+	<-e.fetched
+	if e.err != nil {
+		return nil, e.err
+	}
+	c.mutex.Lock()
+	e.lastUsed = time.Now()
+	paths := validPaths(e.paths, time.Now())
+	c.mutex.Unlock()
+	if len(paths) == 0 {
+		return c.refresh(ia, e)
+	}
+	return paths, nil
+}
+
+// Subscribe registers notify to be called with the new paths to ia, whenever
+// the paths change. This includes refreshed paths with a later expiry.
+// The notify function is called from the background refresh and should
+// return quickly. The returned function cancels the subscription.
+func (c *pathCache) Subscribe(ia addr.IA, notify func(paths []snet.Path)) func() {
+	// Ensure the entry exists, so that it is refreshed
+	_, _ = c.get(ia)
+
+	s := &pathSubscription{notify: notify}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return func() {}
+	}
+	e, ok := c.entries[ia]
+	if !ok {
+		// The initial query failed; keep the subscription in an entry that
+		// will be refreshed later.
+		e = &pathCacheEntry{
+			fetched:     make(chan struct{}),
+			subscribers: make(map[*pathSubscription]struct{}),
+		}
+		close(e.fetched)
+		c.entries[ia] = e
+		c.scheduleRefresh(ia, e, minPathRefreshInterval)
+	}
+	e.subscribers[s] = struct{}{}
+	return func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(e.subscribers, s)
+	}
+}
+
+// Revoke removes the paths traversing the interface from the cache and
+// notifies the subscribers of the affected destinations. For
+// scmpRevocationTTL, these paths are also excluded from the results of
+// queries, in case sciond has not yet learned about the revocation.
+func (c *pathCache) Revoke(iface snet.PathInterface) {
+	type notification struct {
+		paths       []snet.Path
+		subscribers []*pathSubscription
+	}
+	var notifications []notification
+
+	now := time.Now()
+	c.mutex.Lock()
+	c.revoked[iface] = now.Add(scmpRevocationTTL)
+	for ia, e := range c.entries {
+		remaining := c.filterRevoked(e.paths, now)
+		if len(remaining) == len(e.paths) {
+			continue
+		}
+		log.Debug("pathCache: removing revoked paths", "ia", ia, "interface", iface,
+			"remaining", len(remaining))
+		e.paths = remaining
+		n := notification{paths: remaining}
+		for s := range e.subscribers {
+			n.subscribers = append(n.subscribers, s)
+		}
+		notifications = append(notifications, n)
+	}
+	c.mutex.Unlock()
+
+	// Notify outside of the lock, subscribers may query the cache.
+	for _, n := range notifications {
+		for _, s := range n.subscribers {
+			s.notify(copyPaths(n.paths))
+		}
+	}
+}
+
+// filterRevoked returns the paths that do not traverse a revoked interface.
+// Expired revocations are removed.
+// Must be called with c.mutex held.
+func (c *pathCache) filterRevoked(paths []snet.Path, now time.Time) []snet.Path {
+	if len(c.revoked) == 0 {
+		return paths
+	}
+	for iface, expiry := range c.revoked {
+		if !expiry.After(now) {
+			delete(c.revoked, iface)
+		}
+	}
+	filtered := make([]snet.Path, 0, len(paths))
+	for _, p := range paths {
+		revoked := false
+		for iface := range c.revoked {
+			if pathContainsInterface(p, iface) {
+				revoked = true
+				break
+			}
+		}
+		if !revoked {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+// Close stops all background refreshes.
+func (c *pathCache) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	for ia, e := range c.entries {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		delete(c.entries, ia)
+	}
+}
+
+// fetch performs the initial query for a new entry.
+func (c *pathCache) fetch(ia addr.IA, e *pathCacheEntry) ([]snet.Path, error) {
+	paths, err := c.query(ia)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e.err = err
+	close(e.fetched)
+	if err != nil {
+		// Do not cache errors; the next Get queries again.
+		if c.entries[ia] == e {
+			delete(c.entries, ia)
+		}
+		return nil, err
+	}
+	paths = c.filterRevoked(paths, time.Now())
+	e.paths = paths
+	e.lastUsed = time.Now()
+	if !c.closed {
+		c.scheduleRefresh(ia, e, refreshDelay(paths, time.Now()))
+	}
+	return paths, nil
+}
+
+// refresh queries the paths for an existing entry and notifies the
+// subscribers if the paths have changed.
+// Concurrent refreshes of the same entry share a single query.
+func (c *pathCache) refresh(ia addr.IA, e *pathCacheEntry) ([]snet.Path, error) {
+	c.mutex.Lock()
+	if r := e.refreshing; r != nil {
+		c.mutex.Unlock()
+		<-r.done
+		return r.paths, r.err
+	}
+	r := &pathRefresh{done: make(chan struct{})}
+	e.refreshing = r
+	c.mutex.Unlock()
+
+	r.paths, r.err = c.doRefresh(ia, e)
+
+	c.mutex.Lock()
+	e.refreshing = nil
+	c.mutex.Unlock()
+	close(r.done)
+	return r.paths, r.err
+}
+
+func (c *pathCache) doRefresh(ia addr.IA, e *pathCacheEntry) ([]snet.Path, error) {
+	paths, err := c.query(ia)
+
+	c.mutex.Lock()
+	if c.closed || c.entries[ia] != e {
+		c.mutex.Unlock()
+		return paths, err
+	}
+	if err != nil {
+		log.Debug("pathCache: refresh failed", "ia", ia, "err", err)
+		c.scheduleRefresh(ia, e, minPathRefreshInterval)
+		c.mutex.Unlock()
+		return nil, err
+	}
+	paths = c.filterRevoked(paths, time.Now())
+	changed := !equalPaths(e.paths, paths)
+	e.paths = paths
+	c.scheduleRefresh(ia, e, refreshDelay(paths, time.Now()))
+	var subscribers []*pathSubscription
+	if changed {
+		for s := range e.subscribers {
+			subscribers = append(subscribers, s)
+		}
+	}
+	c.mutex.Unlock()
+
+	// Notify outside of the lock, subscribers may query the cache.
+	for _, s := range subscribers {
+		s.notify(copyPaths(paths))
+	}
+	return paths, nil
+}
+
+// scheduleRefresh (re)starts the refresh timer of the entry.
+// Must be called with c.mutex held.
+func (c *pathCache) scheduleRefresh(ia addr.IA, e *pathCacheEntry, delay time.Duration) {
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.timer = time.AfterFunc(delay, func() {
+		c.mutex.Lock()
+		if c.closed || c.entries[ia] != e {
+			c.mutex.Unlock()
+			return
+		}
+		if len(e.subscribers) == 0 && time.Since(e.lastUsed) > pathCacheIdleTimeout {
+			delete(c.entries, ia)
+			c.mutex.Unlock()
+			return
+		}
+		c.mutex.Unlock()
+		_, _ = c.refresh(ia, e)
+	})
+}
+
+func (c *pathCache) query(ia addr.IA) ([]snet.Path, error) {
+	ctx := context.Background()
+	if c.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.queryTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	paths, err := c.querier.Query(ctx, ia)
+	if err != nil || len(paths) == 0 {
+		observePathQuery(ia, start, err)
+		return nil, err
+	}
+	paths = filterDuplicates(paths)
+	observePathQuery(ia, start, nil)
+	recordPaths(paths)
+	return paths, nil
+}
+
+// refreshDelay returns the time until the paths should be refreshed, i.e.
+// shortly before the first path expires.
+func refreshDelay(paths []snet.Path, now time.Time) time.Duration {
+	delay := maxPathRefreshInterval
+	for _, p := range paths {
+		md := p.Metadata()
+		if md == nil || md.Expiry.IsZero() {
+			continue
+		}
+		if d := md.Expiry.Sub(now) - pathRefreshMargin; d < delay {
+			delay = d
+		}
+	}
+	if delay < minPathRefreshInterval {
+		delay = minPathRefreshInterval
+	}
+	return delay
+}
+
+// validPaths returns the paths that have not expired.
+func validPaths(paths []snet.Path, now time.Time) []snet.Path {
+	valid := make([]snet.Path, 0, len(paths))
+	for _, p := range paths {
+		md := p.Metadata()
+		if md == nil || md.Expiry.IsZero() || md.Expiry.After(now) {
+			valid = append(valid, p)
+		}
+	}
+	return valid
+}
+
+func copyPaths(paths []snet.Path) []snet.Path {
+	if paths == nil {
+		return nil
+	}
+	return append([]snet.Path(nil), paths...)
+}
+
+// equalPaths returns true if a and b contain the same paths, with the same
+// expiry, in the same order.
+func equalPaths(a, b []snet.Path) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if snet.Fingerprint(a[i]) != snet.Fingerprint(b[i]) {
+			return false
+		}
+		ma, mb := a[i].Metadata(), b[i].Metadata()
+		if (ma == nil) != (mb == nil) || ma != nil && !ma.Expiry.Equal(mb.Expiry) {
+			return false
+		}
+	}
+	return true
+}
+
+// knownPaths maps the key of the dataplane paths (see pathKey) obtained from
+// path queries of this process to the paths, so that the path can be
+// identified from the dataplane path of a packet, e.g. for the metrics or for
+// SCMP errors.
+var knownPaths = struct {
+	sync.Mutex
+	m map[string]*knownPath
+}{m: make(map[string]*knownPath)}
+
+// knownPathsGeneration is incremented whenever knownPaths changes, so that
+// information derived from the known paths can be cached, see metricsConn.
+var knownPathsGeneration uint64
+
+type knownPath struct {
+	path        snet.Path
+	fingerprint string
+}
+
+// recordPaths adds the paths to the registry of known paths.
+func recordPaths(paths []snet.Path) {
+	knownPaths.Lock()
+	defer knownPaths.Unlock()
+	if len(knownPaths.m)+len(paths) > maxKnownPaths {
+		knownPaths.m = make(map[string]*knownPath)
+	}
+	for _, p := range paths {
+		knownPaths.m[pathKey(p.Path())] = &knownPath{
+			path:        p,
+			fingerprint: snet.Fingerprint(p).String(),
+		}
+	}
+	atomic.AddUint64(&knownPathsGeneration, 1)
+}
+
+// lookupPath returns the known path with the dataplane path p, or nil.
+func lookupPath(p spath.Path) *knownPath {
+	key := pathKey(p)
+	knownPaths.Lock()
+	defer knownPaths.Unlock()
+	return knownPaths.m[key]
+}
+
+// pathKey returns a key identifying the dataplane path independent of the
+// state changed while forwarding a packet over the path.
+// For SCION paths, the key consists of the hop fields; otherwise, the raw path
+// is used.
+func pathKey(p spath.Path) string {
+	if p.Type == scion.PathType {
+		var decoded scion.Decoded
+		if err := decoded.DecodeFromBytes(p.Raw); err == nil {
+			var b strings.Builder
+			for _, hf := range decoded.HopFields {
+				fmt.Fprintf(&b, "%d>%d:%x,", hf.ConsIngress, hf.ConsEgress, hf.Mac)
+			}
+			return b.String()
+		}
+	}
+	return string(p.Raw)
+}
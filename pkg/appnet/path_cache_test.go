@@ -0,0 +1,266 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+func TestPathCacheGet(t *testing.T) {
+	ia := addr.IA{I: 1, A: 0xff0000000111}
+	querier := &mockQuerier{paths: []snet.Path{
+		makeExpiringPath(1, time.Now().Add(time.Hour)),
+		makeExpiringPath(2, time.Now().Add(time.Hour)),
+	}}
+	c := newPathCache(querier, 0)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paths, err := c.Get(ia)
+			if err != nil || len(paths) != 2 {
+				t.Errorf("unexpected result %v, %v", paths, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := querier.count(); n != 1 {
+		t.Errorf("expected 1 query, got %d", n)
+	}
+
+	// Expired paths are queried again
+	querier.setPaths([]snet.Path{makeExpiringPath(1, time.Now().Add(-time.Minute))})
+	c.entries[ia].paths = querier.paths
+	paths, err := c.Get(ia)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := querier.count(); n != 2 {
+		t.Errorf("expected 2 queries, got %d", n)
+	}
+	if len(paths) != 1 {
+		t.Errorf("expected 1 path, got %d", len(paths))
+	}
+}
+
+func TestPathCacheGetExpired(t *testing.T) {
+	ia := addr.IA{I: 1, A: 0xff0000000111}
+	querier := &mockQuerier{paths: []snet.Path{
+		makeExpiringPath(1, time.Now().Add(time.Hour)),
+		makeExpiringPath(2, time.Now().Add(time.Hour)),
+	}}
+	c := newPathCache(querier, 0)
+	defer c.Close()
+	if _, err := c.Get(ia); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired paths are not returned
+	c.entries[ia].paths[1] = makeExpiringPath(2, time.Now().Add(-time.Minute))
+	paths, err := c.Get(ia)
+	if err != nil || len(paths) != 1 || paths[0].Metadata().Interfaces[0].ID != 1 {
+		t.Errorf("expected only the valid path, got %v, %v", paths, err)
+	}
+	if n := querier.count(); n != 1 {
+		t.Errorf("expected 1 query, got %d", n)
+	}
+
+	// Once all paths have expired, concurrent requests share a single query
+	c.entries[ia].paths = []snet.Path{makeExpiringPath(1, time.Now().Add(-time.Minute))}
+	querier.delay = 50 * time.Millisecond
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paths, err := c.Get(ia)
+			if err != nil || len(paths) != 2 {
+				t.Errorf("unexpected result %v, %v", paths, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := querier.count(); n != 2 {
+		t.Errorf("expected 2 queries, got %d", n)
+	}
+}
+
+func TestPathCacheRevoke(t *testing.T) {
+	ia := addr.IA{I: 1, A: 0xff0000000111}
+	expiry := time.Now().Add(time.Hour)
+	querier := &mockQuerier{paths: []snet.Path{
+		makeExpiringPath(1, expiry),
+		makeExpiringPath(2, expiry),
+	}}
+	c := newPathCache(querier, 0)
+	defer c.Close()
+
+	var notified [][]snet.Path
+	unsubscribe := c.Subscribe(ia, func(paths []snet.Path) {
+		notified = append(notified, paths)
+	})
+	defer unsubscribe()
+
+	revoked := querier.paths[0].Metadata().Interfaces[0]
+	c.Revoke(revoked)
+	paths, err := c.Get(ia)
+	if err != nil || len(paths) != 1 || paths[0].Metadata().Interfaces[0].ID != 2 {
+		t.Errorf("expected only the path not traversing the revoked interface, got %v, %v", paths, err)
+	}
+	if len(notified) != 1 || len(notified[0]) != 1 {
+		t.Errorf("expected notification with 1 path, got %v", notified)
+	}
+
+	// The revoked path is excluded from refreshed paths, until the
+	// revocation expires
+	if paths, err := c.refresh(ia, c.entries[ia]); err != nil || len(paths) != 1 {
+		t.Errorf("expected revoked path to be excluded after refresh, got %v, %v", paths, err)
+	}
+	c.revoked[revoked] = time.Now().Add(-time.Second)
+	if paths, err := c.refresh(ia, c.entries[ia]); err != nil || len(paths) != 2 {
+		t.Errorf("expected 2 paths after revocation expired, got %v, %v", paths, err)
+	}
+}
+
+func TestPathCacheGetError(t *testing.T) {
+	ia := addr.IA{I: 1, A: 0xff0000000111}
+	querier := &mockQuerier{err: errors.New("sciond unavailable")}
+	c := newPathCache(querier, 0)
+	defer c.Close()
+
+	if _, err := c.Get(ia); err == nil {
+		t.Fatal("expected error")
+	}
+	// Errors are not cached
+	querier.setPaths([]snet.Path{makeExpiringPath(1, time.Now().Add(time.Hour))})
+	paths, err := c.Get(ia)
+	if err != nil || len(paths) != 1 {
+		t.Errorf("unexpected result %v, %v", paths, err)
+	}
+}
+
+func TestPathCacheSubscribe(t *testing.T) {
+	ia := addr.IA{I: 1, A: 0xff0000000111}
+	expiry := time.Now().Add(time.Hour)
+	querier := &mockQuerier{paths: []snet.Path{makeExpiringPath(1, expiry)}}
+	c := newPathCache(querier, 0)
+	defer c.Close()
+
+	var notified [][]snet.Path
+	unsubscribe := c.Subscribe(ia, func(paths []snet.Path) {
+		notified = append(notified, paths)
+	})
+
+	// Unchanged paths, no notification
+	querier.setPaths([]snet.Path{makeExpiringPath(1, expiry)})
+	if _, err := c.refresh(ia, c.entries[ia]); err != nil {
+		t.Fatal(err)
+	}
+	if len(notified) != 0 {
+		t.Errorf("unexpected notification for unchanged paths")
+	}
+
+	// Refreshed expiry and new path
+	querier.setPaths([]snet.Path{
+		makeExpiringPath(1, expiry.Add(time.Hour)),
+		makeExpiringPath(2, expiry.Add(time.Hour)),
+	})
+	if _, err := c.refresh(ia, c.entries[ia]); err != nil {
+		t.Fatal(err)
+	}
+	if len(notified) != 1 || len(notified[0]) != 2 {
+		t.Fatalf("expected notification with 2 paths, got %v", notified)
+	}
+
+	unsubscribe()
+	querier.setPaths([]snet.Path{makeExpiringPath(3, expiry)})
+	if _, err := c.refresh(ia, c.entries[ia]); err != nil {
+		t.Fatal(err)
+	}
+	if len(notified) != 1 {
+		t.Errorf("unexpected notification after unsubscribe")
+	}
+}
+
+func TestRefreshDelay(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		expiry   time.Time
+		expected time.Duration
+	}{
+		{now.Add(time.Hour), maxPathRefreshInterval},
+		{now.Add(pathRefreshMargin + time.Minute), time.Minute},
+		{now.Add(time.Second), minPathRefreshInterval},
+	}
+	for _, c := range cases {
+		paths := []snet.Path{makeExpiringPath(1, now.Add(time.Hour)), makeExpiringPath(2, c.expiry)}
+		if d := refreshDelay(paths, now); d != c.expected {
+			t.Errorf("refreshDelay for expiry in %s: expected %s, got %s", c.expiry.Sub(now), c.expected, d)
+		}
+	}
+}
+
+func makeExpiringPath(ifID int, expiry time.Time) snet.Path {
+	return &mockPath{metadata: &snet.PathMetadata{
+		Interfaces: []snet.PathInterface{
+			{IA: addr.IA{I: 1, A: 0xff0000000110}, ID: common.IFIDType(ifID)},
+		},
+		Expiry: expiry,
+	}}
+}
+
+// mockQuerier is a snet.PathQuerier returning a fixed set of paths and
+// counting the queries.
+type mockQuerier struct {
+	mutex   sync.Mutex
+	paths   []snet.Path
+	err     error
+	queries int
+	// delay is the duration of each query
+	delay time.Duration
+}
+
+func (q *mockQuerier) Query(ctx context.Context, ia addr.IA) ([]snet.Path, error) {
+	q.mutex.Lock()
+	q.queries++
+	paths, err, delay := q.paths, q.err, q.delay
+	q.mutex.Unlock()
+	time.Sleep(delay)
+	return paths, err
+}
+
+func (q *mockQuerier) setPaths(paths []snet.Path) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.paths = paths
+	q.err = nil
+}
+
+func (q *mockQuerier) count() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.queries
+}
@@ -0,0 +1,447 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bclicn/color"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// PathChooserConfig configures the interactive path chooser, see
+// ChoosePathsInteractive.
+type PathChooserConfig struct {
+	// Probe is the address to which SCMP echo requests are sent to measure
+	// the latency of the paths, see ProbePaths. If nil, the paths cannot be
+	// sorted by latency.
+	Probe *snet.UDPAddr
+	// Multi allows to select multiple paths, e.g. for multipath tools.
+	Multi bool
+}
+
+// iaRegexp matches the IAs in a path description, for highlighting.
+var iaRegexp = regexp.MustCompile(`\d{1,4}-([0-9a-f]{1,4}:){2}[0-9a-f]{1,4}`)
+
+var errNoPathChosen = errors.New("no path chosen")
+
+// ChoosePathInteractive presents the user a selection of paths to choose from.
+// If the remote address is in the local IA, return (nil, nil), without prompting the user.
+// See ChoosePathsInteractive.
+func ChoosePathInteractive(dst addr.IA) (snet.Path, error) {
+	paths, err := ChoosePathsInteractive(dst, PathChooserConfig{})
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+	return paths[0], nil
+}
+
+// ChoosePathsInteractive presents the user a selection of paths to choose from.
+//
+// If stdin is a terminal, the list of paths can be sorted by number of hops,
+// MTU, expiry or measured latency, filtered by ISD or AS, and the interfaces
+// of each hop of a path can be shown; enter "h" at the prompt for the list of
+// commands. Otherwise, the paths are listed once and the index of the chosen
+// path is read from stdin.
+// With cfg.Multi, multiple comma separated indices can be entered.
+// If the remote address is in the local IA, return (nil, nil), without prompting the user.
+func ChoosePathsInteractive(dst addr.IA, cfg PathChooserConfig) ([]snet.Path, error) {
+	paths, err := QueryPaths(dst)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+	c := newPathChooser(dst, paths, cfg, os.Stdin, os.Stdout)
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return c.chooseSimple()
+	}
+	return c.choose()
+}
+
+// pathChooser implements the interactive path selection on the paths to dst.
+// The paths are identified by their index in paths, independent of the
+// current sort order and filter.
+type pathChooser struct {
+	dst   addr.IA
+	cfg   PathChooserConfig
+	paths []snet.Path
+	infos []*PathInfo
+	// rtts are the measured round trip times, negative if no reply was
+	// received. Nil if the paths have not been probed.
+	rtts  []time.Duration
+	probe func(paths []snet.Path) []PathProbe
+
+	in  *bufio.Scanner
+	out io.Writer
+
+	order  []int
+	sortBy string
+	filter string
+}
+
+func newPathChooser(dst addr.IA, paths []snet.Path, cfg PathChooserConfig,
+	in io.Reader, out io.Writer) *pathChooser {
+
+	c := &pathChooser{
+		dst:   dst,
+		cfg:   cfg,
+		paths: paths,
+		infos: make([]*PathInfo, len(paths)),
+		in:    bufio.NewScanner(in),
+		out:   out,
+		order: make([]int, len(paths)),
+	}
+	for i, p := range paths {
+		c.infos[i] = NewPathInfo(p)
+		c.order[i] = i
+	}
+	if cfg.Probe != nil {
+		c.probe = func(paths []snet.Path) []PathProbe {
+			return ProbePaths(context.Background(), cfg.Probe, paths, ProbeConfig{})
+		}
+	}
+	return c
+}
+
+// chooseSimple lists the paths once and reads the index of the chosen
+// path(s). The output format is parsed by other tools (e.g. the webapp) and
+// must not be changed.
+func (c *pathChooser) chooseSimple() ([]snet.Path, error) {
+	fmt.Fprintf(c.out, "Available paths to %v\n", c.dst)
+	for i, path := range c.paths {
+		fmt.Fprintf(c.out, "[%2d] %s\n", i, fmt.Sprintf("%s", path))
+	}
+	for {
+		fmt.Fprintf(c.out, "Choose path: ")
+		if !c.in.Scan() {
+			return nil, c.inputError()
+		}
+		chosen, err := c.parseSelection(c.in.Text())
+		if err != nil {
+			fmt.Fprintf(c.out, "ERROR: %v\n", err)
+			continue
+		}
+		return c.use(chosen), nil
+	}
+}
+
+// choose runs the interactive chooser with commands to sort and filter the
+// paths and to show the details of a path.
+func (c *pathChooser) choose() ([]snet.Path, error) {
+	c.list()
+	prompt := "Choose path"
+	if c.cfg.Multi {
+		prompt = "Choose paths"
+	}
+	for {
+		fmt.Fprintf(c.out, "%s (h for help): ", prompt)
+		if !c.in.Scan() {
+			return nil, c.inputError()
+		}
+		line := strings.TrimSpace(c.in.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var err error
+		switch fields[0] {
+		case "h", "help", "?":
+			c.help()
+		case "l", "list":
+			c.list()
+		case "s", "sort":
+			if len(fields) != 2 {
+				err = errors.New("usage: s hops|mtu|expiry|latency")
+				break
+			}
+			if err = c.sort(fields[1]); err == nil {
+				c.list()
+			}
+		case "f", "filter":
+			c.filter = strings.Join(fields[1:], " ")
+			c.list()
+		case "d", "details":
+			if len(fields) != 2 {
+				err = errors.New("usage: d <index>")
+				break
+			}
+			var i int
+			if i, err = c.parseIndex(fields[1]); err == nil {
+				c.details(i)
+			}
+		case "q", "quit":
+			return nil, errNoPathChosen
+		default:
+			var chosen []int
+			if chosen, err = c.parseSelection(line); err == nil {
+				return c.use(chosen), nil
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(c.out, "ERROR: %v\n", err)
+		}
+	}
+}
+
+func (c *pathChooser) inputError() error {
+	if err := c.in.Err(); err != nil {
+		return err
+	}
+	return errNoPathChosen
+}
+
+func (c *pathChooser) help() {
+	fmt.Fprintln(c.out, "Commands:")
+	if c.cfg.Multi {
+		fmt.Fprintln(c.out, "  <index>[,<index>...]  use the paths with these indices")
+	} else {
+		fmt.Fprintln(c.out, "  <index>               use the path with this index")
+	}
+	fmt.Fprintln(c.out, "  s hops|mtu|expiry|latency")
+	fmt.Fprintln(c.out, "                        sort the paths")
+	fmt.Fprintln(c.out, "  f <ISD or AS>         only show paths through a matching AS, e.g. \"f 2-\" or")
+	fmt.Fprintln(c.out, "                        \"f ff00:0:111\"; \"f\" alone clears the filter")
+	fmt.Fprintln(c.out, "  d <index>             show the hops and interfaces of a path")
+	fmt.Fprintln(c.out, "  l                     list the paths")
+	fmt.Fprintln(c.out, "  q                     quit without choosing a path")
+}
+
+// list prints the paths matching the filter, in the current sort order.
+func (c *pathChooser) list() {
+	var shown []int
+	for _, i := range c.order {
+		if c.matches(i) {
+			shown = append(shown, i)
+		}
+	}
+	var qualifiers []string
+	if c.sortBy != "" {
+		qualifiers = append(qualifiers, "sorted by "+c.sortBy)
+	}
+	if c.filter != "" {
+		qualifiers = append(qualifiers, fmt.Sprintf("%d of %d matching %q", len(shown), len(c.paths), c.filter))
+	}
+	fmt.Fprintf(c.out, "Available paths to %v", c.dst)
+	if len(qualifiers) > 0 {
+		fmt.Fprintf(c.out, " (%s)", strings.Join(qualifiers, ", "))
+	}
+	fmt.Fprintln(c.out)
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	for _, i := range shown {
+		info := c.infos[i]
+		fmt.Fprintf(w, "[%2d]\thops: %d\tmtu: %d\texpiry: %s", i, len(info.Hops), info.MTU, expiryString(info.Expiry))
+		if c.rtts != nil {
+			fmt.Fprintf(w, "\tlatency: %s", rttString(c.rtts[i]))
+		}
+		fmt.Fprintf(w, "\t%s\n", iaRegexp.ReplaceAllStringFunc(hopsString(info), color.Cyan))
+	}
+	w.Flush()
+}
+
+// matches returns true if the ith path passes through an AS matching the
+// filter.
+func (c *pathChooser) matches(i int) bool {
+	if c.filter == "" {
+		return true
+	}
+	for _, hop := range c.infos[i].Hops {
+		if strings.Contains(hop.IA.String(), c.filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// sort orders the paths by key, best first. Paths with equal keys keep their
+// original order.
+func (c *pathChooser) sort(key string) error {
+	var less func(a, b int) bool
+	switch key {
+	case "hops":
+		less = func(a, b int) bool { return len(c.infos[a].Hops) < len(c.infos[b].Hops) }
+	case "mtu":
+		less = func(a, b int) bool { return c.infos[a].MTU > c.infos[b].MTU }
+	case "expiry":
+		less = func(a, b int) bool { return c.infos[a].Expiry.After(c.infos[b].Expiry) }
+	case "latency":
+		if err := c.measure(); err != nil {
+			return err
+		}
+		less = func(a, b int) bool {
+			ra, rb := c.rtts[a], c.rtts[b]
+			if ra < 0 || rb < 0 {
+				return rb < 0 && ra >= 0
+			}
+			return ra < rb
+		}
+	default:
+		return fmt.Errorf("unknown sort key %q, valid keys are hops, mtu, expiry, latency", key)
+	}
+	for i := range c.order {
+		c.order[i] = i
+	}
+	sort.SliceStable(c.order, func(x, y int) bool { return less(c.order[x], c.order[y]) })
+	c.sortBy = key
+	return nil
+}
+
+// measure probes the paths to measure their latency, unless this has
+// already been done.
+func (c *pathChooser) measure() error {
+	if c.rtts != nil {
+		return nil
+	}
+	if c.probe == nil {
+		return errors.New("latency not available, no address to probe")
+	}
+	fmt.Fprintf(c.out, "Probing %d paths...\n", len(c.paths))
+	probes := c.probe(c.paths)
+	c.rtts = make([]time.Duration, len(c.paths))
+	for i, p := range probes {
+		if p.Err != nil || p.Loss >= 1 {
+			c.rtts[i] = -1
+		} else {
+			c.rtts[i] = p.RTT
+		}
+	}
+	return nil
+}
+
+// details prints the hops of the ith path with their interfaces, and the
+// announced latency and bandwidth of the links between them, if available.
+func (c *pathChooser) details(i int) {
+	info := c.infos[i]
+	fmt.Fprintf(c.out, "Path %d to %v\n", i, c.dst)
+	fmt.Fprintf(c.out, "  Fingerprint: %s\n", info.Fingerprint)
+	fmt.Fprintf(c.out, "  MTU:         %d\n", info.MTU)
+	fmt.Fprintf(c.out, "  Expiry:      %s (%s)\n", info.Expiry.Format(time.RFC3339), expiryString(info.Expiry))
+	if c.rtts != nil {
+		fmt.Fprintf(c.out, "  Latency:     %s (measured round trip time)\n", rttString(c.rtts[i]))
+	}
+	fmt.Fprintln(c.out, "  Hops:")
+	for k, hop := range info.Hops {
+		var ifaces []string
+		if k > 0 {
+			ifaces = append(ifaces, fmt.Sprintf("ingress %d", hop.Ingress))
+		}
+		if k < len(info.Hops)-1 {
+			ifaces = append(ifaces, fmt.Sprintf("egress %d", hop.Egress))
+		}
+		fmt.Fprintf(c.out, "    %s  %s\n", color.Cyan(hop.IA.String()), strings.Join(ifaces, ", "))
+		if k < len(info.Hops)-1 {
+			if link := linkString(info, k); link != "" {
+				fmt.Fprintf(c.out, "      | %s\n", link)
+			}
+		}
+	}
+}
+
+// linkString describes the announced properties of the link between the kth
+// and the next hop of the path. The link connects the interfaces 2k and 2k+1
+// of the path.
+func linkString(info *PathInfo, k int) string {
+	var props []string
+	if 2*k < len(info.Latency) && info.Latency[2*k] > 0 {
+		props = append(props, fmt.Sprintf("latency %s", info.Latency[2*k]))
+	}
+	if 2*k < len(info.Bandwidth) && info.Bandwidth[2*k] > 0 {
+		props = append(props, fmt.Sprintf("bandwidth %d Kbit/s", info.Bandwidth[2*k]))
+	}
+	return strings.Join(props, ", ")
+}
+
+// parseSelection parses the index, or with cfg.Multi the comma separated
+// indices, of the chosen paths.
+func (c *pathChooser) parseSelection(s string) ([]int, error) {
+	parts := []string{s}
+	if c.cfg.Multi {
+		parts = strings.Split(s, ",")
+	}
+	var chosen []int
+	seen := make(map[int]bool)
+	for _, part := range parts {
+		i, err := c.parseIndex(part)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[i] {
+			seen[i] = true
+			chosen = append(chosen, i)
+		}
+	}
+	return chosen, nil
+}
+
+func (c *pathChooser) parseIndex(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i >= len(c.paths) {
+		return 0, fmt.Errorf("invalid path index %v, valid indices range: [0, %v]", s, len(c.paths)-1)
+	}
+	return i, nil
+}
+
+// use prints and returns the chosen paths.
+func (c *pathChooser) use(chosen []int) []snet.Path {
+	if len(chosen) == 1 {
+		fmt.Fprintf(c.out, "Using path:\n")
+	} else {
+		fmt.Fprintf(c.out, "Using paths:\n")
+	}
+	paths := make([]snet.Path, len(chosen))
+	for k, i := range chosen {
+		paths[k] = c.paths[i]
+		fmt.Fprintf(c.out, " %s\n", iaRegexp.ReplaceAllStringFunc(fmt.Sprintf("%s", paths[k]), color.Cyan))
+	}
+	return paths
+}
+
+// hopsString returns the hops of the path, as in PathInfo.String but without
+// MTU and expiry.
+func hopsString(info *PathInfo) string {
+	hops := *info
+	hops.MTU = 0
+	hops.Expiry = time.Time{}
+	return hops.String()
+}
+
+func expiryString(expiry time.Time) string {
+	d := time.Until(expiry)
+	if d <= 0 {
+		return "expired"
+	}
+	return "in " + d.Truncate(time.Second).String()
+}
+
+func rttString(rtt time.Duration) string {
+	if rtt < 0 {
+		return "-"
+	}
+	return rtt.Round(100 * time.Microsecond).String()
+}
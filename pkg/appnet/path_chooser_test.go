@@ -0,0 +1,182 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	snetpath "github.com/scionproto/scion/go/lib/snet/path"
+)
+
+func chooserTestPaths() (addr.IA, []snet.Path) {
+	ia110 := addr.IA{I: 1, A: 0xff0000000110}
+	ia111 := addr.IA{I: 1, A: 0xff0000000111}
+	ia112 := addr.IA{I: 1, A: 0xff0000000112}
+	ia210 := addr.IA{I: 2, A: 0xff0000000210}
+	now := time.Now()
+	makePath := func(mtu uint16, expiry time.Duration, ias ...addr.IA) snet.Path {
+		var interfaces []snet.PathInterface
+		for i, ia := range ias {
+			if i > 0 {
+				interfaces = append(interfaces, snet.PathInterface{IA: ia, ID: common.IFIDType(2 * i)})
+			}
+			if i < len(ias)-1 {
+				interfaces = append(interfaces, snet.PathInterface{IA: ia, ID: common.IFIDType(2*i + 1)})
+			}
+		}
+		return snetpath.Path{Meta: snet.PathMetadata{
+			Interfaces: interfaces,
+			MTU:        mtu,
+			Expiry:     now.Add(expiry),
+		}}
+	}
+	return ia112, []snet.Path{
+		makePath(1400, 2*time.Hour, ia110, ia111, ia210, ia112),
+		makePath(1472, 1*time.Hour, ia110, ia112),
+		makePath(1300, 3*time.Hour, ia110, ia111, ia112),
+	}
+}
+
+// listedIndices returns the indices of the paths in the last list printed.
+func listedIndices(out string) []string {
+	lists := strings.Split(out, "Available paths to")
+	var indices []string
+	for _, line := range strings.Split(lists[len(lists)-1], "\n") {
+		if strings.HasPrefix(line, "[") {
+			indices = append(indices, strings.TrimSpace(line[1:strings.Index(line, "]")]))
+		}
+	}
+	return indices
+}
+
+func TestPathChooserSimple(t *testing.T) {
+	dst, paths := chooserTestPaths()
+	var out bytes.Buffer
+	c := newPathChooser(dst, paths, PathChooserConfig{}, strings.NewReader("x\n3\n1\n"), &out)
+	chosen, err := c.chooseSimple()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(chosen) != 1 || snet.Fingerprint(chosen[0]) != snet.Fingerprint(paths[1]) {
+		t.Fatalf("expected path 1, got %v", chosen)
+	}
+	// The format is parsed by the webapp
+	lines := strings.Split(out.String(), "\n")
+	if lines[0] != "Available paths to 1-ff00:0:112" {
+		t.Errorf("unexpected header %q", lines[0])
+	}
+	for i, p := range paths {
+		if expected := "[ " + string(rune('0'+i)) + "] " + p.(snetpath.Path).String(); lines[1+i] != expected {
+			t.Errorf("unexpected line %q, expected %q", lines[1+i], expected)
+		}
+	}
+	if strings.Count(out.String(), "ERROR: invalid path index") != 2 {
+		t.Errorf("expected two errors for invalid indices, got %q", out.String())
+	}
+	if !strings.Contains(out.String(), "Using path:\n ") {
+		t.Errorf("expected chosen path, got %q", out.String())
+	}
+
+	c = newPathChooser(dst, paths, PathChooserConfig{}, strings.NewReader("x\n"), &out)
+	if _, err := c.chooseSimple(); !errors.Is(err, errNoPathChosen) {
+		t.Errorf("expected errNoPathChosen at end of input, got %v", err)
+	}
+}
+
+func TestPathChooser(t *testing.T) {
+	dst, paths := chooserTestPaths()
+	rtts := []time.Duration{30 * time.Millisecond, 0, 10 * time.Millisecond}
+	cases := []struct {
+		name     string
+		input    string
+		cfg      PathChooserConfig
+		listed   []string
+		expected []int
+	}{
+		{"default order", "l\n2\n", PathChooserConfig{}, []string{"0", "1", "2"}, []int{2}},
+		{"sort hops", "s hops\n0\n", PathChooserConfig{}, []string{"1", "2", "0"}, []int{0}},
+		{"sort mtu", "s mtu\n0\n", PathChooserConfig{}, []string{"1", "0", "2"}, []int{0}},
+		{"sort expiry", "s expiry\n0\n", PathChooserConfig{}, []string{"2", "0", "1"}, []int{0}},
+		{"sort latency", "s latency\n0\n", PathChooserConfig{Probe: &snet.UDPAddr{}}, []string{"2", "0", "1"}, []int{0}},
+		{"filter AS", "f ff00:0:111\n0\n", PathChooserConfig{}, []string{"0", "2"}, []int{0}},
+		{"filter ISD", "f 2-\n0\n", PathChooserConfig{}, []string{"0"}, []int{0}},
+		{"filter cleared", "f 2-\nf\n0\n", PathChooserConfig{}, []string{"0", "1", "2"}, []int{0}},
+		{"sort and filter", "s hops\nf ff00:0:111\n0\n", PathChooserConfig{}, []string{"2", "0"}, []int{0}},
+		{"multi", "2, 0,2\n", PathChooserConfig{Multi: true}, []string{"0", "1", "2"}, []int{2, 0}},
+		{"single rejects multi", "2,0\n1\n", PathChooserConfig{}, []string{"0", "1", "2"}, []int{1}},
+		{"invalid commands", "s\ns foo\ns latency\nd 7\nd 1\n1\n", PathChooserConfig{}, []string{"0", "1", "2"}, []int{1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			chooser := newPathChooser(dst, paths, c.cfg, strings.NewReader(c.input), &out)
+			if chooser.probe != nil {
+				chooser.probe = func(paths []snet.Path) []PathProbe {
+					probes := make([]PathProbe, len(paths))
+					for i := range paths {
+						probes[i] = PathProbe{Path: paths[i], RTT: rtts[i]}
+						if rtts[i] == 0 {
+							probes[i].Loss = 1
+						}
+					}
+					return probes
+				}
+			}
+			chosen, err := chooser.choose()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			listed := listedIndices(out.String())
+			if strings.Join(listed, " ") != strings.Join(c.listed, " ") {
+				t.Errorf("expected paths %v to be listed, got %v\n%s", c.listed, listed, out.String())
+			}
+			if len(chosen) != len(c.expected) {
+				t.Fatalf("expected paths %v, got %v", c.expected, chosen)
+			}
+			for i, e := range c.expected {
+				if snet.Fingerprint(chosen[i]) != snet.Fingerprint(paths[e]) {
+					t.Errorf("expected path %d at position %d, got %v", e, i, chosen[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPathChooserDetails(t *testing.T) {
+	dst, paths := chooserTestPaths()
+	var out bytes.Buffer
+	c := newPathChooser(dst, paths, PathChooserConfig{}, strings.NewReader("d 0\nq\n"), &out)
+	if _, err := c.choose(); !errors.Is(err, errNoPathChosen) {
+		t.Fatalf("expected errNoPathChosen on quit, got %v", err)
+	}
+	for _, expected := range []string{
+		"Fingerprint: " + snet.Fingerprint(paths[0]).String(),
+		"1-ff00:0:110\x1b[0m  egress 1\n",
+		"1-ff00:0:111\x1b[0m  ingress 2, egress 3\n",
+		"2-ff00:0:210\x1b[0m  ingress 4, egress 5\n",
+		"1-ff00:0:112\x1b[0m  ingress 6\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected details to contain %q, got\n%s", expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/slayers/path/scion"
+	"github.com/scionproto/scion/go/lib/snet"
+	snetpath "github.com/scionproto/scion/go/lib/snet/path"
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+// PathInfo is a structured description of a path, for logging and storing
+// the path used by an application, e.g. together with a measurement.
+//
+// PathInfo is encoded as JSON with encoding/json. Additionally, String
+// returns a stable textual representation that can be parsed with
+// ParsePathInfo, e.g.
+//
+//	1-ff00:0:110 1>2 1-ff00:0:111 3>4 1-ff00:0:112 mtu=1472 expiry=2020-12-17T16:29:07Z
+//
+// The textual representation contains the hops, the MTU and the expiry (with a
+// precision of seconds) only.
+type PathInfo struct {
+	// Fingerprint identifies the path by its sequence of interfaces, see
+	// snet.Fingerprint, hex encoded.
+	Fingerprint string `json:"fingerprint"`
+	// Hops are the ASes on the path, from source to destination.
+	Hops []PathHop `json:"hops"`
+	// MTU is the maximum transmission unit for the path, in bytes.
+	MTU uint16 `json:"mtu,omitempty"`
+	// Expiry is the expiration time of the path.
+	Expiry time.Time `json:"expiry"`
+	// Latency lists the announced latencies between any two consecutive
+	// interfaces on the path, see snet.PathMetadata. Optional.
+	Latency []time.Duration `json:"latency,omitempty"`
+	// Bandwidth lists the announced bandwidths between any two consecutive
+	// interfaces on the path, in Kbit/s, see snet.PathMetadata. Optional.
+	Bandwidth []uint64 `json:"bandwidth,omitempty"`
+	// Geo lists the announced positions of the border routers for each
+	// interface on the path, see snet.PathMetadata. Optional.
+	Geo []snet.GeoCoordinates `json:"geo,omitempty"`
+}
+
+// PathHop is an AS on a path, with the interface IDs through which the path
+// enters and leaves the AS. The ingress interface of the first hop and the
+// egress interface of the last hop are 0.
+type PathHop struct {
+	IA      addr.IA         `json:"ia"`
+	Ingress common.IFIDType `json:"ingress"`
+	Egress  common.IFIDType `json:"egress"`
+}
+
+// NewPathInfo returns the description of the path.
+// Returns nil if path is nil, i.e. for the empty path in the local AS.
+func NewPathInfo(path snet.Path) *PathInfo {
+	if path == nil {
+		return nil
+	}
+	info := &PathInfo{
+		Fingerprint: snet.Fingerprint(path).String(),
+	}
+	md := path.Metadata()
+	if md == nil {
+		return info
+	}
+	info.Hops = hopsFromInterfaces(md.Interfaces)
+	info.MTU = md.MTU
+	info.Expiry = md.Expiry
+	if anyNonZeroDuration(md.Latency) {
+		info.Latency = append([]time.Duration(nil), md.Latency...)
+	}
+	if anyNonZeroUint64(md.Bandwidth) {
+		info.Bandwidth = append([]uint64(nil), md.Bandwidth...)
+	}
+	if anyNonZeroGeo(md.Geo) {
+		info.Geo = append([]snet.GeoCoordinates(nil), md.Geo...)
+	}
+	return info
+}
+
+// ReplyPathInfo returns the description of the dataplane path in raddr, e.g.
+// of the path on which replies are sent to a remote address returned by
+// ReadFrom on a listening conn. See Network.ReplyPathInfo.
+func ReplyPathInfo(raddr *snet.UDPAddr) *PathInfo {
+	return DefNetwork().ReplyPathInfo(raddr)
+}
+
+// ReplyPathInfo returns the description of the dataplane path in raddr.
+// The path is looked up among the paths to raddr.IA, to obtain its metadata.
+// If the path is not among these paths, e.g. because the remote has chosen a
+// path that is not allowed by the local path policy, only the interface IDs
+// are known; the IAs of the intermediate hops are the zero IA and the
+// fingerprint is empty.
+// Returns nil if raddr has an empty path, i.e. for a remote in the local AS,
+// or if the path cannot be decoded.
+func (n *Network) ReplyPathInfo(raddr *snet.UDPAddr) *PathInfo {
+	if raddr.Path.IsEmpty() {
+		return nil
+	}
+	if known := lookupPath(raddr.Path); known != nil {
+		return NewPathInfo(known.path)
+	}
+	// Querying the paths records them, see recordPaths
+	if _, err := n.paths.Get(raddr.IA); err == nil {
+		if known := lookupPath(raddr.Path); known != nil {
+			return NewPathInfo(known.path)
+		}
+	}
+	ids, ok := pathInterfaceIDs(raddr.Path)
+	if !ok || len(ids)%2 != 0 {
+		return nil
+	}
+	interfaces := make([]snet.PathInterface, len(ids))
+	for i, id := range ids {
+		interfaces[i].ID = id
+	}
+	if len(interfaces) > 0 {
+		interfaces[0].IA = n.IA
+		interfaces[len(interfaces)-1].IA = raddr.IA
+	}
+	return &PathInfo{Hops: hopsFromInterfaces(interfaces)}
+}
+
+// Interfaces returns the sequence of interfaces traversed by the path, as in
+// snet.PathMetadata.
+func (p *PathInfo) Interfaces() []snet.PathInterface {
+	if len(p.Hops) < 2 {
+		return nil
+	}
+	interfaces := make([]snet.PathInterface, 0, 2*len(p.Hops)-2)
+	for i, hop := range p.Hops {
+		if i > 0 {
+			interfaces = append(interfaces, snet.PathInterface{IA: hop.IA, ID: hop.Ingress})
+		}
+		if i < len(p.Hops)-1 {
+			interfaces = append(interfaces, snet.PathInterface{IA: hop.IA, ID: hop.Egress})
+		}
+	}
+	return interfaces
+}
+
+// ISDs returns the ISDs traversed by the path, in order and without
+// duplicates. Unknown IAs are skipped, see Network.ReplyPathInfo.
+func (p *PathInfo) ISDs() []addr.ISD {
+	var isds []addr.ISD
+	for _, hop := range p.Hops {
+		if hop.IA.I == 0 {
+			continue
+		}
+		if len(isds) == 0 || isds[len(isds)-1] != hop.IA.I {
+			isds = append(isds, hop.IA.I)
+		}
+	}
+	return isds
+}
+
+// String returns the textual representation of the path, see PathInfo.
+func (p *PathInfo) String() string {
+	if p == nil {
+		return ""
+	}
+	var b strings.Builder
+	for i, hop := range p.Hops {
+		if i > 0 {
+			fmt.Fprintf(&b, " %d>%d ", p.Hops[i-1].Egress, hop.Ingress)
+		}
+		b.WriteString(hop.IA.String())
+	}
+	if p.MTU != 0 {
+		fmt.Fprintf(&b, " mtu=%d", p.MTU)
+	}
+	if !p.Expiry.IsZero() {
+		fmt.Fprintf(&b, " expiry=%s", p.Expiry.UTC().Format(time.RFC3339))
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// ParsePathInfo parses the textual representation of a path, as returned by
+// PathInfo.String. The fingerprint is computed from the hops.
+func ParsePathInfo(s string) (*PathInfo, error) {
+	p := &PathInfo{}
+	fields := strings.Fields(s)
+	n := 0
+	for n < len(fields) && !strings.ContainsRune(fields[n], '=') {
+		n++
+	}
+	hops, attrs := fields[:n], fields[n:]
+	if len(hops)%2 == 0 && len(hops) > 0 {
+		return nil, fmt.Errorf("invalid path %q: expected IA after last link", s)
+	}
+	for i := 0; i < len(hops); i += 2 {
+		ia, err := addr.IAFromString(hops[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: invalid IA %q", s, hops[i])
+		}
+		hop := PathHop{IA: ia}
+		if i > 0 {
+			egress, ingress, err := parseLink(hops[i-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q: %s", s, err)
+			}
+			p.Hops[len(p.Hops)-1].Egress = egress
+			hop.Ingress = ingress
+		}
+		p.Hops = append(p.Hops, hop)
+	}
+	for _, attr := range attrs {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid path %q: unexpected %q after attributes", s, attr)
+		}
+		switch kv[0] {
+		case "mtu":
+			mtu, err := strconv.ParseUint(kv[1], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q: invalid MTU %q", s, kv[1])
+			}
+			p.MTU = uint16(mtu)
+		case "expiry":
+			expiry, err := time.Parse(time.RFC3339, kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q: invalid expiry %q", s, kv[1])
+			}
+			p.Expiry = expiry
+		default:
+			return nil, fmt.Errorf("invalid path %q: unknown attribute %q", s, kv[0])
+		}
+	}
+	p.Fingerprint = snet.Fingerprint(snetpath.Path{
+		Meta: snet.PathMetadata{Interfaces: p.Interfaces()},
+	}).String()
+	return p, nil
+}
+
+// parseLink parses a link "egress>ingress" between two hops.
+func parseLink(s string) (egress, ingress common.IFIDType, err error) {
+	parts := strings.Split(s, ">")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid link %q, expected egress>ingress", s)
+	}
+	if err := egress.UnmarshalText([]byte(parts[0])); err != nil {
+		return 0, 0, fmt.Errorf("invalid link %q: %s", s, err)
+	}
+	if err := ingress.UnmarshalText([]byte(parts[1])); err != nil {
+		return 0, 0, fmt.Errorf("invalid link %q: %s", s, err)
+	}
+	return egress, ingress, nil
+}
+
+// pathInterfaceIDs returns the IDs of the interfaces traversed by a SCION
+// dataplane path, in the order of traversal, like the interfaces in
+// snet.PathMetadata.
+func pathInterfaceIDs(p spath.Path) ([]common.IFIDType, bool) {
+	if p.Type != scion.PathType {
+		return nil, false
+	}
+	var decoded scion.Decoded
+	if err := decoded.DecodeFromBytes(p.Raw); err != nil {
+		return nil, false
+	}
+	var ids []common.IFIDType
+	hop := 0
+	for i := 0; i < decoded.NumINF; i++ {
+		consDir := decoded.InfoFields[i].ConsDir
+		for j := 0; j < int(decoded.PathMeta.SegLen[i]); j++ {
+			hf := decoded.HopFields[hop]
+			hop++
+			ingress, egress := hf.ConsIngress, hf.ConsEgress
+			if !consDir {
+				ingress, egress = egress, ingress
+			}
+			if ingress != 0 {
+				ids = append(ids, common.IFIDType(ingress))
+			}
+			if egress != 0 {
+				ids = append(ids, common.IFIDType(egress))
+			}
+		}
+	}
+	return ids, true
+}
+
+func hopsFromInterfaces(interfaces []snet.PathInterface) []PathHop {
+	if len(interfaces) == 0 {
+		return nil
+	}
+	hops := []PathHop{{IA: interfaces[0].IA, Egress: interfaces[0].ID}}
+	for i := 1; i < len(interfaces)-1; i += 2 {
+		hops = append(hops, PathHop{
+			IA:      interfaces[i].IA,
+			Ingress: interfaces[i].ID,
+			Egress:  interfaces[i+1].ID,
+		})
+	}
+	last := interfaces[len(interfaces)-1]
+	return append(hops, PathHop{IA: last.IA, Ingress: last.ID})
+}
+
+func anyNonZeroDuration(l []time.Duration) bool {
+	for _, v := range l {
+		if v != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func anyNonZeroUint64(l []uint64) bool {
+	for _, v := range l {
+		if v != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func anyNonZeroGeo(l []snet.GeoCoordinates) bool {
+	for _, v := range l {
+		if v != (snet.GeoCoordinates{}) {
+			return true
+		}
+	}
+	return false
+}
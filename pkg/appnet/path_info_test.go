@@ -0,0 +1,210 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	slpath "github.com/scionproto/scion/go/lib/slayers/path"
+	"github.com/scionproto/scion/go/lib/slayers/path/scion"
+	"github.com/scionproto/scion/go/lib/snet"
+	snetpath "github.com/scionproto/scion/go/lib/snet/path"
+)
+
+func TestPathInfo(t *testing.T) {
+	ia110 := addr.IA{I: 1, A: 0xff0000000110}
+	ia111 := addr.IA{I: 1, A: 0xff0000000111}
+	ia112 := addr.IA{I: 1, A: 0xff0000000112}
+	expiry := time.Date(2020, 12, 17, 16, 29, 7, 0, time.UTC)
+	path := snetpath.Path{
+		Meta: snet.PathMetadata{
+			Interfaces: []snet.PathInterface{
+				{IA: ia110, ID: 1},
+				{IA: ia111, ID: 2},
+				{IA: ia111, ID: 3},
+				{IA: ia112, ID: 4},
+			},
+			MTU:       1472,
+			Expiry:    expiry,
+			Latency:   []time.Duration{10 * time.Millisecond, 0, 5 * time.Millisecond},
+			Bandwidth: []uint64{0, 0, 0},
+		},
+	}
+	info := NewPathInfo(path)
+
+	expectedHops := []PathHop{
+		{IA: ia110, Egress: 1},
+		{IA: ia111, Ingress: 2, Egress: 3},
+		{IA: ia112, Ingress: 4},
+	}
+	if !reflect.DeepEqual(info.Hops, expectedHops) {
+		t.Errorf("wrong hops, expected %v, got %v", expectedHops, info.Hops)
+	}
+	if !reflect.DeepEqual(info.Interfaces(), path.Meta.Interfaces) {
+		t.Errorf("wrong interfaces, expected %v, got %v", path.Meta.Interfaces, info.Interfaces())
+	}
+	if info.Fingerprint != snet.Fingerprint(path).String() {
+		t.Errorf("wrong fingerprint %s", info.Fingerprint)
+	}
+	if info.Bandwidth != nil || info.Geo != nil {
+		t.Errorf("expected unannounced metadata to be omitted, got %v, %v", info.Bandwidth, info.Geo)
+	}
+
+	// Text round trip
+	expectedText := "1-ff00:0:110 1>2 1-ff00:0:111 3>4 1-ff00:0:112 mtu=1472 expiry=2020-12-17T16:29:07Z"
+	if text := info.String(); text != expectedText {
+		t.Errorf("wrong text, expected %q, got %q", expectedText, text)
+	}
+	parsed, err := ParsePathInfo(expectedText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	textInfo := *info
+	textInfo.Latency = nil
+	if !reflect.DeepEqual(*parsed, textInfo) {
+		t.Errorf("wrong parsed path, expected %+v, got %+v", textInfo, *parsed)
+	}
+
+	// JSON round trip
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded PathInfo
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, *info) {
+		t.Errorf("wrong JSON round trip, expected %+v, got %+v (%s)", *info, decoded, encoded)
+	}
+
+	if NewPathInfo(nil) != nil {
+		t.Errorf("expected nil PathInfo for nil path")
+	}
+}
+
+func TestParsePathInfo(t *testing.T) {
+	valid := []string{
+		"",
+		"1-ff00:0:110 1>2 1-ff00:0:111",
+		"1-ff00:0:110 1>2 1-ff00:0:111 mtu=1280",
+		"  1-ff00:0:110   1>2 1-ff00:0:111   ",
+	}
+	for _, s := range valid {
+		if _, err := ParsePathInfo(s); err != nil {
+			t.Errorf("unexpected error for %q: %s", s, err)
+		}
+	}
+	invalid := []string{
+		"1-ff00:0:110 1>2",
+		"1-ff00:0:110 1-ff00:0:111",
+		"1-ff00:0:110 1>2>3 1-ff00:0:111",
+		"1-ff00:0:110 a>2 1-ff00:0:111",
+		"foo 1>2 1-ff00:0:111",
+		"1-ff00:0:110 1>2 1-ff00:0:111 mtu=x",
+		"1-ff00:0:110 1>2 1-ff00:0:111 mtu=70000",
+		"1-ff00:0:110 1>2 1-ff00:0:111 expiry=tomorrow",
+		"1-ff00:0:110 1>2 1-ff00:0:111 foo=bar",
+		"1-ff00:0:110 1>2 1-ff00:0:111 mtu=1280 1-ff00:0:112",
+	}
+	for _, s := range invalid {
+		if _, err := ParsePathInfo(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestReplyPathInfo(t *testing.T) {
+	ia110 := addr.IA{I: 1, A: 0xff0000000110}
+	ia111 := addr.IA{I: 1, A: 0xff0000000111}
+	ia112 := addr.IA{I: 1, A: 0xff0000000112}
+	// Up segment 110->111 and down segment 111->112
+	newDecoded := func() *scion.Decoded {
+		return &scion.Decoded{
+			Base: scion.Base{
+				PathMeta: scion.MetaHdr{SegLen: [3]uint8{2, 2, 0}},
+				NumINF:   2,
+				NumHops:  4,
+			},
+			InfoFields: []*slpath.InfoField{
+				{SegID: 0x111, Timestamp: 1},
+				{SegID: 0x222, Timestamp: 2, ConsDir: true},
+			},
+			HopFields: []*slpath.HopField{
+				{ConsIngress: 1, ConsEgress: 0, Mac: []byte{1, 1, 1, 1, 1, 1}},
+				{ConsIngress: 0, ConsEgress: 2, Mac: []byte{2, 2, 2, 2, 2, 2}},
+				{ConsIngress: 0, ConsEgress: 3, Mac: []byte{3, 3, 3, 3, 3, 3}},
+				{ConsIngress: 4, ConsEgress: 0, Mac: []byte{4, 4, 4, 4, 4, 4}},
+			},
+		}
+	}
+	p := snetpath.Path{
+		Dst:   ia112,
+		SPath: serializeSCIONPath(t, newDecoded()),
+		Meta: snet.PathMetadata{Interfaces: []snet.PathInterface{
+			{IA: ia110, ID: 1},
+			{IA: ia111, ID: 2},
+			{IA: ia111, ID: 3},
+			{IA: ia112, ID: 4},
+		}},
+	}
+	n := NewCustomNetwork(ia110, nil, &mockQuerier{paths: []snet.Path{p}}, nil, Config{})
+	defer n.Close()
+
+	// The path of a received packet, reversed by snet, with the segment IDs
+	// updated by the routers on the way.
+	received := newDecoded()
+	received.InfoFields[0].SegID = 0x333
+	received.InfoFields[1].SegID = 0x444
+	raddr := &snet.UDPAddr{IA: ia112, Path: serializeSCIONPath(t, received)}
+	info := n.ReplyPathInfo(raddr)
+	if info == nil || info.Fingerprint != snet.Fingerprint(p).String() {
+		t.Fatalf("expected info for the known path, got %+v", info)
+	}
+
+	unknown := newDecoded()
+	unknown.HopFields[1].Mac = []byte{5, 5, 5, 5, 5, 5}
+	raddr.Path = serializeSCIONPath(t, unknown)
+	info = n.ReplyPathInfo(raddr)
+	expectedHops := []PathHop{
+		{IA: ia110, Egress: 1},
+		{Ingress: 2, Egress: 3},
+		{IA: ia112, Ingress: 4},
+	}
+	if info == nil || !reflect.DeepEqual(info.Hops, expectedHops) || info.Fingerprint != "" {
+		t.Fatalf("expected hops %v for the unknown path, got %+v", expectedHops, info)
+	}
+	if isds := info.ISDs(); !reflect.DeepEqual(isds, []addr.ISD{1}) {
+		t.Errorf("expected ISDs [1], got %v", isds)
+	}
+
+	if info := n.ReplyPathInfo(&snet.UDPAddr{IA: ia110}); info != nil {
+		t.Errorf("expected nil info for empty path, got %+v", info)
+	}
+}
+
+func TestPathInfoISDs(t *testing.T) {
+	info, err := ParsePathInfo("1-ff00:0:110 1>2 2-ff00:0:210 3>4 2-ff00:0:211 5>6 1-ff00:0:111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isds := info.ISDs(); !reflect.DeepEqual(isds, []addr.ISD{1, 2, 1}) {
+		t.Errorf("expected ISDs [1 2 1], got %v", isds)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/topology/underlay"
+)
+
+// ProbeConfig contains the parameters for ProbePaths.
+// Zero values are replaced by defaults.
+type ProbeConfig struct {
+	// Attempts is the number of SCMP echo requests sent on each path.
+	Attempts uint16
+	// Interval is the time between two echo requests on the same path.
+	Interval time.Duration
+	// Timeout is the time after which an echo request is considered lost.
+	Timeout time.Duration
+}
+
+const (
+	defaultProbeAttempts = 3
+	defaultProbeInterval = 100 * time.Millisecond
+	defaultProbeTimeout  = 1 * time.Second
+)
+
+// PathProbe is the result of probing a path with SCMP echo requests.
+type PathProbe struct {
+	Path snet.Path
+	// RTT is the average round trip time of the echo replies received.
+	// Zero if no reply was received.
+	RTT time.Duration
+	// Loss is the fraction of echo requests without reply, in [0,1].
+	Loss float64
+	// Err is the error that occurred while probing this path, if any.
+	Err error
+}
+
+// ProbePaths sends SCMP echo requests to the host dst over each of the paths
+// and measures the round trip time and loss. All paths are probed concurrently.
+// The result contains one entry for each path, in the same order.
+func ProbePaths(ctx context.Context, dst *snet.UDPAddr, paths []snet.Path, cfg ProbeConfig) []PathProbe {
+	return DefNetwork().ProbePaths(ctx, dst, paths, cfg)
+}
+
+// ProbePaths sends SCMP echo requests over each of the paths.
+// See ProbePaths.
+func (n *Network) ProbePaths(ctx context.Context, dst *snet.UDPAddr, paths []snet.Path, cfg ProbeConfig) []PathProbe {
+	if cfg.Attempts == 0 {
+		cfg.Attempts = defaultProbeAttempts
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultProbeInterval
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultProbeTimeout
+	}
+
+	probes := make([]PathProbe, len(paths))
+	var wg sync.WaitGroup
+	wg.Add(len(paths))
+	for i := range paths {
+		go func(i int) {
+			defer wg.Done()
+			probes[i] = n.probePath(ctx, dst, paths[i], cfg)
+		}(i)
+	}
+	wg.Wait()
+	return probes
+}
+
+func (n *Network) probePath(ctx context.Context, dst *snet.UDPAddr, path snet.Path, cfg ProbeConfig) PathProbe {
+	remote := dst.Copy()
+	SetPath(remote, path)
+	localIP, err := n.resolveLocal(remote)
+	if err != nil {
+		return PathProbe{Path: path, Loss: 1, Err: err}
+	}
+	local := &snet.UDPAddr{IA: n.IA, Host: &net.UDPAddr{IP: localIP}}
+
+	sent, rtts, err := n.probeEcho(ctx, local, remote, cfg)
+	if err != nil {
+		return PathProbe{Path: path, Loss: 1, Err: err}
+	}
+	probe := PathProbe{Path: path, Loss: 1}
+	if sent > 0 {
+		probe.Loss = 1 - float64(len(rtts))/float64(sent)
+	}
+	if len(rtts) > 0 {
+		var sum time.Duration
+		for _, rtt := range rtts {
+			sum += rtt
+		}
+		probe.RTT = sum / time.Duration(len(rtts))
+	}
+	return probe
+}
+
+// echoReply is an SCMP echo reply with the sequence number seq, received at
+// time received.
+type echoReply struct {
+	seq      uint16
+	received time.Time
+}
+
+// probeEcho sends cfg.Attempts SCMP echo requests from local to remote, one
+// every cfg.Interval, and returns the number of requests sent and the round
+// trip times of the replies received within cfg.Timeout.
+// This does not use the scion ping package, whose Run is not free of data
+// races.
+func (n *Network) probeEcho(ctx context.Context, local, remote *snet.UDPAddr,
+	cfg ProbeConfig) (int, []time.Duration, error) {
+
+	conn, port, err := n.dispatcher.Register(ctx, local.IA, local.Host, addr.SvcNone)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+	local = local.Copy()
+	local.Host.Port = int(port)
+	nextHop := remote.NextHop
+	if nextHop == nil && local.IA == remote.IA {
+		nextHop = &net.UDPAddr{IP: remote.Host.IP, Port: underlay.EndhostPort}
+	}
+
+	id := uint16(rand.Uint32())
+	replies := make(chan echoReply, cfg.Attempts)
+	done := make(chan struct{})
+	defer close(done)
+	go readEchoReplies(conn, id, replies, done)
+
+	sent := make([]time.Time, 0, cfg.Attempts)
+	send := func() error {
+		pkt := &snet.Packet{
+			PacketInfo: snet.PacketInfo{
+				Source:      snet.SCIONAddress{IA: local.IA, Host: addr.HostFromIP(local.Host.IP)},
+				Destination: snet.SCIONAddress{IA: remote.IA, Host: addr.HostFromIP(remote.Host.IP)},
+				Path:        remote.Path,
+				Payload: snet.SCMPEchoRequest{
+					Identifier: id,
+					SeqNumber:  uint16(len(sent)),
+				},
+			},
+		}
+		if err := pkt.Serialize(); err != nil {
+			return err
+		}
+		if _, err := conn.WriteTo(pkt.Bytes, nextHop); err != nil {
+			return err
+		}
+		sent = append(sent, time.Now())
+		return nil
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	// timeout is set once all requests are sent
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	startTimeout := func() {
+		if len(sent) == int(cfg.Attempts) {
+			timer = time.NewTimer(cfg.Timeout)
+			timeout = timer.C
+		}
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	if err := send(); err != nil {
+		return 0, nil, err
+	}
+	startTimeout()
+	var rtts []time.Duration
+	received := make(map[uint16]bool)
+	for len(received) < int(cfg.Attempts) {
+		select {
+		case <-ticker.C:
+			if len(sent) < int(cfg.Attempts) {
+				if err := send(); err != nil {
+					return len(sent), rtts, err
+				}
+				startTimeout()
+			}
+		case r := <-replies:
+			if int(r.seq) >= len(sent) || received[r.seq] {
+				continue
+			}
+			if rtt := r.received.Sub(sent[r.seq]); rtt <= cfg.Timeout {
+				received[r.seq] = true
+				rtts = append(rtts, rtt)
+			}
+		case <-timeout:
+			return len(sent), rtts, nil
+		case <-ctx.Done():
+			return len(sent), rtts, nil
+		}
+	}
+	return len(sent), rtts, nil
+}
+
+// readEchoReplies reads the echo replies with the identifier id from conn,
+// until conn is closed.
+func readEchoReplies(conn net.PacketConn, id uint16, replies chan<- echoReply, done <-chan struct{}) {
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		pkt := &snet.Packet{Bytes: buf[:n]}
+		if err := pkt.Decode(); err != nil {
+			continue
+		}
+		echo, ok := pkt.Payload.(snet.SCMPEchoReply)
+		if !ok || echo.Identifier != id {
+			continue
+		}
+		select {
+		case replies <- echoReply{seq: echo.SeqNumber, received: received}:
+		case <-done:
+			return
+		}
+	}
+}
@@ -15,15 +15,11 @@
 package appnet
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"math"
-	"os"
-	"regexp"
-	"strconv"
+	"time"
 
-	"github.com/bclicn/color"
 	log "github.com/inconshreveable/log15"
 
 	"github.com/scionproto/scion/go/lib/addr"
@@ -36,49 +32,89 @@ const (
 	PathAlgoDefault = iota // default algorithm
 	MTU                    // metric for path with biggest MTU
 	Shortest               // metric for shortest path
+	Latency                // metric for path with lowest measured round trip time
+	Loss                   // metric for path with lowest measured packet loss
 )
 
-// ChoosePathInteractive presents the user a selection of paths to choose from.
-// If the remote address is in the local IA, return (nil, nil), without prompting the user.
-func ChoosePathInteractive(dst addr.IA) (snet.Path, error) {
+// ChoosePathByMetric chooses the best path to dst based on the metric pathAlgo.
+// If the remote address is in the local IA, return (nil, nil).
+//
+// The Latency and Loss metrics require the address of a host to probe, use
+// ChoosePathByMetricAddr for these.
+func ChoosePathByMetric(pathAlgo int, dst addr.IA) (snet.Path, error) {
+	return DefNetwork().ChoosePathByMetric(pathAlgo, dst)
+}
 
-	paths, err := QueryPaths(dst)
-	if err != nil || len(paths) == 0 {
-		return nil, err
+// ChoosePathByMetric chooses the best path to dst based on the metric pathAlgo.
+// See ChoosePathByMetric.
+func (n *Network) ChoosePathByMetric(pathAlgo int, dst addr.IA) (snet.Path, error) {
+	if pathAlgo == Latency || pathAlgo == Loss {
+		return nil, fmt.Errorf("path selection by %s requires a host to probe, use ChoosePathByMetricAddr",
+			pathAlgoName(pathAlgo))
 	}
+	return n.ChoosePathByMetricAddr(pathAlgo, &snet.UDPAddr{IA: dst})
+}
 
-	fmt.Printf("Available paths to %v\n", dst)
-	for i, path := range paths {
-		fmt.Printf("[%2d] %s\n", i, fmt.Sprintf("%s", path))
-	}
+// ChoosePathByMetricAddr chooses the best path to dst based on the metric
+// pathAlgo. The Latency and Loss metrics are measured by probing all paths
+// with SCMP echo requests to dst, see ProbePaths.
+// If the remote address is in the local IA, return (nil, nil).
+func ChoosePathByMetricAddr(pathAlgo int, dst *snet.UDPAddr) (snet.Path, error) {
+	return DefNetwork().ChoosePathByMetricAddr(pathAlgo, dst)
+}
 
-	var selectedPath snet.Path
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		fmt.Printf("Choose path: ")
-		scanner.Scan()
-		pathIndexStr := scanner.Text()
-		pathIndex, err := strconv.Atoi(pathIndexStr)
-		if err == nil && 0 <= pathIndex && pathIndex < len(paths) {
-			selectedPath = paths[pathIndex]
-			break
-		}
-		fmt.Printf("ERROR: Invalid path index %v, valid indices range: [0, %v]\n", pathIndex, len(paths)-1)
+// ChoosePathByMetricAddr chooses the best path to dst based on the metric
+// pathAlgo. See ChoosePathByMetricAddr.
+func (n *Network) ChoosePathByMetricAddr(pathAlgo int, dst *snet.UDPAddr) (snet.Path, error) {
+
+	candidates, err := n.queryPathCandidates(dst, pathAlgo == Latency || pathAlgo == Loss)
+	if err != nil || len(candidates) == 0 {
+		return nil, err
 	}
-	re := regexp.MustCompile(`\d{1,4}-([0-9a-f]{1,4}:){2}[0-9a-f]{1,4}`)
-	fmt.Printf("Using path:\n %s\n", re.ReplaceAllStringFunc(fmt.Sprintf("%s", selectedPath), color.Cyan))
-	return selectedPath, nil
+	return pathSelection(candidates, pathAlgo), nil
 }
 
-// ChoosePathByMetric chooses the best path based on the metric pathAlgo
+// ChoosePathByWeightedMetrics chooses the best path to dst based on the
+// weighted sum of the normalized scores of multiple metrics. The weights map
+// the metrics (MTU, Shortest, Latency, Loss) to their relative weight, e.g.
+//
+//	appnet.ChoosePathByWeightedMetrics(map[int]float64{appnet.Latency: 2, appnet.MTU: 1}, dst)
+//
 // If the remote address is in the local IA, return (nil, nil).
-func ChoosePathByMetric(pathAlgo int, dst addr.IA) (snet.Path, error) {
+func ChoosePathByWeightedMetrics(weights map[int]float64, dst *snet.UDPAddr) (snet.Path, error) {
+	return DefNetwork().ChoosePathByWeightedMetrics(weights, dst)
+}
+
+// ChoosePathByWeightedMetrics chooses the best path to dst based on the
+// weighted sum of the scores of multiple metrics.
+// See ChoosePathByWeightedMetrics.
+func (n *Network) ChoosePathByWeightedMetrics(weights map[int]float64, dst *snet.UDPAddr) (snet.Path, error) {
 
-	paths, err := QueryPaths(dst)
+	candidates, err := n.queryPathCandidates(dst, weights[Latency] != 0 || weights[Loss] != 0)
+	if err != nil || len(candidates) == 0 {
+		return nil, err
+	}
+	return weightedPathSelection(candidates, weights), nil
+}
+
+// queryPathCandidates queries the paths to dst and, if requested, probes
+// them to measure latency and loss.
+func (n *Network) queryPathCandidates(dst *snet.UDPAddr, probe bool) ([]pathCandidate, error) {
+	paths, err := n.QueryPaths(dst.IA)
 	if err != nil || len(paths) == 0 {
 		return nil, err
 	}
-	return pathSelection(paths, pathAlgo), nil
+	candidates := make([]pathCandidate, len(paths))
+	for i, p := range paths {
+		candidates[i] = pathCandidate{path: p}
+	}
+	if probe {
+		probes := n.ProbePaths(context.Background(), dst, paths, ProbeConfig{})
+		for i := range probes {
+			candidates[i].probe = &probes[i]
+		}
+	}
+	return candidates, nil
 }
 
 // SetPath is a helper function to set the path on an snet.UDPAddr
@@ -95,7 +131,13 @@ func SetPath(addr *snet.UDPAddr, path snet.Path) {
 // SetDefaultPath sets the first path returned by a query to sciond.
 // This is a no-op if if remote is in the local AS.
 func SetDefaultPath(addr *snet.UDPAddr) error {
-	paths, err := QueryPaths(addr.IA)
+	return DefNetwork().SetDefaultPath(addr)
+}
+
+// SetDefaultPath sets the first path returned by a query to sciond.
+// See SetDefaultPath.
+func (n *Network) SetDefaultPath(addr *snet.UDPAddr) error {
+	paths, err := n.QueryPaths(addr.IA)
 	if err != nil || len(paths) == 0 {
 		return err
 	}
@@ -105,17 +147,66 @@ func SetDefaultPath(addr *snet.UDPAddr) error {
 
 // QueryPaths queries the DefNetwork's sciond PathQuerier connection for paths to addr
 // If addr is in the local IA, an empty slice and no error is returned.
+// If a path policy is set, only the paths allowed by the policy are returned.
+// Likewise, if a path specification is set for ia, only the matching paths
+// are returned, see SetPathSpec.
+//
+// The paths are cached and refreshed in the background before they expire,
+// so that repeated queries for the same destination do not reach sciond.
 func QueryPaths(ia addr.IA) ([]snet.Path, error) {
-	if ia == DefNetwork().IA {
+	return DefNetwork().QueryPaths(ia)
+}
+
+// QueryPaths queries the Network's sciond PathQuerier connection for paths to addr
+// See QueryPaths.
+func (n *Network) QueryPaths(ia addr.IA) ([]snet.Path, error) {
+	if ia == n.IA {
 		return nil, nil
-	} else {
-		paths, err := DefNetwork().PathQuerier.Query(context.Background(), ia)
-		if err != nil || len(paths) == 0 {
-			return nil, err
+	}
+	paths, err := n.paths.Get(ia)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+	return n.applyPathPolicy(ia, paths)
+}
+
+// SubscribePaths registers notify to be called with the new paths to ia
+// whenever the paths in the DefNetwork's path cache change.
+// See Network.SubscribePaths.
+func SubscribePaths(ia addr.IA, notify func(paths []snet.Path)) (unsubscribe func()) {
+	return DefNetwork().SubscribePaths(ia, notify)
+}
+
+// SubscribePaths registers notify to be called with the new paths to ia
+// whenever the paths in the Network's path cache change, i.e. when paths are
+// added or removed, or when they are refreshed before their expiry.
+// The path policy is applied to the paths passed to notify.
+// The notify function is called from the background refresh and should
+// return quickly. The returned function cancels the subscription.
+func (n *Network) SubscribePaths(ia addr.IA, notify func(paths []snet.Path)) (unsubscribe func()) {
+	return n.paths.Subscribe(ia, func(paths []snet.Path) {
+		paths, err := n.applyPathPolicy(ia, paths)
+		if err != nil {
+			log.Debug("SubscribePaths: no path allowed", "ia", ia, "err", err)
+		}
+		notify(paths)
+	})
+}
+
+func (n *Network) applyPathPolicy(ia addr.IA, paths []snet.Path) ([]snet.Path, error) {
+	if policy := n.PathPolicy(); policy != nil {
+		paths = policy.Filter(paths)
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no path to %s allowed by path policy", ia)
+		}
+	}
+	if spec := n.PathSpec(ia); spec != nil {
+		paths = spec.Filter(paths)
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no path to %s matches path %q", ia, spec)
 		}
-		paths = filterDuplicates(paths)
-		return paths, nil
 	}
+	return paths, nil
 }
 
 // filterDuplicates filters paths with identical sequence of interfaces.
@@ -148,27 +239,39 @@ func filterDuplicates(paths []snet.Path) []snet.Path {
 	return filtered
 }
 
-func pathSelection(paths []snet.Path, pathAlgo int) snet.Path {
+// pathCandidate is a path considered for path selection, with the
+// result of probing the path, if available.
+type pathCandidate struct {
+	path  snet.Path
+	probe *PathProbe
+}
+
+// A path selection algorithm consists of a metric function normalizing some path
+// property to a value in [0,1], where larger is better; the path with the
+// best score is selected.
+// Available path selection algorithms, the metric returned must be normalized between [0,1]:
+var pathAlgos = map[int](func(pathCandidate) float64){
+	Shortest: shortestPathMetric,
+	MTU:      largestMTUPathMetric,
+	Latency:  lowestLatencyPathMetric,
+	Loss:     lowestLossPathMetric,
+}
+
+// defaultPathAlgos are the algorithms considered by the default algorithm.
+// The probing metrics are not included, as probing is comparatively slow.
+var defaultPathAlgos = []int{Shortest, MTU}
+
+func pathSelection(candidates []pathCandidate, pathAlgo int) snet.Path {
 	var selectedPath snet.Path
 	var metric float64
-	// A path selection algorithm consists of a simple comparison function selecting the best path according
-	// to some path property and a metric function normalizing that property to a value in [0,1], where larger is better
-	// Available path selection algorithms, the metric returned must be normalized between [0,1]:
-	pathAlgos := map[int](func([]snet.Path) (snet.Path, float64)){
-		Shortest: selectShortestPath,
-		MTU:      selectLargestMTUPath,
-	}
 	switch pathAlgo {
-	case Shortest:
-		log.Debug("Path selection algorithm", "pathAlgo", "shortest")
-		selectedPath, metric = pathAlgos[pathAlgo](paths)
-	case MTU:
-		log.Debug("Path selection algorithm", "pathAlgo", "MTU")
-		selectedPath, metric = pathAlgos[pathAlgo](paths)
+	case Shortest, MTU, Latency, Loss:
+		log.Debug("Path selection algorithm", "pathAlgo", pathAlgoName(pathAlgo))
+		selectedPath, metric = selectBestPath(candidates, pathAlgos[pathAlgo])
 	default:
 		// Default is to take result with best score
-		for _, algo := range pathAlgos {
-			cadidatePath, cadidateMetric := algo(paths)
+		for _, algo := range defaultPathAlgos {
+			cadidatePath, cadidateMetric := selectBestPath(candidates, pathAlgos[algo])
 			if cadidateMetric > metric {
 				selectedPath = cadidatePath
 				metric = cadidateMetric
@@ -179,35 +282,86 @@ func pathSelection(paths []snet.Path, pathAlgo int) snet.Path {
 	return selectedPath
 }
 
-func selectShortestPath(paths []snet.Path) (selectedPath snet.Path, metric float64) {
-	// Selects shortest path by number of hops
-	for _, path := range paths {
-		if selectedPath == nil || len(path.Metadata().Interfaces) < len(selectedPath.Metadata().Interfaces) {
-			selectedPath = path
+func weightedPathSelection(candidates []pathCandidate, weights map[int]float64) snet.Path {
+	var totalWeight float64
+	for algo, weight := range weights {
+		if _, ok := pathAlgos[algo]; ok {
+			totalWeight += weight
 		}
 	}
-	metricFn := func(rawMetric int) (result float64) {
-		hopCount := float64(rawMetric)
-		midpoint := 7.0
-		result = math.Exp(-(hopCount - midpoint)) / (1 + math.Exp(-(hopCount - midpoint)))
-		return result
+	weightedMetric := func(c pathCandidate) (result float64) {
+		if totalWeight == 0 {
+			return 0
+		}
+		for algo, weight := range weights {
+			if metricFn, ok := pathAlgos[algo]; ok {
+				result += weight * metricFn(c)
+			}
+		}
+		return result / totalWeight
 	}
-	return selectedPath, metricFn(len(selectedPath.Metadata().Interfaces))
+	selectedPath, metric := selectBestPath(candidates, weightedMetric)
+	log.Debug("Path selection algorithm choice", "path", fmt.Sprintf("%s", selectedPath), "score", metric)
+	return selectedPath
 }
 
-func selectLargestMTUPath(paths []snet.Path) (selectedPath snet.Path, metric float64) {
-	// Selects path with largest MTU
-	for _, path := range paths {
-		if selectedPath == nil || path.Metadata().MTU > selectedPath.Metadata().MTU {
-			selectedPath = path
+// selectBestPath returns the first of the candidates with the best score.
+func selectBestPath(candidates []pathCandidate, metricFn func(pathCandidate) float64) (selectedPath snet.Path, metric float64) {
+	for _, c := range candidates {
+		m := metricFn(c)
+		if selectedPath == nil || m > metric {
+			selectedPath = c.path
+			metric = m
 		}
 	}
-	metricFn := func(rawMetric uint16) (result float64) {
-		mtu := float64(rawMetric)
-		midpoint := 1500.0
-		tilt := 0.004
-		result = 1 / (1 + math.Exp(-tilt*(mtu-midpoint)))
-		return result
+	return selectedPath, metric
+}
+
+func pathAlgoName(pathAlgo int) string {
+	switch pathAlgo {
+	case Shortest:
+		return "shortest"
+	case MTU:
+		return "MTU"
+	case Latency:
+		return "latency"
+	case Loss:
+		return "loss"
+	default:
+		return "default"
+	}
+}
+
+func shortestPathMetric(c pathCandidate) float64 {
+	// Prefers shortest path by number of hops
+	hopCount := float64(len(c.path.Metadata().Interfaces))
+	midpoint := 7.0
+	return math.Exp(-(hopCount - midpoint)) / (1 + math.Exp(-(hopCount - midpoint)))
+}
+
+func largestMTUPathMetric(c pathCandidate) float64 {
+	// Prefers path with largest MTU
+	mtu := float64(c.path.Metadata().MTU)
+	midpoint := 1500.0
+	tilt := 0.004
+	return 1 / (1 + math.Exp(-tilt*(mtu-midpoint)))
+}
+
+func lowestLatencyPathMetric(c pathCandidate) float64 {
+	// Prefers path with lowest measured RTT; paths without any reply score 0
+	if c.probe == nil || c.probe.Err != nil || c.probe.Loss >= 1 {
+		return 0
+	}
+	rtt := float64(c.probe.RTT) / float64(time.Millisecond)
+	midpoint := 150.0
+	tilt := 0.02
+	return 1 / (1 + math.Exp(tilt*(rtt-midpoint)))
+}
+
+func lowestLossPathMetric(c pathCandidate) float64 {
+	// Prefers path with lowest measured loss rate
+	if c.probe == nil || c.probe.Err != nil {
+		return 0
 	}
-	return selectedPath, metricFn(selectedPath.Metadata().MTU)
+	return 1 - c.probe.Loss
 }
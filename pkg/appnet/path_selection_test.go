@@ -0,0 +1,69 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+func TestPathSelection(t *testing.T) {
+	// short: 2 hops, small MTU, slow
+	// large: 6 hops, large MTU, fast but lossy
+	// fast:  4 hops, medium MTU, fast and reliable
+	short := &mockPath{metadata: &snet.PathMetadata{Interfaces: make([]snet.PathInterface, 2), MTU: 1280}}
+	large := &mockPath{metadata: &snet.PathMetadata{Interfaces: make([]snet.PathInterface, 6), MTU: 9000}}
+	fast := &mockPath{metadata: &snet.PathMetadata{Interfaces: make([]snet.PathInterface, 4), MTU: 1472}}
+	candidates := []pathCandidate{
+		{short, &PathProbe{Path: short, RTT: 300 * time.Millisecond, Loss: 0}},
+		{large, &PathProbe{Path: large, RTT: 20 * time.Millisecond, Loss: 2.0 / 3}},
+		{fast, &PathProbe{Path: fast, RTT: 30 * time.Millisecond, Loss: 0}},
+	}
+
+	cases := []struct {
+		pathAlgo int
+		expected snet.Path
+	}{
+		{Shortest, short},
+		{MTU, large},
+		{Latency, large},
+		{Loss, short},
+	}
+	for _, c := range cases {
+		actual := pathSelection(candidates, c.pathAlgo)
+		if actual != c.expected {
+			t.Errorf("wrong path for algorithm %s, expected %v, got %v",
+				pathAlgoName(c.pathAlgo), c.expected.Metadata(), actual.Metadata())
+		}
+	}
+
+	weighted := weightedPathSelection(candidates, map[int]float64{Latency: 1, Loss: 1})
+	if weighted != fast {
+		t.Errorf("wrong path for weighted latency and loss, expected %v, got %v",
+			fast.Metadata(), weighted.Metadata())
+	}
+}
+
+func TestPathSelectionUnprobed(t *testing.T) {
+	p := &mockPath{metadata: &snet.PathMetadata{MTU: 1472}}
+	unreachable := &PathProbe{Path: p, Loss: 1}
+	for _, c := range []pathCandidate{{p, nil}, {p, unreachable}} {
+		if m := lowestLatencyPathMetric(c); m != 0 {
+			t.Errorf("expected latency metric 0 for path without replies, got %v", m)
+		}
+	}
+}
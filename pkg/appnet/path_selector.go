@@ -0,0 +1,232 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// PathSelector schedules the packets sent to one destination IA in a
+// MultipathConn onto the available paths.
+type PathSelector interface {
+	// Reset initializes this path selector with the paths available to the
+	// destination dst. The paths are never empty.
+	Reset(dst *snet.UDPAddr, paths []snet.Path) error
+	// Next returns the paths on which the next packet is sent.
+	Next() []snet.Path
+}
+
+var errNoPaths = errors.New("no paths")
+
+// StaticSelector implements static path selection.
+// The connection uses the first path for all packets.
+type StaticSelector struct {
+	path []snet.Path
+}
+
+func (s *StaticSelector) Reset(dst *snet.UDPAddr, paths []snet.Path) error {
+	if len(paths) == 0 {
+		return errNoPaths
+	}
+	s.path = paths[:1]
+	return nil
+}
+
+func (s *StaticSelector) Next() []snet.Path {
+	return s.path
+}
+
+// RoundRobinSelector implements round-robin path selection.
+// For N arbitrarily ordered paths, the ith packet uses the (i % N)th path.
+type RoundRobinSelector struct {
+	paths        []snet.Path
+	nextKeyIndex int
+}
+
+func (s *RoundRobinSelector) Reset(dst *snet.UDPAddr, paths []snet.Path) error {
+	if len(paths) == 0 {
+		return errNoPaths
+	}
+	s.paths = paths
+	s.nextKeyIndex = s.nextKeyIndex % len(paths)
+	return nil
+}
+
+func (s *RoundRobinSelector) Next() []snet.Path {
+	path := s.paths[s.nextKeyIndex : s.nextKeyIndex+1]
+	s.nextKeyIndex = (s.nextKeyIndex + 1) % len(s.paths)
+	return path
+}
+
+// RedundantSelector sends every packet on N paths simultaneously.
+// If fewer than N paths are available, all paths are used.
+type RedundantSelector struct {
+	N     int
+	paths []snet.Path
+}
+
+func (s *RedundantSelector) Reset(dst *snet.UDPAddr, paths []snet.Path) error {
+	if len(paths) == 0 {
+		return errNoPaths
+	}
+	n := s.N
+	if n <= 0 || n > len(paths) {
+		n = len(paths)
+	}
+	s.paths = paths[:n]
+	return nil
+}
+
+func (s *RedundantSelector) Next() []snet.Path {
+	return s.paths
+}
+
+// WeightedRTTSelector distributes the packets over all responsive paths,
+// with a share inversely proportional to their round trip time.
+// The RTT is measured by probing the paths, see ProbePaths; paths without
+// replies are not used, unless no path responds at all.
+// Note that probing delays the first packet to a destination.
+type WeightedRTTSelector struct {
+	// Network is used to probe the paths. Defaults to DefNetwork.
+	Network *Network
+
+	probes  map[snet.PathFingerprint]PathProbe
+	paths   []snet.Path
+	weights []float64
+	current []float64
+}
+
+func (s *WeightedRTTSelector) Reset(dst *snet.UDPAddr, paths []snet.Path) error {
+	if len(paths) == 0 {
+		return errNoPaths
+	}
+	probes := probePathsCached(s.Network, &s.probes, dst, paths)
+	s.paths, s.weights = nil, nil
+	for _, p := range probes {
+		if p.Err == nil && p.Loss < 1 && p.RTT > 0 {
+			s.paths = append(s.paths, p.Path)
+			s.weights = append(s.weights, 1/p.RTT.Seconds())
+		}
+	}
+	if len(s.paths) == 0 {
+		s.paths = paths
+		s.weights = make([]float64, len(paths))
+		for i := range s.weights {
+			s.weights[i] = 1
+		}
+	}
+	s.current = make([]float64, len(s.paths))
+	return nil
+}
+
+// Next implements smooth weighted round-robin, i.e. the packets on a path are
+// spread out evenly in the sequence instead of being sent in bursts.
+func (s *WeightedRTTSelector) Next() []snet.Path {
+	var total float64
+	best := 0
+	for i := range s.weights {
+		total += s.weights[i]
+		s.current[i] += s.weights[i]
+		if s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	s.current[best] -= total
+	return s.paths[best : best+1]
+}
+
+// LowestLatencySelector uses the path with the lowest round trip time.
+// The RTT is measured by probing the paths, see ProbePaths. If the path does
+// not respond, the path with the next lowest RTT is used, falling back to the
+// path order of QueryPaths if no path responds.
+// When the path is revoked, the MultipathConn resets the selector with the
+// remaining paths, so that it falls back to the next best path without
+// probing again.
+type LowestLatencySelector struct {
+	// Network is used to probe the paths. Defaults to DefNetwork.
+	Network *Network
+
+	probes map[snet.PathFingerprint]PathProbe
+	path   []snet.Path
+}
+
+func (s *LowestLatencySelector) Reset(dst *snet.UDPAddr, paths []snet.Path) error {
+	if len(paths) == 0 {
+		return errNoPaths
+	}
+	probes := probePathsCached(s.Network, &s.probes, dst, paths)
+	sort.SliceStable(probes, func(i, j int) bool {
+		return probeLess(probes[i], probes[j])
+	})
+	s.path = []snet.Path{probes[0].Path}
+	return nil
+}
+
+func (s *LowestLatencySelector) Next() []snet.Path {
+	return s.path
+}
+
+// probeLess orders probes by responsiveness first and RTT second.
+func probeLess(a, b PathProbe) bool {
+	aOk := a.Err == nil && a.Loss < 1
+	bOk := b.Err == nil && b.Loss < 1
+	if aOk != bOk {
+		return aOk
+	}
+	return aOk && a.RTT < b.RTT
+}
+
+// probePathsCached probes the paths, reusing previous results in cache.
+// Only the paths that have not been probed before are actually probed; the
+// cache is replaced by the results for the current paths.
+func probePathsCached(n *Network, cache *map[snet.PathFingerprint]PathProbe,
+	dst *snet.UDPAddr, paths []snet.Path) []PathProbe {
+
+	var unknown []snet.Path
+	for _, p := range paths {
+		if _, ok := (*cache)[snet.Fingerprint(p)]; !ok {
+			unknown = append(unknown, p)
+		}
+	}
+	updated := make(map[snet.PathFingerprint]PathProbe, len(paths))
+	if len(unknown) > 0 {
+		if n == nil {
+			n = DefNetwork()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, p := range n.ProbePaths(ctx, dst, unknown, ProbeConfig{}) {
+			updated[snet.Fingerprint(p.Path)] = p
+		}
+	}
+	probes := make([]PathProbe, len(paths))
+	for i, p := range paths {
+		fp := snet.Fingerprint(p)
+		probe, ok := updated[fp]
+		if !ok {
+			probe = (*cache)[fp]
+			updated[fp] = probe
+		}
+		probe.Path = p
+		probes[i] = probe
+	}
+	*cache = updated
+	return probes
+}
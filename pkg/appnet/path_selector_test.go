@@ -0,0 +1,162 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+func TestStaticSelector(t *testing.T) {
+
+	const numPaths = 5
+	const numRepetitions = 3
+	paths := makePaths(numPaths)
+
+	selector := &StaticSelector{}
+	if err := selector.Reset(nil, paths); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < numRepetitions*numPaths; i++ {
+		expected := paths[0]
+		actual := selector.Next()
+		if len(actual) != 1 || actual[0] != expected {
+			t.Fatalf("Static path selection: Expected path %v, found path %v", expected, actual)
+		}
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+
+	const numPaths = 5
+	const numRepetitions = 3
+	paths := makePaths(numPaths)
+
+	roundRobinSeq := []snet.Path{}
+	for i := 0; i < numRepetitions; i++ {
+		roundRobinSeq = append(roundRobinSeq, paths...)
+	}
+
+	selector := &RoundRobinSelector{}
+	if err := selector.Reset(nil, paths); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < numRepetitions*numPaths; i++ {
+		expected := roundRobinSeq[i]
+		actual := selector.Next()
+		if len(actual) != 1 || actual[0] != expected {
+			t.Fatalf("Round robin path selection: Expected path %v, found path %v", expected, actual)
+		}
+	}
+}
+
+func TestRedundantSelector(t *testing.T) {
+	paths := makePaths(5)
+
+	selector := &RedundantSelector{N: 2}
+	if err := selector.Reset(nil, paths); err != nil {
+		t.Fatal(err)
+	}
+	actual := selector.Next()
+	if len(actual) != 2 || actual[0] != paths[0] || actual[1] != paths[1] {
+		t.Errorf("Redundant path selection: Expected paths %v, found paths %v", paths[:2], actual)
+	}
+
+	selector = &RedundantSelector{N: 10}
+	if err := selector.Reset(nil, paths); err != nil {
+		t.Fatal(err)
+	}
+	if actual := selector.Next(); len(actual) != len(paths) {
+		t.Errorf("Redundant path selection: Expected all %d paths, found %d", len(paths), len(actual))
+	}
+}
+
+func TestWeightedRTTSelector(t *testing.T) {
+	paths := makePaths(3)
+	// path 0 is twice as fast as path 1, path 2 does not respond
+	selector := &WeightedRTTSelector{
+		probes: makeProbes(paths, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 0}),
+	}
+	if err := selector.Reset(nil, paths); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[snet.Path]int)
+	for i := 0; i < 30; i++ {
+		next := selector.Next()
+		if len(next) != 1 {
+			t.Fatalf("Weighted RTT path selection: Expected 1 path, found %d", len(next))
+		}
+		counts[next[0]]++
+	}
+	if counts[paths[0]] != 20 || counts[paths[1]] != 10 || counts[paths[2]] != 0 {
+		t.Errorf("Weighted RTT path selection: Unexpected distribution %d/%d/%d",
+			counts[paths[0]], counts[paths[1]], counts[paths[2]])
+	}
+}
+
+func TestLowestLatencySelector(t *testing.T) {
+	paths := makePaths(3)
+	// path 1 is the fastest, path 2 does not respond
+	selector := &LowestLatencySelector{
+		probes: makeProbes(paths, []time.Duration{30 * time.Millisecond, 20 * time.Millisecond, 0}),
+	}
+	if err := selector.Reset(nil, paths); err != nil {
+		t.Fatal(err)
+	}
+	if actual := selector.Next(); len(actual) != 1 || actual[0] != paths[1] {
+		t.Errorf("Lowest latency path selection: Expected path %v, found %v", paths[1], actual)
+	}
+
+	// fall back after path 1 is removed, e.g. because it was revoked
+	if err := selector.Reset(nil, []snet.Path{paths[0], paths[2]}); err != nil {
+		t.Fatal(err)
+	}
+	if actual := selector.Next(); len(actual) != 1 || actual[0] != paths[0] {
+		t.Errorf("Lowest latency path selection: Expected fallback path %v, found %v", paths[0], actual)
+	}
+}
+
+func makePaths(num int) []snet.Path {
+	paths := make([]snet.Path, num)
+	for i := 0; i < num; i++ {
+		paths[i] = &mockPath{metadata: &snet.PathMetadata{
+			Interfaces: []snet.PathInterface{
+				{IA: addr.IA{I: 1, A: 0xff0000000110}, ID: common.IFIDType(i)},
+			},
+		}}
+	}
+	return paths
+}
+
+// makeProbes creates a cache of probe results for the paths, so that the
+// selectors do not need to actually probe. An RTT of 0 denotes no reply.
+func makeProbes(paths []snet.Path, rtts []time.Duration) map[snet.PathFingerprint]PathProbe {
+	probes := make(map[snet.PathFingerprint]PathProbe)
+	for i, p := range paths {
+		loss := 0.0
+		if rtts[i] == 0 {
+			loss = 1
+		}
+		probes[snet.Fingerprint(p)] = PathProbe{Path: p, RTT: rtts[i], Loss: loss}
+	}
+	return probes
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/pathpol"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// fingerprintRegexp matches a (prefix of a) hex encoded path fingerprint.
+// The minimum length avoids ambiguity with an ISD in a hop sequence.
+var fingerprintRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8,64}$`)
+
+// PathSpec selects specific paths, to choose a path non-interactively, e.g.
+// with a -path command line flag. See ParsePathSpec.
+type PathSpec struct {
+	raw         string
+	fingerprint string
+	sequence    *pathpol.Sequence
+}
+
+// ParsePathSpec parses a path specification, which is one of
+//
+//   - a path fingerprint, or a prefix of at least 8 hex digits thereof, e.g.
+//     "6b5d8a0f"
+//   - the textual representation of a PathInfo, e.g.
+//     "1-ff00:0:110 1>2 1-ff00:0:111", matching exactly this path
+//   - a hop predicate sequence, as in the sequence of a path policy, e.g.
+//     "1-ff00:0:110#0 1-ff00:0:111#2,3 1-ff00:0:112#0" or "0* 1-ff00:0:111 0*"
+func ParsePathSpec(s string) (*PathSpec, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("empty path specification")
+	case fingerprintRegexp.MatchString(s):
+		return &PathSpec{raw: s, fingerprint: strings.ToLower(s)}, nil
+	case strings.ContainsRune(s, '>'):
+		info, err := ParsePathInfo(s)
+		if err != nil {
+			return nil, err
+		}
+		return &PathSpec{raw: s, fingerprint: info.Fingerprint}, nil
+	default:
+		seq, err := pathpol.NewSequence(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path specification %q: %w", s, err)
+		}
+		return &PathSpec{raw: s, sequence: seq}, nil
+	}
+}
+
+// Filter returns the paths matching the specification, in the original
+// order.
+func (s *PathSpec) Filter(paths []snet.Path) []snet.Path {
+	if s.sequence != nil {
+		return s.sequence.Eval(paths)
+	}
+	var matching []snet.Path
+	for _, p := range paths {
+		if strings.HasPrefix(snet.Fingerprint(p).String(), s.fingerprint) {
+			matching = append(matching, p)
+		}
+	}
+	return matching
+}
+
+func (s *PathSpec) String() string {
+	return s.raw
+}
+
+// SetPathSpec restricts the paths of the default Network to ia to the paths
+// matching spec. See Network.SetPathSpec.
+func SetPathSpec(ia addr.IA, spec *PathSpec) {
+	DefNetwork().SetPathSpec(ia, spec)
+}
+
+// SetPathSpec restricts the paths to ia returned by QueryPaths to the paths
+// matching spec, in addition to the path policy. Paths to other destinations
+// are not affected, as a path specification typically only matches paths to
+// a single destination.
+// A nil spec allows all paths to ia.
+func (n *Network) SetPathSpec(ia addr.IA, spec *PathSpec) {
+	n.policyMutex.Lock()
+	defer n.policyMutex.Unlock()
+	if spec == nil {
+		delete(n.pathSpecs, ia)
+		return
+	}
+	if n.pathSpecs == nil {
+		n.pathSpecs = make(map[addr.IA]*PathSpec)
+	}
+	n.pathSpecs[ia] = spec
+}
+
+// PathSpec returns the path specification for the paths to ia, or nil if none
+// is set.
+func (n *Network) PathSpec(ia addr.IA) *PathSpec {
+	n.policyMutex.RLock()
+	defer n.policyMutex.RUnlock()
+	return n.pathSpecs[ia]
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	snetpath "github.com/scionproto/scion/go/lib/snet/path"
+)
+
+func TestPathSpec(t *testing.T) {
+	ia110 := addr.IA{I: 1, A: 0xff0000000110}
+	ia111 := addr.IA{I: 1, A: 0xff0000000111}
+	ia112 := addr.IA{I: 1, A: 0xff0000000112}
+	makePath := func(ifids ...common.IFIDType) snet.Path {
+		return snetpath.Path{Meta: snet.PathMetadata{Interfaces: []snet.PathInterface{
+			{IA: ia110, ID: ifids[0]},
+			{IA: ia111, ID: ifids[1]},
+			{IA: ia111, ID: ifids[2]},
+			{IA: ia112, ID: ifids[3]},
+		}}}
+	}
+	paths := []snet.Path{
+		makePath(1, 2, 3, 4),
+		makePath(1, 2, 5, 6),
+		makePath(7, 8, 3, 4),
+	}
+	fingerprint := snet.Fingerprint(paths[1]).String()
+
+	cases := []struct {
+		spec     string
+		expected []int
+	}{
+		{fingerprint, []int{1}},
+		{fingerprint[:8], []int{1}},
+		{"1-ff00:0:110 7>8 1-ff00:0:111 3>4 1-ff00:0:112", []int{2}},
+		{"1-ff00:0:110 7>8 1-ff00:0:111 3>4 1-ff00:0:112 mtu=1472", []int{2}},
+		{"1-ff00:0:110 1>2 1-ff00:0:111 3>5 1-ff00:0:112", nil},
+		{"1-ff00:0:110#1 1-ff00:0:111#2,3 1-ff00:0:112#4", []int{0}},
+		{"0* 1-ff00:0:111#0,3 0*", []int{0, 2}},
+		{"0*", []int{0, 1, 2}},
+	}
+	for _, c := range cases {
+		spec, err := ParsePathSpec(c.spec)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", c.spec, err)
+			continue
+		}
+		actual := spec.Filter(paths)
+		if len(actual) != len(c.expected) {
+			t.Errorf("wrong number of paths for %q, expected %d, got %d", c.spec, len(c.expected), len(actual))
+			continue
+		}
+		for i, e := range c.expected {
+			if snet.Fingerprint(actual[i]) != snet.Fingerprint(paths[e]) {
+				t.Errorf("wrong path %d for %q, expected %s, got %s", i, c.spec, paths[e], actual[i])
+			}
+		}
+	}
+
+	invalid := []string{"", "abc", "1-ff00:0:110 1>2", "1-ff00:0:110#", "0* (", "1234567g"}
+	for _, s := range invalid {
+		if _, err := ParsePathSpec(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
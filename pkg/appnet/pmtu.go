@@ -0,0 +1,388 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/slayers"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+	"github.com/scionproto/scion/go/lib/topology/underlay"
+)
+
+const (
+	// defaultMTU is the MTU assumed for paths without metadata, e.g. in the
+	// local AS.
+	defaultMTU = 1472
+	// pmtuCacheTimeout is the time after which a discovered path MTU is
+	// discarded, so that increases are eventually detected.
+	pmtuCacheTimeout = 10 * time.Minute
+	// pmtuProbesPerRound is the number of packet sizes probed concurrently in
+	// each round of the path MTU discovery.
+	pmtuProbesPerRound = 8
+	// pmtuProbeTimeout is the time after which a probe without reply is
+	// considered too big.
+	pmtuProbeTimeout = 1 * time.Second
+)
+
+// MaxPayload returns the maximum size of the payload of UDP packets sent to
+// raddr over the path of raddr, on the default Network.
+// See Network.MaxPayload.
+func MaxPayload(raddr *snet.UDPAddr) int {
+	return DefNetwork().MaxPayload(raddr)
+}
+
+// MaxPayload returns the maximum size of the payload of UDP packets sent to
+// raddr over the path of raddr, i.e. the path MTU minus the size of the SCION
+// and UDP headers.
+//
+// The path MTU is the value discovered with ProbeMaxPayload or reported in
+// SCMP packet too big errors, if any. Otherwise, it is the MTU announced in the
+// path metadata, which may be too optimistic.
+func (n *Network) MaxPayload(raddr *snet.UDPAddr) int {
+	mtu, ok := n.pmtu.get(raddr.Path)
+	if !ok {
+		mtu = announcedMTU(raddr.Path)
+	}
+	local, err := n.pmtuLocalAddr(raddr)
+	if err != nil {
+		return 0
+	}
+	hdrLen, err := headerLen(local, raddr, snet.UDPPayload{})
+	if err != nil || hdrLen >= mtu {
+		return 0
+	}
+	return mtu - hdrLen
+}
+
+// ProbeMaxPayload discovers the path MTU of the path of raddr on the default
+// Network and returns the maximum size of the payload of UDP packets.
+// See Network.ProbeMaxPayload.
+func ProbeMaxPayload(ctx context.Context, raddr *snet.UDPAddr) (int, error) {
+	return DefNetwork().ProbeMaxPayload(ctx, raddr)
+}
+
+// ProbeMaxPayload discovers the path MTU of the path of raddr and returns the
+// maximum size of the payload of UDP packets sent to raddr over this path.
+//
+// The path MTU is probed with SCMP echo requests of different sizes to the host
+// of raddr, up to the MTU announced in the path metadata. The result is cached
+// for some minutes and is also returned by MaxPayload.
+// Lost echo requests are considered too big, so that on a lossy path the path
+// MTU may be underestimated.
+func (n *Network) ProbeMaxPayload(ctx context.Context, raddr *snet.UDPAddr) (int, error) {
+	local, err := n.pmtuLocalAddr(raddr)
+	if err != nil {
+		return 0, err
+	}
+	hdrLen, err := headerLen(local, raddr, snet.UDPPayload{})
+	if err != nil {
+		return 0, err
+	}
+	mtu, ok := n.pmtu.get(raddr.Path)
+	if !ok || !n.pmtu.probed(raddr.Path) {
+		if mtu, err = n.probePathMTU(ctx, local, raddr); err != nil {
+			return 0, err
+		}
+		n.pmtu.set(raddr.Path, mtu, true)
+	}
+	if hdrLen >= mtu {
+		return 0, fmt.Errorf("path MTU %d too small for headers of %d bytes", mtu, hdrLen)
+	}
+	return mtu - hdrLen, nil
+}
+
+func (n *Network) pmtuLocalAddr(raddr *snet.UDPAddr) (*snet.UDPAddr, error) {
+	localIP, err := n.resolveLocal(raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &snet.UDPAddr{IA: n.IA, Host: &net.UDPAddr{IP: localIP}}, nil
+}
+
+// announcedMTU returns the MTU in the metadata of the path, if the path is
+// known, or defaultMTU.
+func announcedMTU(p spath.Path) int {
+	if known := lookupPath(p); known != nil {
+		if md := known.path.Metadata(); md != nil && md.MTU > 0 {
+			return int(md.MTU)
+		}
+	}
+	return defaultMTU
+}
+
+// headerLen returns the size of the packet from local to remote, over the path
+// of remote, with the given (empty) payload.
+func headerLen(local, remote *snet.UDPAddr, payload snet.Payload) (int, error) {
+	pkt := &snet.Packet{
+		PacketInfo: snet.PacketInfo{
+			Source:      snet.SCIONAddress{IA: local.IA, Host: addr.HostFromIP(local.Host.IP)},
+			Destination: snet.SCIONAddress{IA: remote.IA, Host: addr.HostFromIP(remote.Host.IP)},
+			Path:        remote.Path,
+			Payload:     payload,
+		},
+	}
+	if err := pkt.Serialize(); err != nil {
+		return 0, err
+	}
+	return len(pkt.Bytes), nil
+}
+
+// pmtuReply is the result of a probe: the echo reply to the probe with
+// sequence number seq, or a packet too big error reporting mtu.
+type pmtuReply struct {
+	seq uint16
+	mtu int
+}
+
+// probePathMTU returns the largest packet size, between the size of the
+// headers and the announced MTU, for which an echo reply is received.
+// Each round probes up to pmtuProbesPerRound sizes in the remaining range.
+func (n *Network) probePathMTU(ctx context.Context, local, remote *snet.UDPAddr) (int, error) {
+	conn, port, err := n.connDispatcher.Register(ctx, local.IA, local.Host, addr.SvcNone)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	local = local.Copy()
+	local.Host.Port = int(port)
+
+	echoHdrLen, err := headerLen(local, remote, snet.SCMPEchoRequest{})
+	if err != nil {
+		return 0, err
+	}
+	nextHop := remote.NextHop
+	if nextHop == nil && local.IA == remote.IA {
+		nextHop = &net.UDPAddr{IP: remote.Host.IP, Port: underlay.EndhostPort}
+	}
+
+	id := uint16(rand.Uint32())
+	replies := make(chan pmtuReply, pmtuProbesPerRound)
+	done := make(chan struct{})
+	defer close(done)
+	go readPMTUReplies(conn, id, replies, done)
+
+	lo, hi := echoHdrLen, announcedMTU(remote.Path)
+	best := 0
+	var seq uint16
+	for lo <= hi {
+		sizes := pmtuProbeSizes(lo, hi)
+		probes := make(map[uint16]int, len(sizes))
+		for _, size := range sizes {
+			pkt := &snet.Packet{
+				PacketInfo: snet.PacketInfo{
+					Source:      snet.SCIONAddress{IA: local.IA, Host: addr.HostFromIP(local.Host.IP)},
+					Destination: snet.SCIONAddress{IA: remote.IA, Host: addr.HostFromIP(remote.Host.IP)},
+					Path:        remote.Path,
+					Payload: snet.SCMPEchoRequest{
+						Identifier: id,
+						SeqNumber:  seq,
+						Payload:    make([]byte, size-echoHdrLen),
+					},
+				},
+			}
+			if err := pkt.Serialize(); err != nil {
+				return 0, err
+			}
+			if _, err := conn.WriteTo(pkt.Bytes, nextHop); err != nil {
+				return 0, err
+			}
+			probes[seq] = size
+			seq++
+		}
+
+		roundBest, tooBig := waitPMTURound(ctx, sizes, probes, replies, hi+1)
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if roundBest > best {
+			best = roundBest
+		}
+		if best+1 > lo {
+			lo = best + 1
+		}
+		// The smallest size above the largest reply is too big
+		for _, size := range sizes {
+			if size > roundBest {
+				hi = size - 1
+				break
+			}
+		}
+		if tooBig-1 < hi {
+			hi = tooBig - 1
+		}
+	}
+	if best == 0 {
+		return 0, fmt.Errorf("no reply to path MTU probes from %s", remote)
+	}
+	return best, nil
+}
+
+// waitPMTURound waits for the replies to the probes of a round, until the
+// result is known for each size or the timeout expires. It returns the
+// largest size with a reply and the smallest size known to be too big from
+// packet too big errors, or tooBig if there are none.
+func waitPMTURound(ctx context.Context, sizes []int, probes map[uint16]int,
+	replies <-chan pmtuReply, tooBig int) (int, int) {
+
+	best := 0
+	resolved := func() bool {
+		for _, size := range sizes {
+			if size > best && size < tooBig {
+				return false
+			}
+		}
+		return true
+	}
+	timeout := time.NewTimer(pmtuProbeTimeout)
+	defer timeout.Stop()
+	for !resolved() {
+		select {
+		case r := <-replies:
+			if r.mtu > 0 && r.mtu < tooBig {
+				tooBig = r.mtu + 1
+			} else if size, ok := probes[r.seq]; r.mtu == 0 && ok && size > best {
+				best = size
+			}
+		case <-timeout.C:
+			return best, tooBig
+		case <-ctx.Done():
+			return best, tooBig
+		}
+	}
+	return best, tooBig
+}
+
+// pmtuProbeSizes returns up to pmtuProbesPerRound distinct sizes in
+// [lo, hi], evenly spaced and including hi.
+func pmtuProbeSizes(lo, hi int) []int {
+	n := hi - lo + 1
+	if n > pmtuProbesPerRound {
+		n = pmtuProbesPerRound
+	}
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = lo + (hi-lo)*(i+1)/n
+	}
+	return sizes
+}
+
+// readPMTUReplies reads the echo replies with the identifier id and the packet
+// too big errors from conn, until conn is closed.
+func readPMTUReplies(conn net.PacketConn, id uint16, replies chan<- pmtuReply, done <-chan struct{}) {
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		var r pmtuReply
+		var scmpErr *SCMPError
+		switch {
+		case errors.As(err, &scmpErr):
+			if scmpErr.TypeCode.Type() != slayers.SCMPTypePacketTooBig {
+				continue
+			}
+			r.mtu = int(scmpErr.MTU)
+		case err != nil:
+			return
+		default:
+			pkt := &snet.Packet{Bytes: buf[:n]}
+			if err := pkt.Decode(); err != nil {
+				continue
+			}
+			echo, ok := pkt.Payload.(snet.SCMPEchoReply)
+			if !ok || echo.Identifier != id {
+				continue
+			}
+			r.seq = echo.SeqNumber
+		}
+		select {
+		case replies <- r:
+		case <-done:
+			return
+		}
+	}
+}
+
+// pmtuCache caches the path MTUs discovered or reported in SCMP errors, by
+// dataplane path.
+type pmtuCache struct {
+	mutex   sync.Mutex
+	entries map[string]pmtuEntry
+}
+
+type pmtuEntry struct {
+	mtu    int
+	probed bool
+	expiry time.Time
+}
+
+func newPMTUCache() *pmtuCache {
+	return &pmtuCache{entries: make(map[string]pmtuEntry)}
+}
+
+func (c *pmtuCache) get(p spath.Path) (int, bool) {
+	e, ok := c.entry(p)
+	return e.mtu, ok
+}
+
+// probed returns true if the cached path MTU was discovered by probing.
+func (c *pmtuCache) probed(p spath.Path) bool {
+	e, ok := c.entry(p)
+	return ok && e.probed
+}
+
+func (c *pmtuCache) entry(p spath.Path) (pmtuEntry, bool) {
+	key := pathKey(p)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[key]
+	if ok && !e.expiry.After(time.Now()) {
+		delete(c.entries, key)
+		return pmtuEntry{}, false
+	}
+	return e, ok
+}
+
+func (c *pmtuCache) set(p spath.Path, mtu int, probed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.entries) >= maxKnownPaths {
+		c.entries = make(map[string]pmtuEntry)
+	}
+	c.entries[pathKey(p)] = pmtuEntry{
+		mtu:    mtu,
+		probed: probed,
+		expiry: time.Now().Add(pmtuCacheTimeout),
+	}
+}
+
+// reduce lowers the cached path MTU to mtu, as reported in a packet too big
+// error.
+func (c *pmtuCache) reduce(p spath.Path, mtu int) {
+	current, ok := c.get(p)
+	if !ok {
+		current = announcedMTU(p)
+	}
+	if mtu < current {
+		c.set(p, mtu, c.probed(p))
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/spath"
+)
+
+func TestPMTUProbeSizes(t *testing.T) {
+	cases := []struct {
+		lo, hi   int
+		expected []int
+	}{
+		{100, 100, []int{100}},
+		{100, 102, []int{100, 101, 102}},
+		{100, 107, []int{100, 101, 102, 103, 104, 105, 106, 107}},
+		{100, 108, []int{101, 102, 103, 104, 105, 106, 107, 108}},
+		{100, 900, []int{200, 300, 400, 500, 600, 700, 800, 900}},
+	}
+	for _, c := range cases {
+		if sizes := pmtuProbeSizes(c.lo, c.hi); !reflect.DeepEqual(sizes, c.expected) {
+			t.Errorf("pmtuProbeSizes(%d, %d): expected %v, got %v", c.lo, c.hi, c.expected, sizes)
+		}
+	}
+}
+
+func TestPMTUCache(t *testing.T) {
+	c := newPMTUCache()
+	p := spath.Path{Raw: []byte{1, 2, 3, 4, 5, 6, 7, 8}, Type: 253}
+	if _, ok := c.get(p); ok {
+		t.Fatal("unexpected entry in empty cache")
+	}
+	c.reduce(p, 1200)
+	if mtu, ok := c.get(p); !ok || mtu != 1200 || c.probed(p) {
+		t.Errorf("expected unprobed MTU 1200 after packet too big, got %d, %v", mtu, ok)
+	}
+	c.reduce(p, 1300)
+	if mtu, _ := c.get(p); mtu != 1200 {
+		t.Errorf("expected MTU 1200 not to be raised by packet too big, got %d", mtu)
+	}
+	c.set(p, 1250, true)
+	if mtu, ok := c.get(p); !ok || mtu != 1250 || !c.probed(p) {
+		t.Errorf("expected probed MTU 1250, got %d, %v", mtu, ok)
+	}
+	c.reduce(p, 1000)
+	if mtu, _ := c.get(p); mtu != 1000 || !c.probed(p) {
+		t.Errorf("expected probed MTU 1000 after packet too big, got %d", mtu)
+	}
+}
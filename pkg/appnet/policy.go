@@ -0,0 +1,79 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/scionproto/scion/go/lib/pathpol"
+)
+
+// SetPathPolicy sets the path policy of the default Network.
+// See Network.SetPathPolicy.
+func SetPathPolicy(policy *pathpol.Policy) {
+	DefNetwork().SetPathPolicy(policy)
+}
+
+// SetPathPolicy sets the path policy used to filter the paths returned by
+// QueryPaths. As all path lookups go through QueryPaths, the policy applies to
+// all dial and path selection functions of this Network.
+// A nil policy allows all paths.
+func (n *Network) SetPathPolicy(policy *pathpol.Policy) {
+	n.policyMutex.Lock()
+	defer n.policyMutex.Unlock()
+	n.policy = policy
+}
+
+// PathPolicy returns the path policy of the Network, or nil if none is set.
+func (n *Network) PathPolicy() *pathpol.Policy {
+	n.policyMutex.RLock()
+	defer n.policyMutex.RUnlock()
+	return n.policy
+}
+
+// PolicyFromString parses a path policy from its JSON representation, or, if
+// s does not look like a JSON object, reads it from the file named s.
+//
+// The policy consists of an ACL, a sequence and options, as described in the
+// SCION path policy documentation. For example, the following policy avoids
+// any path transiting ISD 2:
+//
+//	{"acl": ["- 2-0#0", "+"]}
+func PolicyFromString(s string) (*pathpol.Policy, error) {
+	s = strings.TrimSpace(s)
+	var raw []byte
+	if strings.HasPrefix(s, "{") {
+		raw = []byte(s)
+	} else {
+		var err error
+		raw, err = ioutil.ReadFile(s)
+		if err != nil {
+			return nil, fmt.Errorf("error loading path policy: %w", err)
+		}
+	}
+	policy := &pathpol.Policy{}
+	if err := json.Unmarshal(raw, policy); err != nil {
+		return nil, fmt.Errorf("error parsing path policy: %w", err)
+	}
+	if policy.ACL != nil {
+		if _, err := pathpol.NewACL(policy.ACL.Entries...); err != nil {
+			return nil, fmt.Errorf("invalid path policy ACL: %w", err)
+		}
+	}
+	return pathpol.NewPolicy(policy.Name, policy.ACL, policy.Sequence, policy.Options), nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+func TestPolicyFromString(t *testing.T) {
+	policy, err := PolicyFromString(`{"acl": ["- 2-0#0", "+"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	via1 := &mockPath{metadata: &snet.PathMetadata{Interfaces: []snet.PathInterface{
+		{IA: addr.IA{I: 1, A: 0xff0000000110}, ID: 1},
+		{IA: addr.IA{I: 1, A: 0xff0000000111}, ID: 2},
+	}}}
+	via2 := &mockPath{metadata: &snet.PathMetadata{Interfaces: []snet.PathInterface{
+		{IA: addr.IA{I: 1, A: 0xff0000000110}, ID: 3},
+		{IA: addr.IA{I: 2, A: 0xff0000000210}, ID: 4},
+	}}}
+	filtered := policy.Filter([]snet.Path{via1, via2})
+	if len(filtered) != 1 || filtered[0] != via1 {
+		t.Errorf("policy did not filter path via ISD 2, got %v", filtered)
+	}
+
+	invalid := []string{
+		`{"acl": ["- 2-0#0"]}`, // no default entry
+		`{"sequence": "1-0#0 ("}`,
+		`{"acl": `,
+		"non_existing_policy_file",
+	}
+	for _, s := range invalid {
+		if _, err := PolicyFromString(s); err == nil {
+			t.Errorf("expected error for invalid policy %q", s)
+		}
+	}
+}
@@ -20,31 +20,87 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/netsec-ethz/rains/pkg/rains"
+	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
 const rainsConfigPath = "/etc/scion/rains.cfg"
 
+// defaultRainsTimeout is the default timeout for a RAINS query.
+// TODO(chaehni): The query can sometimes cause a timeout even though the
+// server is reachable (see issue #221). The timeout value has been decreased
+// to counter this behavior until the problem is resolved.
+const defaultRainsTimeout = 500 * time.Millisecond
+
 func init() {
-	resolveRains = &rainsResolver{}
+	resolveRains = NewCachingResolver(&rainsResolver{})
+	newRainsResolver = func(server *snet.UDPAddr, timeout time.Duration) Resolver {
+		return NewCachingResolver(&rainsResolver{server: server, timeout: timeout})
+	}
 }
 
-type rainsResolver struct{}
+// rainsResolver queries a RAINS server. If server is nil, the server
+// configured in /etc/scion/rains.cfg is used.
+// Reverse lookups query the name assertions for the reverse name of the
+// address, see rainsReverseName.
+type rainsResolver struct {
+	server  *snet.UDPAddr
+	timeout time.Duration
+}
 
 func (r *rainsResolver) Resolve(name string) (*snet.SCIONAddress, error) {
-	server, err := readRainsConfig()
+	addr, _, err := r.ResolveTTL(name)
+	return addr, err
+}
+
+// ResolveTTL implements TTLResolver. The TTL is derived from the validity of
+// the signatures on the RAINS assertion.
+func (r *rainsResolver) ResolveTTL(name string) (*snet.SCIONAddress, time.Duration, error) {
+	server, err := r.getServer()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	if server == nil {
 		// nobody to ask, so we won't get a reply
-		return nil, &HostNotFoundError{name}
+		return nil, 0, &HostNotFoundError{name}
+	}
+	return rainsQuery(server, name, r.getTimeout())
+}
+
+// ReverseResolve implements ReverseResolver.
+func (r *rainsResolver) ReverseResolve(address *snet.SCIONAddress) ([]string, error) {
+	name, err := rainsReverseName(address)
+	if err != nil {
+		return nil, err
+	}
+	server, err := r.getServer()
+	if err != nil {
+		return nil, err
+	}
+	if server == nil {
+		return nil, &HostNotFoundError{address.String()}
+	}
+	return rainsReverseQuery(server, name, address, r.getTimeout())
+}
+
+func (r *rainsResolver) getServer() (*snet.UDPAddr, error) {
+	if r.server != nil {
+		return r.server, nil
+	}
+	return readRainsConfig()
+}
+
+func (r *rainsResolver) getTimeout() time.Duration {
+	if r.timeout <= 0 {
+		return defaultRainsTimeout
 	}
-	return rainsQuery(server, name)
+	return r.timeout
 }
 
 func readRainsConfig() (*snet.UDPAddr, error) {
@@ -61,32 +117,231 @@ func readRainsConfig() (*snet.UDPAddr, error) {
 	return address, nil
 }
 
-func rainsQuery(server *snet.UDPAddr, hostname string) (*snet.SCIONAddress, error) {
+func rainsQuery(server *snet.UDPAddr, hostname string,
+	timeout time.Duration) (*snet.SCIONAddress, time.Duration, error) {
 
 	const (
-		ctx     = "."                    // use global context
-		qType   = rains.OTScionAddr      // request SCION addresses
-		expire  = 5 * time.Minute        // sensible expiry date?
-		timeout = 500 * time.Millisecond // timeout for query
+		ctx    = "."               // use global context
+		qType  = rains.OTScionAddr // request SCION addresses
+		expire = 5 * time.Minute   // sensible expiry date?
 	)
 	qOpts := []rains.Option{} // no options
 
 	// TODO(matzf): check that this behaves as expected:
 	// - return error on timeout, network problems, invalid format, ...
 	// - return HostNotFoundError error if all went well, but host not found
-	// TODO(chaehni): This call can sometimes cause a timeout even though the server is reachable (see issue #221)
-	// The timeout value has been decreased to counter this behavior until the problem is resolved.
-	reply, err := rains.Query(hostname, ctx, []rains.Type{qType}, qOpts, expire, timeout, server)
+	reply, err := rains.QueryRaw(hostname, ctx, []rains.Type{qType}, qOpts, expire, timeout, server)
 	if err != nil {
-		return nil, fmt.Errorf("address for host %q not found: %v", hostname, err)
+		return nil, 0, fmt.Errorf("address for host %q not found: %v", hostname, err)
 	}
-	addrStr, ok := reply[qType]
+	values, err := reply.ParseMessage()
+	if err != nil {
+		return nil, 0, fmt.Errorf("address for host %q not found: %v", hostname, err)
+	}
+	addrStr, ok := values[qType]
 	if !ok {
-		return nil, &HostNotFoundError{hostname}
+		return nil, 0, &HostNotFoundError{hostname}
 	}
 	addr, err := addrFromString(addrStr)
 	if err != nil {
-		return nil, fmt.Errorf("address for host %q invalid: %v", hostname, err)
+		return nil, 0, fmt.Errorf("address for host %q invalid: %v", hostname, err)
+	}
+	sections, err := rainsSections(reply)
+	if err != nil {
+		return nil, 0, fmt.Errorf("address for host %q: %v", hostname, err)
+	}
+	validUntil, err := rainsSigValidity(sections)
+	if err != nil {
+		return nil, 0, fmt.Errorf("address for host %q: %v", hostname, err)
+	}
+	return &addr, rainsTTL(validUntil, time.Now()), nil
+}
+
+func rainsReverseQuery(server *snet.UDPAddr, name string, address *snet.SCIONAddress,
+	timeout time.Duration) ([]string, error) {
+
+	const (
+		ctx    = "."             // use global context
+		qType  = rains.OTName    // request the names
+		expire = 5 * time.Minute // sensible expiry date?
+	)
+	reply, err := rains.QueryRaw(name, ctx, []rains.Type{qType}, []rains.Option{}, expire, timeout, server)
+	if err != nil {
+		return nil, fmt.Errorf("name for address %s not found: %v", address, err)
+	}
+	sections, err := rainsSections(reply)
+	if err != nil {
+		return nil, fmt.Errorf("name for address %s: %v", address, err)
+	}
+	names, err := rainsNames(sections)
+	if err != nil {
+		return nil, fmt.Errorf("name for address %s: %v", address, err)
+	}
+	if len(names) == 0 {
+		return nil, &HostNotFoundError{address.String()}
+	}
+	return names, nil
+}
+
+// rainsReverseName returns the name under which the names for address are
+// published in RAINS. Analogous to the reverse zones in DNS, this consists of
+// the labels of the host address in reverse order (the octets of an IPv4
+// address or the nibbles of an IPv6 address, in hex), the AS (with ':'
+// replaced by '-'), the ISD and the suffix "scion.arpa.". For example, the
+// reverse name of 17-ffaa:0:1,192.0.2.1 is
+// "1.2.0.192.ffaa-0-1.17.scion.arpa.".
+func rainsReverseName(address *snet.SCIONAddress) (string, error) {
+	if address.Host == nil || address.Host.Type() != addr.HostTypeIPv4 &&
+		address.Host.Type() != addr.HostTypeIPv6 {
+		return "", &HostNotFoundError{address.String()}
+	}
+	var labels []string
+	if ip := address.Host.IP().To4(); ip != nil {
+		for i := len(ip) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip[i])))
+		}
+	} else {
+		ip := address.Host.IP().To16()
+		for i := len(ip) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.FormatUint(uint64(ip[i]&0xf), 16),
+				strconv.FormatUint(uint64(ip[i]>>4), 16))
+		}
+	}
+	labels = append(labels,
+		strings.ReplaceAll(address.IA.A.String(), ":", "-"),
+		address.IA.I.String(),
+		"scion", "arpa", "")
+	return strings.Join(labels, "."), nil
+}
+
+// The rains package does not expose the parsed sections of a reply, so the
+// sections are read via reflection, from the layout of the rains package
+// (v0.2.0) pinned by TestRainsMessageLayout:
+//   rains.Message{msg message.Message{Content []section.Section}}
+//   section.Assertion{Signatures []signature.Sig, SubjectName string, Content []object.Object}
+//   signature.Sig{ValidUntil int64}
+//   object.Object{Type object.Type, Value interface{}}
+//   object.Name{Name string}
+// Apart from rains.Message.msg, only exported fields are accessed. If a field
+// is not found, an error is returned rather than ignoring the section.
+
+// rainsLayoutError returns the error for a field of a RAINS message that is
+// not found.
+func rainsLayoutError(field string) error {
+	return fmt.Errorf("unexpected layout of RAINS message, field %s not found", field)
+}
+
+// rainsSections returns the sections of a RAINS message, dereferenced to the
+// underlying structs.
+func rainsSections(msg rains.Message) ([]reflect.Value, error) {
+	m := rainsField(reflect.ValueOf(msg), "msg")
+	if m.Kind() != reflect.Struct {
+		return nil, rainsLayoutError("Message.msg")
+	}
+	content := rainsField(m, "Content")
+	if content.Kind() != reflect.Slice {
+		return nil, rainsLayoutError("Message.msg.Content")
+	}
+	var sections []reflect.Value
+	for i := 0; i < content.Len(); i++ {
+		sec := derefValue(content.Index(i))
+		if sec.Kind() != reflect.Struct {
+			return nil, rainsLayoutError("Message.msg.Content[i]")
+		}
+		sections = append(sections, sec)
+	}
+	return sections, nil
+}
+
+// rainsField returns the field of the struct v, following interfaces and
+// pointers. Returns the zero Value if there is no such field.
+func rainsField(v reflect.Value, name string) reflect.Value {
+	v = derefValue(v)
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	return v.FieldByName(name)
+}
+
+// derefValue follows interfaces and pointers to the underlying value.
+func derefValue(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// rainsSigValidity returns the validUntil timestamps (seconds since the UNIX
+// epoch) of the signatures on the sections of a RAINS message.
+func rainsSigValidity(sections []reflect.Value) ([]int64, error) {
+	var validUntil []int64
+	for _, sec := range sections {
+		sigs := rainsField(sec, "Signatures")
+		if sigs.Kind() != reflect.Slice {
+			return nil, rainsLayoutError("Signatures")
+		}
+		for j := 0; j < sigs.Len(); j++ {
+			v := rainsField(sigs.Index(j), "ValidUntil")
+			if v.Kind() != reflect.Int64 {
+				return nil, rainsLayoutError("Signatures[j].ValidUntil")
+			}
+			validUntil = append(validUntil, v.Int())
+		}
+	}
+	return validUntil, nil
+}
+
+// rainsNames returns the names in the name objects of the assertions of a
+// RAINS message, without the trailing ".". Other sections, e.g. the shards
+// and zones proving that no assertion exists, are skipped.
+func rainsNames(sections []reflect.Value) ([]string, error) {
+	var names []string
+	for _, sec := range sections {
+		if !rainsField(sec, "SubjectName").IsValid() {
+			continue
+		}
+		objs := rainsField(sec, "Content")
+		if objs.Kind() != reflect.Slice {
+			return nil, rainsLayoutError("Assertion.Content")
+		}
+		for j := 0; j < objs.Len(); j++ {
+			obj := objs.Index(j)
+			typ := rainsField(obj, "Type")
+			if typ.Kind() != reflect.Int {
+				return nil, rainsLayoutError("Assertion.Content[j].Type")
+			}
+			if typ.Int() != int64(rains.OTName) {
+				continue
+			}
+			name := rainsField(rainsField(obj, "Value"), "Name")
+			if name.Kind() != reflect.String {
+				return nil, rainsLayoutError("Assertion.Content[j].Value.Name")
+			}
+			if name.String() != "" {
+				names = append(names, strings.TrimSuffix(name.String(), "."))
+			}
+		}
+	}
+	return names, nil
+}
+
+// rainsTTL returns the time until the first of the signatures expires, given
+// by their validUntil timestamps, 0 if there are no signatures, or -1 if a
+// signature has already expired.
+func rainsTTL(validUntil []int64, now time.Time) time.Duration {
+	var ttl time.Duration
+	for _, v := range validUntil {
+		d := time.Unix(v, 0).Sub(now)
+		if d <= 0 {
+			// expired, don't cache
+			return -1
+		}
+		if ttl == 0 || d < ttl {
+			ttl = d
+		}
 	}
-	return &addr, nil
+	return ttl
 }
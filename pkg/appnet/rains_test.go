@@ -0,0 +1,166 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !norains
+
+package appnet
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/rains/pkg/rains"
+)
+
+func TestRainsTTL(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cases := []struct {
+		validUntil []int64
+		expected   time.Duration
+	}{
+		{nil, 0},
+		{[]int64{1600000600}, 10 * time.Minute},
+		{[]int64{1600003600, 1600000060}, time.Minute},
+		{[]int64{1600003600, 1599999999}, -1},
+	}
+	for _, c := range cases {
+		if actual := rainsTTL(c.validUntil, now); actual != c.expected {
+			t.Errorf("wrong TTL for %v, expected %v, got %v", c.validUntil, c.expected, actual)
+		}
+	}
+}
+
+func TestRainsMessageLayout(t *testing.T) {
+	// Pins the layout of rains.Message read in rainsSections. The section types
+	// are internal to the rains package and only reachable from a parsed
+	// reply, see TestRainsSections; the signatures of the message are of the
+	// same type as those of the sections.
+	msg, ok := reflect.TypeOf(rains.Message{}).FieldByName("msg")
+	if !ok || msg.Type.Kind() != reflect.Struct {
+		t.Fatal("rains.Message.msg not found")
+	}
+	content, ok := msg.Type.FieldByName("Content")
+	if !ok || content.Type.Kind() != reflect.Slice || content.Type.Elem().Kind() != reflect.Interface {
+		t.Fatal("rains.Message.msg.Content not found")
+	}
+	sigs, ok := msg.Type.FieldByName("Signatures")
+	if !ok || sigs.Type.Kind() != reflect.Slice {
+		t.Fatal("rains.Message.msg.Signatures not found")
+	}
+	validUntil, ok := sigs.Type.Elem().FieldByName("ValidUntil")
+	if !ok || validUntil.Type.Kind() != reflect.Int64 {
+		t.Fatal("ValidUntil of the RAINS signatures not found")
+	}
+	if sections, err := rainsSections(rains.Message{}); err != nil || len(sections) != 0 {
+		t.Errorf("expected no sections, got %v, %v", sections, err)
+	}
+}
+
+// Stand-ins for the types of the rains package read via reflection, see
+// rainsSections.
+type testRainsSig struct {
+	ValidSince int64
+	ValidUntil int64
+}
+
+type testRainsObject struct {
+	Type  int
+	Value interface{}
+}
+
+type testRainsName struct {
+	Name  string
+	Types []int
+}
+
+type testRainsAssertion struct {
+	Signatures  []testRainsSig
+	SubjectName string
+	Content     []testRainsObject
+}
+
+type testRainsShard struct {
+	Signatures []testRainsSig
+	Content    []*testRainsAssertion
+}
+
+func TestRainsSections(t *testing.T) {
+	assertion := &testRainsAssertion{
+		Signatures:  []testRainsSig{{ValidUntil: 1600000100}},
+		SubjectName: "1.2.0.192.ffaa-0-1.17",
+		Content: []testRainsObject{
+			{Type: int(rains.OTName), Value: testRainsName{Name: "host.example."}},
+			{Type: int(rains.OTScionAddr), Value: "17-ffaa:0:1,[192.0.2.1]"},
+		},
+	}
+	shard := &testRainsShard{
+		Signatures: []testRainsSig{{ValidUntil: 1600000200}},
+		Content: []*testRainsAssertion{{
+			SubjectName: "other",
+			Content:     []testRainsObject{{Type: int(rains.OTName), Value: &testRainsName{Name: "other.example."}}},
+		}},
+	}
+	sections := []reflect.Value{reflect.ValueOf(assertion).Elem(), reflect.ValueOf(shard).Elem()}
+
+	validUntil, err := rainsSigValidity(sections)
+	if err != nil || !reflect.DeepEqual(validUntil, []int64{1600000100, 1600000200}) {
+		t.Errorf("wrong signature validity, got %v, %v", validUntil, err)
+	}
+	names, err := rainsNames(sections)
+	if err != nil || !reflect.DeepEqual(names, []string{"host.example"}) {
+		t.Errorf("wrong names, got %v, %v", names, err)
+	}
+
+	// unexpected layouts fail instead of being ignored
+	noSigs := reflect.ValueOf(struct{ Content []testRainsObject }{})
+	if v, err := rainsSigValidity([]reflect.Value{noSigs}); err == nil {
+		t.Errorf("expected error for section without signatures, got %v", v)
+	}
+	badName := reflect.ValueOf(testRainsAssertion{
+		SubjectName: "host",
+		Content:     []testRainsObject{{Type: int(rains.OTName), Value: "host.example."}},
+	})
+	if v, err := rainsNames([]reflect.Value{badName}); err == nil {
+		t.Errorf("expected error for name object without name, got %v", v)
+	}
+}
+
+func TestRainsReverseName(t *testing.T) {
+	cases := []struct {
+		address  string
+		expected string
+	}{
+		{"17-ffaa:0:1,[192.0.2.1]", "1.2.0.192.ffaa-0-1.17.scion.arpa."},
+		{"1-ff00:0:110,[2001:db8::1]",
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ff00-0-110.1.scion.arpa."},
+	}
+	for _, c := range cases {
+		a, err := addrFromString(c.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := rainsReverseName(&a)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", c.address, err)
+		} else if actual != c.expected {
+			t.Errorf("wrong reverse name for %s, expected %q, got %q", c.address, c.expected, actual)
+		}
+	}
+
+	a, _ := addrFromString("17-ffaa:0:1,[CS]")
+	if _, err := rainsReverseName(&a); err == nil {
+		t.Error("expected error for SVC address")
+	}
+}
@@ -17,12 +17,15 @@ package appnet
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/scionproto/scion/go/lib/snet"
 )
 
 // Resolver is the interface to resolve a host name to a SCION host address.
-// Currently, this is implemented for reading a hosts file and RAINS
+// Currently, this is implemented for reading a hosts file, RAINS and DNS TXT
+// records.
 type Resolver interface {
 	// Resolve finds an address for the name.
 	// Returns a HostNotFoundError if the name was not found, but otherwise no
@@ -59,3 +62,156 @@ func (resolvers ResolverList) Resolve(name string) (*snet.SCIONAddress, error) {
 	}
 	return nil, &HostNotFoundError{name}
 }
+
+// ReverseResolver is implemented by Resolvers that can look up the host names
+// for an address.
+type ReverseResolver interface {
+	// ReverseResolve returns the names for the address, the preferred name
+	// first.
+	// Returns a HostNotFoundError if no name was found, but otherwise no error
+	// occurred.
+	ReverseResolve(address *snet.SCIONAddress) ([]string, error)
+}
+
+// ReverseResolve returns the names of the first resolver in the list
+// returning a name for the address. Resolvers not implementing
+// ReverseResolver are skipped.
+func (resolvers ResolverList) ReverseResolve(address *snet.SCIONAddress) ([]string, error) {
+
+	var errHostNotFound *HostNotFoundError
+	for _, resolver := range resolvers {
+		if r, ok := resolver.(ReverseResolver); ok {
+			names, err := r.ReverseResolve(address)
+			if err == nil {
+				return names, nil
+			} else if !errors.As(err, &errHostNotFound) {
+				return nil, err
+			}
+		}
+	}
+	return nil, &HostNotFoundError{address.String()}
+}
+
+// TTLResolver is a Resolver that also reports how long a result remains valid,
+// e.g. based on the lifetime of a record. A TTL of 0 means that the lifetime
+// is unknown, a negative TTL means that the result must not be cached.
+type TTLResolver interface {
+	Resolver
+	// ResolveTTL finds an address for the name, like Resolve, and returns
+	// the time during which the address can be cached.
+	ResolveTTL(name string) (*snet.SCIONAddress, time.Duration, error)
+}
+
+const (
+	defaultResolverTTL         = 5 * time.Minute
+	defaultResolverNegativeTTL = 10 * time.Second
+	// resolverCacheMaxEntries is the number of entries above which expired
+	// entries are purged from the cache of a CachingResolver.
+	resolverCacheMaxEntries = 1024
+)
+
+// CachingResolver wraps a Resolver and caches its results.
+// Addresses are cached for the TTL reported by the Resolver, if it implements
+// TTLResolver, or otherwise for DefaultTTL. HostNotFoundErrors are cached for
+// NegativeTTL. Other errors are not cached.
+type CachingResolver struct {
+	Resolver Resolver
+	// DefaultTTL is the time for which addresses are cached if the Resolver
+	// does not report a TTL. Defaults to 5 minutes.
+	DefaultTTL time.Duration
+	// NegativeTTL is the time for which names that were not found are
+	// cached. Defaults to 10 seconds.
+	NegativeTTL time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]resolverCacheEntry
+}
+
+type resolverCacheEntry struct {
+	addr    *snet.SCIONAddress // nil if the host was not found
+	expires time.Time
+}
+
+// NewCachingResolver creates a CachingResolver wrapping r, with the default
+// TTLs.
+func NewCachingResolver(r Resolver) *CachingResolver {
+	return &CachingResolver{Resolver: r}
+}
+
+func (c *CachingResolver) Resolve(name string) (*snet.SCIONAddress, error) {
+	now := time.Now()
+	c.mutex.Lock()
+	e, ok := c.entries[name]
+	c.mutex.Unlock()
+	if ok && now.Before(e.expires) {
+		if e.addr == nil {
+			return nil, &HostNotFoundError{name}
+		}
+		return copySCIONAddress(e.addr), nil
+	}
+
+	addr, ttl, err := c.resolve(name)
+	var errHostNotFound *HostNotFoundError
+	switch {
+	case err == nil && ttl >= 0:
+		if ttl == 0 {
+			ttl = c.DefaultTTL
+			if ttl <= 0 {
+				ttl = defaultResolverTTL
+			}
+		}
+		c.store(name, resolverCacheEntry{addr: copySCIONAddress(addr), expires: now.Add(ttl)})
+	case errors.As(err, &errHostNotFound):
+		ttl = c.NegativeTTL
+		if ttl <= 0 {
+			ttl = defaultResolverNegativeTTL
+		}
+		c.store(name, resolverCacheEntry{expires: now.Add(ttl)})
+	}
+	return addr, err
+}
+
+// ReverseResolve implements ReverseResolver, if the wrapped Resolver does.
+// Reverse lookups are not cached.
+func (c *CachingResolver) ReverseResolve(address *snet.SCIONAddress) ([]string, error) {
+	if r, ok := c.Resolver.(ReverseResolver); ok {
+		return r.ReverseResolve(address)
+	}
+	return nil, &HostNotFoundError{address.String()}
+}
+
+func (c *CachingResolver) resolve(name string) (*snet.SCIONAddress, time.Duration, error) {
+	if r, ok := c.Resolver.(TTLResolver); ok {
+		return r.ResolveTTL(name)
+	}
+	addr, err := c.Resolver.Resolve(name)
+	return addr, 0, err
+}
+
+func (c *CachingResolver) store(name string, e resolverCacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]resolverCacheEntry)
+	}
+	if len(c.entries) >= resolverCacheMaxEntries {
+		now := time.Now()
+		for k, v := range c.entries {
+			if !now.Before(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[name] = e
+}
+
+func copySCIONAddress(a *snet.SCIONAddress) *snet.SCIONAddress {
+	if a == nil {
+		return nil
+	}
+	c := &snet.SCIONAddress{IA: a.IA}
+	if a.Host != nil {
+		c.Host = a.Host.Copy()
+	}
+	return c
+}
@@ -0,0 +1,204 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/inconshreveable/log15"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+const (
+	// ResolverConfigEnv is the environment variable overriding the path of
+	// the resolver configuration file used by DefaultResolver.
+	ResolverConfigEnv = "SCION_RESOLVER_CONFIG"
+	// DefaultResolverConfigPath is the path of the resolver configuration
+	// file used by DefaultResolver, if ResolverConfigEnv is not set.
+	DefaultResolverConfigPath = "/etc/scion/resolver.toml"
+)
+
+// resolverConfig is the content of a resolver configuration file.
+type resolverConfig struct {
+	// Timeout is the default timeout for the network lookups, i.e. for the
+	// rains and dns resolvers.
+	Timeout   duration              `toml:"timeout"`
+	Resolvers []resolverConfigEntry `toml:"resolver"`
+}
+
+type resolverConfigEntry struct {
+	// Type is one of "hosts", "rains" or "dns".
+	Type string `toml:"type"`
+	// Path is the path of the hosts file, for type hosts. Relative paths are
+	// relative to the directory of the configuration file.
+	Path string `toml:"path"`
+	// Server is the address of the RAINS server (ISD-AS,[IP]:port) or of the
+	// DNS server (host:port). If empty, the server configured in
+	// /etc/scion/rains.cfg or the system's DNS configuration is used,
+	// respectively.
+	Server string `toml:"server"`
+	// Timeout overrides the default timeout for this resolver.
+	Timeout duration `toml:"timeout"`
+}
+
+// duration is a time.Duration that can be decoded from a TOML string like
+// "1.5s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// LoadResolverConfig creates the Resolver configured in the TOML file at path.
+// The file declares the resolvers, which are queried in the given order, like
+// a ResolverList:
+//
+//	# default timeout for RAINS and DNS queries
+//	timeout = "1s"
+//
+//	[[resolver]]
+//	type = "hosts"
+//	path = "project.hosts" # relative to the directory of this file
+//
+//	[[resolver]]
+//	type = "hosts"
+//	path = "/etc/scion/hosts"
+//
+//	[[resolver]]
+//	type = "rains"
+//	server = "17-ffaa:0:1,[192.0.2.1]:55553"
+//	timeout = "500ms"
+//
+//	[[resolver]]
+//	type = "dns"
+//	server = "192.0.2.53:53" # optional, defaults to system configuration
+//
+// RAINS resolvers are ignored if built with norains. The results of RAINS and
+// DNS lookups are cached, see CachingResolver.
+func LoadResolverConfig(path string) (Resolver, error) {
+	var cfg resolverConfig
+	md, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error loading %s: %s", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("error loading %s: unknown keys %v", path, undecoded)
+	}
+	resolvers := make(ResolverList, 0, len(cfg.Resolvers))
+	for i, e := range cfg.Resolvers {
+		timeout := e.Timeout.Duration
+		if timeout == 0 {
+			timeout = cfg.Timeout.Duration
+		}
+		r, err := newConfiguredResolver(e, filepath.Dir(path), timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s: resolver %d: %s", path, i+1, err)
+		}
+		if r != nil {
+			resolvers = append(resolvers, r)
+		}
+	}
+	return resolvers, nil
+}
+
+// newConfiguredResolver creates the Resolver for an entry of the
+// configuration file. Returns nil if the resolver is not supported in this
+// build.
+func newConfiguredResolver(e resolverConfigEntry, dir string,
+	timeout time.Duration) (Resolver, error) {
+
+	switch strings.ToLower(e.Type) {
+	case "hosts":
+		if e.Server != "" {
+			return nil, errors.New("hosts resolver does not support server")
+		}
+		if e.Path == "" {
+			return nil, errors.New("hosts resolver requires path")
+		}
+		path := e.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		return &hostsfileResolver{path: path}, nil
+	case "rains":
+		if e.Path != "" {
+			return nil, errors.New("rains resolver does not support path")
+		}
+		var server *snet.UDPAddr
+		if e.Server != "" {
+			var err error
+			server, err = snet.ParseUDPAddr(e.Server)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RAINS server address %q: %s", e.Server, err)
+			}
+		}
+		if newRainsResolver == nil {
+			log.Warn("Ignoring rains resolver, RAINS support disabled in this build")
+			return nil, nil
+		}
+		return newRainsResolver(server, timeout), nil
+	case "dns":
+		if e.Path != "" {
+			return nil, errors.New("dns resolver does not support path")
+		}
+		r := NewDNSResolver(e.Server)
+		r.Timeout = timeout
+		return NewCachingResolver(r), nil
+	default:
+		return nil, fmt.Errorf("unknown resolver type %q", e.Type)
+	}
+}
+
+// loadDefaultResolver returns the Resolver configured in the resolver
+// configuration file, see DefaultResolver.
+func loadDefaultResolver() Resolver {
+	path := os.Getenv(ResolverConfigEnv)
+	if path == "" {
+		path = DefaultResolverConfigPath
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return builtinResolver()
+		}
+	}
+	r, err := LoadResolverConfig(path)
+	if err != nil {
+		log.Error("Unable to load resolver configuration", "err", err)
+		return &errorResolver{err: err}
+	}
+	return r
+}
+
+// errorResolver fails every lookup with err.
+type errorResolver struct {
+	err error
+}
+
+func (r *errorResolver) Resolve(name string) (*snet.SCIONAddress, error) {
+	return nil, r.err
+}
+
+func (r *errorResolver) ReverseResolve(address *snet.SCIONAddress) ([]string, error) {
+	return nil, r.err
+}
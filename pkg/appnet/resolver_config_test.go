@@ -0,0 +1,135 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadResolverConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dnsServer := startDNSStub(t, map[string][]string{
+		"host1.": {"scion=1-ff00:0:1,192.0.2.1"},
+		"dns.":   {"scion=1-ff00:0:2,192.0.2.2"},
+	})
+	defer dnsServer.Close()
+
+	writeFile(t, filepath.Join(dir, "project.hosts"), "1-ff00:0:3,[192.0.2.3] host1. project.\n")
+	config := fmt.Sprintf(`
+timeout = "2s"
+
+[[resolver]]
+type = "hosts"
+path = "project.hosts"
+
+[[resolver]]
+type = "dns"
+server = "%s"
+timeout = "1s"
+`, dnsServer.LocalAddr())
+	configPath := filepath.Join(dir, "resolver.toml")
+	writeFile(t, configPath, config)
+
+	resolver, err := LoadResolverConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResolver(t, resolver, []testCase{
+		{"host1.", mustParse("1-ff00:0:3,[192.0.2.3]")}, // hosts file first
+		{"project.", mustParse("1-ff00:0:3,[192.0.2.3]")},
+		{"dns.", mustParse("1-ff00:0:2,[192.0.2.2]")},
+		{"unknown.", nil},
+	})
+
+	list := resolver.(ResolverList)
+	if len(list) != 2 {
+		t.Fatalf("expected 2 resolvers, got %d", len(list))
+	}
+	if path := list[0].(*hostsfileResolver).path; path != filepath.Join(dir, "project.hosts") {
+		t.Errorf("wrong hosts file path %s", path)
+	}
+	if timeout := list[1].(*CachingResolver).Resolver.(*DNSResolver).Timeout; timeout != time.Second {
+		t.Errorf("wrong DNS timeout, expected %v, got %v", time.Second, timeout)
+	}
+}
+
+func TestLoadResolverConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]string{
+		"unknown type":    "[[resolver]]\ntype = \"foo\"\n",
+		"unknown key":     "[[resolver]]\ntype = \"hosts\"\npath = \"hosts\"\nfoo = 1\n",
+		"missing path":    "[[resolver]]\ntype = \"hosts\"\n",
+		"bad duration":    "timeout = \"1 second\"\n",
+		"bad rains":       "[[resolver]]\ntype = \"rains\"\nserver = \"localhost:55553\"\n",
+		"path for dns":    "[[resolver]]\ntype = \"dns\"\npath = \"hosts\"\n",
+		"invalid syntax":  "[[resolver]\n",
+		"server in hosts": "[[resolver]]\ntype = \"hosts\"\npath = \"hosts\"\nserver = \"1.1.1.1:53\"\n",
+	}
+	for name, config := range cases {
+		configPath := filepath.Join(dir, "resolver.toml")
+		writeFile(t, configPath, config)
+		if _, err := LoadResolverConfig(configPath); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := LoadResolverConfig(filepath.Join(dir, "nonexisting.toml")); err == nil {
+		t.Errorf("expected error for non-existing file")
+	}
+}
+
+func TestLoadDefaultResolverEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv(ResolverConfigEnv)
+
+	configPath := filepath.Join(dir, "resolver.toml")
+	writeFile(t, filepath.Join(dir, "hosts"), "1-ff00:0:1,[192.0.2.1] foo\n")
+	writeFile(t, configPath, "[[resolver]]\ntype = \"hosts\"\npath = \"hosts\"\n")
+	os.Setenv(ResolverConfigEnv, configPath)
+	testResolver(t, loadDefaultResolver(), []testCase{
+		{"foo", mustParse("1-ff00:0:1,[192.0.2.1]")},
+		{"localhost", nil}, // system hosts files not used
+	})
+
+	// Explicitly configured file must exist
+	os.Setenv(ResolverConfigEnv, filepath.Join(dir, "nonexisting.toml"))
+	if _, err := loadDefaultResolver().Resolve("foo"); err == nil {
+		t.Errorf("expected error for missing configuration file")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
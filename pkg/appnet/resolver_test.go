@@ -15,8 +15,13 @@
 package appnet
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/snet"
@@ -26,7 +31,7 @@ const hostsTestFile = "hosts_test_file"
 
 func TestCount(t *testing.T) {
 
-	hosts, err := loadHostsFile(hostsTestFile)
+	hosts, _, err := loadHostsFile(hostsTestFile)
 	if err != nil {
 		t.Fatal("error loading test file", err)
 	}
@@ -37,7 +42,7 @@ func TestCount(t *testing.T) {
 }
 
 func TestHostsfileResolver(t *testing.T) {
-	resolver := &hostsfileResolver{hostsTestFile}
+	resolver := &hostsfileResolver{path: hostsTestFile}
 
 	cases := []testCase{
 		{"host1.1", mustParse("17-ffaa:0:1,[192.168.1.1]")},
@@ -55,10 +60,92 @@ func TestHostsfileResolver(t *testing.T) {
 }
 
 func TestHostsfileResolverNonexisting(t *testing.T) {
-	resolver := &hostsfileResolver{"non_existing_hosts_file"}
+	resolver := &hostsfileResolver{path: "non_existing_hosts_file"}
 	testResolver(t, resolver, []testCase{{"something", nil}})
 }
 
+func TestHostsfileResolverReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	resolver := &hostsfileResolver{path: path}
+
+	if err := ioutil.WriteFile(path, []byte("17-ffaa:0:1,[192.168.1.1] foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testResolver(t, resolver, []testCase{
+		{"foo", mustParse("17-ffaa:0:1,[192.168.1.1]")},
+		{"bar", nil},
+	})
+
+	if err := ioutil.WriteFile(path, []byte("17-ffaa:0:1,[192.168.1.2] bar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Same size, ensure the modification time changes
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	testResolver(t, resolver, []testCase{
+		{"foo", nil},
+		{"bar", mustParse("17-ffaa:0:1,[192.168.1.2]")},
+	})
+}
+
+func TestHostsfileReverseResolver(t *testing.T) {
+	resolver := &hostsfileResolver{path: hostsTestFile}
+
+	cases := []struct {
+		address  *snet.SCIONAddress
+		expected []string
+	}{
+		{mustParse("17-ffaa:0:1,[192.168.1.1]"), []string{"host1.1", "host1.2", "host3"}},
+		{mustParse("18-ffaa:1:2,[10.0.8.10]"), []string{"host2"}},
+		{mustParse("20-ffaa:c0ff:ee12,[::ff1:ce00:dead:10cc:baad:f00d]"), []string{"host4"}},
+		{mustParse("17-ffaa:0:1,[192.168.1.2]"), nil},
+		{mustParse("18-ffaa:1:3,[10.0.8.10]"), nil},
+	}
+	for _, c := range cases {
+		actual, err := resolver.ReverseResolve(c.address)
+		if c.expected == nil {
+			if _, ok := err.(*HostNotFoundError); !ok {
+				t.Errorf("expected HostNotFoundError for %s, got %v, %v", c.address, actual, err)
+			}
+		} else if err != nil {
+			t.Errorf("unexpected error for %s: %v", c.address, err)
+		} else if fmt.Sprint(actual) != fmt.Sprint(c.expected) {
+			t.Errorf("wrong result for %s, expected %v, got %v", c.address, c.expected, actual)
+		}
+	}
+}
+
+func TestNamedAddr(t *testing.T) {
+	resolver := ResolverList{
+		dummyResolver{}, // not a ReverseResolver, skipped
+		&hostsfileResolver{path: hostsTestFile},
+	}
+	cases := map[string]string{
+		"17-ffaa:0:1,[192.168.1.1]:80": "host1.1 (17-ffaa:0:1,192.168.1.1:80)",
+		"18-ffaa:1:2,[10.0.8.10]:1234": "host2 (18-ffaa:1:2,10.0.8.10:1234)",
+		"18-ffaa:1:2,[10.0.8.11]:1234": "18-ffaa:1:2,10.0.8.11:1234",
+	}
+	for address, expected := range cases {
+		a, err := snet.ParseUDPAddr(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := namedAddr(a, resolver); actual != expected {
+			t.Errorf("wrong name for %s, expected %q, got %q", address, expected, actual)
+		}
+	}
+	if actual := namedAddr(nil, resolver); actual != "<nil>" {
+		t.Errorf("wrong name for nil address, got %q", actual)
+	}
+}
+
 func TestResolverList(t *testing.T) {
 	primary := map[string]*snet.SCIONAddress{
 		"foo": mustParse("1-ff00:0:f00,[192.0.2.1]"),
@@ -94,6 +181,104 @@ func (r dummyResolver) Resolve(name string) (*snet.SCIONAddress, error) {
 	}
 }
 
+func TestCachingResolver(t *testing.T) {
+	backend := &countingResolver{
+		dummyResolver: dummyResolver{map[string]*snet.SCIONAddress{
+			"foo": mustParse("1-ff00:0:f00,[192.0.2.1]"),
+		}},
+		ttl: map[string]time.Duration{},
+	}
+	resolver := NewCachingResolver(backend)
+	cases := []testCase{
+		{"foo", mustParse("1-ff00:0:f00,[192.0.2.1]")},
+		{"boo", nil},
+	}
+	testResolver(t, resolver, cases)
+	testResolver(t, resolver, cases)
+	if backend.count["foo"] != 1 || backend.count["boo"] != 1 {
+		t.Errorf("expected one query per name, got %v", backend.count)
+	}
+
+	// Entries expire after the TTL
+	resolver.entries["foo"] = resolverCacheEntry{
+		addr:    resolver.entries["foo"].addr,
+		expires: time.Now().Add(-time.Second),
+	}
+	testResolver(t, resolver, cases)
+	if backend.count["foo"] != 2 || backend.count["boo"] != 1 {
+		t.Errorf("expected a new query for expired name, got %v", backend.count)
+	}
+
+	// Other errors are not cached
+	backend.err = errors.New("boom")
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.Resolve("bar"); err != backend.err {
+			t.Errorf("expected error %v, got %v", backend.err, err)
+		}
+	}
+	if backend.count["bar"] != 2 {
+		t.Errorf("expected errors not to be cached, got %d queries", backend.count["bar"])
+	}
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	backend := &countingResolver{
+		dummyResolver: dummyResolver{map[string]*snet.SCIONAddress{
+			"default": mustParse("1-ff00:0:1,[192.0.2.1]"),
+			"short":   mustParse("1-ff00:0:2,[192.0.2.1]"),
+			"nocache": mustParse("1-ff00:0:3,[192.0.2.1]"),
+		}},
+		ttl: map[string]time.Duration{
+			"short":   time.Second,
+			"nocache": -1,
+		},
+	}
+	resolver := &CachingResolver{Resolver: backend, DefaultTTL: time.Hour, NegativeTTL: time.Minute}
+	now := time.Now()
+	for _, name := range []string{"default", "short", "nocache", "notfound"} {
+		_, _ = resolver.Resolve(name)
+	}
+
+	expected := map[string]time.Duration{
+		"default":  time.Hour,
+		"short":    time.Second,
+		"notfound": time.Minute,
+	}
+	for name, ttl := range expected {
+		e, ok := resolver.entries[name]
+		if !ok {
+			t.Errorf("expected %s to be cached", name)
+			continue
+		}
+		if d := e.expires.Sub(now); d < ttl || d > ttl+time.Second {
+			t.Errorf("wrong TTL for %s, expected %v, got %v", name, ttl, d)
+		}
+	}
+	if _, ok := resolver.entries["nocache"]; ok {
+		t.Errorf("expected result with negative TTL not to be cached")
+	}
+}
+
+// countingResolver is a TTLResolver counting the queries for each name.
+type countingResolver struct {
+	dummyResolver
+	ttl   map[string]time.Duration
+	err   error
+	count map[string]int
+}
+
+func (r *countingResolver) ResolveTTL(name string) (*snet.SCIONAddress, time.Duration, error) {
+	if r.count == nil {
+		r.count = make(map[string]int)
+	}
+	r.count[name]++
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	addr, err := r.Resolve(name)
+	return addr, r.ttl[name], err
+}
+
 type testCase struct {
 	name     string
 	expected *snet.SCIONAddress
@@ -0,0 +1,348 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	log "github.com/inconshreveable/log15"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/ctrl/path_mgmt"
+	"github.com/scionproto/scion/go/lib/slayers"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/sock/reliable"
+	"github.com/scionproto/scion/go/lib/spath"
+	"github.com/scionproto/scion/go/lib/util"
+)
+
+// Errors matched by SCMPError, with errors.Is.
+var (
+	// ErrDestinationUnreachable matches SCMP destination unreachable errors,
+	// e.g. if no application is listening on the destination port.
+	ErrDestinationUnreachable = errors.New("destination unreachable")
+	// ErrPathDown matches SCMP external interface down and internal
+	// connectivity down errors, i.e. the path is (temporarily) unusable.
+	ErrPathDown = errors.New("path down")
+	// ErrPacketTooBig matches SCMP packet too big errors. The MTU of the path
+	// is reported in SCMPError.MTU.
+	ErrPacketTooBig = errors.New("packet too big")
+	// ErrParameterProblem matches SCMP parameter problem errors, e.g. for an
+	// expired path.
+	ErrParameterProblem = errors.New("parameter problem")
+)
+
+// scmpRevocationTTL is the validity of the revocations created for interface
+// down messages, as in snet.
+const scmpRevocationTTL = 10 * time.Second
+
+// SCMPError is an SCMP error message received in response to a packet sent
+// from a conn.
+//
+// The SCMP error is returned by the next Read (or ReadFrom) of the conn that
+// sent the packet. As SCMP messages arrive asynchronously, Write can not
+// report them. Applications that only write can subscribe to the errors with
+// NotifySCMP; note however that SCMP messages are only received while the conn
+// is being read.
+//
+// The ManagedConn and MultipathConn handle path down errors internally, by
+// switching to other paths, and do not return them from Read.
+type SCMPError struct {
+	// TypeCode is the type and code of the SCMP message.
+	TypeCode slayers.SCMPTypeCode
+	// Source is the address of the router or host that sent the message.
+	Source snet.SCIONAddress
+	// Destination is the destination of the packet that triggered the
+	// message, with the dataplane path on which it was sent. Nil if the
+	// packet is not quoted in the message.
+	Destination *snet.UDPAddr
+	// Path is the path on which the packet that triggered the message was
+	// sent. Nil if the path is not known, i.e. it was not obtained from a path
+	// query of this process, e.g. for replies sent by a server.
+	Path snet.Path
+	// Interface is the interface reported in path down errors.
+	Interface *snet.PathInterface
+	// MTU is the maximum packet size reported in packet too big errors.
+	MTU uint16
+}
+
+func (e *SCMPError) Error() string {
+	msg := fmt.Sprintf("SCMP %s from %s", e.TypeCode, e.Source)
+	if e.Interface != nil {
+		msg += fmt.Sprintf(", interface %s", e.Interface)
+	}
+	if e.TypeCode.Type() == slayers.SCMPTypePacketTooBig {
+		msg += fmt.Sprintf(", MTU %d", e.MTU)
+	}
+	if e.Destination != nil {
+		msg += fmt.Sprintf(", for packet to %s", e.Destination)
+	}
+	if e.Path != nil {
+		msg += fmt.Sprintf(" over path %s", snet.Fingerprint(e.Path))
+	}
+	return msg
+}
+
+// Is returns true if target is the sentinel error corresponding to the SCMP
+// type, e.g. ErrPathDown.
+func (e *SCMPError) Is(target error) bool {
+	switch e.TypeCode.Type() {
+	case slayers.SCMPTypeDestinationUnreachable:
+		return target == ErrDestinationUnreachable
+	case slayers.SCMPTypeExternalInterfaceDown, slayers.SCMPTypeInternalConnectivityDown:
+		return target == ErrPathDown
+	case slayers.SCMPTypePacketTooBig:
+		return target == ErrPacketTooBig
+	case slayers.SCMPTypeParameterProblem:
+		return target == ErrParameterProblem
+	}
+	return false
+}
+
+// NotifySCMP registers ch to receive the SCMP errors received on any conn of
+// the default Network, see Network.NotifySCMP.
+func NotifySCMP(ch chan<- *SCMPError) (stop func()) {
+	return DefNetwork().NotifySCMP(ch)
+}
+
+// NotifySCMP registers ch to receive the SCMP errors received on any conn
+// created from this Network. The errors are sent in addition to being
+// returned from Read.
+// Sending to ch does not block; errors are dropped if ch is not ready.
+// The returned function cancels the registration.
+func (n *Network) NotifySCMP(ch chan<- *SCMPError) (stop func()) {
+	return n.scmp.subscribe(ch)
+}
+
+// scmpNotifier handles the SCMP errors received on the conns of a Network.
+type scmpNotifier struct {
+	revHandler snet.RevocationHandler
+	paths      *pathCache
+	pmtu       *pmtuCache
+
+	mutex       sync.Mutex
+	subscribers map[chan<- *SCMPError]struct{}
+}
+
+func newSCMPNotifier(revHandler snet.RevocationHandler, paths *pathCache, pmtu *pmtuCache) *scmpNotifier {
+	return &scmpNotifier{
+		revHandler:  revHandler,
+		paths:       paths,
+		pmtu:        pmtu,
+		subscribers: make(map[chan<- *SCMPError]struct{}),
+	}
+}
+
+func (s *scmpNotifier) subscribe(ch chan<- *SCMPError) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscribers[ch] = struct{}{}
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.subscribers, ch)
+	}
+}
+
+// handle informs sciond and the path cache about revoked interfaces, records
+// the reported path MTU and notifies the subscribers.
+func (s *scmpNotifier) handle(e *SCMPError) {
+	log.Debug("Received SCMP error", "err", e)
+	if e.Interface != nil {
+		if s.revHandler != nil {
+			s.revoke(*e.Interface)
+		}
+		s.paths.Revoke(*e.Interface)
+	}
+	if e.TypeCode.Type() == slayers.SCMPTypePacketTooBig && e.Destination != nil && e.MTU > 0 {
+		s.pmtu.reduce(e.Destination.Path, int(e.MTU))
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (s *scmpNotifier) revoke(iface snet.PathInterface) {
+	sRev, err := path_mgmt.NewSignedRevInfo(&path_mgmt.RevInfo{
+		IfID:         iface.ID,
+		RawIsdas:     iface.IA.IAInt(),
+		RawTimestamp: util.TimeToSecs(time.Now()),
+		RawTTL:       uint32(scmpRevocationTTL / time.Second),
+	})
+	if err != nil {
+		log.Debug("Unable to create revocation", "err", err)
+		return
+	}
+	raw, err := sRev.Pack()
+	if err != nil {
+		log.Debug("Unable to pack revocation", "err", err)
+		return
+	}
+	s.revHandler.RevokeRaw(context.TODO(), raw)
+}
+
+// scmpDispatcher wraps the connections registered with the dispatcher, to
+// return SCMP error messages as SCMPError.
+type scmpDispatcher struct {
+	reliable.Dispatcher
+	notifier *scmpNotifier
+}
+
+func (d *scmpDispatcher) Register(ctx context.Context, ia addr.IA, address *net.UDPAddr,
+	svc addr.HostSVC) (net.PacketConn, uint16, error) {
+
+	conn, port, err := d.Dispatcher.Register(ctx, ia, address, svc)
+	if err != nil {
+		return conn, port, err
+	}
+	return &scmpConn{PacketConn: conn, notifier: d.notifier}, port, nil
+}
+
+// scmpConn returns the SCMP error messages read from the underlying
+// connection to the dispatcher as SCMPError. The packet itself is consumed.
+type scmpConn struct {
+	net.PacketConn
+	notifier *scmpNotifier
+}
+
+func (c *scmpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, from, err
+	}
+	if scmpErr := parseSCMPError(b[:n]); scmpErr != nil {
+		c.notifier.handle(scmpErr)
+		return 0, from, scmpErr
+	}
+	return n, from, nil
+}
+
+func (c *scmpConn) writePackets(pkts [][]byte, nextHop *net.UDPAddr) error {
+	return writePackets(c.PacketConn, pkts, nextHop)
+}
+
+// parseSCMPError returns the SCMPError for a serialized SCION packet
+// containing an SCMP error message, or nil for any other packet.
+func parseSCMPError(raw []byte) *SCMPError {
+	var scn slayers.SCION
+	if err := scn.DecodeFromBytes(raw, gopacket.NilDecodeFeedback); err != nil ||
+		scn.NextHdr != common.L4SCMP {
+		return nil
+	}
+	var scmp slayers.SCMP
+	if err := scmp.DecodeFromBytes(scn.Payload, gopacket.NilDecodeFeedback); err != nil ||
+		scmp.TypeCode.InfoMsg() {
+		return nil
+	}
+	srcAddr, err := scn.SrcAddr()
+	if err != nil {
+		return nil
+	}
+	e := &SCMPError{
+		TypeCode: scmp.TypeCode,
+		Source:   snet.SCIONAddress{IA: scn.SrcIA, Host: hostAddr(srcAddr)},
+	}
+
+	var quote []byte
+	switch scmp.TypeCode.Type() {
+	case slayers.SCMPTypeExternalInterfaceDown:
+		var msg slayers.SCMPExternalInterfaceDown
+		if err := msg.DecodeFromBytes(scmp.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return nil
+		}
+		e.Interface = &snet.PathInterface{IA: msg.IA, ID: common.IFIDType(msg.IfID)}
+		quote = msg.Payload
+	case slayers.SCMPTypeInternalConnectivityDown:
+		var msg slayers.SCMPInternalConnectivityDown
+		if err := msg.DecodeFromBytes(scmp.Payload, gopacket.NilDecodeFeedback); err != nil {
+			return nil
+		}
+		e.Interface = &snet.PathInterface{IA: msg.IA, ID: common.IFIDType(msg.Egress)}
+		quote = msg.Payload
+	case slayers.SCMPTypePacketTooBig:
+		// slayers has no layer for this message: 2 bytes reserved, 2 bytes MTU
+		if len(scmp.Payload) < 4 {
+			return nil
+		}
+		e.MTU = binary.BigEndian.Uint16(scmp.Payload[2:4])
+		quote = scmp.Payload[4:]
+	default:
+		// Destination unreachable and parameter problem: 4 bytes, then quote
+		if len(scmp.Payload) < 4 {
+			return nil
+		}
+		quote = scmp.Payload[4:]
+	}
+	e.Destination, e.Path = parseQuote(quote)
+	return e
+}
+
+// parseQuote returns the destination and the path of the packet quoted in an
+// SCMP error message, if possible.
+func parseQuote(quote []byte) (*snet.UDPAddr, snet.Path) {
+	var scn slayers.SCION
+	if err := scn.DecodeFromBytes(quote, gopacket.NilDecodeFeedback); err != nil {
+		return nil, nil
+	}
+	dstAddr, err := scn.DstAddr()
+	if err != nil {
+		return nil, nil
+	}
+	dst := &snet.UDPAddr{IA: scn.DstIA}
+	if ipAddr, ok := dstAddr.(*net.IPAddr); ok {
+		dst.Host = &net.UDPAddr{IP: ipAddr.IP}
+	} else {
+		dst.Host = &net.UDPAddr{}
+	}
+	if scn.NextHdr == common.L4UDP && len(scn.Payload) >= 4 {
+		dst.Host.Port = int(binary.BigEndian.Uint16(scn.Payload[2:4]))
+	}
+	// A path of length 4 is an empty path, see snet.Packet.Decode
+	if l := scn.Path.Len(); l <= 4 {
+		return dst, nil
+	}
+	raw := make([]byte, scn.Path.Len())
+	if err := scn.Path.SerializeTo(raw); err != nil {
+		return dst, nil
+	}
+	dst.Path = spath.Path{Raw: raw, Type: scn.PathType}
+	if known := lookupPath(dst.Path); known != nil {
+		return dst, known.path
+	}
+	return dst, nil
+}
+
+func hostAddr(a net.Addr) addr.HostAddr {
+	switch v := a.(type) {
+	case *net.IPAddr:
+		return addr.HostFromIP(v.IP)
+	case addr.HostSVC:
+		return v
+	}
+	return addr.HostNone{}
+}
@@ -0,0 +1,331 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/internal/deadline"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/snet/addrutil"
+)
+
+const (
+	// wildcardPeerTimeout is the time after which the local address used to
+	// reply to a remote is forgotten, if no further packets were received.
+	wildcardPeerTimeout = 5 * time.Minute
+	// wildcardMaxPeers is the number of remotes above which the forgotten
+	// remotes are purged.
+	wildcardMaxPeers = 4096
+)
+
+var errWildcardConnClosed = errors.New("use of closed connection")
+
+// WildcardConn is a SCION/UDP socket listening on the same port on all local
+// IP addresses that are usable in the local AS, emulating a socket bound to
+// a wildcard address.
+//
+// Replies are sent from the local address on which the last packet from the
+// remote was received. Packets to other remotes are sent from the local
+// address determined by the route to the next hop, like for Dial.
+type WildcardConn struct {
+	network *Network
+	conns   []*snet.Conn
+
+	packets chan wildcardPacket
+
+	mutex sync.Mutex
+	peers map[string]wildcardPeer
+
+	closeOnce    sync.Once
+	closed       chan struct{}
+	readDeadline deadline.Deadline
+}
+
+type wildcardPacket struct {
+	data []byte
+	from net.Addr
+	err  error
+	conn int
+}
+
+type wildcardPeer struct {
+	conn int
+	seen time.Time
+}
+
+// ListenAll listens on the port on all local IP addresses of the host that
+// are usable in the local AS, see WildcardConn.
+// If port is 0, the port is chosen when binding the first address.
+func ListenAll(port uint16) (*WildcardConn, error) {
+	return DefNetwork().ListenAll(port)
+}
+
+// ListenAll listens on the port on all usable local IP addresses.
+// See ListenAll.
+func (n *Network) ListenAll(port uint16) (*WildcardConn, error) {
+	ips, err := n.localIPs()
+	if err != nil {
+		return nil, err
+	}
+	c := &WildcardConn{
+		network: n,
+		packets: make(chan wildcardPacket),
+		peers:   make(map[string]wildcardPeer),
+		closed:  make(chan struct{}),
+	}
+	for _, ip := range ips {
+		conn, err := n.ListenUDP(&net.UDPAddr{IP: ip, Port: int(port)})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if port == 0 {
+			port = uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+		}
+		c.conns = append(c.conns, conn)
+	}
+	for i := range c.conns {
+		go c.receive(i)
+	}
+	return c, nil
+}
+
+// localIPs returns the local IP addresses that are considered usable in the
+// local AS, i.e. from which the infrastructure of the AS is reachable. These
+// are the source addresses of the routes to the host in the local AS and to
+// the border routers of the AS, and the addresses on the same subnets as these
+// hosts. Other addresses, e.g. of container bridges, are not included.
+// The default local IP is first.
+func (n *Network) localIPs() ([]net.IP, error) {
+	defaultIP, err := n.defaultLocalIP()
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{defaultIP}
+	add := func(ip net.IP) {
+		for _, known := range ips {
+			if known.Equal(ip) {
+				return
+			}
+		}
+		ips = append(ips, ip)
+	}
+	hosts := append([]net.IP{n.hostInLocalAS}, n.borderRouterIPs()...)
+	for _, host := range hosts {
+		if ip, err := addrutil.ResolveLocal(host); err == nil {
+			add(ip)
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+			continue
+		}
+		for _, host := range hosts {
+			if ipnet.Contains(host) {
+				add(ip)
+				break
+			}
+		}
+	}
+	return ips, nil
+}
+
+// borderRouterIPs returns the underlay addresses of the border routers of the
+// local AS, as reported by sciond. Returns nil if sciond is not available.
+func (n *Network) borderRouterIPs() []net.IP {
+	if n.sciondConn == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.queryTimeout)
+	defer cancel()
+	ifs, err := n.sciondConn.IFInfo(ctx, nil)
+	if err != nil {
+		log.Debug("Unable to query border router addresses", "err", err)
+		return nil
+	}
+	var ips []net.IP
+	for _, a := range ifs {
+		ips = append(ips, a.IP)
+	}
+	return ips
+}
+
+// receive reads from the ith socket and passes the packets to ReadFrom.
+// Errors are passed on as well; after a persistent error, i.e. one that is
+// neither temporary nor an SCMP error for a single packet, receiving on the
+// socket stops.
+func (c *WildcardConn) receive(i int) {
+	buf := make([]byte, snet.BufSize)
+	for {
+		n, from, err := c.conns[i].ReadFrom(buf)
+		p := wildcardPacket{from: from, err: err, conn: i}
+		if err == nil {
+			p.data = append([]byte(nil), buf[:n]...)
+		}
+		select {
+		case c.packets <- p:
+		case <-c.closed:
+			return
+		}
+		if err != nil && !isTransientError(err) {
+			log.Debug("WildcardConn: stop receiving", "local", c.conns[i].LocalAddr(), "err", err)
+			return
+		}
+	}
+}
+
+// isTransientError returns true if err only affects a single read, i.e. for
+// SCMP errors and temporary errors.
+func isTransientError(err error) bool {
+	var scmpErr *SCMPError
+	if errors.As(err, &scmpErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Temporary()
+}
+
+// ReadFrom reads a packet received on any of the local addresses.
+func (c *WildcardConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.packets:
+		if p.err != nil {
+			return 0, p.from, p.err
+		}
+		c.addPeer(p.from, p.conn)
+		return copy(b, p.data), p.from, nil
+	case <-c.closed:
+		return 0, nil, errWildcardConnClosed
+	case <-c.readDeadline.Wait():
+		return 0, nil, deadline.TimeoutError{}
+	}
+}
+
+// WriteTo writes to the remote address, from the local address on which the
+// last packet from this remote was received.
+func (c *WildcardConn) WriteTo(b []byte, raddr net.Addr) (int, error) {
+	return c.conns[c.connFor(raddr)].WriteTo(b, raddr)
+}
+
+// LocalAddrFor returns the local address used to send to raddr, i.e. the
+// address on which the last packet from raddr was received.
+func (c *WildcardConn) LocalAddrFor(raddr net.Addr) *net.UDPAddr {
+	return c.conns[c.connFor(raddr)].LocalAddr().(*net.UDPAddr)
+}
+
+// LocalAddr returns the local address on the default local IP.
+func (c *WildcardConn) LocalAddr() net.Addr {
+	return c.conns[0].LocalAddr()
+}
+
+// LocalAddrs returns the local addresses on which the conn listens.
+func (c *WildcardConn) LocalAddrs() []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, len(c.conns))
+	for i, conn := range c.conns {
+		addrs[i] = conn.LocalAddr().(*net.UDPAddr)
+	}
+	return addrs
+}
+
+func (c *WildcardConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		for _, conn := range c.conns {
+			if cerr := conn.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (c *WildcardConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *WildcardConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *WildcardConn) SetWriteDeadline(t time.Time) error {
+	for _, conn := range c.conns {
+		if err := conn.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *WildcardConn) addPeer(from net.Addr, conn int) {
+	if from == nil || len(c.conns) == 1 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if len(c.peers) >= wildcardMaxPeers {
+		for k, p := range c.peers {
+			if now.Sub(p.seen) > wildcardPeerTimeout {
+				delete(c.peers, k)
+			}
+		}
+	}
+	c.peers[from.String()] = wildcardPeer{conn: conn, seen: now}
+}
+
+// connFor returns the index of the socket used to send to raddr.
+func (c *WildcardConn) connFor(raddr net.Addr) int {
+	if len(c.conns) == 1 || raddr == nil {
+		return 0
+	}
+	c.mutex.Lock()
+	p, ok := c.peers[raddr.String()]
+	c.mutex.Unlock()
+	if ok && time.Since(p.seen) <= wildcardPeerTimeout {
+		return p.conn
+	}
+	if a, ok := raddr.(*snet.UDPAddr); ok && a.NextHop != nil {
+		if ip, err := c.network.resolveLocal(a); err == nil {
+			for i, conn := range c.conns {
+				if conn.LocalAddr().(*net.UDPAddr).IP.Equal(ip) {
+					return i
+				}
+			}
+		}
+	}
+	log.Debug("WildcardConn: no local address for remote, using default", "remote", raddr)
+	return 0
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 ETH Zurich
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appnet_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet/appnettest"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+func TestListenAll(t *testing.T) {
+	iaA := addr.IA{I: 1, A: 0xff0000000110}
+	iaB := addr.IA{I: 1, A: 0xff0000000111}
+	mn := appnettest.NewNet()
+	mn.AddPath(iaA, iaB, appnettest.PathConfig{})
+
+	server, err := mn.NewNetwork(iaB).ListenAll(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	addrs := server.LocalAddrs()
+	if len(addrs) == 0 || addrs[0].Port == 0 {
+		t.Fatalf("unexpected local addresses %v", addrs)
+	}
+	for _, a := range addrs {
+		if a.Port != addrs[0].Port {
+			t.Errorf("expected same port on all addresses, got %v", addrs)
+		}
+	}
+
+	raddr := &snet.UDPAddr{IA: iaB, Host: addrs[len(addrs)-1]}
+	client, err := mn.NewNetwork(iaA).DialAddr(raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("unexpected payload %q", buf[:n])
+	}
+	if local := server.LocalAddrFor(from); !local.IP.Equal(raddr.Host.IP) {
+		t.Errorf("expected reply from %s, got %s", raddr.Host.IP, local.IP)
+	}
+	if _, err := server.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Errorf("unexpected payload %q", buf[:n])
+	}
+
+	// Read deadline
+	_ = server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := server.ReadFrom(buf); err == nil {
+		t.Errorf("expected timeout")
+	} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
@@ -15,18 +15,25 @@
 package shttp
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
+	"github.com/scionproto/scion/go/lib/snet"
 )
 
 // Server wraps a http3.Server making it work with SCION
 type Server struct {
 	*http3.Server
+
+	mutex   sync.Mutex
+	closed  bool
+	servers map[*http3.Server]struct{}
 }
 
 // ListenAndServe listens for HTTPS connections on the SCION address addr and calls Serve
@@ -68,7 +75,12 @@ func (srv *Server) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
-	sconn, err := appnet.Listen(laddr)
+	var sconn net.PacketConn
+	if laddr.IP == nil || laddr.IP.IsUnspecified() {
+		sconn, err = appnet.ListenAll(uint16(laddr.Port))
+	} else {
+		sconn, err = appnet.Listen(laddr)
+	}
 	if err != nil {
 		return err
 	}
@@ -79,19 +91,105 @@ func (srv *Server) ListenAndServe() error {
 // a goroutine is spawned for every request and handled by srv.srv.handler
 func (srv *Server) Serve(conn net.PacketConn) error {
 
-	// set dummy TLS config if not set:
+	// set dummy TLS config if not set.
+	// For a persistent certificate, set TLSConfig.GetCertificate to the
+	// GetCertificate method of an appquic.KeyPair.
 	if srv.TLSConfig == nil {
 		srv.TLSConfig = &tls.Config{}
 	}
-	if len(srv.TLSConfig.Certificates) == 0 {
+	if len(srv.TLSConfig.Certificates) == 0 && srv.TLSConfig.GetCertificate == nil {
 		srv.TLSConfig.Certificates = appquic.GetDummyTLSCerts()
 	}
 
-	return srv.Server.Serve(conn)
+	// keep track of the paths of the clients, see RemoteSCIONAddr
+	pathConn := appquic.NewPathConn(conn)
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	// the handler passing the pathConn to the requests is specific to conn,
+	// so it is set on a server for this call only
+	server := &http3.Server{
+		Server: &http.Server{
+			Addr: srv.Addr,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := context.WithValue(r.Context(), pathConnContextKey{}, pathConn)
+				handler.ServeHTTP(w, r.WithContext(ctx))
+			}),
+			TLSConfig:      srv.TLSConfig,
+			MaxHeaderBytes: srv.MaxHeaderBytes,
+		},
+		QuicConfig: srv.QuicConfig,
+	}
+	if err := srv.addServer(server); err != nil {
+		return err
+	}
+	defer srv.removeServer(server)
+	return server.Serve(pathConn)
+}
+
+func (srv *Server) addServer(server *http3.Server) error {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.closed {
+		return http.ErrServerClosed
+	}
+	if srv.servers == nil {
+		srv.servers = make(map[*http3.Server]struct{})
+	}
+	srv.servers[server] = struct{}{}
+	return nil
+}
+
+func (srv *Server) removeServer(server *http3.Server) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	delete(srv.servers, server)
+}
+
+type pathConnContextKey struct{}
+
+// RemoteSCIONAddr returns the SCION address of the client of a request
+// received by a Server, including the path on which replies are sent to the
+// client. Returns nil if the request was not received by a Server.
+func RemoteSCIONAddr(r *http.Request) *snet.UDPAddr {
+	pathConn, ok := r.Context().Value(pathConnContextKey{}).(*appquic.PathConn)
+	if !ok {
+		return nil
+	}
+	raddr, err := snet.ParseUDPAddr(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	if reply := pathConn.ReplyAddr(raddr); reply != nil {
+		return reply
+	}
+	return raddr
+}
+
+// RemotePath returns the description of the path on which replies are sent to
+// the client of a request received by a Server, e.g. to log the ISDs through
+// which clients connect. See appnet.ReplyPathInfo.
+// Returns nil if the path is unknown or if the client is in the local AS.
+func RemotePath(r *http.Request) *appnet.PathInfo {
+	raddr := RemoteSCIONAddr(r)
+	if raddr == nil {
+		return nil
+	}
+	return appnet.ReplyPathInfo(raddr)
 }
 
 // Close the server immediately, aborting requests and sending CONNECTION_CLOSE frames to connected clients
 // Close in combination with ListenAndServe (instead of Serve) may race if it is called before a UDP socket is established
 func (srv *Server) Close() error {
-	return srv.Server.Close()
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.closed = true
+	err := srv.Server.Close()
+	for server := range srv.servers {
+		if cerr := server.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
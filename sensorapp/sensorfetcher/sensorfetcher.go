@@ -35,6 +35,7 @@ func check(e error) {
 func main() {
 
 	serverAddrStr := flag.String("s", "", "Server address (<ISD-AS,[IP]:port> or <hostname:port>)")
+	policy := flag.String("policy", "", "Path policy, as JSON or name of a JSON file")
 	flag.Parse()
 
 	if len(*serverAddrStr) == 0 {
@@ -42,6 +43,12 @@ func main() {
 		os.Exit(2)
 	}
 
+	if *policy != "" {
+		pathPolicy, err := appnet.PolicyFromString(*policy)
+		check(err)
+		appnet.SetPathPolicy(pathPolicy)
+	}
+
 	conn, err := appnet.Dial(*serverAddrStr)
 	check(err)
 
@@ -26,6 +26,7 @@ type ClientConfig struct {
 	LocalForward           string   `regex:".*"`
 	RemoteForward          string   `regex:".*"`
 	UserKnownHostsFile     string   `regex:".*"`
+	UserKnownQUICHostsFile string   `regex:".*"`
 	ProxyCommand           string   `regex:".*"`
 }
 
@@ -39,6 +40,7 @@ func Create() *ClientConfig {
 		PubkeyAuthentication:   "yes",
 		StrictHostKeyChecking:  "ask",
 		UserKnownHostsFile:     "~/.ssh/known_hosts",
+		UserKnownQUICHostsFile: "~/.ssh/known_quic_hosts",
 		IdentityFile: []string{
 			"~/.ssh/id_ed25519",
 			"~/.ssh/id_ecdsa",
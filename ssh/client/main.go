@@ -31,6 +31,7 @@ import (
 
 	"github.com/scionproto/scion/go/lib/pathpol"
 
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
 	"github.com/netsec-ethz/scion-apps/ssh/client/clientconfig"
 	"github.com/netsec-ethz/scion-apps/ssh/client/ssh"
 	"github.com/netsec-ethz/scion-apps/ssh/config"
@@ -49,6 +50,7 @@ var (
 	policyFile    = kingpin.Flag("policy-file", "Path to the JSON policy file").Default("").String()
 	policyName    = kingpin.Flag("policy-name", "Name of policy to be applied.").Default("").String()
 	pathSelection = kingpin.Flag("selection", "Path selection mode").Default("arbitrary").Enum("static", "arbitrary", "random", "round-robin")
+	pathSpec      = kingpin.Flag("path", "Path to use, as fingerprint or hop sequence").Default("").String()
 
 	// TODO: additional file paths
 	knownHostsFile = kingpin.Flag("known-hosts", "File where known hosts are stored").ExistingFile()
@@ -163,6 +165,13 @@ func main() {
 		}
 		policy = extPolicy.Policy
 	}
+	var spec *appnet.PathSpec
+	if *pathSpec != "" {
+		spec, err = appnet.ParsePathSpec(*pathSpec)
+		if err != nil {
+			golog.Panicf("Invalid path: %v", err)
+		}
+	}
 	appConf, err := scionutils.NewPathAppConf(policy, *pathSelection)
 	if err != nil {
 		golog.Panicf("Invalid application config: %v", err)
@@ -174,6 +183,13 @@ func main() {
 	}
 
 	serverAddress := fmt.Sprintf("%s:%v", conf.HostAddress, conf.Port)
+	if spec != nil {
+		raddr, err := appnet.ResolveUDPAddr(serverAddress)
+		if err != nil {
+			golog.Panicf("Can't resolve %s: %v", serverAddress, err)
+		}
+		appnet.SetPathSpec(raddr.IA, spec)
+	}
 
 	err = sshClient.Connect(serverAddress)
 	if err != nil {
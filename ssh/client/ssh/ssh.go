@@ -51,6 +51,7 @@ type Client struct {
 	promptForForeignKeyConfirmation VerifyHostKeyHandler
 	knownHostsFileHandler           ssh.HostKeyCallback
 	knownHostsFilePath              string
+	verifyQUIC                      bool
 
 	client  *ssh.Client
 	session *ssh.Session
@@ -107,6 +108,15 @@ func Create(username string, config *clientconfig.ClientConfig, passAuthHandler
 		client.knownHostsFileHandler = khh
 		client.config.HostKeyCallback = client.verifyHostKey
 		client.promptForForeignKeyConfirmation = verifyNewKeyHandler
+
+		// The QUIC certificates of the servers are pinned on first use, like
+		// the host keys
+		pins, err := appquic.LoadPinStore(utils.ParsePath(config.UserKnownQUICHostsFile))
+		if err != nil {
+			return nil, err
+		}
+		appquic.SetPinStore(pins)
+		client.verifyQUIC = true
 	} else {
 		log.Debug("Not verifying host key!")
 		client.config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
@@ -118,7 +128,7 @@ func Create(username string, config *clientconfig.ClientConfig, passAuthHandler
 
 // Connect connects the Client to the given address.
 func (client *Client) Connect(addr string) error {
-	goClient, err := sssh.DialSCIONWithConf(addr, client.config, client.appConf)
+	goClient, err := sssh.DialSCIONWithConf(addr, client.config, client.appConf, client.verifyQUIC)
 	if err != nil {
 		return err
 	}
@@ -22,30 +22,53 @@ import (
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/netsec-ethz/scion-apps/pkg/appnet/appquic"
+	"github.com/scionproto/scion/go/lib/snet"
 )
 
 // ProtoSSH is the protocol string used in the tls.Config NextProtos
 const ProtoSSH = "ssh"
 
-var clientTLSConf = tls.Config{
-	InsecureSkipVerify: true,
-	NextProtos:         []string{ProtoSSH},
+// pathProbeInterval is the interval at which the paths to the server are
+// probed, to switch the session to the path with the lowest RTT.
+const pathProbeInterval = 10 * time.Second
+
+// clientTLSConf returns the TLS configuration for dialling a server. Unless
+// verify is false, the certificate of the server is verified, see
+// appquic.DialAddr; self-signed certificates are checked against the PinStore
+// set with appquic.SetPinStore.
+func clientTLSConf(verify bool) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: !verify,
+		NextProtos:         []string{ProtoSSH},
+	}
 }
 
 // Dial dials a new Quic session, opens a new stream in this session and
-// returns this session/stream pair as a QuicConn
-func Dial(addr string) (*QuicConn, error) {
-	session, err := appquic.Dial(addr, &clientTLSConf, nil)
+// returns this session/stream pair as a QuicConn.
+// The certificate of the server is verified, unless verify is false. Only
+// skip the verification if the server is authenticated otherwise, e.g. for a
+// tunnel carrying an SSH session which verifies the host key of the server.
+// The session switches to another path if the path fails or if another path
+// has a lower RTT, see appquic.MigratingSession.
+func Dial(addr string, verify bool) (*QuicConn, error) {
+	session, err := appquic.DialMigrating(addr, clientTLSConf(verify), nil, &appquic.MigrationConfig{
+		ProbeInterval: pathProbeInterval,
+	})
 	if err != nil {
 		return nil, err
 	}
 	return newQuicConn(session)
 }
 
-// New dials a new Quic session on an established socket, opens a new stream
-// in this session and returns this session/stream pair as a QuicConn
-func New(conn net.PacketConn, raddr net.Addr) (*QuicConn, error) {
-	session, err := quic.Dial(conn, raddr, "host:0", &clientTLSConf, nil)
+// New dials a new Quic session to the server dialled as host, at raddr, opens
+// a new stream in this session and returns this session/stream pair as a
+// QuicConn. The server is verified as in Dial.
+// The session switches to another path as configured in migrationConf, see
+// appquic.MigrationConfig.
+func New(raddr *snet.UDPAddr, host string, verify bool,
+	migrationConf *appquic.MigrationConfig) (*QuicConn, error) {
+
+	session, err := appquic.DialAddrMigrating(raddr, host, clientTLSConf(verify), nil, migrationConf)
 	if err != nil {
 		return nil, err
 	}
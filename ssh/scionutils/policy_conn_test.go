@@ -15,26 +15,23 @@
 package scionutils
 
 import (
-	"net"
 	"reflect"
 	"testing"
 
-	"github.com/scionproto/scion/go/lib/addr"
-	"github.com/scionproto/scion/go/lib/snet"
-	"github.com/scionproto/scion/go/lib/spath"
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
 )
 
-//All tests in this file test the correctness of the path selection modes (round-robin, static)
-//The assumption is that path filtering has already been tested in SCIONProto
+// The path selectors themselves are tested in appnet. This only tests the
+// mapping of the path selection modes to the selectors.
 
 func TestPolicyConn_SelectorType(t *testing.T) {
 	tables := []struct {
 		pathSelection PathSelection
-		policyConn    PathSelector
+		policyConn    appnet.PathSelector
 	}{
-		{Arbitrary, &staticPathSelector{}},
-		{RoundRobin, &roundRobinPathSelector{}},
-		{Static, &staticPathSelector{}},
+		{Arbitrary, &appnet.StaticSelector{}},
+		{RoundRobin, &appnet.RoundRobinSelector{}},
+		{Static, &appnet.StaticSelector{}},
 	}
 
 	for _, table := range tables {
@@ -48,60 +45,23 @@ func TestPolicyConn_SelectorType(t *testing.T) {
 	}
 }
 
-func TestPolicyConn_StaticPathSelector(t *testing.T) {
-
-	const numPaths = 5
-	const numRepetitions = 3
-	paths := makePaths(numPaths)
-
-	selector := newSelector(Static)
-	selector.Reset(paths)
-
-	for i := 0; i < numRepetitions*numPaths; i++ {
-		expected := paths[0]
-		actual := selector.Next()
-		if actual != expected {
-			t.Fatalf("Static path selection: Expected path %v, found path %v", expected, actual)
-		}
+func TestNewMigrationConfig(t *testing.T) {
+	policy, err := appnet.PolicyFromString(`{"acl": ["- 2-0#0", "+"]}`)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestPolicyConn_RoundRobinSelector(t *testing.T) {
-
-	const numPaths = 5
-	const numRepetitions = 3
-	paths := makePaths(numPaths)
-
-	roundRobinSeq := []snet.Path{}
-	for i := 0; i < numRepetitions; i++ {
-		roundRobinSeq = append(roundRobinSeq, paths...)
+	conf, err := NewPathAppConf(policy, "round-robin")
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	selector := newSelector(RoundRobin)
-	selector.Reset(paths)
-
-	for i := 0; i < numRepetitions*numPaths; i++ {
-		expected := roundRobinSeq[i]
-		actual := selector.Next()
-		if actual != expected {
-			t.Fatalf("Round robin path selection: Expected path %v, found path %v", expected, actual)
-		}
+	migrationConf := NewMigrationConfig(conf)
+	if migrationConf.PathPolicy != policy {
+		t.Errorf("NewMigrationConfig expecting the path policy of the PathAppConf")
 	}
-}
-
-// mockPath satisfies the snet.Path interface but does not actually implement anything.
-type mockPath struct{}
-
-func (p *mockPath) UnderlayNextHop() *net.UDPAddr { return nil }
-func (p *mockPath) Path() spath.Path              { return spath.Path{} }
-func (p *mockPath) Destination() addr.IA          { return addr.IA{} }
-func (p *mockPath) Metadata() *snet.PathMetadata  { return nil }
-func (p *mockPath) Copy() snet.Path               { return nil }
-
-func makePaths(num int) []snet.Path {
-	paths := make([]snet.Path, num)
-	for i := 0; i < num; i++ {
-		paths[i] = &mockPath{}
+	if _, ok := migrationConf.NewSelector().(*appnet.RoundRobinSelector); !ok {
+		t.Errorf("NewMigrationConfig expecting a round-robin path selector")
+	}
+	if migrationConf.ProbeInterval != 0 {
+		t.Errorf("NewMigrationConfig expecting no probing, got interval %s", migrationConf.ProbeInterval)
 	}
-	return paths
 }
@@ -72,6 +72,30 @@ func updateConfigFromFile(conf *serverconfig.ServerConfig, pth string) {
 	}
 }
 
+// createTLSConfig creates the TLS configuration for the QUIC listener. The
+// certificate is loaded from the QUICIdentity directory (by default
+// /etc/ssh/scion_quic), so that clients can pin it. If QUICIdentity is set to
+// the empty string, a new certificate is generated on every start.
+func createTLSConfig(conf *serverconfig.ServerConfig) *tls.Config {
+	tlsConf := &tls.Config{
+		NextProtos: []string{quicconn.ProtoSSH},
+	}
+	if conf.QUICIdentity == "" {
+		tlsConf.Certificates = appquic.GetDummyTLSCerts()
+		return tlsConf
+	}
+	keyType, err := appquic.ParseKeyType(conf.QUICKeyType)
+	if err != nil {
+		golog.Panicf("Invalid QUICKeyType: %v", err)
+	}
+	keyPair, err := appquic.LoadKeyPairDir(utils.ParsePath(conf.QUICIdentity), keyType)
+	if err != nil {
+		golog.Panicf("Can't load QUIC certificate from %s: %v", conf.QUICIdentity, err)
+	}
+	tlsConf.GetCertificate = keyPair.GetCertificate
+	return tlsConf
+}
+
 func main() {
 	kingpin.Parse()
 	log.Debug("Starting SCION SSH server...")
@@ -91,14 +115,15 @@ func main() {
 	log.Debug("Currently, ListenAddress.Port is ignored (only value from config taken)")
 	listener, err := appquic.ListenPort(
 		uint16(port),
-		&tls.Config{
-			Certificates: appquic.GetDummyTLSCerts(),
-			NextProtos:   []string{quicconn.ProtoSSH},
-		},
+		createTLSConfig(conf),
 		nil)
 	if err != nil {
 		golog.Panicf("Failed to listen (%v)", err)
 	}
+	// The clients switch paths when a path fails, see quicconn.Dial and
+	// quicconn.New. Following them is not authenticated, but the SSH session
+	// on top is.
+	listener.SetFollowPaths(true)
 
 	log.Debug("Starting to wait for connections")
 	for {
@@ -18,9 +18,12 @@ import (
 	"fmt"
 	"io/ioutil"
 
+	log "github.com/inconshreveable/log15"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/msteinert/pam"
+
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
 )
 
 // PasswordAuth authenticates the client using password authentication.
@@ -89,3 +92,16 @@ func (s *Server) PublicKeyAuth(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.P
 
 	return nil, fmt.Errorf("unknown public key for %q", c.User())
 }
+
+// LogAuth logs the authentication attempts, with the host name of the client
+// if it can be resolved.
+func (s *Server) LogAuth(c ssh.ConnMetadata, method string, err error) {
+	remote := appnet.NamedAddr(c.RemoteAddr())
+	if err != nil {
+		if method != "none" {
+			log.Info("Authentication failed", "user", c.User(), "method", method, "remote", remote, "error", err)
+		}
+		return
+	}
+	log.Info("Authentication succeeded", "user", c.User(), "method", method, "remote", remote)
+}
@@ -24,6 +24,7 @@ import (
 
 	"golang.org/x/crypto/ssh"
 
+	"github.com/netsec-ethz/scion-apps/pkg/appnet"
 	"github.com/netsec-ethz/scion-apps/ssh/server/serverconfig"
 	"github.com/netsec-ethz/scion-apps/ssh/utils"
 )
@@ -51,6 +52,7 @@ func Create(config *serverconfig.ServerConfig, version string) (*Server, error)
 	server.configuration = &ssh.ServerConfig{
 		PasswordCallback:  server.PasswordAuth,
 		PublicKeyCallback: server.PublicKeyAuth,
+		AuthLogCallback:   server.LogAuth,
 		MaxAuthTries:      maxAuthTries,
 		//ServerVersion: fmt.Sprintf("SCION-ssh-server-v%s", version),
 	}
@@ -98,7 +100,8 @@ func (s *Server) HandleConnection(conn net.Conn) error {
 		return err
 	}
 
-	log.Debug("New SSH connection", "remoteAddress", sshConn.RemoteAddr(), "clientVersion", sshConn.ClientVersion())
+	log.Debug("New SSH connection", "remoteAddress", appnet.NamedAddr(sshConn.RemoteAddr()),
+		"clientVersion", sshConn.ClientVersion())
 	// Discard all global out-of-band Requests
 	go ssh.DiscardRequests(reqs)
 	// Accept all channels
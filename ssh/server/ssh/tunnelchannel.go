@@ -81,7 +81,9 @@ func handleSCIONQUICTunnel(perms *ssh.Permissions, newChannel ssh.NewChannel) {
 
 	go ssh.DiscardRequests(requests)
 
-	remoteConnection, err := quicconn.Dial(address)
+	// The tunnel carries the SSH session of the client to the remote server,
+	// which authenticates the server by its host key.
+	remoteConnection, err := quicconn.Dial(address, false)
 	if err != nil {
 		log.Debug("Could not open remote connection (%s)", err)
 		return
@@ -27,8 +27,9 @@ import (
 )
 
 // DialSCION starts a client connection to the given SSH server over SCION using QUIC.
+// The certificate of the QUIC server is verified, see quicconn.Dial.
 func DialSCION(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
-	transportStream, err := quicconn.Dial(addr)
+	transportStream, err := quicconn.Dial(addr, true)
 	if err != nil {
 		return nil, err
 	}
@@ -37,17 +38,16 @@ func DialSCION(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
 
 // DialSCION starts a client connection to the given SSH server over SCION using QUIC
 // Passes an instance of PathAppConf to the connection to make it aware of user-defined path configurations
-func DialSCIONWithConf(addr string, config *ssh.ClientConfig, appConf *scionutils.PathAppConf) (*ssh.Client, error) {
+// The certificate of the QUIC server is verified unless verifyQUIC is false,
+// see quicconn.Dial. The session switches to another path allowed by the path
+// policy of appConf if the path fails, see quicconn.New.
+func DialSCIONWithConf(addr string, config *ssh.ClientConfig, appConf *scionutils.PathAppConf,
+	verifyQUIC bool) (*ssh.Client, error) {
 	raddr, err := appnet.ResolveUDPAddr(addr)
 	if err != nil {
 		return nil, err
 	}
-	sconn, err := appnet.Listen(nil)
-	if err != nil {
-		return nil, err
-	}
-	policyConn := scionutils.NewPolicyConn(sconn, appConf)
-	transportStream, err := quicconn.New(policyConn, raddr)
+	transportStream, err := quicconn.New(raddr, addr, verifyQUIC, scionutils.NewMigrationConfig(appConf))
 	if err != nil {
 		return nil, err
 	}